@@ -0,0 +1,81 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"context"
+	"time"
+)
+
+// calmHost records the ENHANCE_YOUR_CALM errors a host has sent
+// recently, for backing off from it.
+type calmHost struct {
+	n     int       // ENHANCE_YOUR_CALM errors in a row
+	until time.Time // when new streams may start again
+}
+
+func (t *Transport) calmBackoff() time.Duration {
+	if t.CalmBackoff > 0 {
+		return t.CalmBackoff
+	}
+	return 100 * time.Millisecond
+}
+
+func (t *Transport) maxCalmBackoff() time.Duration {
+	if t.MaxCalmBackoff > 0 {
+		return t.MaxCalmBackoff
+	}
+	return 10 * time.Second
+}
+
+// noteCalm records that the host at key, a host:port, reset a
+// stream or closed a conn with ENHANCE_YOUR_CALM, doubling how long
+// new streams to it wait.
+func (t *Transport) noteCalm(key string) {
+	t.calmMu.Lock()
+	defer t.calmMu.Unlock()
+	now := t.clock().Now()
+	h := t.calm[key]
+	if now.After(h.until.Add(t.maxCalmBackoff())) {
+		// Calm for long enough; start over.
+		h.n = 0
+	}
+	d := t.calmBackoff() << uint(h.n)
+	if max := t.maxCalmBackoff(); d > max || d <= 0 {
+		d = max
+	} else {
+		h.n++
+	}
+	h.until = now.Add(d)
+	if t.calm == nil {
+		t.calm = make(map[string]calmHost)
+	}
+	t.calm[key] = h
+}
+
+// waitCalm waits out any backoff noteCalm has put on key, or until
+// ctx is done.
+func (t *Transport) waitCalm(ctx context.Context, key string) error {
+	now := t.clock().Now()
+	t.calmMu.Lock()
+	h, ok := t.calm[key]
+	if ok && now.After(h.until.Add(t.maxCalmBackoff())) {
+		delete(t.calm, key)
+	}
+	t.calmMu.Unlock()
+	d := h.until.Sub(now)
+	if !ok || d <= 0 {
+		return nil
+	}
+	timer := t.clock().NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
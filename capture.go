@@ -0,0 +1,199 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// captureMagic starts every capture, naming the format and its
+// version.
+const captureMagic = "h2cap\x00\x00\x01"
+
+// captureRecordLen is the length of a capture record's header: the
+// time as big-endian Unix nanoseconds, then the direction.
+const captureRecordLen = 9
+
+var errNotCapture = errors.New("http2: not a frame capture")
+
+// A CaptureDirection is which way a captured frame went.
+type CaptureDirection uint8
+
+const (
+	CaptureRead  CaptureDirection = iota // received from the peer
+	CaptureWrite                         // sent to the peer
+)
+
+func (d CaptureDirection) String() string {
+	if d == CaptureWrite {
+		return "write"
+	}
+	return "read"
+}
+
+// A FrameCapture records the frames a connection reads and writes,
+// with when and which way each went, so that a protocol bug seen in
+// production can be inspected, and replayed, offline. See
+// Transport.CaptureFrames, Server.CaptureFrames and
+// Framer.SetFrameCapture; read a capture back with a CaptureReader.
+//
+// A capture is the magic "h2cap\x00\x00\x01" followed by a record
+// for each frame: its time as 8 bytes of big-endian Unix
+// nanoseconds, a byte for its CaptureDirection, and the frame as it
+// was on the wire, header and all.
+type FrameCapture struct {
+	clock Clock
+
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+	err error // sticky
+}
+
+// NewFrameCapture returns a FrameCapture that writes to w, starting
+// with the magic.
+func NewFrameCapture(w io.Writer) *FrameCapture {
+	c := &FrameCapture{clock: realClock{}, w: w}
+	_, c.err = io.WriteString(w, captureMagic)
+	return c
+}
+
+// Err returns the error, if any, writing the capture. Frames after
+// it aren't recorded, but the connection carries on.
+func (c *FrameCapture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// record writes a record of the frame with header hdr, including
+// its length, and payload.
+func (c *FrameCapture) record(dir CaptureDirection, hdr, payload []byte) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	var rec [captureRecordLen]byte
+	binary.BigEndian.PutUint64(rec[:8], uint64(now.UnixNano()))
+	rec[8] = byte(dir)
+	c.buf = append(c.buf[:0], rec[:]...)
+	c.buf = append(c.buf, hdr...)
+	c.buf = append(c.buf, payload...)
+	_, c.err = c.w.Write(c.buf)
+}
+
+// SetFrameCapture makes fr record each frame it reads or writes in
+// c, as it is on the wire: frames read are recorded before any
+// FaultInjector sees them, and frames written after. A nil c turns
+// capture off.
+func (fr *Framer) SetFrameCapture(c *FrameCapture) {
+	fr.capture = c
+}
+
+// newConnCapture returns the FrameCapture for the conn c, per
+// capture, which is a Transport's or Server's CaptureFrames, or nil
+// for none.
+func newConnCapture(capture func(c net.Conn) io.Writer, c net.Conn, clock Clock) *FrameCapture {
+	if capture == nil {
+		return nil
+	}
+	w := capture(c)
+	if w == nil {
+		return nil
+	}
+	fc := NewFrameCapture(w)
+	fc.clock = clock
+	return fc
+}
+
+// close closes the writer c was made with, if it's an io.Closer.
+func (c *FrameCapture) close() {
+	if c == nil {
+		return
+	}
+	if cl, ok := c.w.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+// A CapturedFrame is a frame read from a capture.
+type CapturedFrame struct {
+	Time time.Time
+	Dir  CaptureDirection
+
+	// Raw is the frame as it was on the wire, header and all.
+	// Frame is it parsed, or nil if it's malformed. Both are only
+	// valid until the next call to Next.
+	Raw   []byte
+	Frame Frame
+}
+
+// A CaptureReader reads back the frames of a FrameCapture.
+type CaptureReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// NewCaptureReader returns a CaptureReader reading the capture in
+// r, after checking it starts with the magic.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != captureMagic {
+		return nil, errNotCapture
+	}
+	return &CaptureReader{r: br}, nil
+}
+
+// Next returns the next frame in the capture, or io.EOF after the
+// last. A frame that doesn't parse, as a misbehaving peer's may
+// not, is returned with its Frame nil along with the parse error,
+// and Next may then be called for the frame after it.
+func (cr *CaptureReader) Next() (*CapturedFrame, error) {
+	var rec [captureRecordLen]byte
+	if _, err := io.ReadFull(cr.r, rec[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errNotCapture
+		}
+		return nil, err
+	}
+	if cap(cr.buf) < frameHeaderLen {
+		cr.buf = make([]byte, frameHeaderLen, initialMaxFrameSize+frameHeaderLen)
+	}
+	fh, err := readFrameHeader(cr.buf[:frameHeaderLen], cr.r)
+	if err != nil {
+		return nil, errNotCapture
+	}
+	size := frameHeaderLen + int(fh.Length)
+	if cap(cr.buf) < size {
+		buf := make([]byte, size)
+		copy(buf, cr.buf[:frameHeaderLen])
+		cr.buf = buf
+	}
+	cr.buf = cr.buf[:size]
+	if _, err := io.ReadFull(cr.r, cr.buf[frameHeaderLen:]); err != nil {
+		return nil, errNotCapture
+	}
+	cf := &CapturedFrame{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(rec[:8]))),
+		Dir:  CaptureDirection(rec[8]),
+		Raw:  cr.buf,
+	}
+	cf.Frame, err = typeFrameParser(fh.Type)(fh, cr.buf[frameHeaderLen:])
+	if err != nil {
+		cf.Frame = nil
+		return cf, err
+	}
+	return cf, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readCapture returns the frames in the capture in b, one line each.
+func readCapture(t *testing.T, b []byte) []string {
+	cr, err := NewCaptureReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []string
+	for {
+		cf, err := cr.Next()
+		if err == io.EOF {
+			return frames
+		}
+		if cf == nil {
+			t.Fatal(err)
+		}
+		s := fmt.Sprintf("%v %v %s", cf.Time.Sub(time.Unix(0, 0)), cf.Dir, cf.Raw[3:9])
+		if err != nil {
+			s += " malformed"
+		} else {
+			s += " " + cf.Frame.Header().Type.String()
+		}
+		frames = append(frames, s)
+	}
+}
+
+func TestFrameCapture(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	var capture, wire bytes.Buffer
+	fc := NewFrameCapture(&capture)
+	fc.clock = clock
+	fr := NewFramer(&wire, &wire)
+	fr.SetFrameCapture(fc)
+
+	fr.WriteSettings(Setting{SettingEnablePush, 0})
+	clock.advance(time.Second)
+	fr.WriteData(1, true, []byte("hi"))
+	fr.AllowIllegalWrites = true
+	fr.WriteData(0, false, nil)
+	want := append([]byte(nil), wire.Bytes()...)
+	for i := 0; i < 2; i++ {
+		if _, err := fr.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fr.ReadFrame(); err == nil {
+		t.Fatal("ReadFrame of DATA on stream 0 succeeded")
+	}
+	if err := fc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readCapture(t, capture.Bytes())
+	wantFrames := []string{
+		"0s write \x04\x00\x00\x00\x00\x00 SETTINGS",
+		"1s write \x00\x01\x00\x00\x00\x01 DATA",
+		"1s write \x00\x00\x00\x00\x00\x00 malformed",
+		"1s read \x04\x00\x00\x00\x00\x00 SETTINGS",
+		"1s read \x00\x01\x00\x00\x00\x01 DATA",
+		"1s read \x00\x00\x00\x00\x00\x00 malformed",
+	}
+	if strings.Join(got, "\n") != strings.Join(wantFrames, "\n") {
+		t.Errorf("capture has frames:\n%q\nwant:\n%q", got, wantFrames)
+	}
+
+	// The frames recorded each way are just those on the wire.
+	cr, _ := NewCaptureReader(bytes.NewReader(capture.Bytes()))
+	var written []byte
+	for {
+		cf, _ := cr.Next()
+		if cf == nil {
+			break
+		}
+		if cf.Dir == CaptureWrite {
+			written = append(written, cf.Raw...)
+		}
+	}
+	if !bytes.Equal(written, want) {
+		t.Errorf("written frames in capture = %x; want %x", written, want)
+	}
+
+	if _, err := NewCaptureReader(strings.NewReader("not a capture")); err != errNotCapture {
+		t.Errorf("NewCaptureReader of junk = %v; want %v", err, errNotCapture)
+	}
+}
+
+// closeBuffer is a bytes.Buffer that's an io.Closer, for captures.
+type closeBuffer struct {
+	bytes.Buffer
+	closed chan bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed <- true
+	return nil
+}
+
+func TestTransportCaptureFrames(t *testing.T) {
+	serverCapture := &closeBuffer{closed: make(chan bool, 1)}
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}, optOnlyServer, func(s *Server) {
+		s.CaptureFrames = func(c net.Conn) io.Writer { return serverCapture }
+	})
+	defer st.Close()
+	clientCapture := &closeBuffer{closed: make(chan bool, 1)}
+	tr := &Transport{
+		InsecureTLSDial: true,
+		CaptureFrames:   func(c net.Conn) io.Writer { return clientCapture },
+	}
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	tr.CloseIdleConnections()
+
+	for _, tt := range []struct {
+		name     string
+		capture  *closeBuffer
+		request  CaptureDirection
+		response CaptureDirection
+	}{
+		{"client", clientCapture, CaptureWrite, CaptureRead},
+		{"server", serverCapture, CaptureRead, CaptureWrite},
+	} {
+		select {
+		case <-tt.capture.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s capture not closed", tt.name)
+		}
+		cr, err := NewCaptureReader(&tt.capture.Buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sawRequest, sawResponse bool
+		for {
+			cf, err := cr.Next()
+			if err != nil {
+				break
+			}
+			switch f := cf.Frame.(type) {
+			case *HeadersFrame:
+				if f.StreamID == 1 && cf.Dir == tt.request {
+					sawRequest = true
+				}
+			case *DataFrame:
+				if f.StreamID == 1 && cf.Dir == tt.response && string(f.Data()) == "hello" {
+					sawResponse = true
+				}
+			}
+		}
+		if !sawRequest || !sawResponse {
+			t.Errorf("%s capture: saw request HEADERS %v, response DATA %v; want both", tt.name, sawRequest, sawResponse)
+		}
+	}
+}
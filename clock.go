@@ -0,0 +1,48 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import "time"
+
+// A Clock is where a Server or Transport gets the time and its
+// timers from: for idle, read, write and shutdown timeouts, PINGs,
+// hedging, rate limits and the like. Tests, and embedders running
+// simulations, can supply their own via Server.Clock and
+// Transport.Clock to make timer-driven behavior deterministic.
+// Deadlines on network connections still use the real time.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a timer made by a Clock. It behaves like a
+// *time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered when
+	// the timer fires. It's nil for timers made by AfterFunc.
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is the Clock used when none is set.
+type realClock struct{}
+
+func (realClock) Now() time.Time                 { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
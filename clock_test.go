@@ -0,0 +1,126 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves when advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	active bool
+	c      chan time.Time
+	f      func()
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, make(chan time.Time, 1), nil)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.newTimer(d, nil, f)
+}
+
+func (c *fakeClock) newTimer(d time.Duration, ch chan time.Time, f func()) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), active: true, c: ch, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// advance moves the time on by d, firing the timers that expire.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var fire []*fakeTimer
+	for _, t := range c.timers {
+		if t.active && !t.when.After(now) {
+			t.active = false
+			fire = append(fire, t)
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range fire {
+		if t.f != nil {
+			go t.f()
+			continue
+		}
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.active = true
+	t.when = t.clock.now.Add(d)
+	return was
+}
+
+func TestServer_IdleTimeoutClock(t *testing.T) {
+	const timeout = time.Hour
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, func(srv *Server) {
+		srv.IdleTimeout = timeout
+		srv.Clock = clock
+	})
+	defer st.Close()
+
+	st.greet()
+	st.bodylessReq1()
+	st.wantHeaders()
+
+	// The idle timer is only reset once the serve loop sees the
+	// stream close, so keep the fake time moving until it fires.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				clock.advance(timeout)
+			}
+		}
+	}()
+	if ga := st.wantGoAway(); ga.ErrCode != ErrCodeNo {
+		t.Errorf("GOAWAY error code = %v; want %v", ga.ErrCode, ErrCodeNo)
+	}
+}
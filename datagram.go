@@ -0,0 +1,80 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ProtocolConnectUDP is the :protocol value of extended CONNECT
+// requests that tunnel UDP datagrams.
+const ProtocolConnectUDP = "connect-udp"
+
+// maxDatagramSize is the largest payload a datagram length prefix
+// can describe.
+const maxDatagramSize = 1<<16 - 1
+
+var errDatagramTooLarge = errors.New("http2: datagram too large")
+
+// NewDatagramConn returns a conn that carries whole datagrams over
+// the byte stream c, such as a CONNECT stream. Each Write sends one
+// datagram and each Read returns one. As with a UDP socket, the part
+// of a datagram that doesn't fit in the Read buffer is discarded.
+//
+// Datagrams are framed as a 2 byte big-endian length followed by the
+// payload. This framing is experimental and specific to this
+// package; it is not the capsule protocol of RFC 9298.
+func NewDatagramConn(c net.Conn) net.Conn {
+	return &datagramConn{Conn: c, br: bufio.NewReader(c)}
+}
+
+type datagramConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	rmu  sync.Mutex // guards br
+	wmu  sync.Mutex // guards wbuf
+	wbuf []byte
+}
+
+func (c *datagramConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n <= len(p) {
+		return io.ReadFull(c.br, p[:n])
+	}
+	if _, err := io.ReadFull(c.br, p); err != nil {
+		return 0, err
+	}
+	if _, err := c.br.Discard(n - len(p)); err != nil {
+		return len(p), err
+	}
+	return len(p), nil
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	if len(p) > maxDatagramSize {
+		return 0, errDatagramTooLarge
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = append(c.wbuf[:0], byte(len(p)>>8), byte(len(p)))
+	c.wbuf = append(c.wbuf, p...)
+	if _, err := c.Conn.Write(c.wbuf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDatagramConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	d1, d2 := NewDatagramConn(c1), NewDatagramConn(c2)
+	defer d1.Close()
+	defer d2.Close()
+
+	go func() {
+		for _, s := range []string{"one", "", "three", "truncated"} {
+			if _, err := d1.Write([]byte(s)); err != nil {
+				t.Errorf("Write(%q): %v", s, err)
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 5)
+	for _, want := range []string{"one", "", "three", "trunc"} {
+		n, err := d2.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("Read = %q; want %q", got, want)
+		}
+	}
+}
+
+func TestDatagramConnTooLarge(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	d := NewDatagramConn(c1)
+	defer d.Close()
+	big := strings.Repeat("x", maxDatagramSize+1)
+	if _, err := d.Write([]byte(big)); err != errDatagramTooLarge {
+		t.Errorf("Write error = %v; want %v", err, errDatagramTooLarge)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// A Dialer dials TCP connections through an HTTP/2 relay. Each Dial
+// becomes a CONNECT stream, and all streams to the same relay share
+// the Transport's pooled connections.
+//
+// UDP is supported experimentally: the Dialer sends an extended
+// CONNECT with :protocol set to ProtocolConnectUDP and carries
+// datagrams on the stream using the framing of NewDatagramConn.
+//
+// Connections to the relay are redialed on demand when they die.
+// Set Transport.PingInterval to detect dead relay connections
+// before a Dial tries to use them.
+type Dialer struct {
+	// Relay is the host:port of the HTTP/2 relay.
+	Relay string
+
+	// Transport is used to reach the relay.
+	// If nil, a zero Transport is used.
+	Transport *Transport
+
+	// Header optionally specifies additional headers, such as
+	// Proxy-Authorization, to send with each CONNECT request.
+	Header http.Header
+}
+
+var zeroTransport Transport
+
+func (d *Dialer) transport() *Transport {
+	if d.Transport != nil {
+		return d.Transport
+	}
+	return &zeroTransport
+}
+
+// Dial connects to addr through the relay.
+// The network must be "tcp", "tcp4", "tcp6", "udp", "udp4", or "udp6".
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial but takes a context. The context bounds
+// both the CONNECT exchange and the lifetime of the returned conn.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.Relay == "" {
+		return nil, errors.New("http2: Dialer has no Relay")
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return d.connect(ctx, &http.Request{
+			Method:     "CONNECT",
+			URL:        &url.URL{Host: d.Relay},
+			Host:       addr,
+			RequestURI: addr,
+			Header:     d.header(),
+		}, addr)
+	case "udp", "udp4", "udp6":
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		// The target goes in the path, as with RFC 9298's
+		// default URI template.
+		u := "https://" + d.Relay + "/.well-known/masque/udp/" + url.PathEscape(host) + "/" + port + "/"
+		conn, _, err := d.transport().ConnectProtocol(ctx, u, ProtocolConnectUDP, d.Header)
+		if err != nil {
+			return nil, err
+		}
+		return NewDatagramConn(conn), nil
+	}
+	return nil, fmt.Errorf("http2: Dialer does not support network %q", network)
+}
+
+func (d *Dialer) header() http.Header {
+	h := make(http.Header, len(d.Header))
+	for k, vv := range d.Header {
+		h[k] = vv
+	}
+	return h
+}
+
+func (d *Dialer) connect(ctx context.Context, req *http.Request, addr string) (net.Conn, error) {
+	conn, err := d.transport().ConnectContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.(*clientDataConn).statusErr(addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoConnectHandler echoes a CONNECT stream's request body back
+// to the client.
+func echoConnectHandler(w http.ResponseWriter, r *http.Request) {
+	w.(http.Flusher).Flush()
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			w.(http.Flusher).Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestDialer(t *testing.T) {
+	st := newServerTester(t, echoConnectHandler, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	d := &Dialer{Relay: st.ts.Listener.Addr().String(), Transport: tr}
+
+	for i := 0; i < 2; i++ {
+		c, err := d.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatalf("Dial %d: %v", i, err)
+		}
+		if _, err := io.WriteString(c, "ping"); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "ping" {
+			t.Errorf("read %q; want %q", buf, "ping")
+		}
+		c.Close()
+	}
+	if n := len(tr.conns); n != 1 {
+		t.Errorf("Transport has %d pooled conn keys; want 1", n)
+	}
+}
+
+func TestDialerRejectsNetwork(t *testing.T) {
+	d := &Dialer{Relay: "relay.example:443"}
+	if _, err := d.Dial("udp", "example.com:53"); err == nil {
+		t.Error("Dial udp succeeded; want error")
+	}
+}
+
+func TestDialerRelayRefuses(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	d := &Dialer{Relay: st.ts.Listener.Addr().String(), Transport: tr}
+	_, err := d.Dial("tcp", "example.com:80")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Dial error = %v; want 403 refusal", err)
+	}
+}
+
+func TestDialerRedialsAfterConnLoss(t *testing.T) {
+	st := newServerTester(t, echoConnectHandler, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	d := &Dialer{Relay: st.ts.Listener.Addr().String(), Transport: tr}
+
+	c, err := d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := c.(*clientDataConn).re.cc
+	c.Close()
+	st.closeConn()
+	select {
+	case <-cc.readerDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for relay conn to die")
+	}
+
+	c, err = d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("Dial after conn loss: %v", err)
+	}
+	defer c.Close()
+	if c.(*clientDataConn).re.cc == cc {
+		t.Error("Dial reused dead relay conn")
+	}
+}
+
+func TestDialerUDPRequiresExtendedConnect(t *testing.T) {
+	// The raw server's SETTINGS don't enable extended CONNECT.
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		t.Error("extended CONNECT request sent")
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	d := &Dialer{Relay: ts.Listener.Addr().String(), Transport: tr}
+	if _, err := d.Dial("udp", "192.0.2.1:53"); err != errExtendedConnectNotSupported {
+		t.Errorf("Dial error = %v; want %v", err, errExtendedConnectNotSupported)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+//go:build go1.24
+
+package http2
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newECHKey returns an Encrypted Client Hello key for a server, with
+// an X25519 HPKE key, and the ECHConfigList a client needs to use it.
+func newECHKey(t *testing.T, id uint8, publicName string) (tls.EncryptedClientHelloKey, []byte) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := priv.PublicKey().Bytes()
+	var c []byte
+	c = append(c, id)
+	c = binary.BigEndian.AppendUint16(c, 0x0020) // DHKEM(X25519, HKDF-SHA256)
+	c = binary.BigEndian.AppendUint16(c, uint16(len(pub)))
+	c = append(c, pub...)
+	c = binary.BigEndian.AppendUint16(c, 4)
+	c = binary.BigEndian.AppendUint16(c, 0x0001) // HKDF-SHA256
+	c = binary.BigEndian.AppendUint16(c, 0x0001) // AES-128-GCM
+	c = append(c, 0)                             // maximum_name_length
+	c = append(c, uint8(len(publicName)))
+	c = append(c, publicName...)
+	c = binary.BigEndian.AppendUint16(c, 0) // no extensions
+
+	var config []byte
+	config = binary.BigEndian.AppendUint16(config, 0xfe0d)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(c)))
+	config = append(config, c...)
+
+	var list []byte
+	list = binary.BigEndian.AppendUint16(list, uint16(len(config)))
+	list = append(list, config...)
+	return tls.EncryptedClientHelloKey{Config: config, PrivateKey: priv.Bytes(), SendAsRetry: true}, list
+}
+
+func TestTransportECH(t *testing.T) {
+	key, list := newECHKey(t, 1, "example.com")
+	_, staleList := newECHKey(t, 2, "example.com")
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, optOnlyServer, func(ts *httptest.Server) {
+		ts.Config.TLSConfig = &tls.Config{EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{key}}
+	})
+	defer st.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(st.ts.Certificate())
+
+	for _, tt := range []struct {
+		name string
+		list []byte
+	}{
+		{"current config", list},
+		{"stale config, retried", staleList},
+	} {
+		tr := &Transport{TLSClientConfig: &tls.Config{
+			RootCAs:                        roots,
+			ServerName:                     "example.com",
+			EncryptedClientHelloConfigList: tt.list,
+		}}
+		req, _ := http.NewRequest("GET", st.ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		res.Body.Close()
+		if !res.TLS.ECHAccepted {
+			t.Errorf("%s: response's ConnectionState has ECHAccepted false", tt.name)
+		}
+		tr.CloseIdleConnections()
+	}
+}
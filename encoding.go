@@ -0,0 +1,204 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A ContentDecoder returns a reader of the decoded content of r,
+// a response body in some Content-Encoding. It is called on the
+// first Read of the response body, not by RoundTrip.
+type ContentDecoder func(r io.Reader) (io.ReadCloser, error)
+
+// defaultContentDecoders are the decoders the Transport uses unless
+// its ContentDecoders say otherwise. The standard library has no
+// br or zstd decoder, so those are only advertised once the
+// application supplies one.
+var defaultContentDecoders = map[string]ContentDecoder{
+	"gzip": func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+}
+
+// preferredEncodings orders the encodings the Transport advertises
+// in Accept-Encoding, of those it has a decoder for; br and zstd only
+// once the application registers one. Others follow, sorted.
+var preferredEncodings = []string{"br", "zstd", "gzip"}
+
+// contentDecoder returns the decoder for the content coding coding,
+// or nil.
+func (t *Transport) contentDecoder(coding string) ContentDecoder {
+	if dec, ok := t.ContentDecoders[coding]; ok {
+		return dec
+	}
+	return defaultContentDecoders[coding]
+}
+
+// acceptEncoding returns the Accept-Encoding value to add to req so
+// that the response body can be transparently decoded, or "" if req
+// shouldn't ask for compression. As in net/http, requests that set
+// their own Accept-Encoding, ask for a Range (the offsets of which
+// would be into the encoded body), or are HEAD requests are left
+// alone.
+func (t *Transport) acceptEncoding(req *http.Request) string {
+	if t.DisableCompression || req.Method == "HEAD" || req.Method == "CONNECT" ||
+		req.Header.Get("Accept-Encoding") != "" || req.Header.Get("Range") != "" {
+		return ""
+	}
+	if len(t.ContentDecoders) == 0 {
+		return "gzip" // the only built-in decoder
+	}
+	var codings []string
+	for _, c := range preferredEncodings {
+		if t.contentDecoder(c) != nil {
+			codings = append(codings, c)
+		}
+	}
+	var extra []string
+	for c, dec := range t.ContentDecoders {
+		if dec != nil && !isPreferredEncoding(c) {
+			extra = append(extra, c)
+		}
+	}
+	sort.Strings(extra)
+	return strings.Join(append(codings, extra...), ", ")
+}
+
+func isPreferredEncoding(c string) bool {
+	for _, p := range preferredEncodings {
+		if c == p {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeResponse arranges for res's body to be decoded, if it has a
+// single Content-Encoding the Transport has a decoder for. As
+// net/http does, it then drops the Content-Encoding and
+// Content-Length headers, which describe the encoded body, and sets
+// res.Uncompressed. If max isn't -1, reads of more than max decoded
+// bytes call tooLarge and fail with ErrResponseTooLarge.
+func (t *Transport) decodeResponse(res *http.Response, max int64, tooLarge func()) {
+	ce := res.Header["Content-Encoding"]
+	if len(ce) != 1 {
+		return
+	}
+	dec := t.contentDecoder(strings.ToLower(strings.TrimSpace(ce[0])))
+	if dec == nil {
+		return
+	}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	res.Body = &decodingBody{body: res.Body, dec: dec, max: max, tooLarge: tooLarge}
+}
+
+// decodingBody is a response body decoded by dec. The decoder is
+// only set up on the first Read, since some, like gzip's, read a
+// header from the body straight away, and RoundTrip mustn't block
+// waiting for the server to send it.
+type decodingBody struct {
+	body io.ReadCloser
+	dec  ContentDecoder
+	r    io.ReadCloser // the decoder's reader, once set up
+	err  error         // sticky error from setting up r, or ErrResponseTooLarge
+
+	max      int64  // decoded bytes allowed, or -1 for no limit
+	n        int64  // decoded bytes read so far
+	tooLarge func() // called once the limit is passed
+}
+
+func (b *decodingBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.r == nil {
+		b.r, b.err = b.dec(b.body)
+		if b.err != nil {
+			return 0, b.err
+		}
+	}
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.max != -1 && b.n > b.max {
+		b.err = ErrResponseTooLarge
+		b.tooLarge()
+		return 0, b.err
+	}
+	return n, err
+}
+
+func (b *decodingBody) Close() error {
+	if b.r != nil {
+		b.r.Close()
+	}
+	return b.body.Close()
+}
+
+// A ContentEncoder returns a writer that encodes what's written to
+// it in some content coding and writes the result to w. Closing the
+// writer flushes the encoding; it must not close w.
+type ContentEncoder func(w io.Writer) (io.WriteCloser, error)
+
+// defaultContentEncoders are the request body encoders the Transport
+// has unless its ContentEncoders say otherwise.
+var defaultContentEncoders = map[string]ContentEncoder{
+	"gzip": func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+}
+
+type requestEncodingKey struct{}
+
+// WithRequestEncoding returns a copy of ctx that makes the Transport
+// encode the body of a request made with it in the content coding
+// coding, such as "gzip", overriding Transport.RequestEncoding. An
+// empty coding sends the body as is.
+func WithRequestEncoding(ctx context.Context, coding string) context.Context {
+	return context.WithValue(ctx, requestEncodingKey{}, coding)
+}
+
+// requestEncoder returns the content coding in which to send req's
+// body, and its encoder, or "" and nil to send the body as is. Only
+// bodies of a known length are encoded, and not those of CONNECT
+// requests or of requests that have a Content-Encoding already.
+func (t *Transport) requestEncoder(req *http.Request) (string, ContentEncoder, error) {
+	coding := t.RequestEncoding
+	if v, ok := req.Context().Value(requestEncodingKey{}).(string); ok {
+		coding = v
+	}
+	if coding == "" || req.Body == nil || req.ContentLength <= 0 || req.Method == "CONNECT" {
+		return "", nil, nil
+	}
+	if _, ok := req.Header["Content-Encoding"]; ok {
+		return "", nil, nil
+	}
+	coding = strings.ToLower(coding)
+	enc, ok := t.ContentEncoders[coding]
+	if !ok {
+		enc = defaultContentEncoders[coding]
+	}
+	if enc == nil {
+		return "", nil, fmt.Errorf("http2: no encoder for request content coding %q", coding)
+	}
+	return coding, enc, nil
+}
+
+// streamWriter writes to a client stream as DATA frames, through
+// a func like writeRequestBody's send.
+type streamWriter func(p []byte, endStream bool) error
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	if err := w(p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import "time"
+
+// A FaultInjector makes a connection misbehave in the ways real
+// ones do, so that an application's retry and timeout handling can
+// be tested against them. It's consulted at each frame boundary; see
+// Server.Faults, Transport.Faults and Framer.SetFaultInjector. Its
+// methods are called from the connection's goroutines, so must be
+// safe for concurrent use.
+//
+// Dropping WINDOW_UPDATE frames as they're written stalls the
+// peer's flow control.
+type FaultInjector interface {
+	// ReadFault is called with the header of each frame read,
+	// before its payload is parsed.
+	ReadFault(fh FrameHeader) Fault
+
+	// WriteFault is called with the header of each frame about
+	// to be written.
+	WriteFault(fh FrameHeader) Fault
+}
+
+// A Fault is what a FaultInjector does to a frame. The zero Fault
+// leaves the frame alone.
+type Fault struct {
+	// Delay, if positive, holds the frame up for this long, as the
+	// Server's or Transport's Clock tells it. Later frames in the
+	// same direction wait behind it.
+	Delay time.Duration
+
+	// Drop discards the frame, as though it was lost.
+	Drop bool
+
+	// Corrupt inverts the bits of the frame's payload.
+	Corrupt bool
+
+	// GoAway, for a frame being read, first delivers a GOAWAY
+	// with NO_ERROR and the largest last stream ID, as a server
+	// starting a graceful shutdown sends, then the frame itself.
+	GoAway bool
+}
+
+// SetFaultInjector makes fr consult fi about each frame it reads or
+// writes. A nil fi turns fault injection off.
+func (fr *Framer) SetFaultInjector(fi FaultInjector) {
+	fr.faults = fi
+}
+
+// injectRead applies fr.faults to the frame with header fh and
+// payload, as ReadFrame reads it. It reports whether the frame was
+// dropped.
+func (fr *Framer) injectRead(fh FrameHeader, payload []byte) (dropped bool) {
+	ft := fr.faults.ReadFault(fh)
+	if ft.Delay > 0 {
+		fr.faultDelay(ft.Delay)
+	}
+	if ft.Drop {
+		return true
+	}
+	if ft.Corrupt {
+		invertBits(payload)
+	}
+	if ft.GoAway {
+		fr.goAwayFault = true
+	}
+	return false
+}
+
+// injectWrite applies fr.faults to the frame in fr.wbuf, whose
+// header has been filled in. It reports whether the frame was
+// dropped.
+func (fr *Framer) injectWrite() (dropped bool) {
+	fh := FrameHeader{
+		Type:     FrameType(fr.wbuf[3]),
+		Flags:    Flags(fr.wbuf[4]),
+		Length:   uint32(len(fr.wbuf) - frameHeaderLen),
+		StreamID: uint32(fr.wbuf[5])<<24 | uint32(fr.wbuf[6])<<16 | uint32(fr.wbuf[7])<<8 | uint32(fr.wbuf[8]),
+	}
+	ft := fr.faults.WriteFault(fh)
+	if ft.Delay > 0 {
+		fr.faultDelay(ft.Delay)
+	}
+	if ft.Corrupt {
+		invertBits(fr.wbuf[frameHeaderLen:])
+	}
+	return ft.Drop
+}
+
+// faultDelay waits out a Fault's Delay d on fr.clock.
+func (fr *Framer) faultDelay(d time.Duration) {
+	c := fr.clock
+	if c == nil {
+		c = realClock{}
+	}
+	<-c.NewTimer(d).C()
+}
+
+func invertBits(b []byte) {
+	for i := range b {
+		b[i] = ^b[i]
+	}
+}
@@ -33,6 +33,9 @@ const (
 	FrameGoAway       FrameType = 0x7
 	FrameWindowUpdate FrameType = 0x8
 	FrameContinuation FrameType = 0x9
+
+	// FramePriorityUpdate is from RFC 9218, section 7.1.
+	FramePriorityUpdate FrameType = 0x10
 )
 
 var frameName = map[FrameType]string{
@@ -46,6 +49,8 @@ var frameName = map[FrameType]string{
 	FrameGoAway:       "GOAWAY",
 	FrameWindowUpdate: "WINDOW_UPDATE",
 	FrameContinuation: "CONTINUATION",
+
+	FramePriorityUpdate: "PRIORITY_UPDATE",
 }
 
 func (t FrameType) String() string {
@@ -131,6 +136,8 @@ var frameParsers = map[FrameType]frameParser{
 	FrameGoAway:       parseGoAwayFrame,
 	FrameWindowUpdate: parseWindowUpdateFrame,
 	FrameContinuation: parseContinuationFrame,
+
+	FramePriorityUpdate: parsePriorityUpdateFrame,
 }
 
 func typeFrameParser(t FrameType) frameParser {
@@ -279,6 +286,20 @@ type Framer struct {
 	// rather than comply.
 	AllowIllegalWrites bool
 
+	// faults, if non-nil, is consulted about each frame read or
+	// written. goAwayFault and pending implement Fault.GoAway:
+	// the frame is parsed into pending and a GOAWAY returned first.
+	faults      FaultInjector
+	goAwayFault bool
+	pending     Frame
+
+	// clock times Fault.Delay; nil means the real one. The Server
+	// and Transport set it to their Clock.
+	clock Clock
+
+	// capture, if non-nil, records each frame read or written.
+	capture *FrameCapture
+
 	// TODO: track which type of frame & with which flags was sent
 	// last.  Then return an error (unless AllowIllegalWrites) if
 	// we're in the middle of a header block and a
@@ -311,6 +332,12 @@ func (f *Framer) endWrite() error {
 		byte(length>>16),
 		byte(length>>8),
 		byte(length))
+	if f.faults != nil && f.injectWrite() {
+		return nil
+	}
+	if f.capture != nil {
+		f.capture.record(CaptureWrite, f.wbuf, nil)
+	}
 	n, err := f.w.Write(f.wbuf)
 	if err == nil && n != len(f.wbuf) {
 		err = io.ErrShortWrite
@@ -365,11 +392,17 @@ var ErrFrameTooLarge = errors.New("http2: frame too large")
 // ReadFrame reads a single frame. The returned Frame is only valid
 // until the next call to ReadFrame.
 // If the frame is larger than previously set with SetMaxReadFrameSize,
-// the returned error is ErrFrameTooLarge.
+// the returned error is ErrFrameTooLarge. If it breaks the spec's
+// rules for its type, the error is a FrameError.
 func (fr *Framer) ReadFrame() (Frame, error) {
 	if fr.lastFrame != nil {
 		fr.lastFrame.invalidate()
 	}
+	if f := fr.pending; f != nil {
+		fr.pending = nil
+		fr.lastFrame = f
+		return f, nil
+	}
 	fh, err := readFrameHeader(fr.headerBuf[:], fr.r)
 	if err != nil {
 		return nil, err
@@ -381,14 +414,60 @@ func (fr *Framer) ReadFrame() (Frame, error) {
 	if _, err := io.ReadFull(fr.r, payload); err != nil {
 		return nil, err
 	}
+	if fr.capture != nil {
+		fr.capture.record(CaptureRead, fr.headerBuf[:], payload)
+	}
+	if fr.faults != nil && fr.injectRead(fh, payload) {
+		return fr.ReadFrame()
+	}
 	f, err := typeFrameParser(fh.Type)(fh, payload)
 	if err != nil {
 		return nil, err
 	}
+	if fr.goAwayFault {
+		fr.goAwayFault = false
+		fr.pending = f
+		f = &GoAwayFrame{
+			FrameHeader:  FrameHeader{valid: true, Type: FrameGoAway, Length: 8},
+			LastStreamID: 1<<31 - 1,
+			ErrCode:      ErrCodeNo,
+		}
+	}
 	fr.lastFrame = f
 	return f, nil
 }
 
+// A FrameError is returned by Framer.ReadFrame for a frame that
+// breaks one of the spec's rules for frames of its type. Err is the
+// ConnectionError or StreamError the spec says to respond with. The
+// frame has been read in full, so after a StreamError the Framer is
+// still in step with the peer and reading can continue.
+type FrameError struct {
+	Header FrameHeader // of the offending frame
+	Err    error       // ConnectionError or StreamError
+	Reason string
+}
+
+func (e FrameError) Error() string {
+	return fmt.Sprintf("http2: invalid %v frame on stream %d, length %d: %s (%v)",
+		e.Header.Type, e.Header.StreamID, e.Header.Length, e.Reason, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e FrameError) Unwrap() error { return e.Err }
+
+// connError returns a FrameError for fh that's a connection error of
+// type code.
+func connError(fh FrameHeader, code ErrCode, reason string) error {
+	return FrameError{fh, ConnectionError(code), reason}
+}
+
+// streamError returns a FrameError for fh that's a stream error of
+// type code.
+func streamError(fh FrameHeader, code ErrCode, reason string) error {
+	return FrameError{fh, StreamError{fh.StreamID, code}, reason}
+}
+
 // A DataFrame conveys arbitrary, variable-length sequences of octets
 // associated with a stream.
 // See http://http2.github.io/http2-spec/#rfc.section.6.1
@@ -417,7 +496,7 @@ func parseDataFrame(fh FrameHeader, payload []byte) (Frame, error) {
 		// field is 0x0, the recipient MUST respond with a
 		// connection error (Section 5.4.1) of type
 		// PROTOCOL_ERROR.
-		return nil, ConnectionError(ErrCodeProtocol)
+		return nil, connError(fh, ErrCodeProtocol, "DATA on stream 0")
 	}
 	f := &DataFrame{
 		FrameHeader: fh,
@@ -427,7 +506,7 @@ func parseDataFrame(fh FrameHeader, payload []byte) (Frame, error) {
 		var err error
 		payload, padSize, err = readByte(payload)
 		if err != nil {
-			return nil, err
+			return nil, connError(fh, ErrCodeFrameSize, "missing pad length")
 		}
 	}
 	if int(padSize) > len(payload) {
@@ -435,7 +514,7 @@ func parseDataFrame(fh FrameHeader, payload []byte) (Frame, error) {
 		// length of the frame payload, the recipient MUST
 		// treat this as a connection error.
 		// Filed: https://github.com/http2/http2-spec/issues/610
-		return nil, ConnectionError(ErrCodeProtocol)
+		return nil, connError(fh, ErrCodeProtocol, "padding longer than payload")
 	}
 	f.data = payload[:len(payload)-int(padSize)]
 	return f, nil
@@ -452,16 +531,50 @@ func validStreamID(streamID uint32) bool {
 // It will perform exactly one Write to the underlying Writer.
 // It is the caller's responsibility to not call other Write methods concurrently.
 func (f *Framer) WriteData(streamID uint32, endStream bool, data []byte) error {
-	// TODO: ignoring padding for now. will add when somebody cares.
+	return f.WriteDataPadded(streamID, endStream, data, nil)
+}
+
+var (
+	errPadLength = errors.New("pad length too large")
+	errPadBytes  = errors.New("padding bytes must all be zeros unless AllowIllegalWrites is enabled")
+)
+
+// WriteDataPadded writes a DATA frame with optional padding.
+//
+// If pad is nil, the padding bit is not sent.
+// The length of pad must not exceed 255 bytes.
+// The bytes of pad must all be zero, unless f.AllowIllegalWrites is set.
+//
+// It will perform exactly one Write to the underlying Writer.
+// It is the caller's responsibility to not call other Write methods concurrently.
+func (f *Framer) WriteDataPadded(streamID uint32, endStream bool, data, pad []byte) error {
 	if !validStreamID(streamID) && !f.AllowIllegalWrites {
 		return errStreamID
 	}
+	if len(pad) > 255 {
+		return errPadLength
+	}
+	if !f.AllowIllegalWrites {
+		for _, b := range pad {
+			if b != 0 {
+				// "Padding octets MUST be set to zero when sending."
+				return errPadBytes
+			}
+		}
+	}
 	var flags Flags
 	if endStream {
 		flags |= FlagDataEndStream
 	}
+	if pad != nil {
+		flags |= FlagDataPadded
+	}
 	f.startWrite(FrameData, flags, streamID)
+	if pad != nil {
+		f.writeByte(byte(len(pad)))
+	}
 	f.wbuf = append(f.wbuf, data...)
+	f.wbuf = append(f.wbuf, pad...)
 	return f.endWrite()
 }
 
@@ -483,7 +596,7 @@ func parseSettingsFrame(fh FrameHeader, p []byte) (Frame, error) {
 		// field value other than 0 MUST be treated as a
 		// connection error (Section 5.4.1) of type
 		// FRAME_SIZE_ERROR.
-		return nil, ConnectionError(ErrCodeFrameSize)
+		return nil, connError(fh, ErrCodeFrameSize, "ACK with a payload")
 	}
 	if fh.StreamID != 0 {
 		// SETTINGS frames always apply to a connection,
@@ -493,18 +606,18 @@ func parseSettingsFrame(fh FrameHeader, p []byte) (Frame, error) {
 		// field is anything other than 0x0, the endpoint MUST
 		// respond with a connection error (Section 5.4.1) of
 		// type PROTOCOL_ERROR.
-		return nil, ConnectionError(ErrCodeProtocol)
+		return nil, connError(fh, ErrCodeProtocol, "SETTINGS on a stream")
 	}
 	if len(p)%6 != 0 {
 		// Expecting even number of 6 byte settings.
-		return nil, ConnectionError(ErrCodeFrameSize)
+		return nil, connError(fh, ErrCodeFrameSize, "length not a multiple of 6")
 	}
 	f := &SettingsFrame{FrameHeader: fh, p: p}
 	if v, ok := f.Value(SettingInitialWindowSize); ok && v > (1<<31)-1 {
 		// Values above the maximum flow control window size of 2^31 - 1 MUST
 		// be treated as a connection error (Section 5.4.1) of type
 		// FLOW_CONTROL_ERROR.
-		return nil, ConnectionError(ErrCodeFlowControl)
+		return nil, connError(fh, ErrCodeFlowControl, "initial window size over 2^31-1")
 	}
 	return f, nil
 }
@@ -577,10 +690,10 @@ type PingFrame struct {
 
 func parsePingFrame(fh FrameHeader, payload []byte) (Frame, error) {
 	if len(payload) != 8 {
-		return nil, ConnectionError(ErrCodeFrameSize)
+		return nil, connError(fh, ErrCodeFrameSize, "length not 8")
 	}
 	if fh.StreamID != 0 {
-		return nil, ConnectionError(ErrCodeProtocol)
+		return nil, connError(fh, ErrCodeProtocol, "PING on a stream")
 	}
 	f := &PingFrame{FrameHeader: fh}
 	copy(f.Data[:], payload)
@@ -617,10 +730,10 @@ func (f *GoAwayFrame) DebugData() []byte {
 
 func parseGoAwayFrame(fh FrameHeader, p []byte) (Frame, error) {
 	if fh.StreamID != 0 {
-		return nil, ConnectionError(ErrCodeProtocol)
+		return nil, connError(fh, ErrCodeProtocol, "GOAWAY on a stream")
 	}
 	if len(p) < 8 {
-		return nil, ConnectionError(ErrCodeFrameSize)
+		return nil, connError(fh, ErrCodeFrameSize, "length under 8")
 	}
 	return &GoAwayFrame{
 		FrameHeader:  fh,
@@ -668,7 +781,7 @@ type WindowUpdateFrame struct {
 
 func parseWindowUpdateFrame(fh FrameHeader, p []byte) (Frame, error) {
 	if len(p) != 4 {
-		return nil, ConnectionError(ErrCodeFrameSize)
+		return nil, connError(fh, ErrCodeFrameSize, "length not 4")
 	}
 	inc := binary.BigEndian.Uint32(p[:4]) & 0x7fffffff // mask off high reserved bit
 	if inc == 0 {
@@ -679,9 +792,9 @@ func parseWindowUpdateFrame(fh FrameHeader, p []byte) (Frame, error) {
 		// control window MUST be treated as a connection
 		// error (Section 5.4.1).
 		if fh.StreamID == 0 {
-			return nil, ConnectionError(ErrCodeProtocol)
+			return nil, connError(fh, ErrCodeProtocol, "increment of 0")
 		}
-		return nil, StreamError{fh.StreamID, ErrCodeProtocol}
+		return nil, streamError(fh, ErrCodeProtocol, "increment of 0")
 	}
 	return &WindowUpdateFrame{
 		FrameHeader: fh,
@@ -740,29 +853,29 @@ func parseHeadersFrame(fh FrameHeader, p []byte) (_ Frame, err error) {
 		// is received whose stream identifier field is 0x0, the recipient MUST
 		// respond with a connection error (Section 5.4.1) of type
 		// PROTOCOL_ERROR.
-		return nil, ConnectionError(ErrCodeProtocol)
+		return nil, connError(fh, ErrCodeProtocol, "HEADERS on stream 0")
 	}
 	var padLength uint8
 	if fh.Flags.Has(FlagHeadersPadded) {
 		if p, padLength, err = readByte(p); err != nil {
-			return
+			return nil, connError(fh, ErrCodeFrameSize, "missing pad length")
 		}
 	}
 	if fh.Flags.Has(FlagHeadersPriority) {
 		var v uint32
 		p, v, err = readUint32(p)
 		if err != nil {
-			return nil, err
+			return nil, connError(fh, ErrCodeFrameSize, "truncated priority")
 		}
 		hf.Priority.StreamDep = v & 0x7fffffff
 		hf.Priority.Exclusive = (v != hf.Priority.StreamDep) // high bit was set
 		p, hf.Priority.Weight, err = readByte(p)
 		if err != nil {
-			return nil, err
+			return nil, connError(fh, ErrCodeFrameSize, "truncated priority")
 		}
 	}
-	if len(p)-int(padLength) <= 0 {
-		return nil, StreamError{fh.StreamID, ErrCodeProtocol}
+	if int(padLength) > len(p) {
+		return nil, connError(fh, ErrCodeProtocol, "padding longer than payload")
 	}
 	hf.headerFragBuf = p[:len(p)-int(padLength)]
 	return hf, nil
@@ -807,6 +920,10 @@ func (f *Framer) WriteHeaders(p HeadersFrameParam) error {
 	if !validStreamID(p.StreamID) && !f.AllowIllegalWrites {
 		return errStreamID
 	}
+	// A stream may depend on stream 0, the root of the tree.
+	if p.Priority.StreamDep&(1<<31) != 0 && !f.AllowIllegalWrites {
+		return errors.New("invalid dependent stream id")
+	}
 	var flags Flags
 	if p.PadLength != 0 {
 		flags |= FlagHeadersPadded
@@ -826,9 +943,6 @@ func (f *Framer) WriteHeaders(p HeadersFrameParam) error {
 	}
 	if !p.Priority.IsZero() {
 		v := p.Priority.StreamDep
-		if !validStreamID(v) && !f.AllowIllegalWrites {
-			return errors.New("invalid dependent stream id")
-		}
 		if p.Priority.Exclusive {
 			v |= 1 << 31
 		}
@@ -870,10 +984,12 @@ func (p PriorityParam) IsZero() bool {
 
 func parsePriorityFrame(fh FrameHeader, payload []byte) (Frame, error) {
 	if fh.StreamID == 0 {
-		return nil, ConnectionError(ErrCodeProtocol)
+		return nil, connError(fh, ErrCodeProtocol, "PRIORITY on stream 0")
 	}
 	if len(payload) != 5 {
-		return nil, ConnectionError(ErrCodeFrameSize)
+		// "A PRIORITY frame with a length other than 5
+		// octets MUST be treated as a stream error."
+		return nil, streamError(fh, ErrCodeFrameSize, "length not 5")
 	}
 	v := binary.BigEndian.Uint32(payload[:4])
 	streamID := v & 0x7fffffff // mask off high bit
@@ -905,6 +1021,50 @@ func (f *Framer) WritePriority(streamID uint32, p PriorityParam) error {
 	return f.endWrite()
 }
 
+// A PriorityUpdateFrame changes the priority of a stream, in the
+// scheme of RFC 9218: it carries a value for the stream as the
+// Priority header would. Only clients send it, and always on
+// stream 0.
+// See https://www.rfc-editor.org/rfc/rfc9218.html#section-7.1
+type PriorityUpdateFrame struct {
+	FrameHeader
+	PrioritizedStreamID uint32
+	Priority            string // such as "u=1, i"
+}
+
+func parsePriorityUpdateFrame(fh FrameHeader, payload []byte) (Frame, error) {
+	if fh.StreamID != 0 {
+		return nil, connError(fh, ErrCodeProtocol, "PRIORITY_UPDATE on a stream")
+	}
+	if len(payload) < 4 {
+		return nil, connError(fh, ErrCodeFrameSize, "length under 4")
+	}
+	streamID := binary.BigEndian.Uint32(payload[:4]) & (1<<31 - 1)
+	if streamID == 0 {
+		return nil, connError(fh, ErrCodeProtocol, "PRIORITY_UPDATE for stream 0")
+	}
+	return &PriorityUpdateFrame{
+		FrameHeader:         fh,
+		PrioritizedStreamID: streamID,
+		Priority:            string(payload[4:]),
+	}, nil
+}
+
+// WritePriorityUpdate writes a PRIORITY_UPDATE frame giving
+// streamID the priority in the RFC 9218 Priority field value v.
+//
+// It will perform exactly one Write to the underlying Writer.
+// It is the caller's responsibility to not call other Write methods concurrently.
+func (f *Framer) WritePriorityUpdate(streamID uint32, v string) error {
+	if !validStreamID(streamID) && !f.AllowIllegalWrites {
+		return errStreamID
+	}
+	f.startWrite(FramePriorityUpdate, 0, 0)
+	f.writeUint32(streamID)
+	f.writeBytes([]byte(v))
+	return f.endWrite()
+}
+
 // A RSTStreamFrame allows for abnormal termination of a stream.
 // See http://http2.github.io/http2-spec/#rfc.section.6.4
 type RSTStreamFrame struct {
@@ -914,10 +1074,10 @@ type RSTStreamFrame struct {
 
 func parseRSTStreamFrame(fh FrameHeader, p []byte) (Frame, error) {
 	if len(p) != 4 {
-		return nil, ConnectionError(ErrCodeFrameSize)
+		return nil, connError(fh, ErrCodeFrameSize, "length not 4")
 	}
 	if fh.StreamID == 0 {
-		return nil, ConnectionError(ErrCodeProtocol)
+		return nil, connError(fh, ErrCodeProtocol, "RST_STREAM on stream 0")
 	}
 	return &RSTStreamFrame{fh, ErrCode(binary.BigEndian.Uint32(p[:4]))}, nil
 }
@@ -943,6 +1103,9 @@ type ContinuationFrame struct {
 }
 
 func parseContinuationFrame(fh FrameHeader, p []byte) (Frame, error) {
+	if fh.StreamID == 0 {
+		return nil, connError(fh, ErrCodeProtocol, "CONTINUATION on stream 0")
+	}
 	return &ContinuationFrame{fh, p}, nil
 }
 
@@ -1004,26 +1167,26 @@ func parsePushPromise(fh FrameHeader, p []byte) (_ Frame, err error) {
 		// with. If the stream identifier field specifies the value
 		// 0x0, a recipient MUST respond with a connection error
 		// (Section 5.4.1) of type PROTOCOL_ERROR.
-		return nil, ConnectionError(ErrCodeProtocol)
+		return nil, connError(fh, ErrCodeProtocol, "PUSH_PROMISE on stream 0")
 	}
 	// The PUSH_PROMISE frame includes optional padding.
 	// Padding fields and flags are identical to those defined for DATA frames
 	var padLength uint8
 	if fh.Flags.Has(FlagPushPromisePadded) {
 		if p, padLength, err = readByte(p); err != nil {
-			return
+			return nil, connError(fh, ErrCodeFrameSize, "missing pad length")
 		}
 	}
 
 	p, pp.PromiseID, err = readUint32(p)
 	if err != nil {
-		return
+		return nil, connError(fh, ErrCodeFrameSize, "missing promised stream ID")
 	}
 	pp.PromiseID = pp.PromiseID & (1<<31 - 1)
 
 	if int(padLength) > len(p) {
 		// like the DATA frame, error out if padding is longer than the body.
-		return nil, ConnectionError(ErrCodeProtocol)
+		return nil, connError(fh, ErrCodeProtocol, "padding longer than payload")
 	}
 	pp.headerFragBuf = p[:len(p)-int(padLength)]
 	return pp, nil
@@ -1084,6 +1247,13 @@ func (f *Framer) WritePushPromise(p PushPromiseParam) error {
 
 // WriteRawFrame writes a raw frame. This can be used to write
 // extension frames unknown to this package.
+//
+// The type, flags, stream ID and payload are written as given, even
+// for frame types the package implements and regardless of
+// AllowIllegalWrites, so protocol testing tools can produce frames
+// the other Write methods refuse to. The stream ID's reserved high
+// bit is not cleared. Only a payload too large for the 24-bit length
+// field is rejected, with ErrFrameTooLarge.
 func (f *Framer) WriteRawFrame(t FrameType, flags Flags, streamID uint32, payload []byte) error {
 	f.startWrite(t, flags, streamID)
 	f.writeBytes(payload)
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 	"unsafe"
 )
 
@@ -96,6 +97,88 @@ func TestWriteData(t *testing.T) {
 	}
 }
 
+func TestWriteDataPadded(t *testing.T) {
+	tests := [...]struct {
+		streamID   uint32
+		endStream  bool
+		data       []byte
+		pad        []byte
+		wantHeader FrameHeader
+	}{
+		// Unpadded:
+		0: {
+			streamID:  1,
+			endStream: true,
+			data:      []byte("foo"),
+			pad:       nil,
+			wantHeader: FrameHeader{
+				Type:     FrameData,
+				Flags:    FlagDataEndStream,
+				Length:   3,
+				StreamID: 1,
+			},
+		},
+
+		// Padded bit set, but no padding:
+		1: {
+			streamID:  1,
+			endStream: true,
+			data:      []byte("foo"),
+			pad:       []byte{},
+			wantHeader: FrameHeader{
+				Type:     FrameData,
+				Flags:    FlagDataEndStream | FlagDataPadded,
+				Length:   4,
+				StreamID: 1,
+			},
+		},
+
+		// Padded bit set, with padding:
+		2: {
+			streamID:  1,
+			endStream: false,
+			data:      []byte("foo"),
+			pad:       []byte{0, 0, 0},
+			wantHeader: FrameHeader{
+				Type:     FrameData,
+				Flags:    FlagDataPadded,
+				Length:   7,
+				StreamID: 1,
+			},
+		},
+	}
+	for i, tt := range tests {
+		fr, _ := testFramer()
+		if err := fr.WriteDataPadded(tt.streamID, tt.endStream, tt.data, tt.pad); err != nil {
+			t.Errorf("%d. WriteDataPadded = %v", i, err)
+			continue
+		}
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Errorf("%d. ReadFrame: %v", i, err)
+			continue
+		}
+		got := f.Header()
+		tt.wantHeader.valid = true
+		if got != tt.wantHeader {
+			t.Errorf("%d. read %+v; want %+v", i, got, tt.wantHeader)
+			continue
+		}
+		df := f.(*DataFrame)
+		if !bytes.Equal(df.Data(), tt.data) {
+			t.Errorf("%d. got %q; want %q", i, df.Data(), tt.data)
+		}
+	}
+
+	fr, _ := testFramer()
+	if err := fr.WriteDataPadded(1, false, nil, make([]byte, 256)); err != errPadLength {
+		t.Errorf("256 bytes of padding: err = %v; want %v", err, errPadLength)
+	}
+	if err := fr.WriteDataPadded(1, false, nil, []byte{1}); err != errPadBytes {
+		t.Errorf("nonzero padding: err = %v; want %v", err, errPadBytes)
+	}
+}
+
 func TestWriteHeaders(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -198,6 +281,27 @@ func TestWriteHeaders(t *testing.T) {
 				headerFragBuf: []byte("abc"),
 			},
 		},
+		{
+			"with priority on the root",
+			HeadersFrameParam{
+				StreamID:      42,
+				BlockFragment: []byte("abc"),
+				EndHeaders:    true,
+				Priority:      PriorityParam{Weight: 200},
+			},
+			"\x00\x00\b\x01$\x00\x00\x00*\x00\x00\x00\x00\xc8abc",
+			&HeadersFrame{
+				FrameHeader: FrameHeader{
+					valid:    true,
+					StreamID: 42,
+					Type:     FrameHeaders,
+					Flags:    FlagHeadersEndHeaders | FlagHeadersPriority,
+					Length:   uint32(5 + len("abc")), // priority + contents
+				},
+				Priority:      PriorityParam{Weight: 200},
+				headerFragBuf: []byte("abc"),
+			},
+		},
 	}
 	for _, tt := range tests {
 		fr, buf := testFramer()
@@ -343,6 +447,36 @@ func TestWritePriority(t *testing.T) {
 	}
 }
 
+func TestWritePriorityUpdate(t *testing.T) {
+	fr, buf := testFramer()
+	if err := fr.WritePriorityUpdate(5, "u=1, i"); err != nil {
+		t.Fatal(err)
+	}
+	const wantEnc = "\x00\x00\n\x10\x00\x00\x00\x00\x00\x00\x00\x00\x05u=1, i"
+	if buf.String() != wantEnc {
+		t.Errorf("encoded as %q; want %q", buf.Bytes(), wantEnc)
+	}
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &PriorityUpdateFrame{
+		FrameHeader: FrameHeader{
+			valid:  true,
+			Type:   FramePriorityUpdate,
+			Length: 10,
+		},
+		PrioritizedStreamID: 5,
+		Priority:            "u=1, i",
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("read back %#v; want %#v", f, want)
+	}
+	if err := fr.WritePriorityUpdate(0, "u=1"); err != errStreamID {
+		t.Errorf("WritePriorityUpdate for stream 0 = %v; want %v", err, errStreamID)
+	}
+}
+
 func TestWriteSettings(t *testing.T) {
 	fr, buf := testFramer()
 	settings := []Setting{{1, 2}, {3, 4}}
@@ -524,6 +658,107 @@ func TestWriteTooLargeFrame(t *testing.T) {
 	}
 }
 
+func TestReadTooLargeFrame(t *testing.T) {
+	var buf bytes.Buffer
+	NewFramer(&buf, nil).WriteData(1, false, make([]byte, 1<<15))
+	fr := NewFramer(nil, &buf)
+	fr.SetMaxReadFrameSize(1 << 14)
+	fr.getReadBuf = func(size uint32) []byte {
+		t.Fatalf("allocated %d byte payload for a frame over the limit", size)
+		return nil
+	}
+	if _, err := fr.ReadFrame(); err != ErrFrameTooLarge {
+		t.Errorf("ReadFrame = %v; want ErrFrameTooLarge", err)
+	}
+}
+
+func TestWriteRawFrame(t *testing.T) {
+	fr, buf := testFramer()
+	if err := fr.WriteRawFrame(0xfa, 0x81, 0x80000003, []byte("grease")); err != nil {
+		t.Fatal(err)
+	}
+	const wantEnc = "\x00\x00\x06\xfa\x81\x80\x00\x00\x03grease"
+	if buf.String() != wantEnc {
+		t.Errorf("encoded as %q; want %q", buf.Bytes(), wantEnc)
+	}
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uf, ok := f.(*UnknownFrame)
+	if !ok {
+		t.Fatalf("read %T; want *UnknownFrame", f)
+	}
+	if uf.Type != 0xfa || uf.Flags != 0x81 || uf.StreamID != 3 || string(uf.Payload()) != "grease" {
+		t.Errorf("read %v with payload %q", uf.FrameHeader, uf.Payload())
+	}
+
+	// Known types are written unchecked, and read back as such.
+	if err := fr.WriteRawFrame(FramePing, FlagPingAck, 0, []byte("12345678")); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pf, ok := f.(*PingFrame); !ok || !pf.Flags.Has(FlagPingAck) || string(pf.Data[:]) != "12345678" {
+		t.Errorf("read %v; want a PING ACK", f)
+	}
+
+	if err := fr.WriteRawFrame(0xfa, 0, 0, make([]byte, 1<<24)); err != ErrFrameTooLarge {
+		t.Errorf("oversized WriteRawFrame = %v; want ErrFrameTooLarge", err)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      FrameType
+		flags    Flags
+		streamID uint32
+		payload  string
+		want     error
+	}{
+		{"DATA on stream 0", FrameData, 0, 0, "x", ConnectionError(ErrCodeProtocol)},
+		{"DATA overpadded", FrameData, FlagDataPadded, 1, "\x05x", ConnectionError(ErrCodeProtocol)},
+		{"HEADERS on stream 0", FrameHeaders, FlagHeadersEndHeaders, 0, "\x82", ConnectionError(ErrCodeProtocol)},
+		{"HEADERS truncated priority", FrameHeaders, FlagHeadersPriority, 1, "\x00\x00", ConnectionError(ErrCodeFrameSize)},
+		{"CONTINUATION on stream 0", FrameContinuation, 0, 0, "", ConnectionError(ErrCodeProtocol)},
+		{"PRIORITY wrong length", FramePriority, 0, 3, "\x00\x00\x00\x01", StreamError{3, ErrCodeFrameSize}},
+		{"SETTINGS odd length", FrameSettings, 0, 0, "\x00\x01\x00", ConnectionError(ErrCodeFrameSize)},
+		{"SETTINGS ACK with payload", FrameSettings, FlagSettingsAck, 0, "\x00\x01\x00\x00\x00\x00", ConnectionError(ErrCodeFrameSize)},
+		{"PING too short", FramePing, 0, 0, "1234567", ConnectionError(ErrCodeFrameSize)},
+		{"PING on a stream", FramePing, 0, 1, "12345678", ConnectionError(ErrCodeProtocol)},
+		{"WINDOW_UPDATE 0 on conn", FrameWindowUpdate, 0, 0, "\x00\x00\x00\x00", ConnectionError(ErrCodeProtocol)},
+		{"WINDOW_UPDATE 0 on stream", FrameWindowUpdate, 0, 5, "\x00\x00\x00\x00", StreamError{5, ErrCodeProtocol}},
+		{"RST_STREAM on stream 0", FrameRSTStream, 0, 0, "\x00\x00\x00\x00", ConnectionError(ErrCodeProtocol)},
+		{"PRIORITY_UPDATE on a stream", FramePriorityUpdate, 0, 1, "\x00\x00\x00\x01u=1", ConnectionError(ErrCodeProtocol)},
+		{"PRIORITY_UPDATE too short", FramePriorityUpdate, 0, 0, "\x00\x00\x01", ConnectionError(ErrCodeFrameSize)},
+		{"PRIORITY_UPDATE for stream 0", FramePriorityUpdate, 0, 0, "\x00\x00\x00\x00u=1", ConnectionError(ErrCodeProtocol)},
+	}
+	for _, tt := range tests {
+		fr, _ := testFramer()
+		fr.WriteRawFrame(tt.typ, tt.flags, tt.streamID, []byte(tt.payload))
+		// A valid frame after it, for the Framer to go on to.
+		fr.WritePing(false, [8]byte{})
+		_, err := fr.ReadFrame()
+		fe, ok := err.(FrameError)
+		if !ok {
+			t.Errorf("%s: ReadFrame error = %v; want a FrameError", tt.name, err)
+			continue
+		}
+		if fe.Err != tt.want {
+			t.Errorf("%s: Err = %v; want %v", tt.name, fe.Err, tt.want)
+		}
+		if fe.Header.Type != tt.typ || fe.Header.StreamID != tt.streamID || fe.Header.Length != uint32(len(tt.payload)) {
+			t.Errorf("%s: Header = %v", tt.name, fe.Header)
+		}
+		if f, err := fr.ReadFrame(); err != nil {
+			t.Errorf("%s: next ReadFrame = %v, %v", tt.name, f, err)
+		}
+	}
+}
+
 func TestWriteGoAway(t *testing.T) {
 	const debug = "foo"
 	fr, buf := testFramer()
@@ -595,3 +830,103 @@ func TestWritePushPromise(t *testing.T) {
 		t.Fatalf("parsed back:\n%#v\nwant:\n%#v", f, want)
 	}
 }
+
+// faultsByStream is a FaultInjector that applies a fixed Fault to
+// the frames of each stream, in both directions.
+type faultsByStream struct {
+	read, write map[uint32]Fault
+}
+
+func (fi faultsByStream) ReadFault(fh FrameHeader) Fault  { return fi.read[fh.StreamID] }
+func (fi faultsByStream) WriteFault(fh FrameHeader) Fault { return fi.write[fh.StreamID] }
+
+func TestFramerWriteFaults(t *testing.T) {
+	fr, _ := testFramer()
+	fr.SetFaultInjector(faultsByStream{write: map[uint32]Fault{
+		1: {Drop: true},
+		3: {Corrupt: true},
+	}})
+	for _, id := range []uint32{1, 3, 5} {
+		if err := fr.WriteData(id, false, []byte{0x0f}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fr.SetFaultInjector(nil)
+	for _, want := range []struct {
+		id   uint32
+		data byte
+	}{{3, 0xf0}, {5, 0x0f}} {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		df, ok := f.(*DataFrame)
+		if !ok || df.StreamID != want.id || !bytes.Equal(df.Data(), []byte{want.data}) {
+			t.Errorf("read %v; want DATA on stream %d with %#x", f, want.id, want.data)
+		}
+	}
+}
+
+func TestFramerReadFaults(t *testing.T) {
+	fr, _ := testFramer()
+	for _, id := range []uint32{1, 3} {
+		if err := fr.WriteData(id, false, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fr.SetFaultInjector(faultsByStream{read: map[uint32]Fault{
+		1: {Drop: true},
+		3: {GoAway: true},
+	}})
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ga, ok := f.(*GoAwayFrame); !ok || ga.ErrCode != ErrCodeNo || ga.LastStreamID != 1<<31-1 {
+		t.Fatalf("first frame = %v; want graceful GOAWAY", f)
+	}
+	f, err = fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if df, ok := f.(*DataFrame); !ok || df.StreamID != 3 || string(df.Data()) != "x" {
+		t.Errorf("second frame = %v; want the DATA on stream 3", f)
+	}
+}
+
+// A delayed frame is held up on the Framer's clock, not the real one.
+func TestFramerFaultDelayClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	fr, _ := testFramer()
+	fr.clock = clock
+	fr.SetFaultInjector(faultsByStream{write: map[uint32]Fault{1: {Delay: time.Hour}}})
+	done := make(chan error, 1)
+	go func() { done <- fr.WriteData(1, false, []byte("x")) }()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		clock.mu.Lock()
+		n := len(clock.timers)
+		clock.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the delay's timer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("frame written before the delay was up")
+	default:
+	}
+	clock.advance(time.Hour)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("frame still held up after the delay")
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+//go:build go1.23
+
+package http2
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// echRetry reports whether err is a server rejecting Encrypted
+// Client Hello while offering other configs, in which case it sets
+// them in cfg for the dial to be retried with.
+func echRetry(cfg *tls.Config, err error) bool {
+	var e *tls.ECHRejectionError
+	if !errors.As(err, &e) || len(e.RetryConfigList) == 0 {
+		return false
+	}
+	cfg.EncryptedClientHelloConfigList = e.RetryConfigList
+	return true
+}
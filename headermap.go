@@ -29,6 +29,7 @@ func init() {
 		"allow",
 		"authorization",
 		"cache-control",
+		"connection",
 		"content-disposition",
 		"content-encoding",
 		"content-language",
@@ -47,12 +48,15 @@ func init() {
 		"if-modified-since",
 		"if-none-match",
 		"if-unmodified-since",
+		"keep-alive",
 		"last-modified",
 		"link",
 		"location",
 		"max-forwards",
+		"origin",
 		"proxy-authenticate",
 		"proxy-authorization",
+		"proxy-connection",
 		"range",
 		"referer",
 		"refresh",
@@ -60,7 +64,9 @@ func init() {
 		"server",
 		"set-cookie",
 		"strict-transport-security",
+		"te",
 		"transfer-encoding",
+		"upgrade",
 		"user-agent",
 		"vary",
 		"via",
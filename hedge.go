@@ -0,0 +1,124 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type hedgeKey struct{}
+
+// WithHedging returns a copy of ctx that makes the Transport hedge
+// a request made with it: if no response has arrived after delay,
+// the same request is sent again on another connection, and
+// whichever response arrives first is returned. The other stream
+// is reset with CANCEL. Only requests that are safe to send twice,
+// idempotent ones without a body, are hedged; others are sent once
+// as usual.
+func WithHedging(ctx context.Context, delay time.Duration) context.Context {
+	return context.WithValue(ctx, hedgeKey{}, delay)
+}
+
+// hedgeDelay reports whether req should be hedged, and after how
+// long.
+func hedgeDelay(req *http.Request) (time.Duration, bool) {
+	delay, ok := req.Context().Value(hedgeKey{}).(time.Duration)
+	if !ok || actualContentLength(req) != 0 || !isIdempotent(req) {
+		return 0, false
+	}
+	return delay, true
+}
+
+// isIdempotent reports whether req can be sent twice without
+// changing its effect, going by its method or, as net/http does,
+// an Idempotency-Key header.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	if !ok {
+		_, ok = req.Header["X-Idempotency-Key"]
+	}
+	return ok
+}
+
+// hedgeResult is the outcome of one attempt of a hedged request.
+type hedgeResult struct {
+	res *http.Response
+	err error
+}
+
+// roundTripHedged sends req on a conn to host:port and, if it's
+// still waiting for the response after delay, again on a second
+// conn. Each attempt is retried on another conn as roundTripRetry
+// retries an unhedged request. The first response wins; the losing
+// attempt is canceled, or has its body closed if it too got a
+// response, either way resetting its stream. An attempt's error
+// only fails the request once no other attempt is left.
+func (t *Transport) roundTripHedged(req *http.Request, host, port string, delay time.Duration) (*http.Response, error) {
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	start := func(cc *ClientConn) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		go func() {
+			res, err := t.roundTripRetry(ctx, cc, req, host, port)
+			results <- hedgeResult{res, err}
+		}()
+	}
+
+	cc, err := t.getClientConn(host, port)
+	if err != nil {
+		return nil, err
+	}
+	start(cc)
+	pending := 1
+
+	timer := t.clock().NewTimer(delay)
+	defer timer.Stop()
+	timerc := timer.C()
+	for {
+		select {
+		case <-timerc:
+			timerc = nil
+			// If no second conn can be had, the first attempt
+			// carries on alone.
+			if cc2, err := t.getClientConnExcept(host, port, cc); err == nil {
+				start(cc2)
+				pending++
+			}
+		case r := <-results:
+			pending--
+			if r.err != nil && pending > 0 {
+				continue
+			}
+			if pending > 0 {
+				go closeHedgeLosers(results, pending)
+			}
+			return r.res, r.err
+		}
+	}
+}
+
+// closeHedgeLosers waits for the n attempts still outstanding once
+// a hedged request has its response, and closes the bodies of any
+// that got one too.
+func closeHedgeLosers(results <-chan hedgeResult, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.res != nil {
+			r.res.Body.Close()
+		}
+	}
+}
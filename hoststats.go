@@ -0,0 +1,148 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// maxHostSamples bounds the streams a Transport remembers per host
+// for HostStats; under heavier traffic, the window is cut short.
+const maxHostSamples = 4096
+
+// HostStats summarizes a Transport's traffic to a host, as a proxy
+// needs to judge whether an upstream is healthy. See
+// Transport.HostStats.
+type HostStats struct {
+	ActiveConns   int // conns in the pool
+	ActiveStreams int // requests in flight on them
+
+	// Of the streams that closed within the last StatsWindow:
+	Streams   int           // how many there were
+	ErrorRate float64       // the fraction that failed; see Transport.HostStats
+	P50, P99  time.Duration // percentiles of their latency
+}
+
+// hostSamples are the recent streams to a host, oldest first.
+type hostSamples struct {
+	samples []streamSample
+}
+
+// streamSample is a closed stream, as counted by HostStats.
+type streamSample struct {
+	end    time.Time
+	dur    time.Duration
+	failed bool
+}
+
+func (t *Transport) statsWindow() time.Duration {
+	if t.StatsWindow > 0 {
+		return t.StatsWindow
+	}
+	return time.Minute
+}
+
+// HostStats returns the Transport's statistics for the host:port
+// addr, like those ClientConns takes. A stream counts as failed if
+// it ended in an error, other than the caller closing the response
+// body or canceling the request, or if its response was a 5xx.
+func (t *Transport) HostStats(addr string) HostStats {
+	var hs HostStats
+	t.connMu.RLock()
+	for _, cc := range t.conns[addr] {
+		hs.ActiveConns++
+		cc.mu.Lock()
+		hs.ActiveStreams += cc.ownStreams()
+		cc.mu.Unlock()
+	}
+	t.connMu.RUnlock()
+
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	h := t.stats[addr]
+	if h == nil {
+		return hs
+	}
+	h.prune(t.clock().Now().Add(-t.statsWindow()))
+	if len(h.samples) == 0 {
+		delete(t.stats, addr)
+		return hs
+	}
+	durs := make([]time.Duration, len(h.samples))
+	failed := 0
+	for i, s := range h.samples {
+		durs[i] = s.dur
+		if s.failed {
+			failed++
+		}
+	}
+	sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+	hs.Streams = len(durs)
+	hs.ErrorRate = float64(failed) / float64(len(durs))
+	hs.P50 = percentile(durs, 50)
+	hs.P99 = percentile(durs, 99)
+	return hs
+}
+
+// percentile returns the pth percentile of the sorted durs, by the
+// nearest-rank method.
+func percentile(durs []time.Duration, p int) time.Duration {
+	i := (len(durs)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return durs[i]
+}
+
+// recordStream counts s, a stream just closed on a conn to addr,
+// toward HostStats. Hosts idle for a whole window are dropped as it
+// goes.
+func (t *Transport) recordStream(addr string, s StreamStats) {
+	now := s.Start.Add(s.Duration)
+	failed := s.Status >= 500
+	switch s.Err {
+	case nil, errClosedResponseBody, ErrRequestCanceled, context.Canceled:
+	default:
+		failed = true
+	}
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	start := now.Add(-t.statsWindow())
+	if now.Sub(t.statsSwept) > t.statsWindow() {
+		for k, h := range t.stats {
+			if h.prune(start); len(h.samples) == 0 {
+				delete(t.stats, k)
+			}
+		}
+		t.statsSwept = now
+	}
+	h := t.stats[addr]
+	if h == nil {
+		if t.stats == nil {
+			t.stats = make(map[string]*hostSamples)
+		}
+		h = new(hostSamples)
+		t.stats[addr] = h
+	}
+	h.prune(start)
+	if len(h.samples) >= maxHostSamples {
+		h.samples = h.samples[1:]
+	}
+	h.samples = append(h.samples, streamSample{end: now, dur: s.Duration, failed: failed})
+}
+
+// prune drops the samples from start or before.
+func (h *hostSamples) prune(start time.Time) {
+	i := 0
+	for i < len(h.samples) && !h.samples[i].end.After(start) {
+		i++
+	}
+	if i > 0 {
+		h.samples = append(h.samples[:0], h.samples[i:]...)
+	}
+}
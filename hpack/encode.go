@@ -29,8 +29,58 @@ type Encoder struct {
 	tableSizeUpdate bool
 	w               io.Writer
 	buf             []byte
+
+	// sensitive, if non-nil, reports whether fields of the given
+	// name are to be encoded as if HeaderField.Sensitive were set.
+	sensitive func(name string) bool
+
+	// huffman is when to Huffman-code string literals, unless
+	// huffmanFunc is non-nil and decides per field instead.
+	huffman     HuffmanPolicy
+	huffmanFunc func(f HeaderField) HuffmanPolicy
+
+	// indexFunc, if non-nil, decides how each field may use the
+	// header tables. See SetIndexFunc.
+	indexFunc func(f HeaderField) IndexPolicy
 }
 
+// An IndexPolicy says how an Encoder may use the header tables to
+// encode a field.
+type IndexPolicy int
+
+const (
+	// IndexDynamic refers to a matching entry of either table
+	// if there is one, and otherwise sends a literal that adds
+	// the field to the dynamic table. It's the default.
+	IndexDynamic IndexPolicy = iota
+
+	// IndexStatic refers to a matching static table entry, and
+	// otherwise sends a literal without indexing, naming it by a
+	// static table index where possible. The dynamic table is
+	// neither searched nor added to.
+	IndexStatic
+
+	// IndexNone sends a literal without indexing, using neither
+	// table even for the name.
+	IndexNone
+)
+
+// A HuffmanPolicy says when an Encoder Huffman-codes the name and
+// value strings of the fields it sends as literals.
+type HuffmanPolicy int
+
+const (
+	// HuffmanShorter Huffman-codes a string only when that makes
+	// it strictly shorter. It's the default.
+	HuffmanShorter HuffmanPolicy = iota
+
+	// HuffmanAlways Huffman-codes every string.
+	HuffmanAlways
+
+	// HuffmanNever sends every string as plain octets.
+	HuffmanNever
+)
+
 // NewEncoder returns a new Encoder which performs HPACK encoding. An
 // encoded data is written to w.
 func NewEncoder(w io.Writer) *Encoder {
@@ -50,6 +100,10 @@ func NewEncoder(w io.Writer) *Encoder {
 func (e *Encoder) WriteField(f HeaderField) error {
 	e.buf = e.buf[:0]
 
+	if e.sensitive != nil && !f.Sensitive {
+		f.Sensitive = e.sensitive(f.Name)
+	}
+
 	if e.tableSizeUpdate {
 		e.tableSizeUpdate = false
 		if e.minSize < e.dynTab.maxSize {
@@ -59,19 +113,34 @@ func (e *Encoder) WriteField(f HeaderField) error {
 		e.buf = appendTableSize(e.buf, e.dynTab.maxSize)
 	}
 
-	idx, nameValueMatch := e.searchTable(f)
+	policy := IndexDynamic
+	if e.indexFunc != nil {
+		policy = e.indexFunc(f)
+	}
+	var idx uint64
+	var nameValueMatch bool
+	switch policy {
+	case IndexDynamic:
+		idx, nameValueMatch = e.searchTable(f)
+	case IndexStatic:
+		idx, nameValueMatch = searchStaticTable(f)
+	}
 	if nameValueMatch {
 		e.buf = appendIndexed(e.buf, idx)
 	} else {
-		indexing := e.shouldIndex(f)
+		indexing := policy == IndexDynamic && e.shouldIndex(f)
 		if indexing {
 			e.dynTab.add(f)
 		}
 
+		p := e.huffman
+		if e.huffmanFunc != nil {
+			p = e.huffmanFunc(f)
+		}
 		if idx == 0 {
-			e.buf = appendNewName(e.buf, f, indexing)
+			e.buf = appendNewName(e.buf, f, indexing, p)
 		} else {
-			e.buf = appendIndexedName(e.buf, f, idx, indexing)
+			e.buf = appendIndexedName(e.buf, f, idx, indexing, p)
 		}
 	}
 	n, err := e.w.Write(e.buf)
@@ -89,6 +158,21 @@ func (e *Encoder) WriteField(f HeaderField) error {
 // only name matches, i points to that index and nameValueMatch
 // becomes false.
 func (e *Encoder) searchTable(f HeaderField) (i uint64, nameValueMatch bool) {
+	i, nameValueMatch = searchStaticTable(f)
+	if nameValueMatch {
+		return
+	}
+
+	j, nameValueMatch := e.dynTab.search(f)
+	if nameValueMatch || (i == 0 && j != 0) {
+		i = j + uint64(len(staticTable))
+	}
+	return
+}
+
+// searchStaticTable is like searchTable, but only searches the static
+// header table.
+func searchStaticTable(f HeaderField) (i uint64, nameValueMatch bool) {
 	for idx, hf := range staticTable {
 		if !constantTimeStringCompare(hf.Name, f.Name) {
 			continue
@@ -106,14 +190,17 @@ func (e *Encoder) searchTable(f HeaderField) (i uint64, nameValueMatch bool) {
 		nameValueMatch = true
 		return
 	}
-
-	j, nameValueMatch := e.dynTab.search(f)
-	if nameValueMatch || (i == 0 && j != 0) {
-		i = j + uint64(len(staticTable))
-	}
 	return
 }
 
+// DynamicTable returns the entries of the encoder's dynamic table,
+// newest (lowest index) first, along with the table's current size
+// and maximum size in bytes. A decoder in sync with e reports the
+// same entries once it has decoded everything e has written.
+func (e *Encoder) DynamicTable() (ents []TableEntry, size, maxSize uint32) {
+	return e.dynTab.snapshot(), e.dynTab.size, e.dynTab.maxSize
+}
+
 // SetMaxDynamicTableSize changes the dynamic header table size to v.
 // The actual size is bounded by the value passed to
 // SetMaxDynamicTableSizeLimit.
@@ -143,9 +230,42 @@ func (e *Encoder) SetMaxDynamicTableSizeLimit(v uint32) {
 	}
 }
 
+// SetSensitive sets a func reporting whether fields named name carry
+// secrets, such as credentials, and so must be encoded as "Never
+// Indexed" literals, as if their Sensitive field were set. Such
+// values are kept out of the dynamic table, where an attacker
+// sharing the compression context could probe them by observing
+// the encoded size of its own guesses. See RFC 7541 section 7.1.
+// A nil f, the default, leaves this to HeaderField.Sensitive.
+func (e *Encoder) SetSensitive(f func(name string) bool) {
+	e.sensitive = f
+}
+
+// SetHuffmanPolicy sets when e Huffman-codes string literals. The
+// default is HuffmanShorter.
+func (e *Encoder) SetHuffmanPolicy(p HuffmanPolicy) {
+	e.huffman = p
+}
+
+// SetHuffmanFunc sets a func that picks the HuffmanPolicy for each
+// field e sends as a literal, overriding SetHuffmanPolicy. A nil f
+// restores the policy set by SetHuffmanPolicy.
+func (e *Encoder) SetHuffmanFunc(f func(f HeaderField) HuffmanPolicy) {
+	e.huffmanFunc = f
+}
+
+// SetIndexFunc sets a func that picks the IndexPolicy for each field
+// e encodes. Keeping high-cardinality values, such as request IDs,
+// out of the dynamic table stops them from evicting entries that
+// would be reused. Sensitive fields are never indexed, whatever f
+// returns. A nil f, the default, uses IndexDynamic for every field.
+func (e *Encoder) SetIndexFunc(f func(f HeaderField) IndexPolicy) {
+	e.indexFunc = f
+}
+
 // shouldIndex reports whether f should be indexed.
 func (e *Encoder) shouldIndex(f HeaderField) bool {
-	return !f.Sensitive && f.size() <= e.dynTab.maxSize
+	return !f.Sensitive && f.Size() <= e.dynTab.maxSize
 }
 
 // appendIndexed appends index i, as encoded in "Indexed Header Field"
@@ -163,11 +283,11 @@ func appendIndexed(dst []byte, i uint64) []byte {
 //
 // If f.Sensitive is true, "Never Indexed" representation is used. If
 // f.Sensitive is false and indexing is true, "Inremental Indexing"
-// representation is used.
-func appendNewName(dst []byte, f HeaderField, indexing bool) []byte {
+// representation is used. Strings are Huffman-coded per p.
+func appendNewName(dst []byte, f HeaderField, indexing bool, p HuffmanPolicy) []byte {
 	dst = append(dst, encodeTypeByte(indexing, f.Sensitive))
-	dst = appendHpackString(dst, f.Name)
-	return appendHpackString(dst, f.Value)
+	dst = appendHpackString(dst, f.Name, p)
+	return appendHpackString(dst, f.Value, p)
 }
 
 // appendIndexedName appends f and index i referring indexed name
@@ -176,8 +296,8 @@ func appendNewName(dst []byte, f HeaderField, indexing bool) []byte {
 //
 // If f.Sensitive is true, "Never Indexed" representation is used. If
 // f.Sensitive is false and indexing is true, "Incremental Indexing"
-// representation is used.
-func appendIndexedName(dst []byte, f HeaderField, i uint64, indexing bool) []byte {
+// representation is used. The value is Huffman-coded per p.
+func appendIndexedName(dst []byte, f HeaderField, i uint64, indexing bool, p HuffmanPolicy) []byte {
 	first := len(dst)
 	var n byte
 	if indexing {
@@ -187,7 +307,7 @@ func appendIndexedName(dst []byte, f HeaderField, i uint64, indexing bool) []byt
 	}
 	dst = appendVarInt(dst, n, i)
 	dst[first] |= encodeTypeByte(indexing, f.Sensitive)
-	return appendHpackString(dst, f.Value)
+	return appendHpackString(dst, f.Value, p)
 }
 
 // appendTableSize appends v, as encoded in "Header Table Size Update"
@@ -220,11 +340,21 @@ func appendVarInt(dst []byte, n byte, i uint64) []byte {
 // appendHpackString appends s, as encoded in "String Literal"
 // representation, to dst and returns the the extended buffer.
 //
-// s will be encoded in Huffman codes only when it produces strictly
-// shorter byte string.
-func appendHpackString(dst []byte, s string) []byte {
+// Whether s is encoded in Huffman codes depends on p. By default,
+// HuffmanShorter, it is only when that produces a strictly shorter
+// byte string.
+func appendHpackString(dst []byte, s string, p HuffmanPolicy) []byte {
 	huffmanLength := HuffmanEncodeLength(s)
-	if huffmanLength < uint64(len(s)) {
+	var huffman bool
+	switch p {
+	case HuffmanAlways:
+		huffman = true
+	case HuffmanNever:
+		huffman = false
+	default:
+		huffman = huffmanLength < uint64(len(s))
+	}
+	if huffman {
 		first := len(dst)
 		dst = appendVarInt(dst, 7, huffmanLength)
 		dst = AppendHuffmanString(dst, s)
@@ -39,6 +39,113 @@ func TestEncoderTableSizeUpdate(t *testing.T) {
 	}
 }
 
+func TestEncoderTableSizeUpdateNextBlock(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	var got []HeaderField
+	d := NewDecoder(initialHeaderTableSize, func(f HeaderField) {
+		got = append(got, f)
+	})
+	f := pair("foo", "bar")
+	for i, size := range []uint32{initialHeaderTableSize, 0} {
+		e.SetMaxDynamicTableSize(size)
+		buf.Reset()
+		got = nil
+		e.WriteField(f)
+		e.WriteField(f)
+		if buf.Bytes()[0]&0xe0 != 0x20 {
+			t.Errorf("block %d = %x; want a leading table size update", i, buf.Bytes())
+		}
+		if _, err := d.Write(buf.Bytes()); err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if want := []HeaderField{f, f}; !reflect.DeepEqual(got, want) {
+			t.Errorf("block %d decoded to %v; want %v", i, got, want)
+		}
+	}
+	if d.dynTab.maxSize != 0 || len(d.dynTab.ents) != 0 {
+		t.Errorf("decoder table max %d with %d entries; want empty", d.dynTab.maxSize, len(d.dynTab.ents))
+	}
+}
+
+func TestEncoderSetSensitive(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetSensitive(func(name string) bool { return name == "authorization" })
+	fields := []HeaderField{
+		pair("authorization", "secret"),
+		pair("cookie", "a=b"),
+		{Name: "x-token", Value: "t", Sensitive: true},
+	}
+	for _, f := range fields {
+		e.WriteField(f)
+	}
+	got, err := NewDecoder(initialHeaderTableSize, nil).DecodeFull(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HeaderField{
+		{Name: "authorization", Value: "secret", Sensitive: true},
+		pair("cookie", "a=b"),
+		{Name: "x-token", Value: "t", Sensitive: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %v; want %v", got, want)
+	}
+	// Only the cookie may have been indexed.
+	if len(e.dynTab.ents) != 1 || e.dynTab.ents[0].Name != "cookie" {
+		t.Errorf("dynamic table = %v; want just the cookie", e.dynTab.ents)
+	}
+}
+
+func TestEncoderSetIndexFunc(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetHuffmanPolicy(HuffmanNever)
+	e.WriteField(pair("x-req-id", "1"))
+	e.WriteField(pair("x-common", "c"))
+	buf.Reset()
+	e.SetIndexFunc(func(f HeaderField) IndexPolicy {
+		switch f.Name {
+		case "x-req-id":
+			return IndexNone
+		case ":method", "x-common":
+			return IndexStatic
+		}
+		return IndexDynamic
+	})
+
+	tests := []struct {
+		f       HeaderField
+		wantHex string
+	}{
+		// In the dynamic table, but only a literal may be used.
+		{pair("x-req-id", "1"), "00 0878 2d72 6571 2d69 64 0131"},
+		// Static table matches are still used.
+		{pair(":method", "GET"), "82"},
+		// The dynamic table isn't searched.
+		{pair("x-common", "c"), "00 0878 2d63 6f6d 6d6f 6e 0163"},
+		// Static name index, without indexing.
+		{pair(":method", "PUT"), "02 0350 5554"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		if err := e.WriteField(tt.f); err != nil {
+			t.Fatal(err)
+		}
+		want := removeSpace(tt.wantHex)
+		if got := hex.EncodeToString(buf.Bytes()); got != want {
+			t.Errorf("WriteField(%v) = %q; want %q", tt.f, got, want)
+		}
+	}
+	if got := len(e.dynTab.ents); got != 2 {
+		t.Errorf("dynamic table has %d entries; want 2", got)
+	}
+}
+
 func TestEncoderWriteField(t *testing.T) {
 	var buf bytes.Buffer
 	e := NewEncoder(&buf)
@@ -166,13 +273,64 @@ func TestAppendHpackString(t *testing.T) {
 	}
 	for _, tt := range tests {
 		want := removeSpace(tt.wantHex)
-		buf := appendHpackString(nil, tt.s)
+		buf := appendHpackString(nil, tt.s, HuffmanShorter)
 		if got := hex.EncodeToString(buf); want != got {
 			t.Errorf("appendHpackString(nil, %q) = %q; want %q", tt.s, got, want)
 		}
 	}
 }
 
+func TestAppendHpackStringPolicy(t *testing.T) {
+	tests := []struct {
+		s       string
+		p       HuffmanPolicy
+		wantHex string
+	}{
+		{"www.example.com", HuffmanAlways, "8c f1e3 c2e5 f23a 6ba0 ab90 f4ff"},
+		{"www.example.com", HuffmanNever, "0f 7777 772e 6578 616d 706c 652e 636f 6d"},
+		{"a", HuffmanAlways, "81 1f"},
+		{"a", HuffmanNever, "01 61"},
+		{"", HuffmanAlways, "80"},
+	}
+	for _, tt := range tests {
+		want := removeSpace(tt.wantHex)
+		buf := appendHpackString(nil, tt.s, tt.p)
+		if got := hex.EncodeToString(buf); want != got {
+			t.Errorf("appendHpackString(nil, %q, %v) = %q; want %q", tt.s, tt.p, got, want)
+		}
+	}
+}
+
+func TestEncoderHuffmanFunc(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetHuffmanPolicy(HuffmanAlways)
+	e.SetHuffmanFunc(func(f HeaderField) HuffmanPolicy {
+		if f.Name == "x-plain" {
+			return HuffmanNever
+		}
+		return HuffmanAlways
+	})
+	e.WriteField(pair("x-plain", "www.example.com"))
+	if !bytes.Contains(buf.Bytes(), []byte("www.example.com")) {
+		t.Errorf("x-plain encoded as %x; want plain octets", buf.Bytes())
+	}
+
+	buf.Reset()
+	e.SetHuffmanFunc(nil)
+	e.WriteField(pair("x-huff", "a"))
+	got, err := NewDecoder(initialHeaderTableSize, nil).DecodeFull(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []HeaderField{pair("x-huff", "a")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %v; want %v", got, want)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("x-huff")) {
+		t.Errorf("x-huff encoded as %x; want Huffman codes", buf.Bytes())
+	}
+}
+
 func TestAppendIndexed(t *testing.T) {
 	tests := []struct {
 		i       uint64
@@ -213,7 +371,7 @@ func TestAppendNewName(t *testing.T) {
 	}
 	for _, tt := range tests {
 		want := removeSpace(tt.wantHex)
-		buf := appendNewName(nil, tt.f, tt.indexing)
+		buf := appendNewName(nil, tt.f, tt.indexing, HuffmanShorter)
 		if got := hex.EncodeToString(buf); want != got {
 			t.Errorf("appendNewName(nil, %+v, %v) = %q; want %q", tt.f, tt.indexing, got, want)
 		}
@@ -239,7 +397,7 @@ func TestAppendIndexedName(t *testing.T) {
 	}
 	for _, tt := range tests {
 		want := removeSpace(tt.wantHex)
-		buf := appendIndexedName(nil, tt.f, tt.i, tt.indexing)
+		buf := appendIndexedName(nil, tt.f, tt.i, tt.indexing, HuffmanShorter)
 		if got := hex.EncodeToString(buf); want != got {
 			t.Errorf("appendIndexedName(nil, %+v, %v) = %q; want %q", tt.f, tt.indexing, got, want)
 		}
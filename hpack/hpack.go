@@ -42,7 +42,8 @@ type HeaderField struct {
 	Sensitive bool
 }
 
-func (hf *HeaderField) size() uint32 {
+// Size returns the size of an entry per RFC 7541 section 4.1.
+func (hf HeaderField) Size() uint32 {
 	// http://http2.github.io/http2-spec/compression.html#rfc.section.4.1
 	// "The size of the dynamic table is the sum of the size of
 	// its entries.  The size of an entry is the sum of its name's
@@ -64,6 +65,10 @@ type Decoder struct {
 	dynTab dynamicTable
 	emit   func(f HeaderField)
 
+	emitEnabled bool // whether calls to emit are enabled
+	maxStrLen   int  // 0 means unlimited
+	firstField  bool // no field of the current header block decoded yet
+
 	// buf is the unparsed buffer. It's only written to
 	// saveBuf if it was truncated in the middle of a header
 	// block. Because it's usually not owned, we can only
@@ -74,7 +79,9 @@ type Decoder struct {
 
 func NewDecoder(maxSize uint32, emitFunc func(f HeaderField)) *Decoder {
 	d := &Decoder{
-		emit: emitFunc,
+		emit:        emitFunc,
+		emitEnabled: true,
+		firstField:  true,
 	}
 	d.dynTab.allowedMaxSize = maxSize
 	d.dynTab.setMaxSize(maxSize)
@@ -84,6 +91,37 @@ func NewDecoder(maxSize uint32, emitFunc func(f HeaderField)) *Decoder {
 // TODO: add method *Decoder.Reset(maxSize, emitFunc) to let callers re-use Decoders and their
 // underlying buffers for garbage reasons.
 
+// ErrStringLength is returned by Decoder.Write when the max string length
+// (as configured by Decoder.SetMaxStringLength) would be violated.
+var ErrStringLength = errors.New("hpack: string too long")
+
+// SetMaxStringLength sets the maximum size of a HeaderField name or
+// value string. If a string exceeds this length (even after any
+// decompression), Write will return ErrStringLength. The check is
+// made from a string's length prefix, before the rest of it is read,
+// and again while Huffman-decoding it, so an over-long string is
+// never held in memory in full.
+// A value of 0 means unlimited and is the default from NewDecoder.
+func (d *Decoder) SetMaxStringLength(n int) {
+	d.maxStrLen = n
+}
+
+// SetEmitEnabled controls whether the emitFunc provided to NewDecoder
+// should be called. The default is true.
+//
+// This lets callers enforce a limit on the total size of a header
+// list while still decoding the rest of the block to keep the
+// decoder's dynamic table in sync, without the garbage of
+// materializing fields that will be thrown away.
+func (d *Decoder) SetEmitEnabled(v bool) { d.emitEnabled = v }
+
+// EmitEnabled reports whether calls to the emitFunc provided to NewDecoder
+// are enabled. The default is true.
+func (d *Decoder) EmitEnabled() bool { return d.emitEnabled }
+
+// SetMaxDynamicTableSize changes the decoder's current dynamic table
+// size to v, as a Dynamic Table Size Update in the encoded stream
+// would. Most callers want SetAllowedMaxDynamicTableSize instead.
 func (d *Decoder) SetMaxDynamicTableSize(v uint32) {
 	d.dynTab.setMaxSize(v)
 }
@@ -95,6 +133,21 @@ func (d *Decoder) SetAllowedMaxDynamicTableSize(v uint32) {
 	d.dynTab.allowedMaxSize = v
 }
 
+// A TableEntry describes an entry of a dynamic table, for debugging.
+type TableEntry struct {
+	Index uint64 // HPACK index, which counts the static table's entries
+	Name  string
+	Value string
+	Size  uint32 // per HeaderField.Size
+}
+
+// DynamicTable returns the entries of the decoder's dynamic table,
+// newest (lowest index) first, along with the table's current size
+// and maximum size in bytes.
+func (d *Decoder) DynamicTable() (ents []TableEntry, size, maxSize uint32) {
+	return d.dynTab.snapshot(), d.dynTab.size, d.dynTab.maxSize
+}
+
 type dynamicTable struct {
 	// ents is the FIFO described at
 	// http://http2.github.io/http2-spec/compression.html#rfc.section.2.3.2
@@ -106,6 +159,21 @@ type dynamicTable struct {
 	allowedMaxSize uint32 // maxSize may go up to this, inclusive
 }
 
+// snapshot returns a copy of the table's entries, newest first.
+func (dt *dynamicTable) snapshot() []TableEntry {
+	ents := make([]TableEntry, len(dt.ents))
+	for i := range ents {
+		hf := dt.ents[len(dt.ents)-1-i]
+		ents[i] = TableEntry{
+			Index: uint64(len(staticTable) + 1 + i),
+			Name:  hf.Name,
+			Value: hf.Value,
+			Size:  hf.Size(),
+		}
+	}
+	return ents
+}
+
 func (dt *dynamicTable) setMaxSize(v uint32) {
 	dt.maxSize = v
 	dt.evict()
@@ -122,7 +190,7 @@ func (dt *dynamicTable) setMaxSize(v uint32) {
 
 func (dt *dynamicTable) add(f HeaderField) {
 	dt.ents = append(dt.ents, f)
-	dt.size += f.size()
+	dt.size += f.Size()
 	dt.evict()
 }
 
@@ -130,7 +198,7 @@ func (dt *dynamicTable) add(f HeaderField) {
 func (dt *dynamicTable) evict() {
 	base := dt.ents // keep base pointer of slice
 	for dt.size > dt.maxSize {
-		dt.size -= dt.ents[0].size()
+		dt.size -= dt.ents[0].Size()
 		dt.ents = dt.ents[1:]
 	}
 
@@ -220,7 +288,10 @@ func (d *Decoder) DecodeFull(p []byte) ([]HeaderField, error) {
 	return hf, nil
 }
 
+// Close declares that the current header block is complete. The
+// next call to Write starts a new one.
 func (d *Decoder) Close() error {
+	d.firstField = true
 	if d.saveBuf.Len() > 0 {
 		d.saveBuf.Reset()
 		return DecodingError{errors.New("truncated headers")}
@@ -323,8 +394,11 @@ func (d *Decoder) parseFieldIndexed() error {
 	if !ok {
 		return DecodingError{InvalidIndexError(idx)}
 	}
-	d.emit(HeaderField{Name: hf.Name, Value: hf.Value})
 	d.buf = buf
+	d.firstField = false
+	if d.emitEnabled {
+		d.emit(HeaderField{Name: hf.Name, Value: hf.Value})
+	}
 	return nil
 }
 
@@ -336,6 +410,8 @@ func (d *Decoder) parseFieldLiteral(n uint8, it indexType) error {
 		return err
 	}
 
+	// Skip materializing strings that nobody will see.
+	wantStr := d.emitEnabled || it.indexed()
 	var hf HeaderField
 	if nameIdx > 0 {
 		ihf, ok := d.at(nameIdx)
@@ -344,26 +420,35 @@ func (d *Decoder) parseFieldLiteral(n uint8, it indexType) error {
 		}
 		hf.Name = ihf.Name
 	} else {
-		hf.Name, buf, err = readString(buf)
+		hf.Name, buf, err = d.readString(buf, wantStr)
 		if err != nil {
 			return err
 		}
 	}
-	hf.Value, buf, err = readString(buf)
+	hf.Value, buf, err = d.readString(buf, wantStr)
 	if err != nil {
 		return err
 	}
 	d.buf = buf
+	d.firstField = false
 	if it.indexed() {
 		d.dynTab.add(hf)
 	}
 	hf.Sensitive = it.sensitive()
-	d.emit(hf)
+	if d.emitEnabled {
+		d.emit(hf)
+	}
 	return nil
 }
 
 // (same invariants and behavior as parseHeaderFieldRepr)
 func (d *Decoder) parseDynamicTableSizeUpdate() error {
+	// "This dynamic table size update MUST occur at the
+	// beginning of the first header block following the change
+	// to the dynamic table size." RFC 7541 section 4.2.
+	if !d.firstField {
+		return DecodingError{errors.New("dynamic table size update after a header field")}
+	}
 	buf := d.buf
 	size, buf, err := readVarInt(5, buf)
 	if err != nil {
@@ -420,7 +505,12 @@ func readVarInt(n byte, p []byte) (i uint64, remain []byte, err error) {
 	return 0, origP, errNeedMore
 }
 
-func readString(p []byte) (s string, remain []byte, err error) {
+// readString reads a string literal off the beginning of p. If
+// wantStr is false, the string is skipped and "" is returned.
+//
+// Strings longer than d.maxStrLen are rejected before waiting for
+// the rest of their bytes, so a peer can't make us buffer them.
+func (d *Decoder) readString(p []byte, wantStr bool) (s string, remain []byte, err error) {
 	if len(p) == 0 {
 		return "", p, errNeedMore
 	}
@@ -429,16 +519,26 @@ func readString(p []byte) (s string, remain []byte, err error) {
 	if err != nil {
 		return "", p, err
 	}
+	if d.maxStrLen != 0 && strLen > uint64(d.maxStrLen) {
+		return "", nil, ErrStringLength
+	}
 	if uint64(len(p)) < strLen {
 		return "", p, errNeedMore
 	}
+	if !wantStr {
+		return "", p[strLen:], nil
+	}
 	if !isHuff {
 		return string(p[:strLen]), p[strLen:], nil
 	}
 
-	// TODO: optimize this garbage:
-	var buf bytes.Buffer
-	if _, err := HuffmanDecode(&buf, p[:strLen]); err != nil {
+	// Huffman codes are as short as 5 bits, so even a string
+	// within the limit on the wire can decode to more than it.
+	// Stop as soon as it does.
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	if err := huffmanDecode(buf, d.maxStrLen, p[:strLen]); err != nil {
 		return "", nil, err
 	}
 	return buf.String(), p[strLen:], nil
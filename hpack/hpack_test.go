@@ -204,6 +204,34 @@ func TestDynamicTableSizeEvict(t *testing.T) {
 	}
 }
 
+func TestDynamicTableSnapshot(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.WriteField(pair("foo", "bar"))
+	e.WriteField(pair(":method", "GET")) // static; not added
+	e.WriteField(pair("blake", "miz"))
+
+	d := NewDecoder(initialHeaderTableSize, nil)
+	if _, err := d.DecodeFull(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	want := []TableEntry{
+		{Index: 62, Name: "blake", Value: "miz", Size: 40},
+		{Index: 63, Name: "foo", Value: "bar", Size: 38},
+	}
+	for _, tab := range []interface {
+		DynamicTable() ([]TableEntry, uint32, uint32)
+	}{e, d} {
+		ents, size, maxSize := tab.DynamicTable()
+		if !reflect.DeepEqual(ents, want) {
+			t.Errorf("%T entries = %+v; want %+v", tab, ents, want)
+		}
+		if size != 78 || maxSize != initialHeaderTableSize {
+			t.Errorf("%T size, maxSize = %d, %d; want 78, %d", tab, size, maxSize, initialHeaderTableSize)
+		}
+	}
+}
+
 func TestDecoderDecode(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -646,3 +674,113 @@ func dehex(s string) []byte {
 	}
 	return b
 }
+
+func TestDecoderMaxStringLength(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.WriteField(HeaderField{Name: "foo", Value: strings.Repeat("~", 100)}) // not Huffman-coded
+	block := buf.Bytes()
+
+	d := NewDecoder(initialHeaderTableSize, nil)
+	d.SetMaxStringLength(100)
+	if _, err := d.DecodeFull(block); err != nil {
+		t.Fatalf("at limit: %v", err)
+	}
+
+	d = NewDecoder(initialHeaderTableSize, nil)
+	d.SetMaxStringLength(99)
+	if _, err := d.DecodeFull(block); err != ErrStringLength {
+		t.Fatalf("over limit: error = %v; want %v", err, ErrStringLength)
+	}
+
+	// A long string is rejected from its length prefix alone,
+	// before the rest of it arrives.
+	d = NewDecoder(initialHeaderTableSize, func(HeaderField) {})
+	d.SetMaxStringLength(99)
+	if _, err := d.Write(block[:len(block)-10]); err != ErrStringLength {
+		t.Fatalf("partial write: error = %v; want %v", err, ErrStringLength)
+	}
+}
+
+func TestDecoderMaxStringLengthHuffman(t *testing.T) {
+	// "0" has a 5-bit Huffman code, so 80 of them take 50 bytes
+	// on the wire, under the limit, but decode to 80.
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.WriteField(HeaderField{Name: "foo", Value: strings.Repeat("0", 80)})
+	block := buf.Bytes()
+
+	d := NewDecoder(initialHeaderTableSize, nil)
+	d.SetMaxStringLength(80)
+	if _, err := d.DecodeFull(block); err != nil {
+		t.Fatalf("at limit: %v", err)
+	}
+
+	d = NewDecoder(initialHeaderTableSize, nil)
+	d.SetMaxStringLength(60)
+	if _, err := d.DecodeFull(block); err != ErrStringLength {
+		t.Fatalf("over limit: error = %v; want %v", err, ErrStringLength)
+	}
+
+	buf.Reset()
+	if err := huffmanDecode(&buf, 60, AppendHuffmanString(nil, strings.Repeat("0", 80))); err != ErrStringLength {
+		t.Fatalf("huffmanDecode error = %v; want %v", err, ErrStringLength)
+	}
+	if buf.Len() != 60 {
+		t.Errorf("huffmanDecode wrote %d bytes before stopping; want 60", buf.Len())
+	}
+}
+
+func TestDecoderEmitDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.WriteField(HeaderField{Name: "foo", Value: "bar"})
+	enc.WriteField(HeaderField{Name: "foo", Value: "bar"})
+
+	var got []HeaderField
+	d := NewDecoder(initialHeaderTableSize, func(f HeaderField) { got = append(got, f) })
+	d.SetEmitEnabled(false)
+	if _, err := d.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("emitted %v with emit disabled", got)
+	}
+
+	// The dynamic table still has the field.
+	d.SetEmitEnabled(true)
+	if _, err := d.Write([]byte{0x80 | uint8(len(staticTable)+1)}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []HeaderField{{Name: "foo", Value: "bar"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("emitted %v; want %v", got, want)
+	}
+}
+
+func TestDecoderTableSizeUpdatePosition(t *testing.T) {
+	d := NewDecoder(initialHeaderTableSize, func(HeaderField) {})
+	sizeUpdate := appendTableSize(nil, 0)
+	field := []byte{0x82} // :method: GET
+
+	// At the start of a block, including after another update.
+	if _, err := d.Write(append(append(append([]byte(nil), sizeUpdate...), sizeUpdate...), field...)); err != nil {
+		t.Fatalf("update at start of block: %v", err)
+	}
+	if _, err := d.Write(sizeUpdate); err == nil {
+		t.Fatal("update after a field: no error")
+	}
+
+	d = NewDecoder(initialHeaderTableSize, func(HeaderField) {})
+	if _, err := d.Write(field); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Write(sizeUpdate); err != nil {
+		t.Fatalf("update at start of next block: %v", err)
+	}
+	if d.dynTab.maxSize != 0 {
+		t.Errorf("maxSize = %d; want 0", d.dynTab.maxSize)
+	}
+}
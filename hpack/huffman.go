@@ -22,7 +22,16 @@ func HuffmanDecode(w io.Writer, v []byte) (int, error) {
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufPool.Put(buf)
+	if err := huffmanDecode(buf, 0, v); err != nil {
+		return 0, err
+	}
+	return w.Write(buf.Bytes())
+}
 
+// huffmanDecode decodes v to buf. If maxLen is non-zero, it returns
+// ErrStringLength as soon as the output exceeds maxLen bytes, without
+// decoding the rest.
+func huffmanDecode(buf *bytes.Buffer, maxLen int, v []byte) error {
 	n := rootHuffmanNode
 	cur, nbits := uint(0), uint8(0)
 	for _, b := range v {
@@ -31,6 +40,9 @@ func HuffmanDecode(w io.Writer, v []byte) (int, error) {
 		for nbits >= 8 {
 			n = n.children[byte(cur>>(nbits-8))]
 			if n.children == nil {
+				if maxLen != 0 && buf.Len() == maxLen {
+					return ErrStringLength
+				}
 				buf.WriteByte(n.sym)
 				nbits -= n.codeLen
 				n = rootHuffmanNode
@@ -44,11 +56,14 @@ func HuffmanDecode(w io.Writer, v []byte) (int, error) {
 		if n.children != nil || n.codeLen > nbits {
 			break
 		}
+		if maxLen != 0 && buf.Len() == maxLen {
+			return ErrStringLength
+		}
 		buf.WriteByte(n.sym)
 		nbits -= n.codeLen
 		n = rootHuffmanNode
 	}
-	return w.Write(buf.Bytes())
+	return nil
 }
 
 type node struct {
@@ -20,9 +20,13 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 var VerboseLogs = false
@@ -108,6 +112,10 @@ func (s Setting) Valid() error {
 		if s.Val < 16384 || s.Val > 1<<24-1 {
 			return ConnectionError(ErrCodeProtocol)
 		}
+	case SettingEnableConnectProtocol:
+		if s.Val != 1 && s.Val != 0 {
+			return ConnectionError(ErrCodeProtocol)
+		}
 	}
 	return nil
 }
@@ -123,15 +131,20 @@ const (
 	SettingInitialWindowSize    SettingID = 0x4
 	SettingMaxFrameSize         SettingID = 0x5
 	SettingMaxHeaderListSize    SettingID = 0x6
+
+	// SettingEnableConnectProtocol is defined by RFC 8441
+	// (Bootstrapping WebSockets with HTTP/2).
+	SettingEnableConnectProtocol SettingID = 0x8
 )
 
 var settingName = map[SettingID]string{
-	SettingHeaderTableSize:      "HEADER_TABLE_SIZE",
-	SettingEnablePush:           "ENABLE_PUSH",
-	SettingMaxConcurrentStreams: "MAX_CONCURRENT_STREAMS",
-	SettingInitialWindowSize:    "INITIAL_WINDOW_SIZE",
-	SettingMaxFrameSize:         "MAX_FRAME_SIZE",
-	SettingMaxHeaderListSize:    "MAX_HEADER_LIST_SIZE",
+	SettingHeaderTableSize:       "HEADER_TABLE_SIZE",
+	SettingEnablePush:            "ENABLE_PUSH",
+	SettingMaxConcurrentStreams:  "MAX_CONCURRENT_STREAMS",
+	SettingInitialWindowSize:     "INITIAL_WINDOW_SIZE",
+	SettingMaxFrameSize:          "MAX_FRAME_SIZE",
+	SettingMaxHeaderListSize:     "MAX_HEADER_LIST_SIZE",
+	SettingEnableConnectProtocol: "ENABLE_CONNECT_PROTOCOL",
 }
 
 func (s SettingID) String() string {
@@ -141,6 +154,67 @@ func (s SettingID) String() string {
 	return fmt.Sprintf("UNKNOWN_SETTING_%d", uint16(s))
 }
 
+// PeerSettings are the SETTINGS parameters an endpoint has received
+// from its peer. Those the peer hasn't sent have their defaults from
+// RFC 7540 section 6.5.2, where no limit on MaxConcurrentStreams or
+// MaxHeaderListSize is given as math.MaxUint32.
+type PeerSettings struct {
+	HeaderTableSize       uint32
+	EnablePush            bool
+	MaxConcurrentStreams  uint32
+	InitialWindowSize     uint32
+	MaxFrameSize          uint32
+	MaxHeaderListSize     uint32
+	EnableConnectProtocol bool // RFC 8441
+}
+
+var defaultPeerSettings = PeerSettings{
+	HeaderTableSize:      4096,
+	EnablePush:           true,
+	MaxConcurrentStreams: math.MaxUint32,
+	InitialWindowSize:    65535,
+	MaxFrameSize:         16 << 10,
+	MaxHeaderListSize:    math.MaxUint32,
+}
+
+// apply records s, a setting received from the peer, in ps. Unknown
+// settings are ignored.
+func (ps *PeerSettings) apply(s Setting) {
+	switch s.ID {
+	case SettingHeaderTableSize:
+		ps.HeaderTableSize = s.Val
+	case SettingEnablePush:
+		ps.EnablePush = s.Val == 1
+	case SettingMaxConcurrentStreams:
+		ps.MaxConcurrentStreams = s.Val
+	case SettingInitialWindowSize:
+		ps.InitialWindowSize = s.Val
+	case SettingMaxFrameSize:
+		ps.MaxFrameSize = s.Val
+	case SettingMaxHeaderListSize:
+		ps.MaxHeaderListSize = s.Val
+	case SettingEnableConnectProtocol:
+		ps.EnableConnectProtocol = s.Val == 1
+	}
+}
+
+// StreamStats describes a request's stream, for the OnStreamOpen and
+// OnStreamClose hooks of a Transport or Server, as for access logs
+// or accounting by destination. Only the fields up to Start are set
+// when it opens.
+type StreamStats struct {
+	StreamID  uint32
+	Method    string
+	Authority string
+	Start     time.Time
+
+	Status   int           // of the final response, or 0 if none was sent
+	Err      error         // why the stream ended early, or nil if it didn't
+	BytesIn  int64         // DATA payload received, padding excluded
+	BytesOut int64         // DATA payload sent, padding excluded
+	Duration time.Duration // from Start until the stream closed
+}
+
 func validHeader(v string) bool {
 	if len(v) == 0 {
 		return false
@@ -158,6 +232,167 @@ func validHeader(v string) bool {
 	return true
 }
 
+// validFieldName reports whether v is a valid header field name to
+// send: a non-empty token, per RFC 7230 section 3.2.6. Uppercase is
+// permitted, since names are lowercased when encoded.
+func validFieldName(v string) bool {
+	if len(v) == 0 {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if !isTokenByte(v[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTokenByte(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", b) >= 0
+}
+
+// validFieldValue reports whether v is a valid header field value to
+// send. CR, LF and NUL are rejected so that values can't smuggle
+// extra header fields into an HTTP/1 hop.
+func validFieldValue(v string) bool {
+	return strings.IndexAny(v, "\r\n\x00") < 0
+}
+
+// validHost reports whether host is a valid :authority or Host: a
+// host name or IP literal and optional port, with none of the
+// characters, such as '/' or '@', by which a server or proxy might
+// read a different host out of it.
+func validHost(host string) bool {
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("-._~!$&'()*+,;=:[]%", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// sensitiveHeaders are the header fields, keyed by lowercase name,
+// that are always HPACK-encoded as never-indexed literals since they
+// carry credentials.
+var sensitiveHeaders = map[string]bool{
+	"authorization":       true,
+	"cookie":              true,
+	"proxy-authorization": true,
+	"set-cookie":          true,
+}
+
+// sensitiveFunc returns a func for hpack.Encoder.SetSensitive that
+// reports the sensitiveHeaders and the extra names, in any case, as
+// sensitive.
+func sensitiveFunc(extra []string) func(name string) bool {
+	if len(extra) == 0 {
+		return func(name string) bool { return sensitiveHeaders[name] }
+	}
+	m := make(map[string]bool, len(sensitiveHeaders)+len(extra))
+	for k := range sensitiveHeaders {
+		m[k] = true
+	}
+	for _, k := range extra {
+		m[strings.ToLower(k)] = true
+	}
+	return func(name string) bool { return m[name] }
+}
+
+// greaseSetting returns a SETTINGS parameter with one of the
+// identifiers reserved for GREASE, 0x0a0a, 0x1a1a, ... 0xfafa, and a
+// random value. Peers must ignore settings they don't understand, so
+// sending one checks that they (and anything in the middle) do.
+func greaseSetting() Setting {
+	return Setting{SettingID(0x0a0a + 0x1010*rand.Intn(16)), rand.Uint32()}
+}
+
+// greaseFrame returns a frame type of the form 0x0b + 0x1f*N, which
+// no extension will ever use, and a short random payload for it.
+func greaseFrame() (FrameType, []byte) {
+	payload := make([]byte, rand.Intn(16))
+	rand.Read(payload)
+	return FrameType(0x0b + 0x1f*rand.Intn(8)), payload
+}
+
+// A PaddingPolicy decides how many bytes of padding to add to a DATA
+// or HEADERS frame carrying n bytes of data or header block fragment.
+// Padding hides the exact size of what's sent; it counts against flow
+// control like data does. Zero means the frame isn't padded.
+type PaddingPolicy func(n int) uint8
+
+// FixedPadding returns a PaddingPolicy that pads every frame with
+// n bytes.
+func FixedPadding(n uint8) PaddingPolicy {
+	return func(int) uint8 { return n }
+}
+
+// RandomPadding returns a PaddingPolicy that pads each frame with a
+// random number of bytes between 0 and max, inclusive.
+func RandomPadding(max uint8) PaddingPolicy {
+	return func(int) uint8 { return uint8(rand.Intn(int(max) + 1)) }
+}
+
+// padLength returns the number of padding bytes p wants on a frame
+// carrying n bytes, or 0 if p is nil or if the padding and its
+// length byte wouldn't fit in a frame payload of at most max bytes.
+func (p PaddingPolicy) padLength(n, max int) int {
+	if p == nil {
+		return 0
+	}
+	pad := int(p(n))
+	if pad == 0 || n+1+pad > max {
+		return 0
+	}
+	return pad
+}
+
+// split decides how much of n bytes of DATA go in the next frame,
+// whose payload can be at most max bytes, and with what padding.
+// The data is cut short to make room for the padding; pad is nil if
+// p is nil, wants no padding, or wants more than fits at all.
+func (p PaddingPolicy) split(n, max int) (chunk int, pad []byte) {
+	chunk = n
+	if chunk > max {
+		chunk = max
+	}
+	if p == nil {
+		return chunk, nil
+	}
+	if l := int(p(chunk)); l > 0 && 1+l < max {
+		if chunk+1+l > max {
+			chunk = max - 1 - l
+		}
+		pad = padZeros[:l]
+	}
+	return chunk, pad
+}
+
+// frameRateLimiter counts events, such as frames of some kind, in
+// one-second windows.
+type frameRateLimiter struct {
+	max   int // events allowed per window
+	start time.Time
+	n     int
+}
+
+// allow counts an event at now and reports whether it's within the
+// limit.
+func (l *frameRateLimiter) allow(now time.Time) bool {
+	if now.Sub(l.start) >= time.Second {
+		l.start, l.n = now, 0
+	}
+	l.n++
+	return l.n <= l.max
+}
+
 var httpCodeStringCommon = map[int]string{} // n -> strconv.Itoa(n)
 
 func init() {
@@ -31,6 +31,7 @@ func condSkipFailingTest(t *testing.T) {
 
 func init() {
 	DebugGoroutines = true
+	debugStreamRefs = true
 	flag.BoolVar(&VerboseLogs, "verboseh2", false, "Verbose HTTP/2 debug logging")
 }
 
@@ -50,6 +51,38 @@ func TestSettingString(t *testing.T) {
 	}
 }
 
+func TestPaddingPolicySplit(t *testing.T) {
+	tests := []struct {
+		p         PaddingPolicy
+		n, max    int
+		wantChunk int
+		wantPad   int // -1 for none
+	}{
+		{nil, 10, 100, 10, -1},
+		{nil, 200, 100, 100, -1},
+		{FixedPadding(0), 10, 100, 10, -1},
+		{FixedPadding(5), 10, 100, 10, 5},
+		{FixedPadding(5), 100, 100, 94, 5},     // data cut short for the padding
+		{FixedPadding(200), 300, 100, 100, -1}, // padding can't fit at all
+		{FixedPadding(5), 0, 100, 0, 5},
+	}
+	for i, tt := range tests {
+		chunk, pad := tt.p.split(tt.n, tt.max)
+		gotPad := -1
+		if pad != nil {
+			gotPad = len(pad)
+		}
+		if chunk != tt.wantChunk || gotPad != tt.wantPad {
+			t.Errorf("%d. split(%d, %d) = %d, %d bytes of padding; want %d, %d", i, tt.n, tt.max, chunk, gotPad, tt.wantChunk, tt.wantPad)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if n := RandomPadding(3)(0); n > 3 {
+			t.Fatalf("RandomPadding(3) = %d", n)
+		}
+	}
+}
+
 type twriter struct {
 	t  testing.TB
 	st *serverTester // optional
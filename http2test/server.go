@@ -0,0 +1,260 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+// Package http2test provides an in-memory HTTP/2 server for testing
+// code that uses http2.Transport, without sockets or TLS
+// certificates. The server is scripted a frame at a time, so a test
+// can make it send exactly the responses, settings and protocol
+// violations it needs.
+package http2test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/phuslu/http2"
+	"github.com/phuslu/http2/hpack"
+)
+
+// A Server is an in-memory HTTP/2 server. Its zero value answers
+// every request with an empty 200 response.
+type Server struct {
+	// Settings are sent in the SETTINGS frame that starts each
+	// connection.
+	Settings []http2.Setting
+
+	// OnRequest, if non-nil, is called with the stream ID and
+	// decoded header fields of each request once its header block
+	// is complete. If nil, each request gets an empty 200
+	// response.
+	OnRequest func(c *Conn, streamID uint32, fields []hpack.HeaderField)
+
+	// OnFrame, if non-nil, is called with each frame the client
+	// sends that isn't part of a header block, a SETTINGS frame,
+	// or a PING. The Server acknowledges SETTINGS and PINGs
+	// itself.
+	OnFrame func(c *Conn, f http2.Frame)
+
+	mu     sync.Mutex
+	conns  map[*Conn]bool
+	closed bool
+}
+
+// A Conn is the server side of a connection to a Server. Its
+// embedded Framer writes frames to the client; the writes are
+// queued, so they never block on the client reading them. Frames
+// may only be written from the Server's OnRequest and OnFrame
+// funcs, which run on the connection's goroutine.
+type Conn struct {
+	*http2.Framer
+
+	srv  *Server
+	nc   net.Conn
+	w    *queueWriter
+	hbuf bytes.Buffer
+	henc *hpack.Encoder
+}
+
+var errClosed = errors.New("http2test: server closed")
+
+// Dial returns the client end of a new in-memory connection to s.
+func (s *Server) Dial() (net.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errClosed
+	}
+	cli, srv := net.Pipe()
+	c := &Conn{srv: s, nc: srv, w: newQueueWriter(srv)}
+	c.Framer = http2.NewFramer(c.w, srv)
+	c.henc = hpack.NewEncoder(&c.hbuf)
+	if s.conns == nil {
+		s.conns = make(map[*Conn]bool)
+	}
+	s.conns[c] = true
+	go c.serve()
+	return cli, nil
+}
+
+// Transport returns a Transport whose connections, to any host,
+// are made with s.Dial.
+func (s *Server) Transport() *http2.Transport {
+	return &http2.Transport{
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return s.Dial()
+		},
+	}
+}
+
+// Close closes s and all its connections.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for c := range conns {
+		c.Close()
+	}
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	c.w.close()
+	return c.nc.Close()
+}
+
+// WriteHeaderFields writes a complete header block for streamID
+// of the name/value pairs kv, in order and without validation, in a
+// single HEADERS frame.
+func (c *Conn) WriteHeaderFields(streamID uint32, endStream bool, kv ...string) error {
+	if len(kv)%2 != 0 {
+		return errors.New("http2test: odd number of header field names and values")
+	}
+	c.hbuf.Reset()
+	for i := 0; i < len(kv); i += 2 {
+		c.henc.WriteField(hpack.HeaderField{Name: kv[i], Value: kv[i+1]})
+	}
+	return c.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: c.hbuf.Bytes(),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+}
+
+func (c *Conn) serve() {
+	defer func() {
+		c.Close()
+		c.srv.mu.Lock()
+		delete(c.srv.conns, c)
+		c.srv.mu.Unlock()
+	}()
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(c.nc, preface); err != nil || string(preface) != http2.ClientPreface {
+		return
+	}
+	if err := c.WriteSettings(c.srv.Settings...); err != nil {
+		return
+	}
+
+	var fields []hpack.HeaderField
+	hdec := hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		fields = append(fields, f)
+	})
+	for {
+		f, err := c.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				c.WriteSettingsAck()
+			}
+			continue
+		case *http2.PingFrame:
+			if !f.Flags.Has(http2.FlagPingAck) {
+				c.WritePing(true, f.Data)
+			}
+			continue
+		case *http2.HeadersFrame:
+			fields = nil
+			if _, err := hdec.Write(f.HeaderBlockFragment()); err != nil {
+				return
+			}
+			if f.HeadersEnded() {
+				c.request(f.StreamID, fields)
+			}
+			continue
+		case *http2.ContinuationFrame:
+			if _, err := hdec.Write(f.HeaderBlockFragment()); err != nil {
+				return
+			}
+			if f.HeadersEnded() {
+				c.request(f.StreamID, fields)
+			}
+			continue
+		}
+		if c.srv.OnFrame != nil {
+			c.srv.OnFrame(c, f)
+		}
+	}
+}
+
+func (c *Conn) request(streamID uint32, fields []hpack.HeaderField) {
+	if c.srv.OnRequest == nil {
+		c.WriteHeaderFields(streamID, true, ":status", "200")
+		return
+	}
+	c.srv.OnRequest(c, streamID, fields)
+}
+
+// queueWriter writes to w from its own goroutine, so that writes
+// to it never block. net.Pipe is unbuffered, and without this the
+// client and server could each block writing to the other.
+type queueWriter struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	buf    bytes.Buffer
+	err    error
+	closed bool
+}
+
+func newQueueWriter(w io.Writer) *queueWriter {
+	q := new(queueWriter)
+	q.cond.L = &q.mu
+	go q.run(w)
+	return q
+}
+
+func (q *queueWriter) Write(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	if q.closed {
+		return 0, errClosed
+	}
+	q.buf.Write(p)
+	q.cond.Signal()
+	return len(p), nil
+}
+
+func (q *queueWriter) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Signal()
+	q.mu.Unlock()
+}
+
+func (q *queueWriter) run(w io.Writer) {
+	var p []byte
+	for {
+		q.mu.Lock()
+		for q.buf.Len() == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.buf.Len() == 0 {
+			q.mu.Unlock()
+			return
+		}
+		p = append(p[:0], q.buf.Bytes()...)
+		q.buf.Reset()
+		q.mu.Unlock()
+
+		if _, err := w.Write(p); err != nil {
+			q.mu.Lock()
+			q.err = err
+			q.mu.Unlock()
+			return
+		}
+	}
+}
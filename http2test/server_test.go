@@ -0,0 +1,112 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/phuslu/http2"
+	"github.com/phuslu/http2/hpack"
+)
+
+func TestServerDefaultResponse(t *testing.T) {
+	var srv Server
+	defer srv.Close()
+	tr := srv.Transport()
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || res.TLS != nil {
+		t.Errorf("status = %d, TLS = %v; want 200, nil", res.StatusCode, res.TLS)
+	}
+}
+
+func TestServerScripted(t *testing.T) {
+	var gotPath string
+	srv := &Server{
+		Settings: []http2.Setting{{ID: http2.SettingMaxConcurrentStreams, Val: 10}},
+		OnRequest: func(c *Conn, streamID uint32, fields []hpack.HeaderField) {
+			for _, f := range fields {
+				if f.Name == ":path" {
+					gotPath = f.Value
+				}
+			}
+			c.WriteHeaderFields(streamID, false, ":status", "201", "x-foo", "bar")
+			c.WriteData(streamID, true, []byte("hello"))
+		},
+	}
+	defer srv.Close()
+	tr := srv.Transport()
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 201 || res.Header.Get("X-Foo") != "bar" || string(body) != "hello" {
+		t.Errorf("got %d, X-Foo %q, body %q; want 201, %q, %q",
+			res.StatusCode, res.Header.Get("X-Foo"), body, "bar", "hello")
+	}
+	if gotPath == "" {
+		t.Error("request had no :path")
+	}
+}
+
+func TestServerProtocolViolation(t *testing.T) {
+	srv := &Server{
+		OnRequest: func(c *Conn, streamID uint32, fields []hpack.HeaderField) {
+			// No :status.
+			c.WriteHeaderFields(streamID, true, "x-foo", "bar")
+		},
+	}
+	defer srv.Close()
+	tr := srv.Transport()
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip succeeded with a response without :status")
+	}
+}
+
+func TestServerOnFrame(t *testing.T) {
+	srv := &Server{
+		OnRequest: func(c *Conn, streamID uint32, fields []hpack.HeaderField) {
+			c.WriteHeaderFields(streamID, false, ":status", "200")
+		},
+		OnFrame: func(c *Conn, f http2.Frame) {
+			// Echo the request body back.
+			if df, ok := f.(*http2.DataFrame); ok {
+				c.WriteData(df.StreamID, df.StreamEnded(), df.Data())
+			}
+		},
+	}
+	defer srv.Close()
+	tr := srv.Transport()
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("POST", "https://example.com/", bytes.NewReader([]byte("ping")))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "ping" {
+		t.Errorf("body = %q; want %q", body, "ping")
+	}
+}
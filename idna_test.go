@@ -0,0 +1,54 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"example.com", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"Bücher.example", "xn--bcher-kva.example"},
+		{"münchen.de", "xn--mnchen-3ya.de"},
+		{"пример.испытание", "xn--e1afmkfd.xn--80akhbyknj4f"},
+		{"ジェーピーニック.jp", "xn--hckqz9bzb1cyrb.jp"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+		{"192.0.2.1", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		got, err := toASCII(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("toASCII(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := toASCII(strings.Repeat("ü", 64) + ".example"); err == nil {
+		t.Error("toASCII accepted a label longer than 63 bytes once encoded")
+	}
+	if _, err := toASCII("bad\xff.example"); err == nil {
+		t.Error("toASCII accepted invalid UTF-8")
+	}
+}
+
+func TestIDNAAuthorityAndDial(t *testing.T) {
+	u, _ := url.Parse("https://bücher.example:8443/")
+	if host, port := hostPort(u); host != "xn--bcher-kva.example" || port != "8443" {
+		t.Errorf("hostPort = %q, %q; want the ASCII name", host, port)
+	}
+	req := &http.Request{Method: "GET", URL: u}
+	if got, want := authority(req), "xn--bcher-kva.example:8443"; got != want {
+		t.Errorf("authority = %q; want %q", got, want)
+	}
+	if err := checkRequestHeaders(req); err != nil {
+		t.Errorf("checkRequestHeaders: %v", err)
+	}
+}
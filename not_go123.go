@@ -0,0 +1,15 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+//go:build !go1.23
+
+package http2
+
+import "crypto/tls"
+
+// echRetry reports false: Encrypted Client Hello needs Go 1.23.
+func echRetry(cfg *tls.Config, err error) bool {
+	return false
+}
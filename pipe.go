@@ -26,6 +26,13 @@ func (r *pipe) Read(p []byte) (n int, err error) {
 	return r.b.Read(p)
 }
 
+// Len returns the number of bytes of unread data in the buffer.
+func (r *pipe) Len() int {
+	r.c.L.Lock()
+	defer r.c.L.Unlock()
+	return r.b.Len()
+}
+
 // Write copies bytes from p into the buffer and wakes a reader.
 // It is an error to write more data than the buffer can hold.
 func (w *pipe) Write(p []byte) (n int, err error) {
@@ -35,6 +42,49 @@ func (w *pipe) Write(p []byte) (n int, err error) {
 	return w.b.Write(p)
 }
 
+// discard closes the pipe with err, as Close does, and drops any
+// unread data, so that Reads fail with err straight away. It returns
+// how many bytes were dropped.
+func (r *pipe) discard(err error) int {
+	r.c.L.Lock()
+	defer r.c.L.Unlock()
+	defer r.c.Signal()
+	n := r.b.Len()
+	r.b.r = r.b.w
+	r.b.Close(err)
+	return n
+}
+
+// grow enlarges the buffer, if needed, so that n more bytes fit.
+func (r *pipe) grow(n int) {
+	r.c.L.Lock()
+	defer r.c.L.Unlock()
+	b := &r.b
+	if len(b.buf)-b.Len() >= n {
+		return
+	}
+	buf := make([]byte, b.Len()+n)
+	b.w = copy(buf, b.buf[b.r:b.w])
+	b.r = 0
+	b.buf = buf
+}
+
+// release takes the pipe's buffer away, for reuse, if the pipe is
+// closed and drained, so that nothing will read it again. Reads and
+// Writes after that act as on an empty closed pipe. It returns nil
+// if the buffer is still in use.
+func (r *pipe) release() []byte {
+	r.c.L.Lock()
+	defer r.c.L.Unlock()
+	b := &r.b
+	if !b.closed || b.Len() != 0 {
+		return nil
+	}
+	buf := b.buf
+	b.buf, b.r, b.w = nil, 0, 0
+	return buf
+}
+
 func (c *pipe) Close(err error) {
 	c.c.L.Lock()
 	defer c.c.L.Unlock()
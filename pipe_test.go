@@ -22,3 +22,27 @@ func TestPipeClose(t *testing.T) {
 		t.Errorf("err = %v want %v", err, a)
 	}
 }
+
+func TestPipeRelease(t *testing.T) {
+	p := &pipe{b: buffer{buf: make([]byte, 8)}}
+	p.c.L = &p.m
+	p.Write([]byte("abc"))
+	if buf := p.release(); buf != nil {
+		t.Fatal("released the buffer of an open pipe")
+	}
+	done := errors.New("done")
+	p.Close(done)
+	if buf := p.release(); buf != nil {
+		t.Fatal("released a buffer with unread data")
+	}
+	p.discard(errClosedResponseBody)
+	if buf := p.release(); len(buf) != 8 {
+		t.Fatalf("released buffer of %d bytes; want 8", len(buf))
+	}
+	if n, err := p.Read(make([]byte, 1)); n != 0 || err != done {
+		t.Errorf("Read after release = %d, %v; want 0, %v", n, err, done)
+	}
+	if _, err := p.Write([]byte("x")); err != errWriteClosed {
+		t.Errorf("Write after release = %v; want %v", err, errWriteClosed)
+	}
+}
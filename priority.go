@@ -0,0 +1,189 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+type requestPriorityKey struct{}
+
+// requestPriority is the Priority of the requests made with a
+// context from WithPriority, and their streams still open, so that
+// UpdatePriority can reach them.
+type requestPriority struct {
+	mu      sync.Mutex
+	p       Priority
+	streams map[connStream]bool
+}
+
+// connStream names a stream by its conn and ID, which, unlike its
+// clientStream, isn't recycled for another request.
+type connStream struct {
+	cc *ClientConn
+	id uint32
+}
+
+// WithPriority returns a copy of ctx that gives requests made with
+// it priority p, rather than the default of urgency 3 and weight 15
+// (that is, 16), so that interactive calls can overtake bulk
+// transfers sharing a conn. Note that the zero Priority is urgency
+// 0, the most urgent; a zero PriorityParam means the default
+// weight.
+//
+// The Transport tells the server of p with the HEADERS frame's
+// priority fields, for servers following RFC 7540, and with a
+// Priority header, for those following RFC 9218, unless the
+// request has one already. It also schedules the request bodies on
+// a conn by p: those of more urgent streams go first, and equally
+// urgent ones share the conn in proportion to their weights, frame
+// by frame, so that one large upload doesn't starve the others. See
+// UpdatePriority to change p while requests are in flight.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	if p.PriorityParam.IsZero() {
+		p.PriorityParam = defaultPriority.PriorityParam
+	}
+	return context.WithValue(ctx, requestPriorityKey{}, &requestPriority{p: p})
+}
+
+// UpdatePriority changes the priority of the requests made with
+// ctx, which must have come from WithPriority, to p. The servers
+// of those in flight are told with PRIORITY and PRIORITY_UPDATE
+// frames. It reports whether ctx came from WithPriority.
+func UpdatePriority(ctx context.Context, p Priority) bool {
+	rp, ok := ctx.Value(requestPriorityKey{}).(*requestPriority)
+	if !ok {
+		return false
+	}
+	if p.PriorityParam.IsZero() {
+		p.PriorityParam = defaultPriority.PriorityParam
+	}
+	rp.mu.Lock()
+	rp.p = p
+	streams := make([]connStream, 0, len(rp.streams))
+	for s := range rp.streams {
+		streams = append(streams, s)
+	}
+	rp.mu.Unlock()
+	for _, s := range streams {
+		s.cc.reprioritize(s.id, p)
+	}
+	return true
+}
+
+// add records that cs, on cc, was opened with rp's priority, and
+// returns it. requires cc.mu be held.
+func (rp *requestPriority) add(cc *ClientConn, cs *clientStream) Priority {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.streams == nil {
+		rp.streams = make(map[connStream]bool)
+	}
+	rp.streams[connStream{cc, cs.ID}] = true
+	return rp.p
+}
+
+// remove forgets cs, on cc, which has closed. requires cc.mu be
+// held.
+func (rp *requestPriority) remove(cc *ClientConn, cs *clientStream) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	delete(rp.streams, connStream{cc, cs.ID})
+}
+
+// fieldValue returns p's Urgency and Incremental as a Priority
+// header value, as in RFC 9218.
+func (p Priority) fieldValue() string {
+	v := "u=" + strconv.Itoa(p.Urgency)
+	if p.Incremental {
+		v += ", i"
+	}
+	return v
+}
+
+// setRequestPriority gives cs the priority of the request it's
+// opened for, per WithPriority, and adds it to cc's priority tree.
+// requires cc.mu be held.
+func (cc *ClientConn) setRequestPriority(cs *clientStream) {
+	if rp, ok := cs.ctx.Value(requestPriorityKey{}).(*requestPriority); ok {
+		cs.reqPrio = rp
+		cs.prio = rp.add(cc, cs)
+	}
+	if cs.prio.PriorityParam != defaultPriority.PriorityParam {
+		cc.prioTree.reprioritize(cs.ID, cs.prio.PriorityParam)
+	}
+	cc.prioTree.open(cs.ID)
+}
+
+// headersPriority returns the priority fields for cs's HEADERS
+// frame: zero, for none, unless the request's weight isn't the
+// default.
+func (cs *clientStream) headersPriority() PriorityParam {
+	if cs.reqPrio == nil || cs.prio.PriorityParam == defaultPriority.PriorityParam {
+		return PriorityParam{}
+	}
+	return cs.prio.PriorityParam
+}
+
+// priorityHeader returns the Priority header to add to req, opening
+// cs, or "" for none: the request has one, or its urgency and
+// incrementality are the defaults.
+func (cs *clientStream) priorityHeader(req *http.Request) string {
+	if cs.reqPrio == nil || req.Header.Get("Priority") != "" ||
+		cs.prio.Urgency == defaultPriority.Urgency && cs.prio.Incremental == defaultPriority.Incremental {
+		return ""
+	}
+	return cs.prio.fieldValue()
+}
+
+// reprioritize changes the priority of stream id to p, if it's
+// still open, and tells the server.
+func (cc *ClientConn) reprioritize(id uint32, p Priority) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cs := cc.streams[id]
+	if cs == nil {
+		return
+	}
+	old := cs.prio
+	cs.prio = p
+	if p.PriorityParam != old.PriorityParam {
+		cc.prioTree.reprioritize(cs.ID, p.PriorityParam)
+		cc.fr.WritePriority(cs.ID, p.PriorityParam)
+	}
+	if p.Urgency != old.Urgency || p.Incremental != old.Incremental {
+		cc.fr.WritePriorityUpdate(cs.ID, p.fieldValue())
+	}
+	cc.bw.Flush()
+	cc.cond.Broadcast()
+}
+
+// sentData charges cs, in cc's priority tree, for the n bytes of
+// DATA it just sent. requires cc.mu be held.
+func (cc *ClientConn) sentData(cs *clientStream, n int) {
+	cc.prioTree.charge(cs.ID, n)
+}
+
+// outranked reports whether another of cc's streams waiting to
+// send DATA should go before cs, and could now, so that cs must
+// wait for it: it's more urgent, or as urgent and the priority tree
+// picks it, being one cs depends on or further behind in its share.
+// requires cc.mu be held.
+func (cc *ClientConn) outranked(cs *clientStream) bool {
+	for _, o := range cc.streams {
+		if o != cs && o.sending && o.outflow.available() > 0 && o.prio.Urgency < cs.prio.Urgency {
+			return true
+		}
+	}
+	id, ok := cc.prioTree.pick(func(id uint32) bool {
+		o := cc.streams[id]
+		return o != nil && o.sending && o.outflow.available() > 0 && o.prio.Urgency == cs.prio.Urgency
+	})
+	return ok && id != cs.ID
+}
@@ -8,114 +8,277 @@
 package http2
 
 import (
+	"reflect"
 	"testing"
 )
 
-func TestPriority(t *testing.T) {
-	// A -> B
-	// move A's parent to B
-	streams := make(map[uint32]*stream)
-	a := &stream{
-		parent: nil,
-		weight: 16,
-	}
-	streams[1] = a
-	b := &stream{
-		parent: a,
-		weight: 16,
-	}
-	streams[2] = b
-	adjustStreamPriority(streams, 1, PriorityParam{
-		Weight:    20,
-		StreamDep: 2,
-	})
-	if a.parent != b {
-		t.Errorf("Expected A's parent to be B")
+// newTestTree returns a priorityTree with streams opened in order,
+// each with its priority.
+func newTestTree(streams ...testTreeStream) *priorityTree {
+	t := new(priorityTree)
+	for _, st := range streams {
+		t.reprioritize(st.id, st.p)
+		t.open(st.id)
 	}
-	if a.weight != 20 {
-		t.Errorf("Expected A's weight to be 20; got %d", a.weight)
+	return t
+}
+
+type testTreeStream struct {
+	id uint32
+	p  PriorityParam
+}
+
+// checkNode checks that stream id depends on parent with weight.
+func checkNode(t *testing.T, tr *priorityTree, id, parent uint32, weight uint8) {
+	t.Helper()
+	n := tr.node(id)
+	if n == nil {
+		t.Errorf("stream %d not in tree", id)
+		return
 	}
-	if b.parent != nil {
-		t.Errorf("Expected B to have no parent")
+	if n.parent.id != parent || n.parent != tr.node(parent) {
+		t.Errorf("stream %d depends on %d; want %d", id, n.parent.id, parent)
 	}
-	if b.weight != 16 {
-		t.Errorf("Expected B's weight to be 16; got %d", b.weight)
+	if n.weight != weight {
+		t.Errorf("stream %d has weight %d; want %d", id, n.weight, weight)
 	}
 }
 
+func TestPriority(t *testing.T) {
+	// A -> B
+	// move A's parent to B
+	tr := newTestTree(
+		testTreeStream{1, PriorityParam{Weight: 16}},
+		testTreeStream{3, PriorityParam{StreamDep: 1, Weight: 16}},
+	)
+	tr.reprioritize(1, PriorityParam{Weight: 20, StreamDep: 3})
+	checkNode(t, tr, 1, 3, 20)
+	checkNode(t, tr, 3, 0, 16)
+}
+
 func TestPriorityExclusiveZero(t *testing.T) {
 	// A B and C are all children of the 0 stream.
 	// Exclusive reprioritization to any of the streams
 	// should bring the rest of the streams under the
 	// reprioritized stream
-	streams := make(map[uint32]*stream)
-	a := &stream{
-		parent: nil,
-		weight: 16,
-	}
-	streams[1] = a
-	b := &stream{
-		parent: nil,
-		weight: 16,
+	tr := newTestTree(
+		testTreeStream{1, PriorityParam{Weight: 16}},
+		testTreeStream{3, PriorityParam{Weight: 16}},
+		testTreeStream{5, PriorityParam{Weight: 16}},
+	)
+	tr.reprioritize(5, PriorityParam{Weight: 20, Exclusive: true})
+	checkNode(t, tr, 1, 5, 16)
+	checkNode(t, tr, 3, 5, 16)
+	checkNode(t, tr, 5, 0, 20)
+}
+
+func TestPriorityOwnParent(t *testing.T) {
+	tr := newTestTree(
+		testTreeStream{1, PriorityParam{Weight: 16}},
+		testTreeStream{3, PriorityParam{StreamDep: 1, Weight: 16}},
+	)
+	tr.reprioritize(1, PriorityParam{Weight: 20, StreamDep: 1})
+	checkNode(t, tr, 1, 0, 16)
+	checkNode(t, tr, 3, 1, 16)
+}
+
+func TestPriorityExclusiveInsert(t *testing.T) {
+	// 1 has children 3 and 5; 7 opens depending exclusively on 1,
+	// taking them over.
+	tr := newTestTree(
+		testTreeStream{1, PriorityParam{}},
+		testTreeStream{3, PriorityParam{StreamDep: 1, Weight: 10}},
+		testTreeStream{5, PriorityParam{StreamDep: 1, Weight: 20}},
+		testTreeStream{7, PriorityParam{StreamDep: 1, Weight: 30, Exclusive: true}},
+	)
+	checkNode(t, tr, 7, 1, 30)
+	checkNode(t, tr, 3, 7, 10)
+	checkNode(t, tr, 5, 7, 20)
+	if n := len(tr.node(1).kids); n != 1 {
+		t.Errorf("stream 1 has %d children; want 1", n)
 	}
-	streams[2] = b
-	c := &stream{
-		parent: nil,
-		weight: 16,
+
+	// One depending on a stream not in the tree gets the default
+	// priority.
+	tr.reprioritize(9, PriorityParam{StreamDep: 11, Weight: 99, Exclusive: true})
+	checkNode(t, tr, 9, 0, defaultPriority.Weight)
+}
+
+func TestPriorityDescendantParent(t *testing.T) {
+	// 5.3.3's example: A is made to depend on D, its descendant,
+	// which first moves up to A's old parent. Being exclusive, A
+	// then takes over D's children too.
+	//
+	//	    0              0
+	//	    |              |
+	//	    A              D
+	//	   / \     =>      |
+	//	  B   C            A
+	//	      |         / / \ \
+	//	      D        B C   E F
+	//	     / \
+	//	    E   F
+	const a, b, c, d, e, f = 1, 3, 5, 7, 9, 11
+	tr := newTestTree(
+		testTreeStream{a, PriorityParam{Weight: 1}},
+		testTreeStream{b, PriorityParam{StreamDep: a, Weight: 2}},
+		testTreeStream{c, PriorityParam{StreamDep: a, Weight: 3}},
+		testTreeStream{d, PriorityParam{StreamDep: c, Weight: 4}},
+		testTreeStream{e, PriorityParam{StreamDep: d, Weight: 5}},
+		testTreeStream{f, PriorityParam{StreamDep: d, Weight: 6}},
+	)
+	tr.reprioritize(a, PriorityParam{StreamDep: d, Weight: 1, Exclusive: true})
+	checkNode(t, tr, d, 0, 4)
+	checkNode(t, tr, a, d, 1)
+	checkNode(t, tr, b, a, 2)
+	checkNode(t, tr, c, a, 3)
+	checkNode(t, tr, e, a, 5)
+	checkNode(t, tr, f, a, 6)
+}
+
+func TestPriorityClosedRetention(t *testing.T) {
+	// Stream 1, weight 64, has children 3 (weight 16) and 5 (weight
+	// 48). Once it's closed and enough others have closed after it,
+	// it's dropped, and they share its weight under the root.
+	tr := newTestTree(
+		testTreeStream{1, PriorityParam{Weight: 63}},
+		testTreeStream{3, PriorityParam{StreamDep: 1, Weight: 15}},
+		testTreeStream{5, PriorityParam{StreamDep: 1, Weight: 47}},
+	)
+	tr.close(1)
+	for i := 0; i < maxClosedPriorityNodes; i++ {
+		id := uint32(7 + 2*i)
+		checkNode(t, tr, 3, 1, 15)
+		tr.open(id)
+		tr.close(id)
 	}
-	streams[3] = c
-	adjustStreamPriority(streams, 3, PriorityParam{
-		Weight:    20,
-		StreamDep: 0,
-		Exclusive: true,
-	})
-	if a.parent != c {
-		t.Errorf("Expected A's parent to be C")
+	if tr.node(1) != nil {
+		t.Fatal("stream 1 kept after maxClosedPriorityNodes others closed")
 	}
-	if a.weight != 16 {
-		t.Errorf("Expected A's weight to be 16; got %d", a.weight)
+	checkNode(t, tr, 3, 0, 15)
+	checkNode(t, tr, 5, 0, 47)
+	if len(tr.closed) != maxClosedPriorityNodes {
+		t.Errorf("tree keeps %d closed streams; want %d", len(tr.closed), maxClosedPriorityNodes)
 	}
-	if b.parent != c {
-		t.Errorf("Expected B's parent to be C")
+}
+
+func TestPriorityIdle(t *testing.T) {
+	// A PRIORITY frame for an idle stream puts it in the tree, for
+	// others to depend on, and keeps its priority when it opens.
+	tr := new(priorityTree)
+	tr.reprioritize(3, PriorityParam{Weight: 200})
+	tr.open(1)
+	tr.reprioritize(1, PriorityParam{StreamDep: 3, Weight: 7})
+	checkNode(t, tr, 1, 3, 7)
+	tr.open(3)
+	checkNode(t, tr, 3, 0, 200)
+	if len(tr.idle) != 0 {
+		t.Errorf("tree has %d idle streams; want 0", len(tr.idle))
 	}
-	if b.weight != 16 {
-		t.Errorf("Expected B's weight to be 16; got %d", b.weight)
+
+	// Only the newest idle streams are kept.
+	for i := 0; i <= maxIdlePriorityNodes; i++ {
+		tr.reprioritize(uint32(101+2*i), PriorityParam{Weight: 1})
 	}
-	if c.parent != nil {
-		t.Errorf("Expected C to have no parent")
+	if tr.node(101) != nil {
+		t.Error("oldest idle stream kept past maxIdlePriorityNodes")
 	}
-	if c.weight != 20 {
-		t.Errorf("Expected C's weight to be 20; got %d", b.weight)
+	if tr.node(103) == nil {
+		t.Error("newer idle stream dropped")
 	}
 }
 
-func TestPriorityOwnParent(t *testing.T) {
-	streams := make(map[uint32]*stream)
-	a := &stream{
-		parent: nil,
-		weight: 16,
+func TestPriorityTreePick(t *testing.T) {
+	// 3 depends on 1; 5 and 7 are siblings of 1, weights 16 and 64.
+	tr := newTestTree(
+		testTreeStream{1, PriorityParam{Weight: 15}},
+		testTreeStream{3, PriorityParam{StreamDep: 1, Weight: 255}},
+		testTreeStream{5, PriorityParam{Weight: 15}},
+		testTreeStream{7, PriorityParam{Weight: 63}},
+	)
+	ready := map[uint32]bool{1: true, 3: true}
+	readyFunc := func(id uint32) bool { return ready[id] }
+	if id, _ := tr.pick(readyFunc); id != 1 {
+		t.Errorf("picked %d; want 1, which 3 depends on", id)
 	}
-	streams[1] = a
-	b := &stream{
-		parent: a,
-		weight: 16,
+	ready[1] = false
+	if id, _ := tr.pick(readyFunc); id != 3 {
+		t.Errorf("picked %d; want 3, with 1 blocked", id)
 	}
-	streams[2] = b
-	adjustStreamPriority(streams, 1, PriorityParam{
-		Weight:    20,
-		StreamDep: 1,
-	})
-	if a.parent != nil {
-		t.Errorf("Expected A's parent to be nil")
+	delete(ready, 3)
+	if _, ok := tr.pick(readyFunc); ok {
+		t.Error("picked a stream with none ready")
 	}
-	if a.weight != 20 {
-		t.Errorf("Expected A's weight to be 20; got %d", a.weight)
+
+	// 5 and 7 share by weight: 7 gets four frames for each of 5's.
+	ready = map[uint32]bool{5: true, 7: true}
+	sent := map[uint32]int{}
+	for i := 0; i < 100; i++ {
+		id, _ := tr.pick(readyFunc)
+		sent[id]++
+		tr.charge(id, 1000)
 	}
-	if b.parent != a {
-		t.Errorf("Expected B's parent to be A")
+	if sent[5] != 20 || sent[7] != 80 {
+		t.Errorf("frames sent = %v; want 20 from 5 and 80 from 7", sent)
 	}
-	if b.weight != 16 {
-		t.Errorf("Expected B's weight to be 16; got %d", b.weight)
+}
+
+func TestParsePriorityHeader(t *testing.T) {
+	tests := []struct {
+		v    string
+		want Priority
+	}{
+		{"", Priority{Urgency: 3}},
+		{"u=0", Priority{Urgency: 0}},
+		{"u=5, i", Priority{Urgency: 5, Incremental: true}},
+		{"i=?1;x=y, u=2", Priority{Urgency: 2, Incremental: true}},
+		{"i=?0", Priority{Urgency: 3}},
+		{"u=8", Priority{Urgency: 3}},   // out of range
+		{"u=one", Priority{Urgency: 3}}, // malformed
+		{"foo=1, u=6", Priority{Urgency: 6}},
 	}
+	for _, tt := range tests {
+		got := Priority{Urgency: 3}
+		parsePriorityHeader(&got, tt.v)
+		if got != tt.want {
+			t.Errorf("parsePriorityHeader(%q) = %+v; want %+v", tt.v, got, tt.want)
+		}
+	}
+}
 
+func TestWriteSchedulerPriority(t *testing.T) {
+	var connFlow flow
+	connFlow.add(1 << 20)
+	ws := writeScheduler{maxFrameSize: initialMaxFrameSize}
+	newStream := func(id uint32, urgency int, weight uint8) *stream {
+		st := &stream{id: id, urgency: urgency}
+		st.flow.conn = &connFlow
+		st.flow.add(1 << 10)
+		ws.tree.reprioritize(id, PriorityParam{Weight: weight})
+		ws.tree.open(id)
+		return st
+	}
+	for _, st := range []*stream{
+		newStream(1, 3, 15),
+		newStream(3, 1, 15),
+		newStream(5, 3, 255),
+		newStream(7, 1, 100),
+	} {
+		ws.add(frameWriteMsg{
+			write:  &writeData{streamID: st.id, p: []byte("x")},
+			stream: st,
+		})
+	}
+	var got []uint32
+	for !ws.empty() {
+		wm, ok := ws.take()
+		if !ok {
+			t.Fatal("take failed with frames left")
+		}
+		got = append(got, wm.stream.id)
+	}
+	want := []uint32{7, 3, 5, 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("write order = %v; want %v", got, want)
+	}
 }
@@ -0,0 +1,267 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+// maxClosedPriorityNodes and maxIdlePriorityNodes bound the nodes a
+// priorityTree keeps for streams that have closed, and for idle ones
+// named by PRIORITY frames, so that a peer can't grow it without
+// limit. Section 5.3.4 lets us drop them; the newest are kept, being
+// the likeliest to be depended on next.
+const (
+	maxClosedPriorityNodes = 10
+	maxIdlePriorityNodes   = 10
+)
+
+type priorityNodeState uint8
+
+const (
+	priorityNodeIdle priorityNodeState = iota
+	priorityNodeOpen
+	priorityNodeClosed
+)
+
+// A priorityNode is a stream in a priorityTree.
+type priorityNode struct {
+	id     uint32
+	weight uint8 // as in PriorityParam: one less than the real weight
+	state  priorityNodeState
+	parent *priorityNode // nil only for the root
+	kids   []*priorityNode
+
+	// vtime is the node's virtual time among its siblings, advanced
+	// by the DATA sent in its subtree, more slowly the heavier it is.
+	// kidsVtime is the virtual time of the last of its children
+	// served, which a child that's been idle catches up to, so that
+	// it can't make up for the time it had nothing to send.
+	vtime, kidsVtime uint64
+}
+
+// A priorityTree is the stream dependency tree of RFC 7540 section
+// 5.3, used to order the DATA of a conn's streams: a stream goes
+// before those that depend on it, and siblings share what their
+// parent leaves by fair queueing, in proportion to their weights.
+// The Transport keeps one for request bodies and the Server one for
+// responses, in its writeScheduler.
+//
+// The zero value is an empty tree. It is not safe for concurrent
+// use.
+type priorityTree struct {
+	root   priorityNode // stream 0
+	nodes  map[uint32]*priorityNode
+	closed []*priorityNode // oldest first
+	idle   []*priorityNode // oldest first
+}
+
+// node returns the node of stream id, the root for 0, or nil if the
+// tree doesn't have it.
+func (t *priorityTree) node(id uint32) *priorityNode {
+	if id == 0 {
+		return &t.root
+	}
+	return t.nodes[id]
+}
+
+// open notes that stream id has opened. A stream not already in the
+// tree, as an idle one given a priority by PRIORITY frame is, gets
+// the default priority; reprioritize it first to give it another.
+func (t *priorityTree) open(id uint32) {
+	n := t.nodes[id]
+	if n == nil {
+		n = t.add(id, defaultPriority.PriorityParam)
+	}
+	if n.state == priorityNodeIdle {
+		t.idle = removeNode(t.idle, n)
+	}
+	n.state = priorityNodeOpen
+}
+
+// reprioritize applies a PRIORITY frame for stream id. One for a
+// stream not in the tree makes an idle node for it, which others may
+// depend on (section 5.3.4), and one making a stream depend on
+// itself is ignored.
+func (t *priorityTree) reprioritize(id uint32, p PriorityParam) {
+	if id == p.StreamDep {
+		return
+	}
+	n := t.nodes[id]
+	if n == nil {
+		n = t.add(id, p)
+		t.idle = append(t.idle, n)
+		if len(t.idle) > maxIdlePriorityNodes {
+			t.remove(t.idle[0])
+		}
+		return
+	}
+	parent := t.node(p.StreamDep)
+	if parent == nil {
+		parent, p = &t.root, defaultPriority.PriorityParam
+	}
+	n.weight = p.Weight
+	t.move(n, parent, p.Exclusive)
+}
+
+// close notes that stream id has closed. Its node stays, for streams
+// depending on it, until more than maxClosedPriorityNodes have
+// closed after it.
+func (t *priorityTree) close(id uint32) {
+	n := t.nodes[id]
+	if n == nil || n.state == priorityNodeClosed {
+		return
+	}
+	if n.state == priorityNodeIdle {
+		t.idle = removeNode(t.idle, n)
+	}
+	n.state = priorityNodeClosed
+	t.closed = append(t.closed, n)
+	if len(t.closed) > maxClosedPriorityNodes {
+		t.remove(t.closed[0])
+	}
+}
+
+// add makes an idle node for stream id with priority p. Per section
+// 5.3.1, one depending on a stream not in the tree gets the default
+// priority instead.
+func (t *priorityTree) add(id uint32, p PriorityParam) *priorityNode {
+	parent := t.node(p.StreamDep)
+	if parent == nil {
+		parent, p = &t.root, defaultPriority.PriorityParam
+	}
+	if t.nodes == nil {
+		t.nodes = make(map[uint32]*priorityNode)
+	}
+	n := &priorityNode{id: id, weight: p.Weight}
+	t.nodes[id] = n
+	t.move(n, parent, p.Exclusive)
+	return n
+}
+
+// move makes n depend on parent, exclusively taking over parent's
+// other children if exclusive is set.
+func (t *priorityTree) move(n, parent *priorityNode, exclusive bool) {
+	// 5.3.3: if n is to depend on one of its own descendants, that
+	// first moves up to where n was, keeping its weight.
+	for p := parent; p != nil; p = p.parent {
+		if p == n {
+			parent.detach()
+			n.parent.attach(parent)
+			break
+		}
+	}
+	n.detach()
+	if exclusive {
+		for _, k := range parent.kids {
+			k.parent = n
+		}
+		n.kids = append(n.kids, parent.kids...)
+		parent.kids = nil
+	}
+	parent.attach(n)
+}
+
+// remove drops n from the tree. Its children take its place under
+// its parent, sharing its weight in proportion to their own
+// (section 5.3.4).
+func (t *priorityTree) remove(n *priorityNode) {
+	switch n.state {
+	case priorityNodeIdle:
+		t.idle = removeNode(t.idle, n)
+	case priorityNodeClosed:
+		t.closed = removeNode(t.closed, n)
+	}
+	delete(t.nodes, n.id)
+	parent := n.parent
+	n.detach()
+	var sum int
+	for _, k := range n.kids {
+		sum += int(k.weight) + 1
+	}
+	for _, k := range n.kids {
+		w := (int(n.weight) + 1) * (int(k.weight) + 1) / sum
+		if w < 1 {
+			w = 1
+		} else if w > 256 {
+			w = 256
+		}
+		k.weight = uint8(w - 1)
+		k.parent = nil
+		parent.attach(k)
+	}
+	n.kids = nil
+}
+
+func (n *priorityNode) attach(k *priorityNode) {
+	k.parent = n
+	n.kids = append(n.kids, k)
+}
+
+func (n *priorityNode) detach() {
+	if n.parent == nil {
+		return
+	}
+	n.parent.kids = removeNode(n.parent.kids, n)
+	n.parent = nil
+}
+
+func removeNode(s []*priorityNode, n *priorityNode) []*priorityNode {
+	for i, v := range s {
+		if v == n {
+			copy(s[i:], s[i+1:])
+			s[len(s)-1] = nil
+			return s[:len(s)-1]
+		}
+	}
+	return s
+}
+
+// pick returns the open stream that should send DATA next of those
+// for which ready returns true, or false if there are none. A stream
+// goes before the streams depending on it; among siblings, the one
+// whose subtree is furthest behind in virtual time goes, ties going
+// to the heavier, then the lower ID. A ready stream not in the tree
+// is never picked.
+func (t *priorityTree) pick(ready func(id uint32) bool) (uint32, bool) {
+	n := t.pickUnder(&t.root, ready)
+	if n == nil {
+		return 0, false
+	}
+	return n.id, true
+}
+
+func (t *priorityTree) pickUnder(n *priorityNode, ready func(id uint32) bool) *priorityNode {
+	if n != &t.root && n.state == priorityNodeOpen && ready(n.id) {
+		return n
+	}
+	var best, picked *priorityNode
+	var bestVtime uint64
+	for _, k := range n.kids {
+		got := t.pickUnder(k, ready)
+		if got == nil {
+			continue
+		}
+		v := k.vtime
+		if v < n.kidsVtime {
+			v = n.kidsVtime
+		}
+		if best == nil || v < bestVtime ||
+			v == bestVtime && (k.weight > best.weight || k.weight == best.weight && k.id < best.id) {
+			best, picked, bestVtime = k, got, v
+		}
+	}
+	return picked
+}
+
+// charge advances the virtual times of stream id and its ancestors
+// for the n bytes of DATA it just sent.
+func (t *priorityTree) charge(id uint32, n int) {
+	for c := t.nodes[id]; c != nil && c.parent != nil; c = c.parent {
+		p := c.parent
+		if c.vtime < p.kidsVtime {
+			c.vtime = p.kidsVtime
+		}
+		p.kidsVtime = c.vtime
+		c.vtime += uint64(n) << 8 / (uint64(c.weight) + 1)
+	}
+}
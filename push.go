@@ -0,0 +1,336 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/phuslu/http2/hpack"
+)
+
+// maxPushedStreams is the SETTINGS_MAX_CONCURRENT_STREAMS the
+// Transport sends when it accepts server push, bounding how many
+// pushed streams a server may have open at once.
+const maxPushedStreams = 100
+
+// A PushPolicy is how a Transport without a PushedResponseCache,
+// which tells servers not to push, treats a server that does anyway.
+type PushPolicy int
+
+const (
+	// PushRefuse resets each promised stream with CANCEL, quietly
+	// dropping the push.
+	PushRefuse PushPolicy = iota
+
+	// PushConnError treats a PUSH_PROMISE as a connection error
+	// of type PROTOCOL_ERROR, as RFC 7540 section 8.2 requires of
+	// a client that has disabled push.
+	PushConnError
+)
+
+var (
+	errPushCanceled     = errors.New("http2: pushed response canceled")
+	errPushVaryMismatch = errors.New("http2: pushed response varies from request")
+)
+
+// A PushedResponseCache holds the responses servers have promised to
+// push, for the Transport to answer later requests with. See
+// Transport.PushedResponseCache.
+type PushedResponseCache interface {
+	// Put adds p, a push a server has just promised. It's called
+	// on the connection's frame-reading goroutine, so it must not
+	// block. A push the cache drops without handing it out must
+	// be canceled.
+	Put(p *PushedResponse)
+
+	// Take removes and returns a push that may answer req, one
+	// whose Matches method reports true, or nil if there's none.
+	Take(req *http.Request) *PushedResponse
+}
+
+// A PushedResponse is a response a server has promised to push.
+type PushedResponse struct {
+	// Request is the request the server promised the response
+	// to, from its PUSH_PROMISE. It has no body.
+	Request *http.Request
+
+	cc *ClientConn
+	cs *clientStream
+}
+
+// Matches reports whether p was promised for a request like req: one
+// with the same method, :authority and :path. Once the response has
+// come, the Transport also checks that req agrees with p.Request on
+// the header fields named by its Vary, and makes a request of its own
+// if not.
+func (p *PushedResponse) Matches(req *http.Request) bool {
+	return req.Method == p.Request.Method &&
+		authority(req) == p.Request.Host &&
+		requestPath(req) == p.Request.RequestURI
+}
+
+// Cancel resets p's stream, for a cache dropping p unused.
+func (p *PushedResponse) Cancel() {
+	p.cc.resetStream(p.cs, ErrCodeCancel, errPushCanceled)
+}
+
+// response waits for p's response and returns it as the answer to
+// req.
+func (p *PushedResponse) response(req *http.Request) (*http.Response, error) {
+	var re resAndError
+	select {
+	case re = <-p.cs.resc:
+	case <-req.Cancel:
+		p.Cancel()
+		p.cc.abandonResponse(p.cs)
+		return nil, ErrRequestCanceled
+	case <-p.cc.readerDone:
+		return nil, errClientConnClosed
+	}
+	if re.err != nil {
+		return nil, re.err
+	}
+	res := re.res
+	if !varyMatches(res.Header, p.Request.Header, req.Header) {
+		res.Body.Close()
+		return nil, errPushVaryMismatch
+	}
+	res.Request = req
+	res.TLS = p.cc.tlsState
+	return res, nil
+}
+
+// varyMatches reports whether the request headers a and b agree on
+// the fields named by the Vary of the response header h.
+func varyMatches(h, a, b http.Header) bool {
+	for _, v := range h["Vary"] {
+		for _, k := range strings.Split(v, ",") {
+			k = strings.TrimSpace(k)
+			if k == "*" {
+				return false
+			}
+			k = http.CanonicalHeaderKey(k)
+			if strings.Join(a[k], ",") != strings.Join(b[k], ",") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pushedResponse returns a pushed response from t.PushedResponseCache
+// that answers req, or nil if there's none.
+func (t *Transport) pushedResponse(req *http.Request) *http.Response {
+	if t.PushedResponseCache == nil || req.Method != "GET" && req.Method != "HEAD" ||
+		req.Body != nil && req.ContentLength != 0 {
+		return nil
+	}
+	for {
+		p := t.PushedResponseCache.Take(req)
+		if p == nil {
+			return nil
+		}
+		if res, err := p.response(req); err == nil {
+			return res
+		}
+	}
+}
+
+// NewPushedResponseCache returns a PushedResponseCache that keeps up
+// to max pushes in memory, canceling the oldest to make room.
+func NewPushedResponseCache(max int) PushedResponseCache {
+	return &pushCache{max: max}
+}
+
+type pushCache struct {
+	mu     sync.Mutex
+	max    int
+	pushes []*PushedResponse // oldest first
+}
+
+func (c *pushCache) Put(p *PushedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pushes) >= c.max {
+		if len(c.pushes) == 0 {
+			p.Cancel()
+			return
+		}
+		c.pushes[0].Cancel()
+		c.pushes = c.pushes[1:]
+	}
+	c.pushes = append(c.pushes, p)
+}
+
+func (c *pushCache) Take(req *http.Request) *PushedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.pushes {
+		if p.Matches(req) {
+			c.pushes = append(c.pushes[:i], c.pushes[i+1:]...)
+			return p
+		}
+	}
+	return nil
+}
+
+// promise is a PUSH_PROMISE whose header block readLoop is
+// reading: the stream it promises and the request fields so far.
+type promise struct {
+	id                              uint32
+	method, scheme, authority, path string
+	header                          http.Header
+}
+
+// startPush begins reading the PUSH_PROMISE f into cc.push. Without
+// a PushedResponseCache, the header block is only decoded to keep the
+// HPACK state in step, unless t.PushPolicy makes f a connection error.
+func (cc *ClientConn) startPush(f *PushPromiseFrame) error {
+	if cc.t.PushedResponseCache == nil && cc.t.PushPolicy == PushConnError {
+		cc.logf("http2: PUSH_PROMISE with push disabled")
+		return ConnectionError(ErrCodeProtocol)
+	}
+	if f.PromiseID%2 != 0 || f.PromiseID <= cc.lastPushID {
+		cc.logf("http2: PUSH_PROMISE of invalid stream %d", f.PromiseID)
+		return ConnectionError(ErrCodeProtocol)
+	}
+	cc.lastPushID = f.PromiseID
+	cc.push = &promise{id: f.PromiseID, header: make(http.Header)}
+	cc.sawRegularHeader = false
+	cc.resInvalid = false
+	cc.resHeaderSize = 0
+	cc.resTrailers = false
+	cc.keepRaw = false
+	cc.rawFields = nil
+	cc.hdec.SetEmitEnabled(cc.t.PushedResponseCache != nil)
+	if _, err := cc.hdec.Write(f.HeaderBlockFragment()); err != nil {
+		return ConnectionError(ErrCodeCompression)
+	}
+	return nil
+}
+
+// onPushPseudoHeader records f, a pseudo-header field of cc.push's
+// request.
+func (cc *ClientConn) onPushPseudoHeader(f hpack.HeaderField) {
+	pp := cc.push
+	var v *string
+	switch f.Name {
+	case ":method":
+		v = &pp.method
+	case ":scheme":
+		v = &pp.scheme
+	case ":authority":
+		v = &pp.authority
+	case ":path":
+		v = &pp.path
+	default:
+		cc.logf("http2: invalid pseudo-header %q in PUSH_PROMISE", f.Name)
+		cc.resInvalid = true
+		return
+	}
+	if *v != "" {
+		cc.logf("http2: duplicate %s %q in PUSH_PROMISE", f.Name, f.Value)
+		cc.resInvalid = true
+		return
+	}
+	*v = f.Value
+}
+
+// request returns the request pp promises a response to, or an error
+// if it's not one a server may push.
+func (pp *promise) request() (*http.Request, error) {
+	if pp.method == "" || pp.scheme == "" || pp.authority == "" || pp.path == "" {
+		return nil, errors.New("missing pseudo-header")
+	}
+	// 8.2: "Promised requests MUST be cacheable [...] and safe"
+	if pp.method != "GET" && pp.method != "HEAD" {
+		return nil, fmt.Errorf("method %q", pp.method)
+	}
+	if pp.scheme != "https" {
+		return nil, fmt.Errorf("scheme %q", pp.scheme)
+	}
+	u, err := url.ParseRequestURI(pp.path)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = pp.scheme
+	u.Host = pp.authority
+	return &http.Request{
+		Method:     pp.method,
+		URL:        u,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     pp.header,
+		Host:       pp.authority,
+		RequestURI: pp.path,
+	}, nil
+}
+
+// newPush sets up the stream cc.push promises, now that its header
+// block has been read, and puts it in t.PushedResponseCache. A
+// malformed or unwanted promise has its stream reset instead. assoc
+// is the stream the promise came on.
+func (cc *ClientConn) newPush(assoc *clientStream) {
+	pp := cc.push
+	cc.push = nil
+	if cc.t.PushedResponseCache == nil {
+		cc.vlogf("http2: refusing push of stream %d; push is disabled", pp.id)
+		cc.mu.Lock()
+		cc.fr.WriteRSTStream(pp.id, ErrCodeCancel)
+		cc.bw.Flush()
+		cc.unlock()
+		return
+	}
+	req, err := pp.request()
+	if err == nil && pp.authority != assoc.authority {
+		// The server is only known to be authoritative for
+		// the authority it was asked about.
+		err = fmt.Errorf("authority %q", pp.authority)
+	}
+	if err == nil && cc.resInvalid {
+		err = errors.New("malformed header block")
+	}
+	code := ErrCodeProtocol
+	cc.mu.Lock()
+	if err == nil && cc.pushed >= maxPushedStreams {
+		err, code = errors.New("too many pushed streams"), ErrCodeRefusedStream
+	}
+	if err != nil {
+		cc.logf("http2: refusing push of stream %d: %v", pp.id, err)
+		cc.fr.WriteRSTStream(pp.id, code)
+		cc.bw.Flush()
+		cc.unlock()
+		return
+	}
+	cs := &clientStream{
+		ID:            pp.id,
+		resc:          make(chan resAndError, 1),
+		isHead:        pp.method == "HEAD",
+		ctx:           context.Background(),
+		authority:     pp.authority,
+		method:        pp.method,
+		declBodyBytes: -1,
+		maxBodyBytes:  cc.t.maxResponseBodySize(req),
+		// We never send on a pushed stream.
+		state: stateHalfClosedLocal,
+	}
+	cs.inflow.setConnFlow(&cc.inflow)
+	cs.inflow.add(int32(cc.inWindowSize))
+	cs.outflow.setConnFlow(&cc.outflow)
+	cc.acquireStreamLocked(cs) // cc's, until retireStreamsLocked
+	cc.noteStreamActivity(cs)
+	cc.streams[cs.ID] = cs
+	cc.pushed++
+	cc.streamOpened(cs)
+	cc.unlock()
+	cc.t.PushedResponseCache.Put(&PushedResponse{Request: req, cc: cc, cs: cs})
+}
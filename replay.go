@@ -0,0 +1,164 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A ReplayConn is a net.Conn that plays back the frames one side of
+// a captured connection received, so that a bug reported with a
+// FrameCapture can become a deterministic test. Give it to a
+// Transport from DialTLS, to replay a Transport's capture, or to
+// Server.NewH2Conn, to replay a Server's.
+//
+// Each frame is held back until the side replaying the capture has
+// written as many frames as it had when the frame arrived in the
+// capture, so that the exchange unfolds in the captured order, and
+// Read returns io.EOF once it has written as many as it did in all.
+// A side that writes fewer than it did in the capture, as one whose
+// behavior has changed might, stalls until the conn is closed. What
+// it writes is kept, for comparing with the capture; see Written.
+type ReplayConn struct {
+	frames []replayFrame // those the replaying side received
+	total  int           // frames the replaying side wrote in the capture
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	in      []byte // what's left of the frame being read
+	next    int    // index in frames of the next to read
+	preface int    // bytes of the client preface yet to be written
+	out     []byte // frames written, after any client preface
+	framed  int    // bytes of out in complete frames
+	wrote   int    // complete frames in out
+	closed  bool
+}
+
+type replayFrame struct {
+	raw   []byte
+	after int // frames the replaying side wrote before it came
+}
+
+// NewReplayConn returns a ReplayConn playing back the capture in r.
+// If server is true, the capture is a Server's, and the conn yields
+// the client connection preface a server expects before the frames.
+// Otherwise it's a Transport's, and the conn expects the preface to
+// be written first.
+func NewReplayConn(r io.Reader, server bool) (*ReplayConn, error) {
+	cr, err := NewCaptureReader(r)
+	if err != nil {
+		return nil, err
+	}
+	c := &ReplayConn{}
+	c.cond.L = &c.mu
+	for {
+		cf, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if cf == nil {
+			return nil, err
+		}
+		if cf.Dir == CaptureWrite {
+			c.total++
+			continue
+		}
+		raw := append([]byte(nil), cf.Raw...)
+		c.frames = append(c.frames, replayFrame{raw: raw, after: c.total})
+	}
+	if server {
+		c.in = clientPreface
+	} else {
+		c.preface = len(clientPreface)
+	}
+	return c, nil
+}
+
+// Written returns the frames written to c so far, without any client
+// preface, as they would be on the wire.
+func (c *ReplayConn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.out...)
+}
+
+func (c *ReplayConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.in) == 0 {
+		if c.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if c.next == len(c.frames) {
+			if c.wrote >= c.total {
+				return 0, io.EOF
+			}
+		} else if f := c.frames[c.next]; c.wrote >= f.after {
+			c.in = f.raw
+			c.next++
+			break
+		}
+		c.cond.Wait()
+	}
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+func (c *ReplayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n := len(p)
+	if c.preface > 0 {
+		skip := c.preface
+		if skip > len(p) {
+			skip = len(p)
+		}
+		c.preface -= skip
+		p = p[skip:]
+	}
+	c.out = append(c.out, p...)
+	for len(c.out)-c.framed >= frameHeaderLen {
+		b := c.out[c.framed:]
+		size := frameHeaderLen + int(uint32(b[0])<<16|uint32(b[1])<<8|uint32(b[2]))
+		if len(b) < size {
+			break
+		}
+		c.framed += size
+		c.wrote++
+	}
+	c.cond.Broadcast()
+	return n, nil
+}
+
+// Close closes c, failing reads and writes, including those stalled
+// waiting for frames to be written.
+func (c *ReplayConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *ReplayConn) LocalAddr() net.Addr  { return replayAddr{} }
+func (c *ReplayConn) RemoteAddr() net.Addr { return replayAddr{} }
+
+// Deadlines are ignored; time doesn't pass in a replay.
+func (c *ReplayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *ReplayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *ReplayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
@@ -0,0 +1,120 @@
+// Copyright 2015 The Go Authors.
+// See https://go.googlesource.com/go/+/master/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://go.googlesource.com/go/+/master/LICENSE
+
+package http2
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// captureExchange makes a GET request to a Server answering "hello",
+// and returns the captures of the Transport's and Server's conns.
+func captureExchange(t *testing.T) (client, server []byte) {
+	serverCapture := &closeBuffer{closed: make(chan bool, 1)}
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}, optOnlyServer, func(s *Server) {
+		s.CaptureFrames = func(c net.Conn) io.Writer { return serverCapture }
+	})
+	defer st.Close()
+	clientCapture := &closeBuffer{closed: make(chan bool, 1)}
+	tr := &Transport{
+		InsecureTLSDial: true,
+		CaptureFrames:   func(c net.Conn) io.Writer { return clientCapture },
+	}
+	req, _ := http.NewRequest("GET", st.ts.URL+"/replayed", nil)
+	req.RequestURI = "/replayed"
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	tr.CloseIdleConnections()
+	for _, c := range []*closeBuffer{clientCapture, serverCapture} {
+		select {
+		case <-c.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("capture not closed")
+		}
+	}
+	return clientCapture.Bytes(), serverCapture.Bytes()
+}
+
+// writtenFrames returns the types of the frames in b on stream 1.
+func writtenFrames(b []byte) []FrameType {
+	fr := NewFramer(nil, bytes.NewReader(b))
+	var types []FrameType
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return types
+		}
+		if f.Header().StreamID == 1 {
+			types = append(types, f.Header().Type)
+		}
+	}
+}
+
+func TestReplayConn(t *testing.T) {
+	clientCapture, serverCapture := captureExchange(t)
+
+	for i := 0; i < 3; i++ {
+		rc, err := NewReplayConn(bytes.NewReader(clientCapture), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stall := time.AfterFunc(5*time.Second, func() { rc.Close() })
+		tr := &Transport{DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return rc, nil
+		}}
+		req, _ := http.NewRequest("GET", "https://example.com/replayed", nil)
+		req.RequestURI = "/replayed"
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("replaying client: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("replaying client got body %q; want %q", body, "hello")
+		}
+		if got := writtenFrames(rc.Written()); len(got) == 0 || got[0] != FrameHeaders {
+			t.Errorf("replaying client wrote %v on stream 1; want the request HEADERS", got)
+		}
+		stall.Stop()
+	}
+
+	rc, err := NewReplayConn(bytes.NewReader(serverCapture), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stall := time.AfterFunc(5*time.Second, func() { rc.Close() })
+	defer stall.Stop()
+	paths := make(chan string, 1)
+	srv := &Server{}
+	sc := srv.NewH2Conn(&http.Server{}, rc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		io.WriteString(w, "hello")
+	}))
+	sc.Serve()
+	if got := <-paths; got != "/replayed" {
+		t.Errorf("replaying server's handler got path %q; want %q", got, "/replayed")
+	}
+	if got := writtenFrames(rc.Written()); len(got) < 2 || got[0] != FrameHeaders || got[1] != FrameData {
+		t.Errorf("replaying server wrote %v on stream 1; want the response HEADERS and DATA", got)
+	}
+
+	if _, err := NewReplayConn(bytes.NewReader([]byte("junk")), false); err != errNotCapture {
+		t.Errorf("NewReplayConn of junk = %v; want %v", err, errNotCapture)
+	}
+}
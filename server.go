@@ -42,7 +42,9 @@ package http2
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -71,6 +73,12 @@ var (
 	errStreamBroken       = errors.New("http2: stream broken")
 )
 
+// ErrStreamReset is returned by writes to a Handler's ResponseWriter
+// once the client has reset the stream with RST_STREAM. The request's
+// context is canceled at the same time, with the client's StreamError
+// as its cause.
+var ErrStreamReset = errors.New("http2: stream reset by client")
+
 var responseWriterStatePool = sync.Pool{
 	New: func() interface{} {
 		rws := &responseWriterState{}
@@ -79,6 +87,11 @@ var responseWriterStatePool = sync.Pool{
 	},
 }
 
+// maxQueuedControlFrames is the most PING ACKs, WINDOW_UPDATEs, and
+// RST_STREAMs a server connection queues for a client that isn't
+// reading them before it gives up on the connection.
+const maxQueuedControlFrames = 10000
+
 // Test hooks.
 var (
 	testHookOnConn        func()
@@ -90,9 +103,11 @@ var (
 // Server is an HTTP/2 server.
 type Server struct {
 	// MaxHandlers limits the number of http.Handler ServeHTTP goroutines
-	// which may run at a time over all connections.
+	// which may run at a time over all connections. Streams that
+	// arrive while at the limit are refused with REFUSED_STREAM,
+	// which clients may safely retry.
 	// Negative or zero no limit.
-	// TODO: implement
+	// It must not be changed once the Server is in use.
 	MaxHandlers int
 
 	// MaxConcurrentStreams optionally specifies the number of
@@ -109,9 +124,160 @@ type Server struct {
 	// default value is used.
 	MaxReadFrameSize uint32
 
+	// MaxDecoderHeaderTableSize optionally specifies the size of
+	// the HPACK dynamic table used to decode request headers. It's
+	// advertised as SETTINGS_HEADER_TABLE_SIZE. If zero, the
+	// protocol's initial 4096 bytes is used.
+	MaxDecoderHeaderTableSize uint32
+
+	// MaxEncoderHeaderTableSize optionally caps the size of the
+	// HPACK dynamic table used to encode response headers. The
+	// client's SETTINGS_HEADER_TABLE_SIZE is honored up to this
+	// size. If zero, the protocol's initial 4096 bytes is used.
+	MaxEncoderHeaderTableSize uint32
+
+	// MaxHeaderListSize optionally specifies the largest decoded
+	// request header list the server accepts. It's advertised as
+	// SETTINGS_MAX_HEADER_LIST_SIZE. A request over it gets a 431
+	// (Request Header Fields Too Large) response instead of
+	// reaching the handler. If zero, the http.Server's
+	// MaxHeaderBytes is used, or http.DefaultMaxHeaderBytes if that's
+	// zero too.
+	MaxHeaderListSize uint32
+
+	// MaxUploadBufferPerConnection is the most request body data,
+	// over all of a connection's streams, that the server buffers
+	// before handlers read it. It sizes the connection's
+	// flow-control window, which can't be made smaller than the
+	// 65535 bytes every connection starts with. If zero, 65535 is
+	// used.
+	MaxUploadBufferPerConnection int32
+
+	// MaxUploadBufferPerStream is the most request body data that
+	// the server buffers for one stream before its handler reads
+	// it. It's advertised as SETTINGS_INITIAL_WINDOW_SIZE. If zero,
+	// 65535 is used.
+	MaxUploadBufferPerStream int32
+
 	// PermitProhibitedCipherSuites, if true, permits the use of
 	// cipher suites prohibited by the HTTP/2 spec.
 	PermitProhibitedCipherSuites bool
+
+	// MaxResetStreamRate is the most streams per second that a
+	// client may reset before the server has finished with them.
+	// Opening streams and immediately resetting them makes the
+	// server start handlers while the client never waits for a
+	// response (the "rapid reset" attack, CVE-2023-44487), so a
+	// connection exceeding the rate is sent a GOAWAY with
+	// ENHANCE_YOUR_CALM and closed. If zero, a default of 200 is
+	// used. If negative, there is no limit.
+	MaxResetStreamRate int
+
+	// IdleTimeout specifies how long a connection may go without
+	// open streams before the server sends it a GOAWAY and closes
+	// it. If zero, the http.Server's IdleTimeout is used. If both
+	// are zero, idle connections are kept open.
+	IdleTimeout time.Duration
+
+	// ReadTimeout bounds how long a client has to send a request's
+	// headers and body, counted from its first HEADERS frame. A
+	// stream still being read when it expires is reset with CANCEL,
+	// and the handler's body reads fail. If zero, the http.Server's
+	// ReadTimeout is used. If both are zero, there is no limit.
+	ReadTimeout time.Duration
+
+	// WriteTimeout bounds how long a handler has to write its
+	// response, counted from the request's first HEADERS frame. A
+	// stream still open when it expires is reset with CANCEL, and
+	// the handler's further writes fail. If zero, the
+	// http.Server's WriteTimeout is used. If both are zero, there
+	// is no limit.
+	WriteTimeout time.Duration
+
+	// SettingsAckTimeout is how long the server waits for the
+	// client to acknowledge a SETTINGS frame. A client that
+	// doesn't is sent a GOAWAY with SETTINGS_TIMEOUT and
+	// disconnected, as RFC 7540 section 6.5.3 allows. If zero, a
+	// default of 10 seconds is used.
+	SettingsAckTimeout time.Duration
+
+	// PushPreloads, if true, makes the server push the targets of
+	// a response's "Link: <target>; rel=preload" headers when it
+	// sends them, as if the handler had called Push for each. Links
+	// with the nopush parameter, or to another origin, are skipped,
+	// as are pushes the client has disabled with SETTINGS_ENABLE_PUSH.
+	PushPreloads bool
+
+	// MaxConcurrentPushes caps the pushed streams that PushPreloads
+	// may have open at once on a connection; preloads past it
+	// aren't pushed. If zero, 10 is used. Explicit Push calls are
+	// limited only by the client's SETTINGS_MAX_CONCURRENT_STREAMS.
+	MaxConcurrentPushes int
+
+	// SensitiveHeaders names response header fields, in addition
+	// to Set-Cookie, that are HPACK-encoded as never-indexed
+	// literals so that their values never enter the compression
+	// context shared with the client.
+	SensitiveHeaders []string
+
+	// UnknownFrameHandler, if non-nil, is called with each frame
+	// of a type this package doesn't implement, such as an
+	// experimental extension frame, that a client sends on c.
+	// Otherwise such frames are ignored, as the spec requires. It
+	// runs on the connection's serving goroutine, so it must not
+	// block, and the frame's payload is only valid until it
+	// returns. Use WriteRawFrame, from another goroutine, to reply.
+	UnknownFrameHandler func(c net.Conn, f *UnknownFrame)
+
+	// Grease, if true, adds a reserved SETTINGS identifier and a
+	// frame of a reserved type to the connection preface, as
+	// browsers do, so clients and middleboxes that wrongly reject
+	// unknown settings or frames get caught early.
+	Grease bool
+
+	// CaptureFrames, if non-nil, is called with each new
+	// connection and may return a writer for a FrameCapture of
+	// the connection's frames, as Transport.CaptureFrames does for
+	// clients. The writer is closed, if it's an io.Closer, once
+	// the connection is.
+	CaptureFrames func(c net.Conn) io.Writer
+
+	// Faults, if non-nil, injects faults into each connection's
+	// frames, for testing how clients cope with a misbehaving
+	// server. It's not for production use.
+	Faults FaultInjector
+
+	// Clock, if non-nil, replaces the real clock for the Server's
+	// timeouts, for tests and simulations.
+	Clock Clock
+
+	// Padding, if non-nil, chooses how much padding to add to
+	// each response DATA and HEADERS frame. Padding is dropped
+	// from a frame it wouldn't fit in. See FixedPadding and
+	// RandomPadding.
+	Padding PaddingPolicy
+
+	// OnStreamOpen and OnStreamClose, if non-nil, are called as
+	// each request's stream, or each pushed stream, opens and
+	// closes, as for access logs. OnStreamOpen is called just
+	// before the stream's handler starts. Streams refused before
+	// then aren't reported. Both run on the connection's serving
+	// goroutine, so they must not block.
+	OnStreamOpen  func(s StreamStats)
+	OnStreamClose func(s StreamStats)
+
+	handlersOnce sync.Once
+	handlers     chan struct{} // semaphore of MaxHandlers slots
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]*serverConn // being served; for DrainConn
+}
+
+func (s *Server) clock() Clock {
+	if s.Clock != nil {
+		return s.Clock
+	}
+	return realClock{}
 }
 
 func (s *Server) maxReadFrameSize() uint32 {
@@ -121,6 +287,186 @@ func (s *Server) maxReadFrameSize() uint32 {
 	return defaultMaxReadFrameSize
 }
 
+func (s *Server) maxDecoderHeaderTableSize() uint32 {
+	if v := s.MaxDecoderHeaderTableSize; v > 0 {
+		return v
+	}
+	return initialHeaderTableSize
+}
+
+func (s *Server) maxEncoderHeaderTableSize() uint32 {
+	if v := s.MaxEncoderHeaderTableSize; v > 0 {
+		return v
+	}
+	return initialHeaderTableSize
+}
+
+func (s *Server) maxUploadBufferPerConnection() int32 {
+	if v := s.MaxUploadBufferPerConnection; v > initialWindowSize {
+		return v
+	}
+	return initialWindowSize
+}
+
+func (s *Server) maxUploadBufferPerStream() int32 {
+	if v := s.MaxUploadBufferPerStream; v > 0 {
+		return v
+	}
+	return initialWindowSize
+}
+
+func (s *Server) maxResetStreamRate() int {
+	if s.MaxResetStreamRate == 0 {
+		return 200
+	}
+	return s.MaxResetStreamRate
+}
+
+func (s *Server) settingsAckTimeout() time.Duration {
+	if s.SettingsAckTimeout > 0 {
+		return s.SettingsAckTimeout
+	}
+	return 10 * time.Second
+}
+
+func (s *Server) idleTimeout(hs *http.Server) time.Duration {
+	if s.IdleTimeout != 0 {
+		return s.IdleTimeout
+	}
+	if hs != nil {
+		return hs.IdleTimeout
+	}
+	return 0
+}
+
+func (s *Server) readTimeout(hs *http.Server) time.Duration {
+	if s.ReadTimeout != 0 {
+		return s.ReadTimeout
+	}
+	if hs != nil {
+		return hs.ReadTimeout
+	}
+	return 0
+}
+
+func (s *Server) writeTimeout(hs *http.Server) time.Duration {
+	if s.WriteTimeout != 0 {
+		return s.WriteTimeout
+	}
+	if hs != nil {
+		return hs.WriteTimeout
+	}
+	return 0
+}
+
+// acquireHandler reserves one of the MaxHandlers slots for a handler
+// goroutine, reporting whether one was free.
+func (s *Server) acquireHandler() bool {
+	if s.MaxHandlers <= 0 {
+		return true
+	}
+	s.handlersOnce.Do(func() {
+		s.handlers = make(chan struct{}, s.MaxHandlers)
+	})
+	select {
+	case s.handlers <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseHandler frees a slot taken by acquireHandler.
+func (s *Server) releaseHandler() {
+	if s.MaxHandlers > 0 {
+		<-s.handlers
+	}
+}
+
+// trackConn adds or removes sc from the conns that DrainConn can find.
+func (s *Server) trackConn(sc *serverConn, add bool) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if add {
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]*serverConn)
+		}
+		s.conns[sc.conn] = sc
+	} else {
+		delete(s.conns, sc.conn)
+	}
+}
+
+// DrainConn gracefully closes c, a connection being served by s,
+// without affecting its other connections. The client is sent a
+// GOAWAY, so it opens no new streams there, and the streams it
+// already has are left to finish before the connection is closed. If
+// they haven't finished within timeout, the connection is closed
+// anyway. A timeout of zero means no limit.
+//
+// The net.Conn is the one passed to the http.Server's ConnState
+// hook. DrainConn reports whether c was being served.
+func (s *Server) DrainConn(c net.Conn, timeout time.Duration) bool {
+	sc := s.serverConn(c)
+	if sc == nil {
+		return false
+	}
+	select {
+	case sc.drainCh <- timeout:
+	case <-sc.doneServing:
+	}
+	return true
+}
+
+// errNotServing is returned by WriteRawFrame for a connection
+// that isn't being served.
+var errNotServing = errors.New("http2: connection not being served")
+
+// WriteRawFrame writes a frame of a type this package doesn't
+// implement, such as an experimental extension frame, on c, a
+// connection being served by s. It's written in turn with the
+// connection's other frames, and WriteRawFrame returns once it has
+// been. Frame types the package implements are rejected, since
+// writing them behind its back would corrupt the connection's state.
+//
+// The net.Conn is the one passed to UnknownFrameHandler or to the
+// http.Server's ConnState hook. WriteRawFrame must not be called
+// from UnknownFrameHandler itself.
+func (s *Server) WriteRawFrame(c net.Conn, t FrameType, flags Flags, streamID uint32, payload []byte) error {
+	if _, ok := frameParsers[t]; ok {
+		return fmt.Errorf("http2: WriteRawFrame of known frame type %v", t)
+	}
+	sc := s.serverConn(c)
+	if sc == nil {
+		return errNotServing
+	}
+	done := make(chan error, 1)
+	sc.writeFrameFromHandler(frameWriteMsg{
+		write: &writeRawFrame{t, flags, streamID, append([]byte(nil), payload...)},
+		done:  done,
+	})
+	select {
+	case err := <-done:
+		return err
+	case <-sc.doneServing:
+		return errClientDisconnected
+	}
+}
+
+// serverConn returns the serverConn serving c, or nil.
+func (s *Server) serverConn(c net.Conn) *serverConn {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return s.conns[c]
+}
+
+func (s *Server) maxConcurrentPushes() uint32 {
+	if s.MaxConcurrentPushes > 0 {
+		return uint32(s.MaxConcurrentPushes)
+	}
+	return 10
+}
+
 func (s *Server) maxConcurrentStreams() uint32 {
 	if v := s.MaxConcurrentStreams; v > 0 {
 		return v
@@ -214,23 +560,39 @@ func (srv *Server) NewH2Conn(hs *http.Server, c net.Conn, h http.Handler) *serve
 		wantWriteFrameCh: make(chan frameWriteMsg, 64),
 		wroteFrameCh:     make(chan struct{}, 1), // buffered; one send in reading goroutine
 		bodyReadCh:       make(chan bodyReadMsg), // buffering doesn't matter either way
+		resetStreamCh:    make(chan StreamError),
+		streamTimeoutCh:  make(chan streamTimeout),
+		drainCh:          make(chan time.Duration),
+		wantStartPushCh:  make(chan startPushMsg),
+		clientMaxStreams: 1<<32 - 1, // unlimited until their SETTINGS say otherwise
 		doneServing:      make(chan struct{}),
 		advMaxStreams:    srv.maxConcurrentStreams(),
+		idleTimeout:      srv.idleTimeout(hs),
+		readTimeout:      srv.readTimeout(hs),
+		writeTimeout:     srv.writeTimeout(hs),
+		resetStreams:     frameRateLimiter{max: srv.maxResetStreamRate()},
 		writeSched: writeScheduler{
 			maxFrameSize: initialMaxFrameSize,
+			padding:      srv.Padding,
 		},
 		initialWindowSize: initialWindowSize,
 		headerTableSize:   initialHeaderTableSize,
 		serveG:            newGoroutineLock(),
 		pushEnabled:       true,
 	}
+	sc.baseCtx, sc.cancelCtx = serverConnBaseContext(c, hs)
 	sc.flow.add(initialWindowSize)
 	sc.inflow.add(initialWindowSize)
 	sc.hpackEncoder = hpack.NewEncoder(&sc.headerWriteBuf)
-	sc.hpackDecoder = hpack.NewDecoder(initialHeaderTableSize, sc.onNewHeaderField)
+	sc.hpackEncoder.SetMaxDynamicTableSizeLimit(srv.maxEncoderHeaderTableSize())
+	sc.hpackEncoder.SetSensitive(sensitiveFunc(srv.SensitiveHeaders))
+	sc.hpackDecoder = hpack.NewDecoder(srv.maxDecoderHeaderTableSize(), sc.onNewHeaderField)
+	sc.hpackDecoder.SetMaxStringLength(int(sc.advMaxHeaderListSize()))
 
 	fr := NewFramer(sc.bw, c)
 	fr.SetMaxReadFrameSize(srv.maxReadFrameSize())
+	fr.SetFaultInjector(srv.Faults)
+	fr.clock = srv.clock()
 	sc.framer = fr
 
 	if tc, ok := c.(*tls.Conn); ok {
@@ -279,6 +641,9 @@ func (srv *Server) NewH2Conn(hs *http.Server, c net.Conn, h http.Handler) *serve
 		}
 	}
 
+	sc.capture = newConnCapture(srv.CaptureFrames, c, srv.clock())
+	fr.SetFrameCapture(sc.capture)
+
 	if hook := testHookGetServerConn; hook != nil {
 		hook(sc)
 	}
@@ -286,6 +651,124 @@ func (srv *Server) NewH2Conn(hs *http.Server, c net.Conn, h http.Handler) *serve
 	return sc
 }
 
+// serverConnBaseContext returns the context for a new connection c,
+// carrying the same values that net/http gives HTTP/1 requests. It's
+// canceled when the connection is closed.
+func serverConnBaseContext(c net.Conn, hs *http.Server) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, http.ServerContextKey, hs)
+	ctx = context.WithValue(ctx, http.LocalAddrContextKey, c.LocalAddr())
+	return ctx, cancel
+}
+
+// StreamInfo describes the stream and connection that a request to
+// a Server arrived on.
+type StreamInfo struct {
+	StreamID uint32
+
+	// NegotiatedProtocol is the protocol agreed with the client
+	// by ALPN, or empty if the connection isn't TLS.
+	NegotiatedProtocol string
+
+	// PeerCertificates are the certificates presented by the
+	// client, if any.
+	PeerCertificates []*x509.Certificate
+}
+
+type streamInfoKey struct{}
+
+// StreamInfoFromContext returns the StreamInfo for the request whose
+// context is ctx, and whether there was one.
+//
+// A request's context is canceled when the client resets its
+// stream, when the connection is lost, or once the response has
+// been sent. If the client reset the stream, context.Cause reports
+// the StreamError carrying its error code.
+func StreamInfoFromContext(ctx context.Context) (StreamInfo, bool) {
+	si, ok := ctx.Value(streamInfoKey{}).(StreamInfo)
+	return si, ok
+}
+
+// Priority is a client's priority signal for a request's stream.
+// Clients send it in either or both of two schemes: the dependency
+// tree of RFC 7540, set by HEADERS and PRIORITY frames, and the
+// Priority header of RFC 9218.
+type Priority struct {
+	// PriorityParam is the stream's place in the dependency tree.
+	// If the client never set it, its Weight is 15 (that is, 16).
+	PriorityParam
+
+	// Urgency, from 0 (most urgent) to 7, and Incremental, whether
+	// the response is useful in pieces, come from the Priority
+	// header. Without one, they're 3 and false.
+	Urgency     int
+	Incremental bool
+}
+
+var defaultPriority = Priority{
+	PriorityParam: PriorityParam{Weight: 15},
+	Urgency:       3,
+}
+
+// streamPriority is a stream's Priority, written by the serve
+// goroutine and read by handlers through PriorityFromContext.
+type streamPriority struct {
+	mu sync.Mutex
+	p  Priority
+}
+
+func (sp *streamPriority) get() Priority {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.p
+}
+
+func (sp *streamPriority) set(p Priority) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.p = p
+}
+
+type priorityKey struct{}
+
+// PriorityFromContext returns the client's priority for the request
+// whose context is ctx, and whether there was one. The client may
+// change it with PRIORITY frames while the request is being served,
+// so a proxy passing it upstream may want to check again later.
+func PriorityFromContext(ctx context.Context) (Priority, bool) {
+	sp, ok := ctx.Value(priorityKey{}).(*streamPriority)
+	if !ok {
+		return Priority{}, false
+	}
+	return sp.get(), true
+}
+
+// parsePriorityHeader updates p from v, the value of an RFC 9218
+// Priority header: a structured-field dictionary such as "u=1, i".
+// Unknown and malformed members are ignored, as the RFC requires.
+func parsePriorityHeader(p *Priority, v string) {
+	for _, m := range strings.Split(v, ",") {
+		m = strings.TrimSpace(m)
+		if i := strings.IndexByte(m, ';'); i >= 0 {
+			m = m[:i] // parameters; none are defined
+		}
+		k, val, hasVal := strings.Cut(m, "=")
+		switch k {
+		case "u":
+			if u, err := strconv.Atoi(val); err == nil && hasVal && u >= 0 && u <= 7 {
+				p.Urgency = u
+			}
+		case "i":
+			switch {
+			case !hasVal, val == "?1":
+				p.Incremental = true
+			case val == "?0":
+				p.Incremental = false
+			}
+		}
+	}
+}
+
 // isBadCipher reports whether the cipher is blacklisted by the HTTP/2 spec.
 func isBadCipher(cipher uint16) bool {
 	switch cipher {
@@ -324,8 +807,9 @@ func (sc *serverConn) rejectConn(err ErrCode, debug string) {
 // blocks until it has a frame, passes it to serve, and then waits for
 // serve to be done with it before reading the next one.
 type frameAndGate struct {
-	f Frame
-	g gate
+	f   Frame
+	g   gate
+	err error // a stream-level FrameError instead of f
 }
 
 type serverConn struct {
@@ -336,6 +820,7 @@ type serverConn struct {
 	bw               *bufferedWriter // writing to conn
 	handler          http.Handler
 	framer           *Framer
+	capture          *FrameCapture // per Server.CaptureFrames, or nil
 	hpackDecoder     *hpack.Decoder
 	doneServing      chan struct{}     // closed when serverConn.serve ends
 	readFrameCh      chan frameAndGate // written by serverConn.readFrames
@@ -343,22 +828,32 @@ type serverConn struct {
 	wantWriteFrameCh chan frameWriteMsg   // from handlers -> serve
 	wroteFrameCh     chan struct{}        // from writeFrameAsync -> serve, tickles more frame writes
 	bodyReadCh       chan bodyReadMsg     // from handlers -> serve
+	resetStreamCh    chan StreamError     // from handlers -> serve
+	streamTimeoutCh  chan streamTimeout   // from stream timers -> serve
+	drainCh          chan time.Duration   // from Server.DrainConn -> serve
+	wantStartPushCh  chan startPushMsg    // from handlers -> serve
 	testHookCh       chan func()          // code to run on the serve loop
 	flow             flow                 // conn-wide (not stream-specific) outbound flow control
 	inflow           flow                 // conn-wide inbound flow control
 	tlsState         *tls.ConnectionState // shared by all handlers, like net/http
 	remoteAddrStr    string
+	baseCtx          context.Context // parent of each stream's context
+	cancelCtx        context.CancelFunc
 
 	// Everything following is owned by the serve loop; use serveG.check():
 	serveG                goroutineLock // used to verify funcs are on serve()
 	pushEnabled           bool
 	sawFirstSettings      bool // got the initial SETTINGS frame after the preface
 	needToSendSettingsAck bool
-	unackedSettings       int    // how many SETTINGS have we sent without ACKs?
-	clientMaxStreams      uint32 // SETTINGS_MAX_CONCURRENT_STREAMS from client (our PUSH_PROMISE limit)
-	advMaxStreams         uint32 // our SETTINGS_MAX_CONCURRENT_STREAMS advertised the client
-	curOpenStreams        uint32 // client's number of open streams
-	maxStreamID           uint32 // max ever seen
+	unackedSettings       int              // how many SETTINGS have we sent without ACKs?
+	settingsAckTimer      Timer            // nil until SETTINGS are sent
+	settingsAckTimerCh    <-chan time.Time // nil while no SETTINGS are unacknowledged
+	clientMaxStreams      uint32           // SETTINGS_MAX_CONCURRENT_STREAMS from client (our PUSH_PROMISE limit)
+	advMaxStreams         uint32           // our SETTINGS_MAX_CONCURRENT_STREAMS advertised the client
+	curOpenStreams        uint32           // client's number of open streams
+	curPushedStreams      uint32           // number of open streams we've pushed
+	maxPushPromiseID      uint32           // ID of the last stream we pushed, or 0
+	maxStreamID           uint32           // max ever seen
 	streams               map[uint32]*stream
 	initialWindowSize     int32
 	headerTableSize       uint32
@@ -370,9 +865,15 @@ type serverConn struct {
 	writeSched            writeScheduler
 	inGoAway              bool // we've started to or sent GOAWAY
 	needToSendGoAway      bool // we need to schedule a GOAWAY frame write
+	draining              bool // GOAWAY was from drain; open streams may finish
 	goAwayCode            ErrCode
 	shutdownTimerCh       <-chan time.Time // nil until used
-	shutdownTimer         *time.Timer      // nil until used
+	shutdownTimer         Timer            // nil until used
+	idleTimeout           time.Duration    // zero if idle conns are kept
+	idleTimer             Timer            // nil if idleTimeout is zero
+	readTimeout           time.Duration    // per stream; zero means none
+	writeTimeout          time.Duration    // per stream; zero means none
+	resetStreams          frameRateLimiter // client resets of open streams
 
 	// Owned by the writeFrameAsync goroutine:
 	headerWriteBuf bytes.Buffer
@@ -389,8 +890,15 @@ type requestParam struct {
 	header            http.Header
 	method, path      string
 	scheme, authority string
-	sawRegularHeader  bool // saw a non-pseudo header already
-	invalidHeader     bool // an invalid header was seen
+	protocol          string // extended CONNECT (RFC 8441) :protocol
+	sawRegularHeader  bool   // saw a non-pseudo header already
+	invalidHeader     bool   // an invalid header was seen
+	headerListSize    uint32 // decoded size of fields seen so far
+
+	// headerListTooLarge is whether the header list went over
+	// advMaxHeaderListSize. The fields past that are dropped, and
+	// the request is answered with a 431.
+	headerListTooLarge bool
 }
 
 func (rp *requestParam) isValid() bool {
@@ -401,6 +909,12 @@ func (rp *requestParam) isValid() bool {
 	if rp.invalidHeader {
 		return false
 	}
+	if rp.protocol != "" {
+		// RFC 8441 section 4: an extended CONNECT request
+		// carries :scheme and :path like any other request.
+		return rp.method == "CONNECT" && rp.path != "" && rp.authority != "" &&
+			(rp.scheme == "https" || rp.scheme == "http")
+	}
 	if rp.method == "CONNECT" {
 		return rp.scheme == "" && (isHostPort(rp.path) || (rp.path == "" && isHostPort(rp.authority)))
 	}
@@ -413,7 +927,7 @@ func isHostPort(str string) bool {
 }
 
 func (rp *requestParam) parseURL() (u *url.URL, err error) {
-	if rp.method == "CONNECT" {
+	if rp.method == "CONNECT" && rp.protocol == "" {
 		return &url.URL{
 			Host:   rp.authority,
 			Scheme: rp.scheme,
@@ -441,20 +955,34 @@ func (rp *requestParam) parseURL() (u *url.URL, err error) {
 // responseWriter's state field.
 type stream struct {
 	// immutable:
-	id   uint32
-	body *pipe       // non-nil if expecting DATA frames
-	cw   closeWaiter // closed wait stream transitions to closed state
+	id        uint32
+	body      *pipe       // non-nil if expecting DATA frames
+	cw        closeWaiter // closed wait stream transitions to closed state
+	ctx       context.Context
+	cancelCtx context.CancelCauseFunc // called when stream transitions to closed state
 
 	// owned by serverConn's serve loop:
-	bodyBytes     int64   // body bytes seen so far
-	declBodyBytes int64   // or -1 if undeclared
-	flow          flow    // limits writing from Handler to client
-	inflow        flow    // what the client is allowed to POST/etc to us
-	parent        *stream // or nil
-	weight        uint8
+	bodyBytes     int64 // body bytes seen so far
+	declBodyBytes int64 // or -1 if undeclared
+	flow          flow  // limits writing from Handler to client
+	inflow        flow  // what the client is allowed to POST/etc to us
+	urgency       int   // per the Priority header; lower goes first
 	state         streamState
 	sentReset     bool // only true once detached from streams map
 	gotReset      bool // only true once detacted from streams map
+
+	// Timers for Server.ReadTimeout and WriteTimeout, or nil:
+	readTimer  Timer
+	writeTimer Timer
+
+	// For Server.OnStreamOpen and OnStreamClose; method is empty
+	// until the handler starts:
+	method, authority string
+	start             time.Time
+	status            int
+	bytesOut          int64
+
+	prio streamPriority // for PriorityFromContext
 }
 
 func (sc *serverConn) Framer() *Framer  { return sc.framer }
@@ -463,6 +991,9 @@ func (sc *serverConn) Flush() error     { return sc.bw.Flush() }
 func (sc *serverConn) HeaderEncoder() (*hpack.Encoder, *bytes.Buffer) {
 	return sc.hpackEncoder, &sc.headerWriteBuf
 }
+func (sc *serverConn) Padding() PaddingPolicy {
+	return sc.srv.Padding
+}
 
 func (sc *serverConn) state(streamID uint32) (streamState, *stream) {
 	sc.serveG.check()
@@ -476,7 +1007,11 @@ func (sc *serverConn) state(streamID uint32) (streamState, *stream) {
 	// a client sends a HEADERS frame on stream 7 without ever sending a
 	// frame on stream 5, then stream 5 transitions to the "closed"
 	// state when the first frame for stream 7 is sent or received."
-	if streamID <= sc.maxStreamID {
+	maxID := sc.maxStreamID
+	if streamID%2 == 0 {
+		maxID = sc.maxPushPromiseID // streams we push are even
+	}
+	if streamID <= maxID {
 		return stateClosed, nil
 	}
 	return stateIdle, nil
@@ -512,6 +1047,17 @@ func (sc *serverConn) condlogf(err error, format string, args ...interface{}) {
 func (sc *serverConn) onNewHeaderField(f hpack.HeaderField) {
 	sc.serveG.check()
 	sc.vlogf("got header field %+v", f)
+	// Bound what a small, heavily compressed header block can
+	// expand to. The rest of the block is still decoded, to keep
+	// the dynamic table in sync, but not materialized.
+	size := f.Size()
+	if limit := sc.advMaxHeaderListSize(); size > limit-sc.req.headerListSize {
+		sc.logf("request header list larger than %d bytes", limit)
+		sc.req.headerListTooLarge = true
+		sc.hpackDecoder.SetEmitEnabled(false)
+		return
+	}
+	sc.req.headerListSize += size
 	switch {
 	case !validHeader(f.Name):
 		sc.req.invalidHeader = true
@@ -531,6 +1077,8 @@ func (sc *serverConn) onNewHeaderField(f hpack.HeaderField) {
 			dst = &sc.req.scheme
 		case ":authority":
 			dst = &sc.req.authority
+		case ":protocol":
+			dst = &sc.req.protocol
 		default:
 			// 8.1.2.1 Pseudo-Header Fields
 			// "Endpoints MUST treat a request or response
@@ -560,6 +1108,20 @@ func (sc *serverConn) onNewHeaderField(f hpack.HeaderField) {
 	}
 }
 
+// advMaxHeaderListSize returns the largest decoded request header list,
+// per Server.MaxHeaderListSize or http.Server.MaxHeaderBytes, that sc
+// accepts.
+func (sc *serverConn) advMaxHeaderListSize() uint32 {
+	if v := sc.srv.MaxHeaderListSize; v > 0 {
+		return v
+	}
+	n := http.DefaultMaxHeaderBytes
+	if sc.hs != nil && sc.hs.MaxHeaderBytes > 0 {
+		n = sc.hs.MaxHeaderBytes
+	}
+	return uint32(n)
+}
+
 func (sc *serverConn) canonicalHeader(v string) string {
 	sc.serveG.check()
 	cv, ok := commonCanonHeader[v]
@@ -586,12 +1148,20 @@ func (sc *serverConn) readFrames() {
 	g := make(gate, 1)
 	for {
 		f, err := sc.framer.ReadFrame()
+		fg := frameAndGate{f: f, g: g}
+		if fe, ok := err.(FrameError); ok {
+			if _, ok := fe.Err.(StreamError); ok {
+				// Only the stream is broken; the frame
+				// was read in full and we can go on.
+				fg.err, err = fe, nil
+			}
+		}
 		if err != nil {
 			sc.readFrameErrCh <- err
 			return
 		}
 		select {
-		case sc.readFrameCh <- frameAndGate{f, g}:
+		case sc.readFrameCh <- fg:
 		case <-sc.doneServing:
 			// serve loop ended due to invalid hpack encoding,
 			// settings timeout, goaway timeout, etc.
@@ -654,34 +1224,64 @@ func (sc *serverConn) notePanic() {
 func (sc *serverConn) Serve() {
 	sc.serveG.check()
 	defer sc.notePanic()
+	defer sc.capture.close()
 	defer sc.conn.Close()
+	defer sc.cancelCtx()
 	defer sc.closeAllStreamsOnConnClose()
 	defer sc.stopShutdownTimer()
+	defer sc.stopSettingsAckTimer()
 	defer close(sc.doneServing) // unblocks handlers trying to send
 
+	sc.srv.trackConn(sc, true)
+	defer sc.srv.trackConn(sc, false)
+
 	sc.vlogf("HTTP/2 connection from %v on %p", sc.conn.RemoteAddr(), sc.hs)
 
-	sc.writeFrame(frameWriteMsg{
-		write: writeSettings{
-			{SettingMaxFrameSize, sc.srv.maxReadFrameSize()},
-			{SettingMaxConcurrentStreams, sc.advMaxStreams},
-
-			// TODO: more actual settings, notably
-			// SettingInitialWindowSize, but then we also
-			// want to bump up the conn window size the
-			// same amount here right after the settings
-		},
-	})
-	sc.unackedSettings++
+	settings := writeSettings{
+		{SettingMaxFrameSize, sc.srv.maxReadFrameSize()},
+		{SettingHeaderTableSize, sc.srv.maxDecoderHeaderTableSize()},
+		{SettingMaxConcurrentStreams, sc.advMaxStreams},
+		{SettingMaxHeaderListSize, sc.advMaxHeaderListSize()},
+		{SettingEnableConnectProtocol, 1},
+		{SettingInitialWindowSize, uint32(sc.srv.maxUploadBufferPerStream())},
+	}
+	if sc.srv.Grease {
+		settings = append(settings, greaseSetting())
+	}
+	sc.writeSettings(settings)
+	if sc.srv.Grease {
+		typ, payload := greaseFrame()
+		sc.writeFrame(frameWriteMsg{write: &writeRawFrame{typ: typ, payload: payload}})
+	}
+
+	// SETTINGS can't change the connection's window, so grow
+	// it from the initial size with a WINDOW_UPDATE.
+	if diff := sc.srv.maxUploadBufferPerConnection() - initialWindowSize; diff > 0 {
+		sc.sendWindowUpdate(nil, int(diff))
+	}
 
 	if err := sc.readPreface(); err != nil {
 		sc.condlogf(err, "error reading preface from client %v: %v", sc.conn.RemoteAddr(), err)
 		return
 	}
 
+	// net/http bounds the TLS handshake with deadlines from the
+	// http.Server's ReadTimeout and WriteTimeout, which we apply
+	// per stream instead.
+	sc.conn.SetReadDeadline(time.Time{})
+	sc.conn.SetWriteDeadline(time.Time{})
+
 	go sc.readFrames() // closed by defer sc.conn.Close above
 
-	settingsTimer := time.NewTimer(firstSettingsTimeout)
+	var idleTimerCh <-chan time.Time
+	if sc.idleTimeout != 0 {
+		sc.idleTimer = sc.srv.clock().NewTimer(sc.idleTimeout)
+		defer sc.idleTimer.Stop()
+		idleTimerCh = sc.idleTimer.C()
+	}
+
+	settingsTimer := sc.srv.clock().NewTimer(firstSettingsTimeout)
+	settingsTimerCh := settingsTimer.C()
 	for {
 		select {
 		case wm := <-sc.wantWriteFrameCh:
@@ -699,21 +1299,52 @@ func (sc *serverConn) Serve() {
 			if !sc.processFrameFromReader(fg, ok) {
 				return
 			}
-			if settingsTimer.C != nil {
+			if sc.writeSched.controlFrames > maxQueuedControlFrames {
+				// The client keeps sending frames that
+				// need replies but isn't reading them.
+				sc.logf("too many control frames queued for %v; closing conn", sc.conn.RemoteAddr())
+				return
+			}
+			if settingsTimerCh != nil {
 				settingsTimer.Stop()
-				settingsTimer.C = nil
+				settingsTimerCh = nil
 			}
 		case m := <-sc.bodyReadCh:
 			sc.noteBodyRead(m.st, m.n)
-		case <-settingsTimer.C:
+		case se := <-sc.resetStreamCh:
+			if _, ok := sc.streams[se.StreamID]; ok {
+				sc.resetStream(se)
+			}
+		case m := <-sc.streamTimeoutCh:
+			sc.processStreamTimeout(m)
+		case <-settingsTimerCh:
 			sc.logf("timeout waiting for SETTINGS frames from %v", sc.conn.RemoteAddr())
 			return
+		case <-sc.settingsAckTimerCh:
+			sc.logf("timeout waiting for SETTINGS ACK from %v", sc.conn.RemoteAddr())
+			sc.settingsAckTimerCh = nil
+			sc.goAway(ErrCodeSettingsTimeout)
 		case <-sc.shutdownTimerCh:
 			sc.vlogf("GOAWAY close timer fired; closing conn from %v", sc.conn.RemoteAddr())
 			return
+		case <-idleTimerCh:
+			// The timer may have fired just as a stream
+			// opened.
+			if sc.curOpenStreams+sc.curPushedStreams == 0 {
+				sc.vlogf("connection from %v is idle; sending GOAWAY", sc.conn.RemoteAddr())
+				sc.goAway(ErrCodeNo)
+			}
+		case d := <-sc.drainCh:
+			sc.drain(d)
+		case msg := <-sc.wantStartPushCh:
+			sc.startPush(msg)
 		case fn := <-sc.testHookCh:
 			fn()
 		}
+		if sc.draining && sc.drained() {
+			sc.vlogf("connection from %v drained; closing", sc.conn.RemoteAddr())
+			return
+		}
 	}
 }
 
@@ -732,10 +1363,10 @@ func (sc *serverConn) readPreface() error {
 			errc <- nil
 		}
 	}()
-	timer := time.NewTimer(prefaceTimeout) // TODO: configurable on *Server?
+	timer := sc.srv.clock().NewTimer(prefaceTimeout) // TODO: configurable on *Server?
 	defer timer.Stop()
 	select {
-	case <-timer.C:
+	case <-timer.C():
 		return errors.New("timeout waiting for client preface")
 	case err := <-errc:
 		if err == nil {
@@ -758,6 +1389,12 @@ func (sc *serverConn) readPreface() error {
 // the total amount of bytes waiting to be sent and can can have more
 // scheduling decisions available.
 func (sc *serverConn) writeDataFromHandler(stream *stream, writeData *writeData, ch chan error) error {
+	select {
+	case <-stream.cw:
+		// Don't bother queueing it; the stream's gone.
+		return stream.writeErr()
+	default:
+	}
 	sc.writeFrameFromHandler(frameWriteMsg{
 		write:  writeData,
 		stream: stream,
@@ -769,7 +1406,20 @@ func (sc *serverConn) writeDataFromHandler(stream *stream, writeData *writeData,
 	case <-sc.doneServing:
 		return errClientDisconnected
 	case <-stream.cw:
-		return errStreamBroken
+		// The frame is being written, or was or will be
+		// dropped by the scheduler, and either way ch hears
+		// about it. The caller reuses writeData, so wait.
+		select {
+		case err := <-ch:
+			if stream.gotReset || stream.sentReset {
+				return stream.writeErr()
+			}
+			// We closed it ourselves, on starting to
+			// write this frame's END_STREAM.
+			return err
+		case <-sc.doneServing:
+			return errClientDisconnected
+		}
 	}
 }
 
@@ -821,14 +1471,35 @@ func (sc *serverConn) startFrameWrite(wm frameWriteMsg) {
 		case stateClosed:
 			if st.sentReset || st.gotReset {
 				// Skip this frame. But fake the frame write to reschedule:
+				wm.dropped()
 				sc.wroteFrameCh <- struct{}{}
 				return
 			}
 			panic(fmt.Sprintf("internal error: attempt to send a write %v on a closed stream", wm))
 		}
 	}
+	if wpp, ok := wm.write.(*writePushPromise); ok {
+		var err error
+		wpp.promisedID, err = wpp.allocatePromisedID()
+		if err != nil {
+			// Skip this frame, like above, but tell the pusher why.
+			if wm.done != nil {
+				wm.done <- err
+			}
+			sc.wroteFrameCh <- struct{}{}
+			return
+		}
+	}
 
 	sc.needsFrameFlush = true
+	switch w := wm.write.(type) {
+	case *writeData:
+		st.bytesOut += int64(len(w.p))
+	case *writeResHeaders:
+		if w.httpResCode >= 200 {
+			st.status = w.httpResCode
+		}
+	}
 	if endsStream(wm.write) {
 		if st == nil {
 			panic("internal error: expecting non-nil stream")
@@ -885,7 +1556,7 @@ func (sc *serverConn) scheduleFrameWrite() {
 		sc.startFrameWrite(frameWriteMsg{write: writeSettingsAck{}})
 		return
 	}
-	if !sc.inGoAway {
+	if !sc.inGoAway || sc.draining {
 		if wm, ok := sc.writeSched.take(); ok {
 			sc.startFrameWrite(wm)
 			return
@@ -915,10 +1586,46 @@ func (sc *serverConn) goAway(code ErrCode) {
 	sc.scheduleFrameWrite()
 }
 
+// drain sends a GOAWAY like goAway, but keeps writing frames for the
+// streams already open, closing the conn once they're done or after
+// timeout, whichever is first. A zero timeout means no limit.
+func (sc *serverConn) drain(timeout time.Duration) {
+	sc.serveG.check()
+	if sc.inGoAway {
+		return
+	}
+	if timeout > 0 {
+		sc.shutDownIn(timeout)
+	}
+	sc.inGoAway = true
+	sc.draining = true
+	sc.needToSendGoAway = true
+	sc.goAwayCode = ErrCodeNo
+	sc.scheduleFrameWrite()
+}
+
+// drained reports whether a draining conn has no more streams open
+// and nothing left to write.
+func (sc *serverConn) drained() bool {
+	sc.serveG.check()
+	return sc.curOpenStreams+sc.curPushedStreams == 0 && !sc.writingFrame && !sc.needToSendGoAway &&
+		!sc.needsFrameFlush && sc.writeSched.empty()
+}
+
 func (sc *serverConn) shutDownIn(d time.Duration) {
 	sc.serveG.check()
-	sc.shutdownTimer = time.NewTimer(d)
-	sc.shutdownTimerCh = sc.shutdownTimer.C
+	sc.shutdownTimer = sc.srv.clock().NewTimer(d)
+	sc.shutdownTimerCh = sc.shutdownTimer.C()
+}
+
+// resetStreamFromHandler asks the serve goroutine to reset a
+// stream, if it's still open.
+func (sc *serverConn) resetStreamFromHandler(se StreamError) {
+	sc.serveG.checkNotOn() // NOT
+	select {
+	case sc.resetStreamCh <- se:
+	case <-sc.doneServing:
+	}
 }
 
 func (sc *serverConn) resetStream(se StreamError) {
@@ -970,15 +1677,27 @@ func (sc *serverConn) processFrameFromReader(fg frameAndGate, fgValid bool) bool
 	}
 
 	if fgValid {
-		f := fg.f
-		sc.vlogf("got %v: %#v", f.Header(), f)
-		err = sc.processFrame(f)
+		if fg.err != nil {
+			err = fg.err
+			if sc.curHeaderStreamID() != 0 {
+				// Not the CONTINUATION we needed.
+				err = ConnectionError(ErrCodeProtocol)
+			}
+		} else {
+			f := fg.f
+			sc.vlogf("got %v: %#v", f.Header(), f)
+			err = sc.processFrame(f)
+		}
 		fg.g.Done() // unblock the readFrames goroutine
 		if err == nil {
 			return true
 		}
 	}
 
+	if fe, ok := err.(FrameError); ok {
+		sc.vlogf("%v: %v", sc.conn.RemoteAddr(), fe)
+		err = fe.Err
+	}
 	switch ev := err.(type) {
 	case StreamError:
 		sc.resetStream(ev)
@@ -1036,10 +1755,19 @@ func (sc *serverConn) processFrame(f Frame) error {
 		return sc.processResetStream(f)
 	case *PriorityFrame:
 		return sc.processPriority(f)
+	case *PriorityUpdateFrame:
+		return sc.processPriorityUpdate(f)
 	case *PushPromiseFrame:
 		// A client cannot push. Thus, servers MUST treat the receipt of a PUSH_PROMISE
 		// frame as a connection error (Section 5.4.1) of type PROTOCOL_ERROR.
 		return ConnectionError(ErrCodeProtocol)
+	case *UnknownFrame:
+		if h := sc.srv.UnknownFrameHandler; h != nil {
+			h(sc.conn, f)
+		} else {
+			sc.vlogf("Ignoring frame: %v", f.Header())
+		}
+		return nil
 	default:
 		log.Printf("Ignoring frame: %v", f.Header())
 		return nil
@@ -1105,25 +1833,135 @@ func (sc *serverConn) processResetStream(f *RSTStreamFrame) error {
 	if st != nil {
 		st.gotReset = true
 		sc.closeStream(st, StreamError{f.StreamID, f.ErrCode})
+		if sc.resetStreams.max > 0 && !sc.resetStreams.allow(sc.srv.clock().Now()) {
+			sc.logf("client reset more than %d streams per second", sc.resetStreams.max)
+			return ConnectionError(ErrCodeEnhanceYourCalm)
+		}
 	}
 	return nil
 }
 
+// streamTimeout is sent by a stream's ReadTimeout or WriteTimeout
+// timer when it expires.
+type streamTimeout struct {
+	st   *stream
+	read bool // else write
+}
+
+var (
+	errReadTimeout  = errors.New("http2: timeout reading request")
+	errWriteTimeout = errors.New("http2: timeout writing response")
+)
+
+// startStreamTimer starts a timer for st that reports to the serve
+// loop when d expires.
+func (sc *serverConn) startStreamTimer(st *stream, d time.Duration, read bool) Timer {
+	return sc.srv.clock().AfterFunc(d, func() {
+		select {
+		case sc.streamTimeoutCh <- streamTimeout{st, read}:
+		case <-sc.doneServing:
+		}
+	})
+}
+
+// writeErr returns the error for a handler's write to st once st.cw
+// is closed. Reading gotReset is safe then: it's set before the close.
+func (st *stream) writeErr() error {
+	if st.gotReset {
+		return ErrStreamReset
+	}
+	return errStreamBroken
+}
+
+func (sc *serverConn) processStreamTimeout(m streamTimeout) {
+	sc.serveG.check()
+	st := m.st
+	if st.state == stateClosed || m.read && st.state != stateOpen {
+		// Finished in time; the timer raced with its Stop.
+		return
+	}
+	err := errWriteTimeout
+	if m.read {
+		err = errReadTimeout
+	}
+	sc.vlogf("stream %d from %v: %v", st.id, sc.conn.RemoteAddr(), err)
+	if st.body != nil {
+		st.body.Close(err)
+	}
+	sc.resetStream(StreamError{st.id, ErrCodeCancel})
+}
+
 func (sc *serverConn) closeStream(st *stream, err error) {
 	sc.serveG.check()
 	if st.state == stateIdle || st.state == stateClosed {
 		panic(fmt.Sprintf("invariant; can't close stream in state %v", st.state))
 	}
+	if st.readTimer != nil {
+		st.readTimer.Stop()
+	}
+	if st.writeTimer != nil {
+		st.writeTimer.Stop()
+	}
 	st.state = stateClosed
-	sc.curOpenStreams--
+	if h := sc.srv.OnStreamClose; h != nil && st.method != "" {
+		h(StreamStats{
+			StreamID:  st.id,
+			Method:    st.method,
+			Authority: st.authority,
+			Start:     st.start,
+			Status:    st.status,
+			Err:       err,
+			BytesIn:   st.bodyBytes,
+			BytesOut:  st.bytesOut,
+			Duration:  sc.srv.clock().Now().Sub(st.start),
+		})
+	}
+	if st.id%2 == 0 {
+		sc.curPushedStreams--
+	} else {
+		sc.curOpenStreams--
+	}
+	if sc.curOpenStreams+sc.curPushedStreams == 0 && sc.idleTimer != nil {
+		sc.idleTimer.Reset(sc.idleTimeout)
+	}
 	delete(sc.streams, st.id)
 	if p := st.body; p != nil {
 		p.Close(err)
 	}
 	st.cw.Close() // signals Handler's CloseNotifier, unblocks writes, etc
+	st.cancelCtx(err)
 	sc.writeSched.forgetStream(st.id)
 }
 
+// writeSettings sends settings to the client, which has
+// settingsAckTimeout to acknowledge them.
+func (sc *serverConn) writeSettings(settings writeSettings) {
+	sc.serveG.check()
+	sc.writeFrame(frameWriteMsg{write: settings})
+	sc.unackedSettings++
+	if sc.unackedSettings == 1 {
+		sc.startSettingsAckTimer()
+	}
+}
+
+func (sc *serverConn) startSettingsAckTimer() {
+	sc.serveG.check()
+	if sc.settingsAckTimer == nil {
+		sc.settingsAckTimer = sc.srv.clock().NewTimer(sc.srv.settingsAckTimeout())
+	} else {
+		sc.settingsAckTimer.Reset(sc.srv.settingsAckTimeout())
+	}
+	sc.settingsAckTimerCh = sc.settingsAckTimer.C()
+}
+
+func (sc *serverConn) stopSettingsAckTimer() {
+	sc.serveG.check()
+	if t := sc.settingsAckTimer; t != nil {
+		t.Stop()
+	}
+	sc.settingsAckTimerCh = nil
+}
+
 func (sc *serverConn) processSettings(f *SettingsFrame) error {
 	sc.serveG.check()
 	if f.IsAck() {
@@ -1134,6 +1972,12 @@ func (sc *serverConn) processSettings(f *SettingsFrame) error {
 			// hang up on them anyway.
 			return ConnectionError(ErrCodeProtocol)
 		}
+		if sc.unackedSettings == 0 {
+			sc.stopSettingsAckTimer()
+		} else {
+			// Give the next SETTINGS a full timeout.
+			sc.startSettingsAckTimer()
+		}
 		return nil
 	}
 	if err := f.ForeachSetting(sc.processSetting); err != nil {
@@ -1153,7 +1997,11 @@ func (sc *serverConn) processSetting(s Setting) error {
 	switch s.ID {
 	case SettingHeaderTableSize:
 		sc.headerTableSize = s.Val
-		sc.hpackEncoder.SetMaxDynamicTableSize(s.Val)
+		// The encoder belongs to whichever goroutine is
+		// writing frames, so resize it from there. That also
+		// puts the size update at the start of the next
+		// header block, as RFC 7541 section 4.2 requires.
+		sc.writeFrame(frameWriteMsg{write: writeHeaderTableSize(s.Val)})
 	case SettingEnablePush:
 		sc.pushEnabled = s.Val != 0
 	case SettingMaxConcurrentStreams:
@@ -1225,20 +2073,29 @@ func (sc *serverConn) processData(f *DataFrame) error {
 		st.body.Close(fmt.Errorf("sender tried to send more than declared Content-Length of %d bytes", st.declBodyBytes))
 		return StreamError{id, ErrCodeStreamClosed}
 	}
-	if len(data) > 0 {
-		// Check whether the client has flow control quota.
-		if int(st.inflow.available()) < len(data) {
+	if f.Length > 0 {
+		// Check whether the client has flow control quota. The
+		// whole payload counts, padding included.
+		if st.inflow.available() < int32(f.Length) {
 			return StreamError{id, ErrCodeFlowControl}
 		}
-		st.inflow.take(int32(len(data)))
-		wrote, err := st.body.Write(data)
-		if err != nil {
-			return StreamError{id, ErrCodeStreamClosed}
+		st.inflow.take(int32(f.Length))
+		if len(data) > 0 {
+			wrote, err := st.body.Write(data)
+			if err != nil {
+				return StreamError{id, ErrCodeStreamClosed}
+			}
+			if wrote != len(data) {
+				panic("internal error: bad Writer")
+			}
+			st.bodyBytes += int64(len(data))
 		}
-		if wrote != len(data) {
-			panic("internal error: bad Writer")
+		// Padding is never read by the handler, so give its
+		// flow control back now.
+		if pad := int32(f.Length) - int32(len(data)); pad > 0 {
+			sc.sendWindowUpdate32(nil, pad)
+			sc.sendWindowUpdate32(st, pad)
 		}
-		st.bodyBytes += int64(len(data))
 	}
 	if f.StreamEnded() {
 		if st.declBodyBytes != -1 && st.declBodyBytes != st.bodyBytes {
@@ -1248,6 +2105,9 @@ func (sc *serverConn) processData(f *DataFrame) error {
 			st.body.Close(io.EOF)
 		}
 		st.state = stateHalfClosedRemote
+		if st.readTimer != nil {
+			st.readTimer.Stop()
+		}
 	}
 	return nil
 }
@@ -1273,30 +2133,82 @@ func (sc *serverConn) processHeaders(f *HeadersFrame) error {
 	if id > sc.maxStreamID {
 		sc.maxStreamID = id
 	}
+	state := stateOpen
+	if f.StreamEnded() {
+		state = stateHalfClosedRemote
+	}
+	st := sc.newStream(id, state)
+	if f.HasPriority() {
+		sc.adjustStreamPriority(st.id, f.Priority)
+	}
+	sc.req = requestParam{
+		stream: st,
+		header: make(http.Header),
+	}
+	sc.hpackDecoder.SetEmitEnabled(true)
+	return sc.processHeaderBlockFragment(st, f.HeaderBlockFragment(), f.HeadersEnded())
+}
+
+// newStream creates and registers stream id in state: a client's
+// stream, as its HEADERS arrive, or one we've promised with a
+// PUSH_PROMISE.
+func (sc *serverConn) newStream(id uint32, state streamState) *stream {
+	sc.serveG.check()
 	st := &stream{
-		id:    id,
-		state: stateOpen,
+		id:      id,
+		state:   state,
+		urgency: defaultPriority.Urgency,
 	}
-	if f.StreamEnded() {
-		st.state = stateHalfClosedRemote
+	st.prio.p = defaultPriority
+	sc.writeSched.tree.open(id)
+	if state == stateOpen && sc.readTimeout != 0 {
+		st.readTimer = sc.startStreamTimer(st, sc.readTimeout, true)
+	}
+	if sc.writeTimeout != 0 {
+		st.writeTimer = sc.startStreamTimer(st, sc.writeTimeout, false)
 	}
 	st.cw.Init()
+	ctx := context.WithValue(sc.baseCtx, streamInfoKey{}, sc.streamInfo(id))
+	ctx = context.WithValue(ctx, priorityKey{}, &st.prio)
+	st.ctx, st.cancelCtx = context.WithCancelCause(ctx)
 
 	st.flow.conn = &sc.flow // link to conn-level counter
 	st.flow.add(sc.initialWindowSize)
-	st.inflow.conn = &sc.inflow      // link to conn-level counter
-	st.inflow.add(initialWindowSize) // TODO: update this when we send a higher initial window size in the initial settings
+	st.inflow.conn = &sc.inflow // link to conn-level counter
+	st.inflow.add(sc.srv.maxUploadBufferPerStream())
 
 	sc.streams[id] = st
-	if f.HasPriority() {
-		adjustStreamPriority(sc.streams, st.id, f.Priority)
+	if id%2 == 0 {
+		sc.curPushedStreams++
+	} else {
+		sc.curOpenStreams++
 	}
-	sc.curOpenStreams++
-	sc.req = requestParam{
-		stream: st,
-		header: make(http.Header),
+	if sc.curOpenStreams+sc.curPushedStreams == 1 && sc.idleTimer != nil {
+		sc.idleTimer.Stop()
 	}
-	return sc.processHeaderBlockFragment(st, f.HeaderBlockFragment(), f.HeadersEnded())
+	return st
+}
+
+// streamOpened notes that st's handler is starting, to serve req,
+// for Server.OnStreamOpen.
+func (sc *serverConn) streamOpened(st *stream, req *http.Request) {
+	sc.serveG.check()
+	st.method = req.Method
+	st.authority = req.Host
+	st.start = sc.srv.clock().Now()
+	if h := sc.srv.OnStreamOpen; h != nil {
+		h(StreamStats{StreamID: st.id, Method: st.method, Authority: st.authority, Start: st.start})
+	}
+}
+
+// streamInfo returns the StreamInfo for stream id.
+func (sc *serverConn) streamInfo(id uint32) StreamInfo {
+	si := StreamInfo{StreamID: id}
+	if sc.tlsState != nil {
+		si.NegotiatedProtocol = sc.tlsState.NegotiatedProtocol
+		si.PeerCertificates = sc.tlsState.PeerCertificates
+	}
+	return si
 }
 
 func (sc *serverConn) processContinuation(f *ContinuationFrame) error {
@@ -1329,66 +2241,67 @@ func (sc *serverConn) processHeaderBlockFragment(st *stream, frag []byte, end bo
 		// limit to be exceeded MUST treat this as a stream
 		// error (Section 5.4.2) of type PROTOCOL_ERROR or
 		// REFUSED_STREAM."
-		if sc.unackedSettings == 0 {
-			// They should know better.
-			return StreamError{st.id, ErrCodeProtocol}
-		}
-		// Assume it's a network race, where they just haven't
-		// received our last SETTINGS update. But actually
-		// this can't happen yet, because we don't yet provide
-		// a way for users to adjust server parameters at
-		// runtime.
+		//
+		// REFUSED_STREAM tells the client that the request
+		// wasn't processed, so it can retry it once other
+		// streams finish.
+		return StreamError{st.id, ErrCodeRefusedStream}
+	}
+	if !sc.srv.acquireHandler() {
+		sc.vlogf("refusing stream %d from %v: %d handlers running", st.id, sc.conn.RemoteAddr(), sc.srv.MaxHandlers)
 		return StreamError{st.id, ErrCodeRefusedStream}
 	}
 
-	rw, req, err := sc.newWriterAndRequest()
+	rw, req, err := sc.newWriterAndRequest(&sc.req)
 	if err != nil {
+		sc.srv.releaseHandler()
 		return err
 	}
 	st.body = req.Body.(*requestBody).pipe // may be nil
 	st.declBodyBytes = req.ContentLength
-	go sc.runHandler(rw, req)
+	handler := sc.handler.ServeHTTP
+	if sc.req.headerListTooLarge {
+		// The spec lets us send the 431 rather than
+		// resetting the stream (section 10.5.1), which
+		// tells the client why.
+		handler = handleHeaderListTooLarge
+	}
+	sc.streamOpened(st, req)
+	go sc.runHandler(rw, req, handler)
 	return nil
 }
 
 func (sc *serverConn) processPriority(f *PriorityFrame) error {
-	adjustStreamPriority(sc.streams, f.StreamID, f.PriorityParam)
+	sc.adjustStreamPriority(f.StreamID, f.PriorityParam)
 	return nil
 }
 
-func adjustStreamPriority(streams map[uint32]*stream, streamID uint32, priority PriorityParam) {
-	st, ok := streams[streamID]
+// processPriorityUpdate applies a client's RFC 9218 change to the
+// urgency of a stream. The new value replaces the old, members it
+// leaves out taking their defaults. As with PRIORITY, one for a
+// stream that isn't open is ignored.
+func (sc *serverConn) processPriorityUpdate(f *PriorityUpdateFrame) error {
+	st, ok := sc.streams[f.PrioritizedStreamID]
 	if !ok {
-		// TODO: not quite correct (this streamID might
-		// already exist in the dep tree, but be closed), but
-		// close enough for now.
-		return
-	}
-	st.weight = priority.Weight
-	parent := streams[priority.StreamDep] // might be nil
-	if parent == st {
-		// if client tries to set this stream to be the parent of itself
-		// ignore and keep going
-		return
+		return nil
 	}
+	p := st.prio.get()
+	p.Urgency, p.Incremental = defaultPriority.Urgency, defaultPriority.Incremental
+	parsePriorityHeader(&p, f.Priority)
+	st.urgency = p.Urgency
+	st.prio.set(p)
+	return nil
+}
 
-	// section 5.3.3: If a stream is made dependent on one of its
-	// own dependencies, the formerly dependent stream is first
-	// moved to be dependent on the reprioritized stream's previous
-	// parent. The moved dependency retains its weight.
-	for piter := parent; piter != nil; piter = piter.parent {
-		if piter == st {
-			parent.parent = st.parent
-			break
-		}
-	}
-	st.parent = parent
-	if priority.Exclusive && (st.parent != nil || priority.StreamDep == 0) {
-		for _, openStream := range streams {
-			if openStream != st && openStream.parent == st.parent {
-				openStream.parent = st
-			}
-		}
+// adjustStreamPriority applies an RFC 7540 priority to stream id,
+// from its HEADERS or a PRIORITY frame, in the write scheduler's
+// dependency tree, which keeps streams not open too.
+func (sc *serverConn) adjustStreamPriority(id uint32, priority PriorityParam) {
+	sc.writeSched.tree.reprioritize(id, priority)
+	if st, ok := sc.streams[id]; ok && priority.StreamDep != id {
+		p := st.prio.get()
+		p.PriorityParam = priority
+		st.prio.set(p)
 	}
 }
 
@@ -1400,9 +2313,8 @@ func (sc *serverConn) resetPendingRequest() {
 	sc.req = requestParam{}
 }
 
-func (sc *serverConn) newWriterAndRequest() (*responseWriter, *http.Request, error) {
+func (sc *serverConn) newWriterAndRequest(rp *requestParam) (*responseWriter, *http.Request, error) {
 	sc.serveG.check()
-	rp := &sc.req
 	if VerboseLogs {
 		sc.vlogf("%T.requestParam=%#v\n", sc, rp)
 	}
@@ -1422,7 +2334,18 @@ func (sc *serverConn) newWriterAndRequest() (*responseWriter, *http.Request, err
 	if authority == "" {
 		authority = rp.header.Get("Host")
 	}
-	needsContinue := rp.header.Get("Expect") == "100-continue"
+	if rp.protocol != "" {
+		// Like the Transport, pass the :protocol of an
+		// extended CONNECT through as a header.
+		rp.header[":protocol"] = []string{rp.protocol}
+	}
+	if v := rp.header.Get("Priority"); v != "" {
+		p := rp.stream.prio.get()
+		parsePriorityHeader(&p, v)
+		rp.stream.urgency = p.Urgency
+		rp.stream.prio.set(p)
+	}
+	needsContinue := strings.EqualFold(rp.header.Get("Expect"), "100-continue")
 	if needsContinue {
 		rp.header.Del("Expect")
 	}
@@ -1430,7 +2353,7 @@ func (sc *serverConn) newWriterAndRequest() (*responseWriter, *http.Request, err
 	body := &requestBody{
 		conn:          sc,
 		stream:        rp.stream,
-		needsContinue: needsContinue,
+		needsContinue: needsContinue && bodyOpen, // nothing to continue if END_STREAM already came
 	}
 	url, err := rp.parseURL()
 	if err != nil {
@@ -1450,9 +2373,10 @@ func (sc *serverConn) newWriterAndRequest() (*responseWriter, *http.Request, err
 		Host:       authority,
 		Body:       body,
 	}
+	req = req.WithContext(rp.stream.ctx)
 	if bodyOpen {
 		body.pipe = &pipe{
-			b: buffer{buf: make([]byte, initialWindowSize)}, // TODO: share/remove XXX
+			b: buffer{buf: make([]byte, sc.srv.maxUploadBufferPerStream())}, // TODO: share/remove XXX
 		}
 		body.pipe.c.L = &body.pipe.m
 
@@ -1473,16 +2397,25 @@ func (sc *serverConn) newWriterAndRequest() (*responseWriter, *http.Request, err
 	rws.req = req
 	rws.body = body
 	rws.frameWriteCh = make(chan error, 1)
+	if body.pipe != nil {
+		body.rws = rws
+	}
 
 	rw := &responseWriter{rws: rws}
 	return rw, req, nil
 }
 
 // Run on its own goroutine.
-func (sc *serverConn) runHandler(rw *responseWriter, req *http.Request) {
+func (sc *serverConn) runHandler(rw *responseWriter, req *http.Request, handler func(http.ResponseWriter, *http.Request)) {
+	defer sc.srv.releaseHandler()
 	defer rw.handlerDone()
 	// TODO: catch panics like net/http.Server
-	sc.handler.ServeHTTP(rw, req)
+	handler(rw, req)
+}
+
+func handleHeaderListTooLarge(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+	io.WriteString(w, "<h1>HTTP Error 431</h1><p>Request Header Field(s) Too Large</p>")
 }
 
 // called from handler goroutines.
@@ -1596,6 +2529,8 @@ type requestBody struct {
 	closed        bool
 	pipe          *pipe // non-nil if we have a HTTP entity message body
 	needsContinue bool  // need to send a 100-continue
+
+	rws *responseWriterState // flushed before Read blocks; nil if no body
 }
 
 func (b *requestBody) Close() error {
@@ -1609,11 +2544,14 @@ func (b *requestBody) Close() error {
 func (b *requestBody) Read(p []byte) (n int, err error) {
 	if b.needsContinue {
 		b.needsContinue = false
-		b.conn.write100ContinueHeaders(b.stream)
+		b.rws.write100Continue()
 	}
 	if b.pipe == nil {
 		return 0, io.EOF
 	}
+	if b.rws != nil && b.pipe.Len() == 0 {
+		b.rws.flushBeforeRead()
+	}
 	n, err = b.pipe.Read(p)
 	if n > 0 {
 		b.conn.noteBodyReadFromHandler(b.stream, n)
@@ -1635,6 +2573,7 @@ type responseWriter struct {
 var (
 	_ http.CloseNotifier = (*responseWriter)(nil)
 	_ http.Flusher       = (*responseWriter)(nil)
+	_ http.Pusher        = (*responseWriter)(nil)
 	_ stringWriter       = (*responseWriter)(nil)
 )
 
@@ -1646,7 +2585,8 @@ type responseWriterState struct {
 	conn   *serverConn
 
 	// TODO: adjust buffer writing sizes based on server config, frame size updates from peer, etc
-	bw *bufio.Writer // writing to a chunkWriter{this *responseWriterState}
+	bw   *bufio.Writer // writing to a chunkWriter{this *responseWriterState}
+	bwMu sync.Mutex    // guards bw, wroteHeader and handlerDone against the request body's Read
 
 	// mutated by http.Handler goroutine:
 	handlerHeader http.Header // nil until called
@@ -1655,8 +2595,10 @@ type responseWriterState struct {
 	wroteHeader   bool        // WriteHeader called (explicitly or implicitly). Not necessarily sent to user yet.
 	sentHeader    bool        // have we sent the header frame?
 	handlerDone   bool        // handler has finished
+	trailers      []string    // declared trailer keys, canonicalized; see declareTrailer
 	curWrite      writeData
 	frameWriteCh  chan error // re-used whenever we need to block on a frame being written
+	dirty         bool       // a write of curWrite may still be in flight; don't pool
 
 	closeNotifierMu sync.Mutex // guards closeNotifierCh
 	closeNotifierCh chan bool  // nil until first used
@@ -1676,8 +2618,21 @@ func (rws *responseWriterState) writeChunk(p []byte) (n int, err error) {
 	if !rws.wroteHeader {
 		rws.writeHeader(200)
 	}
+	if rws.handlerDone {
+		rws.promoteUndeclaredTrailers()
+	}
 	if !rws.sentHeader {
 		rws.sentHeader = true
+		if rws.conn.srv.PushPreloads {
+			// Before the HEADERS, so the client knows
+			// about the pushes before it goes looking.
+			rws.pushPreloads()
+		}
+		for _, v := range rws.snapHeader["Trailer"] {
+			for _, k := range strings.Split(v, ",") {
+				rws.declareTrailer(strings.TrimSpace(k))
+			}
+		}
 		var ctype, clen string // implicit ones, if we can calculate it
 		if rws.handlerDone && rws.snapHeader.Get("Content-Length") == "" {
 			clen = strconv.Itoa(len(p))
@@ -1685,7 +2640,7 @@ func (rws *responseWriterState) writeChunk(p []byte) (n int, err error) {
 		if rws.snapHeader.Get("Content-Type") == "" {
 			ctype = http.DetectContentType(p)
 		}
-		endStream := rws.handlerDone && len(p) == 0
+		endStream := rws.handlerDone && !rws.hasTrailers() && len(p) == 0
 		rws.conn.writeHeaders(rws.stream, &writeResHeaders{
 			streamID:      rws.stream.id,
 			httpResCode:   rws.status,
@@ -1701,21 +2656,118 @@ func (rws *responseWriterState) writeChunk(p []byte) (n int, err error) {
 	if len(p) == 0 && !rws.handlerDone {
 		return 0, nil
 	}
-	curWrite := &rws.curWrite
-	curWrite.streamID = rws.stream.id
-	curWrite.p = p
-	curWrite.endStream = rws.handlerDone
-	if err := rws.conn.writeDataFromHandler(rws.stream, curWrite, rws.frameWriteCh); err != nil {
-		return 0, err
+	hasTrailers := rws.handlerDone && rws.hasTrailers()
+	if len(p) > 0 || !hasTrailers {
+		curWrite := &rws.curWrite
+		curWrite.streamID = rws.stream.id
+		curWrite.p = p
+		curWrite.endStream = rws.handlerDone && !hasTrailers
+		if err := rws.conn.writeDataFromHandler(rws.stream, curWrite, rws.frameWriteCh); err != nil {
+			rws.dirty = true
+			return 0, err
+		}
+	}
+	if hasTrailers {
+		h := make(http.Header, len(rws.trailers))
+		for _, k := range rws.trailers {
+			if vv := rws.handlerHeader[k]; len(vv) > 0 {
+				h[k] = vv
+			}
+		}
+		rws.conn.writeHeaders(rws.stream, &writeResHeaders{
+			streamID:  rws.stream.id,
+			h:         h,
+			endStream: true,
+		}, rws.frameWriteCh)
 	}
 	return len(p), nil
 }
 
+// badTrailer is the set of header fields that mustn't be sent as
+// trailers, per RFC 7230 section 4.1.2.
+var badTrailer = map[string]bool{
+	"Authorization":       true,
+	"Cache-Control":       true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Expect":              true,
+	"Host":                true,
+	"Keep-Alive":          true,
+	"Max-Forwards":        true,
+	"Pragma":              true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Range":               true,
+	"Realm":               true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Www-Authenticate":    true,
+}
+
+// declareTrailer notes that the handler may send the header field k
+// as a trailer, as it does for keys named in the "Trailer" header
+// before the response headers are sent.
+func (rws *responseWriterState) declareTrailer(k string) {
+	k = http.CanonicalHeaderKey(k)
+	if k == "" || badTrailer[k] {
+		if k != "" {
+			rws.conn.logf("ignoring invalid trailer %q", k)
+		}
+		return
+	}
+	for _, t := range rws.trailers {
+		if t == k {
+			return
+		}
+	}
+	rws.trailers = append(rws.trailers, k)
+}
+
+// promoteUndeclaredTrailers declares the trailers set with keys
+// prefixed by http.TrailerPrefix, which handlers use for trailers
+// not known before the response headers are sent.
+func (rws *responseWriterState) promoteUndeclaredTrailers() {
+	for k, vv := range rws.handlerHeader {
+		if !strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		trailerKey := http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))
+		rws.declareTrailer(trailerKey)
+		rws.handlerHeader[trailerKey] = vv
+	}
+}
+
+// hasTrailers reports whether any declared trailer has a value to
+// send.
+func (rws *responseWriterState) hasTrailers() bool {
+	for _, k := range rws.trailers {
+		if len(rws.handlerHeader[k]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (w *responseWriter) Flush() {
 	rws := w.rws
 	if rws == nil {
 		panic("Header called after Handler finished")
 	}
+	rws.bwMu.Lock()
+	defer rws.bwMu.Unlock()
+	rws.flush()
+}
+
+// flush sends everything the handler has written so far, and then has
+// the serve goroutine flush the conn too, so streaming responses don't
+// sit in a buffer while other streams keep the frame writer busy.
+// rws.bwMu must be held.
+func (rws *responseWriterState) flush() {
 	if rws.bw.Buffered() > 0 {
 		if err := rws.bw.Flush(); err != nil {
 			// Ignore the error. The frame writer already knows.
@@ -1728,6 +2780,302 @@ func (w *responseWriter) Flush() {
 		// final DATA frame (with END_STREAM) to be sent.
 		rws.writeChunk(nil)
 	}
+	if !rws.handlerDone {
+		// Any DATA written above is already in the conn's
+		// buffer, so a flush on the zero queue (which goes
+		// first) is enough.
+		rws.conn.writeFrameFromHandler(frameWriteMsg{write: flushFrameWriter{}})
+	}
+}
+
+// write100Continue sends the interim 100 response to an Expect:
+// 100-continue request, the first time its body is read. Like
+// net/http, it's skipped if the handler has already begun its real
+// response, since a 1xx can't follow that.
+func (rws *responseWriterState) write100Continue() {
+	rws.bwMu.Lock()
+	defer rws.bwMu.Unlock()
+	if rws.handlerDone || rws.wroteHeader {
+		return
+	}
+	rws.conn.write100ContinueHeaders(rws.stream)
+}
+
+// flushBeforeRead is called by the request body before it blocks
+// waiting for more DATA. If the handler has written a response but
+// not flushed it, it's sent, so a handler speaking a request/response
+// protocol over the stream doesn't deadlock with a peer that's waiting
+// for that response before sending more.
+func (rws *responseWriterState) flushBeforeRead() {
+	rws.bwMu.Lock()
+	defer rws.bwMu.Unlock()
+	if rws.handlerDone || !rws.wroteHeader {
+		return
+	}
+	if rws.bw.Buffered() > 0 || !rws.sentHeader {
+		rws.flush()
+	}
+}
+
+var (
+	// ErrRecursivePush is returned by Push when called by the
+	// handler for a pushed stream, since clients can't be pushed
+	// more from those.
+	ErrRecursivePush = errors.New("http2: recursive push not allowed")
+
+	// ErrPushLimitReached is returned by Push when the client
+	// can't take another pushed stream right now, per its
+	// SETTINGS_MAX_CONCURRENT_STREAMS.
+	ErrPushLimitReached = errors.New("http2: push would exceed peer's SETTINGS_MAX_CONCURRENT_STREAMS")
+
+	errPushNoHandler = errors.New("http2: no handler free for pushed stream")
+)
+
+// startPushMsg asks the serve goroutine to push url on parent's
+// behalf. done is sent the result once the PUSH_PROMISE is written.
+type startPushMsg struct {
+	parent *stream
+	method string
+	url    *url.URL
+	header http.Header
+	auto   bool // from PushPreloads; subject to MaxConcurrentPushes
+	done   chan error
+}
+
+// Push implements http.Pusher. It returns once the PUSH_PROMISE has
+// been written, and the pushed request is then served by the
+// connection's Handler like any other. It returns
+// http.ErrNotSupported if the client has disabled push.
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	rws := w.rws
+	if rws == nil {
+		panic("Push called after Handler finished")
+	}
+	return rws.push(target, opts, false)
+}
+
+func (rws *responseWriterState) push(target string, opts *http.PushOptions, auto bool) error {
+	st, sc := rws.stream, rws.conn
+	sc.serveG.checkNotOn() // NOT
+	if st.id%2 == 0 {
+		return ErrRecursivePush
+	}
+	if opts == nil {
+		opts = new(http.PushOptions)
+	}
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+	// 8.2: "Promised requests MUST be cacheable [...] and safe"
+	if method != "GET" && method != "HEAD" {
+		return fmt.Errorf("http2: can't push method %q; must be GET or HEAD", method)
+	}
+
+	wantScheme := "http"
+	if rws.req.TLS != nil {
+		wantScheme = "https"
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" {
+		if !strings.HasPrefix(target, "/") {
+			return fmt.Errorf("http2: push target %q must be an absolute URL or path", target)
+		}
+		u.Scheme = wantScheme
+		u.Host = rws.req.Host
+	} else if u.Scheme != wantScheme {
+		return fmt.Errorf("http2: can't push %q scheme from a request with scheme %q", u.Scheme, wantScheme)
+	}
+	if u.Host == "" {
+		return errors.New("http2: push target needs a host")
+	}
+	for k := range opts.Header {
+		if strings.HasPrefix(k, ":") {
+			return fmt.Errorf("http2: promised request headers can't include pseudo-header %q", k)
+		}
+		switch http.CanonicalHeaderKey(k) {
+		case "Content-Length", "Content-Encoding", "Trailer", "Te", "Expect", "Host":
+			return fmt.Errorf("http2: promised request headers can't include %q", k)
+		}
+	}
+
+	msg := startPushMsg{
+		parent: st,
+		method: method,
+		url:    u,
+		header: cloneHeader(opts.Header),
+		auto:   auto,
+		done:   make(chan error, 1),
+	}
+	select {
+	case sc.wantStartPushCh <- msg:
+	case <-sc.doneServing:
+		return errClientDisconnected
+	case <-st.cw:
+		return st.writeErr()
+	}
+	select {
+	case err := <-msg.done:
+		return err
+	case <-sc.doneServing:
+		return errClientDisconnected
+	case <-st.cw:
+		return st.writeErr()
+	}
+}
+
+// startPush queues the PUSH_PROMISE for msg. The promised stream is
+// set up, and its handler started, only as the frame is written.
+func (sc *serverConn) startPush(msg startPushMsg) {
+	sc.serveG.check()
+	// 6.6: "PUSH_PROMISE frames MUST only be sent on a
+	// peer-initiated stream that is in either the "open" or
+	// "half-closed (remote)" state."
+	if st := msg.parent; st.state != stateOpen && st.state != stateHalfClosedRemote {
+		msg.done <- errStreamBroken
+		return
+	}
+	if !sc.pushEnabled {
+		msg.done <- http.ErrNotSupported
+		return
+	}
+	allocatePromisedID := func() (uint32, error) {
+		sc.serveG.check()
+		// The client's SETTINGS may have changed since the push
+		// was queued, so check again.
+		if !sc.pushEnabled {
+			return 0, http.ErrNotSupported
+		}
+		if sc.curPushedStreams+1 > sc.clientMaxStreams {
+			return 0, ErrPushLimitReached
+		}
+		if msg.auto && sc.curPushedStreams+1 > sc.srv.maxConcurrentPushes() {
+			return 0, ErrPushLimitReached
+		}
+		if sc.inGoAway || sc.maxPushPromiseID+2 >= 1<<31 {
+			return 0, ErrPushLimitReached
+		}
+		if !sc.srv.acquireHandler() {
+			return 0, errPushNoHandler
+		}
+		sc.maxPushPromiseID += 2
+		id := sc.maxPushPromiseID
+		// 5.3.5: pushed streams depend on their associated
+		// stream, with the default weight.
+		sc.writeSched.tree.reprioritize(id, PriorityParam{
+			StreamDep: msg.parent.id,
+			Weight:    defaultPriority.Weight,
+		})
+		promised := sc.newStream(id, stateHalfClosedRemote)
+		rw, req, err := sc.newWriterAndRequest(&requestParam{
+			stream:    promised,
+			header:    msg.header,
+			method:    msg.method,
+			scheme:    msg.url.Scheme,
+			authority: msg.url.Host,
+			path:      msg.url.RequestURI(),
+		})
+		if err != nil {
+			// Push validated it all, so this shouldn't happen.
+			sc.srv.releaseHandler()
+			sc.closeStream(promised, err)
+			return 0, err
+		}
+		sc.streamOpened(promised, req)
+		go sc.runHandler(rw, req, sc.handler.ServeHTTP)
+		return id, nil
+	}
+	sc.writeFrame(frameWriteMsg{
+		write: &writePushPromise{
+			streamID:           msg.parent.id,
+			method:             msg.method,
+			url:                msg.url,
+			h:                  msg.header,
+			allocatePromisedID: allocatePromisedID,
+		},
+		stream: msg.parent,
+		done:   msg.done,
+	})
+}
+
+// pushPreloads pushes the rel=preload links of the response header
+// about to be sent, for Server.PushPreloads. Failures are only
+// logged, since the client can always fetch the links itself.
+func (rws *responseWriterState) pushPreloads() {
+	if rws.stream.id%2 == 0 {
+		return // pushed responses can't push
+	}
+	scheme := "http"
+	if rws.req.TLS != nil {
+		scheme = "https"
+	}
+	base := &url.URL{Scheme: scheme, Host: rws.req.Host, Path: rws.req.URL.Path}
+	var h http.Header
+	for _, k := range []string{"Accept-Encoding", "Accept-Language", "User-Agent"} {
+		if v, ok := rws.req.Header[k]; ok {
+			if h == nil {
+				h = make(http.Header)
+			}
+			h[k] = v
+		}
+	}
+	for _, target := range preloadLinks(rws.snapHeader["Link"]) {
+		u, err := base.Parse(target)
+		if err != nil || u.Scheme != base.Scheme || u.Host != base.Host {
+			continue // not same-origin
+		}
+		if err := rws.push(u.RequestURI(), &http.PushOptions{Header: h}, true); err != nil {
+			rws.conn.vlogf("not pushing preload %q: %v", target, err)
+			if err == http.ErrNotSupported || err == errClientDisconnected {
+				return
+			}
+		}
+	}
+}
+
+// preloadLinks returns the targets of the rel=preload links, other
+// than those marked nopush, in vv, the values of Link headers.
+func preloadLinks(vv []string) []string {
+	var targets []string
+	for _, v := range vv {
+		for {
+			v = strings.TrimLeft(v, " \t,")
+			if !strings.HasPrefix(v, "<") {
+				break
+			}
+			end := strings.IndexByte(v, '>')
+			if end < 0 {
+				break
+			}
+			target := v[1:end]
+			params := v[end+1:]
+			v = ""
+			if i := strings.IndexByte(params, ','); i >= 0 {
+				params, v = params[:i], params[i+1:]
+			}
+			preload, nopush := false, false
+			for _, p := range strings.Split(params, ";") {
+				k, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+				switch strings.ToLower(strings.TrimSpace(k)) {
+				case "rel":
+					for _, rel := range strings.Fields(strings.Trim(val, `"`)) {
+						if strings.EqualFold(rel, "preload") {
+							preload = true
+						}
+					}
+				case "nopush":
+					nopush = true
+				}
+			}
+			if preload && !nopush {
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
 }
 
 type dataConn struct {
@@ -1749,13 +3097,14 @@ func (dc *dataConn) Write(p []byte) (int, error) {
 	curWrite.p = p
 	curWrite.endStream = false
 	if err := dc.rws.conn.writeDataFromHandler(dc.rws.stream, curWrite, dc.rws.frameWriteCh); err != nil {
+		dc.rws.dirty = true
 		return 0, err
 	}
 	return len(p), nil
 }
 
 func (dc *dataConn) Close() error {
-	dc.rws.conn.resetStream(StreamError{dc.rws.stream.id, ErrCodeCancel})
+	dc.rws.conn.resetStreamFromHandler(StreamError{dc.rws.stream.id, ErrCodeCancel})
 	return nil
 }
 
@@ -1779,6 +3128,30 @@ func (dc *dataConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+var errNotConnect = errors.New("http2: AcceptConnect of a request that isn't CONNECT")
+
+// AcceptConnect accepts the CONNECT or extended CONNECT request r,
+// whose handler was passed w, and returns its stream as a conn. It's
+// the server side of Transport.Connect and Transport.ConnectProtocol.
+//
+// If the handler hasn't yet called w.WriteHeader, a 200 response is
+// sent. Reads from the conn return the DATA sent by the client, and
+// writes send DATA to it. The tunnel ends when the handler returns
+// or the conn is closed, which resets the stream.
+//
+// The protocol of an extended CONNECT is in r.Header[":protocol"].
+func AcceptConnect(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.Method != "CONNECT" {
+		return nil, errNotConnect
+	}
+	rw, ok := w.(*responseWriter)
+	if !ok {
+		return nil, fmt.Errorf("http2: AcceptConnect with non-HTTP/2 ResponseWriter %T", w)
+	}
+	rw.Flush()
+	return &dataConn{rw.rws}, nil
+}
+
 func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	w.Flush()
 	dc := &dataConn{w.rws}
@@ -1820,6 +3193,8 @@ func (w *responseWriter) WriteHeader(code int) {
 	if rws == nil {
 		panic("WriteHeader called after Handler finished")
 	}
+	rws.bwMu.Lock()
+	defer rws.bwMu.Unlock()
 	rws.writeHeader(code)
 }
 
@@ -1865,8 +3240,16 @@ func (w *responseWriter) write(lenData int, dataB []byte, dataS string) (n int,
 	if rws == nil {
 		panic("Write called after Handler finished")
 	}
+	select {
+	case <-rws.stream.cw:
+		// Fail now rather than buffering into a dead stream.
+		return 0, rws.stream.writeErr()
+	default:
+	}
+	rws.bwMu.Lock()
+	defer rws.bwMu.Unlock()
 	if !rws.wroteHeader {
-		w.WriteHeader(200)
+		rws.writeHeader(200)
 	}
 	if dataB != nil {
 		return rws.bw.Write(dataB)
@@ -1880,8 +3263,14 @@ func (w *responseWriter) handlerDone() {
 	if rws == nil {
 		panic("handlerDone called twice")
 	}
+	rws.bwMu.Lock()
 	rws.handlerDone = true
+	rws.bwMu.Unlock()
 	w.Flush()
 	w.rws = nil
-	responseWriterStatePool.Put(rws)
+	if !rws.dirty {
+		// Only recycle rws if no write of its curWrite or
+		// frameWriteCh could still be outstanding.
+		responseWriterStatePool.Put(rws)
+	}
 }
@@ -9,6 +9,7 @@ package http2
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"flag"
@@ -82,6 +83,7 @@ func newServerTester(t testing.TB, handler http.HandlerFunc, opts ...interface{}
 	}
 
 	var hooks []func(*serverConn)
+	srv := &Server{}
 	onlyServer := false
 	for _, opt := range opts {
 		switch v := opt.(type) {
@@ -91,6 +93,8 @@ func newServerTester(t testing.TB, handler http.HandlerFunc, opts ...interface{}
 			v(ts)
 		case func(*serverConn):
 			hooks = append(hooks, v)
+		case func(*Server):
+			v(srv)
 		case serverTesterOpt:
 			onlyServer = (v == optOnlyServer)
 		default:
@@ -98,7 +102,7 @@ func newServerTester(t testing.TB, handler http.HandlerFunc, opts ...interface{}
 		}
 	}
 
-	ConfigureServer(ts.Config, &Server{})
+	ConfigureServer(ts.Config, srv)
 
 	st := &serverTester{
 		t:      t,
@@ -874,28 +878,849 @@ func TestServer_Request_Reject_Pseudo_Connect_authority_invalid(t *testing.T) {
 	})
 }
 
+func TestServer_Request_Reject_HeaderListTooLarge(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("server request made it to handler; should've been rejected")
+	}, func(ts *httptest.Server) {
+		ts.Config.MaxHeaderBytes = 16 << 10
+	})
+	defer st.Close()
+	st.addLogFilter("request header list larger than")
+
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: hpackBomb(":method", "GET", ":path", "/", ":scheme", "https"),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	hf := st.wantHeaders()
+	goth := decodeHeader(t, hf.HeaderBlockFragment())
+	if len(goth) == 0 || goth[0] != [2]string{":status", "431"} {
+		t.Errorf("Got headers %v; want :status 431", goth)
+	}
+}
+
+func TestServer_Settings_Configured(t *testing.T) {
+	st := newServerTester(t, nil, func(srv *Server) {
+		srv.MaxDecoderHeaderTableSize = 8192
+		srv.MaxHeaderListSize = 1 << 20
+		srv.MaxReadFrameSize = 1 << 15
+	})
+	defer st.Close()
+	st.writePreface()
+	st.writeInitialSettings()
+	sf := st.wantSettings()
+	want := map[SettingID]uint32{
+		SettingHeaderTableSize:   8192,
+		SettingMaxHeaderListSize: 1 << 20,
+		SettingMaxFrameSize:      1 << 15,
+	}
+	sf.ForeachSetting(func(s Setting) error {
+		if v, ok := want[s.ID]; ok && v != s.Val {
+			t.Errorf("setting %v = %d; want %d", s.ID, s.Val, v)
+		}
+		delete(want, s.ID)
+		return nil
+	})
+	if len(want) > 0 {
+		t.Errorf("settings missing: %v", want)
+	}
+}
+
+func TestServer_Settings_AckTimeout(t *testing.T) {
+	st := newServerTester(t, nil, func(srv *Server) {
+		srv.SettingsAckTimeout = 50 * time.Millisecond
+	})
+	defer st.Close()
+	st.writePreface()
+	st.writeInitialSettings()
+	st.wantSettings()
+	// Don't ACK the server's SETTINGS.
+	for {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatalf("Error while expecting a GOAWAY frame: %v", err)
+		}
+		if ga, ok := f.(*GoAwayFrame); ok {
+			if ga.ErrCode != ErrCodeSettingsTimeout {
+				t.Errorf("GOAWAY error code = %v; want %v", ga.ErrCode, ErrCodeSettingsTimeout)
+			}
+			return
+		}
+	}
+}
+
+func TestServer_Settings_HeaderTableSize(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Foo", "bar")
+	})
+	defer st.Close()
+	st.writePreface()
+	if err := st.fr.WriteSettings(Setting{SettingHeaderTableSize, 0}); err != nil {
+		t.Fatal(err)
+	}
+	st.wantSettings()
+	st.writeSettingsAck()
+	st.wantSettingsAck()
+
+	var got [][2]string
+	d := hpack.NewDecoder(initialHeaderTableSize, func(f hpack.HeaderField) {
+		got = append(got, [2]string{f.Name, f.Value})
+	})
+	d.SetAllowedMaxDynamicTableSize(0)
+	for i, id := range []uint32{1, 3} {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      id,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+		block := st.wantHeaders().HeaderBlockFragment()
+		// Only the first response starts with the table
+		// size update to 0.
+		if sizeUpdate := block[0] == 0x20; sizeUpdate != (i == 0) {
+			t.Errorf("response %d: size update = %v; block %x", i, sizeUpdate, block)
+		}
+		got = nil
+		if _, err := d.Write(block); err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		if len(got) == 0 || got[0] != [2]string{":status", "200"} {
+			t.Errorf("response %d: headers = %v", i, got)
+		}
+	}
+}
+
+func TestServer_Response_SensitiveHeaders(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "a=b")
+		w.Header().Set("X-Secret", "s")
+		w.Header().Set("X-Plain", "p")
+	}, func(srv *Server) {
+		srv.SensitiveHeaders = []string{"X-Secret"}
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+	fields, err := hpack.NewDecoder(initialHeaderTableSize, nil).DecodeFull(st.wantHeaders().HeaderBlockFragment())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, f := range fields {
+		got[f.Name] = f.Sensitive
+	}
+	want := map[string]bool{"set-cookie": true, "x-secret": true, "x-plain": false}
+	for k, v := range want {
+		if s, ok := got[k]; !ok || s != v {
+			t.Errorf("%s: sensitive = %v (present %v); want %v", k, s, ok, v)
+		}
+	}
+}
+
+// hpackBomb returns a header block of the fields kv followed by a
+// field of about 4 KB that is repeated by index until the block
+// decodes to about 1 MB, while staying small on the wire.
+func hpackBomb(kv ...string) []byte {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	for i := 0; i < len(kv); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: kv[i], Value: kv[i+1]})
+	}
+	f := hpack.HeaderField{Name: "x-bomb", Value: strings.Repeat("a", 4000)}
+	for i := 0; i < 256; i++ {
+		enc.WriteField(f)
+	}
+	return buf.Bytes()
+}
+
+func TestServer_RapidReset(t *testing.T) {
+	unblock := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}, func(srv *Server) {
+		srv.MaxResetStreamRate = 10
+	})
+	defer st.Close()
+	defer close(unblock)
+	st.addLogFilter("client reset more than")
+
+	st.greet()
+	for id := uint32(1); id < 2*12; id += 2 {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      id,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+		if err := st.fr.WriteRSTStream(id, ErrCodeCancel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ga := st.wantGoAway()
+	if ga.ErrCode != ErrCodeEnhanceYourCalm {
+		t.Errorf("GOAWAY error code = %v; want %v", ga.ErrCode, ErrCodeEnhanceYourCalm)
+	}
+}
+
+func TestServer_Request_StreamInfo(t *testing.T) {
+	testServerRequest(t, func(st *serverTester) {
+		st.bodylessReq1()
+	}, func(r *http.Request) {
+		si, ok := StreamInfoFromContext(r.Context())
+		if !ok {
+			t.Fatal("no StreamInfo in request context")
+		}
+		if si.StreamID != 1 {
+			t.Errorf("StreamID = %d; want 1", si.StreamID)
+		}
+		if si.NegotiatedProtocol != NextProtoTLS {
+			t.Errorf("NegotiatedProtocol = %q; want %q", si.NegotiatedProtocol, NextProtoTLS)
+		}
+		if r.Context().Value(http.ServerContextKey) == nil {
+			t.Error("no http.Server in request context")
+		}
+	})
+}
+
+func TestServer_StreamHooks(t *testing.T) {
+	opened := make(chan StreamStats, 2)
+	closed := make(chan StreamStats, 2)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(201)
+		io.WriteString(w, "hello")
+	}, func(s *Server) {
+		s.OnStreamOpen = func(s StreamStats) { opened <- s }
+		s.OnStreamClose = func(s StreamStats) { closed <- s }
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST", ":authority", "example.com"),
+		EndHeaders:    true,
+	})
+	st.writeData(1, true, []byte("abc"))
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(":method", "PUT", ":authority", "example.com"),
+		EndHeaders:    true,
+	})
+	st.fr.WriteRSTStream(3, ErrCodeCancel)
+
+	byID := map[uint32]StreamStats{}
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-closed:
+			byID[s.StreamID] = s
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for OnStreamClose")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		open := <-opened
+		got := byID[open.StreamID]
+		if got.Start != open.Start || got.Duration < 0 {
+			t.Errorf("stream %d: OnStreamOpen got Start %v; OnStreamClose got Start %v, Duration %v", open.StreamID, open.Start, got.Start, got.Duration)
+		}
+	}
+	for _, want := range []StreamStats{
+		{StreamID: 1, Method: "POST", Authority: "example.com", Status: 201, BytesIn: 3, BytesOut: 5},
+		{StreamID: 3, Method: "PUT", Authority: "example.com", Err: StreamError{3, ErrCodeCancel}},
+	} {
+		got := byID[want.StreamID]
+		got.Start, got.Duration = time.Time{}, 0
+		if got != want {
+			t.Errorf("OnStreamClose got %+v; want %+v", got, want)
+		}
+	}
+}
+
+func TestServer_Request_Priority(t *testing.T) {
+	testServerRequest(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader("priority", "u=1, i"),
+			EndStream:     true,
+			EndHeaders:    true,
+			Priority:      PriorityParam{StreamDep: 3, Weight: 200},
+		})
+	}, func(r *http.Request) {
+		p, ok := PriorityFromContext(r.Context())
+		if !ok {
+			t.Fatal("no Priority in request context")
+		}
+		want := Priority{PriorityParam: PriorityParam{StreamDep: 3, Weight: 200}, Urgency: 1, Incremental: true}
+		if p != want {
+			t.Errorf("Priority = %+v; want %+v", p, want)
+		}
+	})
+}
+
+func TestServer_PriorityUpdate(t *testing.T) {
+	gotReq := make(chan bool, 1)
+	got := make(chan Priority, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		gotReq <- true
+		deadline := time.Now().Add(2 * time.Second)
+		p, _ := PriorityFromContext(r.Context())
+		for p.Urgency == 1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+			p, _ = PriorityFromContext(r.Context())
+		}
+		got <- p
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader("priority", "u=1, i"),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	<-gotReq
+	// An update for a stream that isn't open is ignored.
+	st.fr.WritePriorityUpdate(7, "u=0")
+	st.fr.WritePriorityUpdate(1, "u=5")
+	want := Priority{PriorityParam: PriorityParam{Weight: 15}, Urgency: 5}
+	if p := <-got; p != want {
+		t.Errorf("Priority after PRIORITY_UPDATE = %+v; want %+v", p, want)
+	}
+}
+
+func TestServer_Request_ContextCanceled(t *testing.T) {
+	tests := []struct {
+		name      string
+		hangUp    func(st *serverTester)
+		wantCause error
+	}{
+		{
+			name:      "reset",
+			hangUp:    func(st *serverTester) { st.fr.WriteRSTStream(1, ErrCodeCancel) },
+			wantCause: StreamError{1, ErrCodeCancel},
+		},
+		{
+			name:      "conn lost",
+			hangUp:    func(st *serverTester) { st.cc.Close() },
+			wantCause: errClientDisconnected,
+		},
+	}
+	for _, tt := range tests {
+		gotReq := make(chan bool, 1)
+		cause := make(chan error, 1)
+		st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+			gotReq <- true
+			select {
+			case <-r.Context().Done():
+				cause <- context.Cause(r.Context())
+			case <-time.After(2 * time.Second):
+				cause <- errors.New("timeout waiting for context cancelation")
+			}
+		})
+		st.greet()
+		st.bodylessReq1()
+		<-gotReq
+		tt.hangUp(st)
+		if err := <-cause; err != tt.wantCause {
+			t.Errorf("%s: context cause = %v; want %v", tt.name, err, tt.wantCause)
+		}
+		st.Close()
+	}
+}
+
+func TestServer_Response_WriteAfterReset(t *testing.T) {
+	gotReq := make(chan bool, 1)
+	errc := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		gotReq <- true
+		<-r.Context().Done()
+		_, err := io.WriteString(w, "too late")
+		errc <- err
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+	<-gotReq
+	st.fr.WriteRSTStream(1, ErrCodeCancel)
+	select {
+	case err := <-errc:
+		if err != ErrStreamReset {
+			t.Errorf("Write error = %v; want ErrStreamReset", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for handler's write")
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		// Outlast the idle timeout; an open stream
+		// keeps the conn busy.
+		time.Sleep(3 * timeout)
+	}, func(srv *Server) {
+		srv.IdleTimeout = timeout
+	})
+	defer st.Close()
+
+	st.greet()
+	st.bodylessReq1()
+	if hf := st.wantHeaders(); !hf.StreamEnded() {
+		t.Fatal("want END_STREAM flag")
+	}
+	ga := st.wantGoAway()
+	if ga.ErrCode != ErrCodeNo {
+		t.Errorf("GOAWAY error code = %v; want %v", ga.ErrCode, ErrCodeNo)
+	}
+	if ga.LastStreamID != 1 {
+		t.Errorf("GOAWAY last stream ID = %d; want 1", ga.LastStreamID)
+	}
+}
+
+func TestServer_DrainConn(t *testing.T) {
+	gotReq := make(chan bool, 1)
+	unblock := make(chan bool)
+	var srv *Server
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		gotReq <- true
+		<-unblock
+		io.WriteString(w, "done")
+	}, func(s *Server) {
+		srv = s
+	})
+	defer st.Close()
+
+	st.greet()
+	st.bodylessReq1()
+	<-gotReq
+	st.scMu.Lock()
+	c := st.sc.conn
+	st.scMu.Unlock()
+	if !srv.DrainConn(c, 0) {
+		t.Fatal("DrainConn didn't find the conn")
+	}
+	ga := st.wantGoAway()
+	if ga.ErrCode != ErrCodeNo || ga.LastStreamID != 1 {
+		t.Errorf("GOAWAY = %v, last stream %d; want NO_ERROR, 1", ga.ErrCode, ga.LastStreamID)
+	}
+
+	// The open stream still gets its response.
+	close(unblock)
+	st.wantHeaders()
+	if df := st.wantData(); string(df.Data()) != "done" || !df.StreamEnded() {
+		t.Errorf("DATA = %q, END_STREAM = %v; want done, true", df.Data(), df.StreamEnded())
+	}
+	if f, err := st.readFrame(); err == nil {
+		t.Errorf("got %v after drained response; want the conn closed", f)
+	}
+}
+
+func TestServer_UnknownFrames(t *testing.T) {
+	type rawFrame struct {
+		c       net.Conn
+		fh      FrameHeader
+		payload string
+	}
+	got := make(chan rawFrame, 1)
+	var srv *Server
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, func(s *Server) {
+		srv = s
+		s.UnknownFrameHandler = func(c net.Conn, f *UnknownFrame) {
+			got <- rawFrame{c, f.FrameHeader, string(f.Payload())}
+		}
+	})
+	defer st.Close()
+	st.greet()
+
+	if err := st.fr.WriteRawFrame(0xf0, 0x1, 0, []byte("ping?")); err != nil {
+		t.Fatal(err)
+	}
+	var rf rawFrame
+	select {
+	case rf = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for UnknownFrameHandler")
+	}
+	if rf.fh.Type != 0xf0 || rf.fh.Flags != 0x1 || rf.payload != "ping?" {
+		t.Errorf("handler got %v %q; want type 0xf0, flags 0x1, payload ping?", rf.fh, rf.payload)
+	}
+
+	if err := srv.WriteRawFrame(rf.c, FrameHeaders, 0, 1, nil); err == nil {
+		t.Error("WriteRawFrame of HEADERS succeeded; want an error")
+	}
+	if err := srv.WriteRawFrame(rf.c, 0xf1, 0, 0, []byte("pong")); err != nil {
+		t.Fatalf("WriteRawFrame: %v", err)
+	}
+	f, err := st.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uf, ok := f.(*UnknownFrame)
+	if !ok || uf.Type != 0xf1 || string(uf.Payload()) != "pong" {
+		t.Errorf("got %v; want the 0xf1 frame with payload pong", f)
+	}
+
+	// The connection still works.
+	st.bodylessReq1()
+	st.wantHeaders()
+}
+
+func TestServer_Grease(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, func(s *Server) {
+		s.Grease = true
+	})
+	defer st.Close()
+	st.writePreface()
+	st.writeInitialSettings()
+
+	var greased bool
+	st.wantSettings().ForeachSetting(func(s Setting) error {
+		if s.ID&0x0f0f == 0x0a0a && s.ID>>12 == (s.ID>>4)&0xf {
+			greased = true
+		}
+		return nil
+	})
+	if !greased {
+		t.Error("no GREASE setting in the server's SETTINGS")
+	}
+	st.writeSettingsAck()
+
+	// The GREASE frame and the ACK of our SETTINGS may come in
+	// either order.
+	var sawGrease, sawAck bool
+	for !sawGrease || !sawAck {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *UnknownFrame:
+			if f.Type%0x1f != 0x0b {
+				t.Errorf("got frame type %v; want a GREASE type", f.Type)
+			}
+			sawGrease = true
+		case *SettingsFrame:
+			sawAck = f.IsAck()
+		default:
+			t.Fatalf("got %v; want a GREASE frame or SETTINGS ACK", f)
+		}
+	}
+	st.bodylessReq1()
+	st.wantHeaders()
+}
+
+func TestServer_DrainConn_Timeout(t *testing.T) {
+	gotReq := make(chan bool, 1)
+	unblock := make(chan bool)
+	defer close(unblock)
+	var srv *Server
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		gotReq <- true
+		<-unblock
+	}, func(s *Server) {
+		srv = s
+	})
+	defer st.Close()
+
+	st.greet()
+	st.bodylessReq1()
+	<-gotReq
+	st.scMu.Lock()
+	c := st.sc.conn
+	st.scMu.Unlock()
+	srv.DrainConn(c, 100*time.Millisecond)
+	st.wantGoAway()
+	if f, err := st.readFrame(); err == nil {
+		t.Errorf("got %v; want the conn closed after the drain timeout", f)
+	}
+	if srv.DrainConn(c, 0) {
+		t.Error("DrainConn found a closed conn")
+	}
+}
+
+func TestServer_ReadTimeout(t *testing.T) {
+	readErr := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			_, err := ioutil.ReadAll(r.Body)
+			readErr <- err
+		}
+	}, func(srv *Server) {
+		srv.ReadTimeout = 50 * time.Millisecond
+	})
+	defer st.Close()
+
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // but never send the body
+		EndHeaders:    true,
+	})
+	st.wantRSTStream(1, ErrCodeCancel)
+	if err := <-readErr; err != errReadTimeout {
+		t.Errorf("body read error = %v; want %v", err, errReadTimeout)
+	}
+
+	// Only the slow stream was reset.
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	if hf := st.wantHeaders(); hf.StreamID != 3 {
+		t.Errorf("HEADERS for stream %d; want 3", hf.StreamID)
+	}
+}
+
+func TestServer_WriteTimeout(t *testing.T) {
+	canceled := make(chan bool, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(2 * time.Second):
+			canceled <- false
+		}
+	}, func(srv *Server) {
+		srv.WriteTimeout = 50 * time.Millisecond
+	})
+	defer st.Close()
+
+	st.greet()
+	st.bodylessReq1()
+	st.wantRSTStream(1, ErrCodeCancel)
+	if !<-canceled {
+		t.Error("handler context not canceled")
+	}
+}
+
+func TestServer_RefusesStreamsBeyondLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  func(*Server)
+	}{
+		{"MaxConcurrentStreams", func(srv *Server) { srv.MaxConcurrentStreams = 1 }},
+		{"MaxHandlers", func(srv *Server) { srv.MaxHandlers = 1 }},
+	}
+	for _, tt := range tests {
+		unblock := make(chan bool)
+		st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+			<-unblock
+		}, tt.opt)
+		st.greet()
+		for _, id := range []uint32{1, 3} {
+			st.writeHeaders(HeadersFrameParam{
+				StreamID:      id,
+				BlockFragment: st.encodeHeader(),
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+		}
+		st.wantRSTStream(3, ErrCodeRefusedStream)
+		close(unblock)
+		if hf := st.wantHeaders(); hf.StreamID != 1 {
+			t.Errorf("%s: HEADERS for stream %d; want 1", tt.name, hf.StreamID)
+		}
+		st.Close()
+	}
+}
+
+func TestServerAcquireHandler(t *testing.T) {
+	srv := &Server{MaxHandlers: 1}
+	if !srv.acquireHandler() {
+		t.Fatal("first acquireHandler failed")
+	}
+	if srv.acquireHandler() {
+		t.Fatal("acquireHandler beyond MaxHandlers succeeded")
+	}
+	srv.releaseHandler()
+	if !srv.acquireHandler() {
+		t.Fatal("acquireHandler after release failed")
+	}
+}
+
+func TestServer_MaxUploadBuffer(t *testing.T) {
+	const bufSize = 1 << 20
+	const bodySize = 200 << 10 // more than the default windows
+	bodyc := make(chan int, 1)
+	unblock := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		slurp, _ := ioutil.ReadAll(r.Body)
+		bodyc <- len(slurp)
+	}, func(srv *Server) {
+		srv.MaxUploadBufferPerConnection = bufSize
+		srv.MaxUploadBufferPerStream = bufSize
+	})
+	defer st.Close()
+
+	st.writePreface()
+	st.writeInitialSettings()
+	sf := st.wantSettings()
+	if v, ok := sf.Value(SettingInitialWindowSize); !ok || v != bufSize {
+		t.Errorf("SETTINGS_INITIAL_WINDOW_SIZE = %d, %v; want %d", v, ok, bufSize)
+	}
+	st.writeSettingsAck()
+	// The WINDOW_UPDATE growing the connection's window and the
+	// ACK of our SETTINGS may come in either order.
+	for gotWU, gotAck := false, false; !gotWU || !gotAck; {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *WindowUpdateFrame:
+			if f.StreamID != 0 || f.Increment != bufSize-initialWindowSize {
+				t.Fatalf("WINDOW_UPDATE = %+v; want conn-level increment of %d", f, bufSize-initialWindowSize)
+			}
+			gotWU = true
+		case *SettingsFrame:
+			if !f.IsAck() {
+				t.Fatal("got non-ACK SETTINGS")
+			}
+			gotAck = true
+		default:
+			t.Fatalf("unexpected %T", f)
+		}
+	}
+
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	chunk := make([]byte, 16<<10)
+	for sent := 0; sent < bodySize; sent += len(chunk) {
+		st.writeData(1, sent+len(chunk) >= bodySize, chunk)
+	}
+	close(unblock)
+	if n := <-bodyc; n < bodySize {
+		t.Errorf("handler read %d bytes; want at least %d", n, bodySize)
+	}
+}
+
 func testRejectRequest(t *testing.T, send func(*serverTester)) {
 	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
 		t.Fatal("server request made it to handler; should've been rejected")
 	})
 	defer st.Close()
 
-	st.greet()
-	send(st)
-	st.wantRSTStream(1, ErrCodeProtocol)
+	st.greet()
+	send(st)
+	st.wantRSTStream(1, ErrCodeProtocol)
+}
+
+func TestServer_Request_Connect(t *testing.T) {
+	const authority = "example.com:443"
+	testServerRequest(t, func(st *serverTester) {
+		st.bodylessReq1(
+			":method", "CONNECT",
+			":scheme", "",
+			":path", "",
+			":authority", authority)
+	}, func(r *http.Request) {
+		if r.URL.Host != authority {
+			t.Errorf("URL.Host = %q; want %q", r.URL.Host, authority)
+		}
+	})
+}
+
+func TestServer_Request_ExtendedConnect(t *testing.T) {
+	testServerRequest(t, func(st *serverTester) {
+		st.bodylessReq1(
+			":method", "CONNECT",
+			":protocol", "websocket",
+			":path", "/chat",
+			":authority", "example.com")
+	}, func(r *http.Request) {
+		if got := r.Header[":protocol"]; len(got) != 1 || got[0] != "websocket" {
+			t.Errorf(":protocol header = %q; want websocket", got)
+		}
+		if r.URL.Path != "/chat" || r.URL.Host != "example.com" {
+			t.Errorf("URL = %v; want path /chat on example.com", r.URL)
+		}
+	})
+}
+
+func TestServer_Request_Reject_Pseudo_Protocol_NotConnect(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) {
+		st.bodylessReq1(":protocol", "websocket", ":authority", "example.com")
+	})
+}
+
+func TestServer_Request_Reject_Pseudo_Protocol_NoAuthority(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) {
+		st.bodylessReq1(":method", "CONNECT", ":protocol", "websocket")
+	})
+}
+
+func TestServer_AcceptConnect(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("X-Accepted", "yes")
+		conn, err := AcceptConnect(w, r)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = io.Copy(conn, conn)
+		return err
+	}, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID: 1,
+			BlockFragment: st.encodeHeader(
+				":method", "CONNECT",
+				":protocol", "websocket",
+				":path", "/chat",
+				":authority", "example.com"),
+			EndStream:  false, // tunneled data coming
+			EndHeaders: true,
+		})
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("tunnel's HEADERS ended the stream")
+		}
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		if len(goth) < 2 || goth[0] != [2]string{":status", "200"} || goth[1] != [2]string{"x-accepted", "yes"} {
+			t.Errorf("Got headers %v; want :status 200 and x-accepted", goth)
+		}
+		st.writeData(1, false, []byte("hello"))
+		for {
+			f, err := st.readFrame()
+			if err != nil {
+				t.Fatalf("Error while expecting the echoed DATA: %v", err)
+			}
+			if _, ok := f.(*WindowUpdateFrame); ok {
+				continue
+			}
+			if df, ok := f.(*DataFrame); !ok || string(df.Data()) != "hello" {
+				t.Fatalf("Got %v; want DATA echoing hello", f)
+			}
+			break
+		}
+		st.writeData(1, true, nil)
+	})
 }
 
-func TestServer_Request_Connect(t *testing.T) {
-	const authority = "example.com:443"
-	testServerRequest(t, func(st *serverTester) {
-		st.bodylessReq1(
-			":method", "CONNECT",
-			":scheme", "",
-			":path", "",
-			":authority", authority)
-	}, func(r *http.Request) {
-		if r.URL.Host != authority {
-			t.Errorf("URL.Host = %q; want %q", r.URL.Host, authority)
+func TestServer_AcceptConnect_NotConnect(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		if _, err := AcceptConnect(w, r); err != errNotConnect {
+			return fmt.Errorf("AcceptConnect error = %v; want %v", err, errNotConnect)
+		}
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		if len(goth) == 0 || goth[0] != [2]string{":status", "200"} {
+			t.Errorf("Got headers %v; want :status 200", goth)
 		}
 	})
 }
@@ -926,6 +1751,27 @@ func TestServer_Ping(t *testing.T) {
 	}
 }
 
+func TestServer_PingFloodWithoutReading(t *testing.T) {
+	st := newServerTester(t, nil, func(sc *serverConn) {
+		// Pretend a write is stuck on a client that isn't
+		// reading, so everything queues.
+		sc.writingFrame = true
+	})
+	defer st.Close()
+	st.addLogFilter("too many control frames queued")
+
+	st.writePreface()
+	st.writeInitialSettings()
+	for i := 0; i <= maxQueuedControlFrames; i++ {
+		if err := st.fr.WritePing(false, [8]byte{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f, err := st.readFrame(); err != io.EOF {
+		t.Fatalf("readFrame = %v, %v; want EOF", f, err)
+	}
+}
+
 func TestServer_RejectsLargeFrames(t *testing.T) {
 	st := newServerTester(t, nil)
 	defer st.Close()
@@ -974,6 +1820,66 @@ func TestServer_Handler_Sends_WindowUpdate(t *testing.T) {
 	st.wantWindowUpdate(0, 3) // no more stream-level, since END_STREAM
 }
 
+// Like TestServer_Handler_Sends_WindowUpdate, but with padded DATA.
+func TestServer_Handler_Sends_WindowUpdate_Padding(t *testing.T) {
+	puppet := newHandlerPuppet()
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		puppet.act(w, r)
+	})
+	defer st.Close()
+	defer puppet.done()
+
+	st.greet()
+
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	st.fr.WriteDataPadded(1, false, []byte("abcdef"), []byte{0, 0, 0, 0})
+
+	// The padding and its length byte are returned right away,
+	// since the handler never reads them.
+	st.wantWindowUpdate(0, 5)
+	st.wantWindowUpdate(1, 5)
+
+	puppet.do(readBodyHandler(t, "abc"))
+	st.wantWindowUpdate(0, 3)
+	st.wantWindowUpdate(1, 3)
+
+	puppet.do(readBodyHandler(t, "def"))
+	st.wantWindowUpdate(0, 3)
+	st.wantWindowUpdate(1, 3)
+}
+
+func TestServer_Response_Padding(t *testing.T) {
+	const msg = "hello, padded world"
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, msg)
+	}, func(srv *Server) {
+		srv.Padding = FixedPadding(7)
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+
+	hf := st.wantHeaders()
+	if !hf.Flags.Has(FlagHeadersPadded) {
+		t.Errorf("HEADERS flags = %v; want PADDED", hf.Flags)
+	}
+	df := st.wantData()
+	if !df.Flags.Has(FlagDataPadded) {
+		t.Errorf("DATA flags = %v; want PADDED", df.Flags)
+	}
+	if got := string(df.Data()); got != msg {
+		t.Errorf("DATA = %q; want %q", got, msg)
+	}
+	if want := uint32(len(msg) + 1 + 7); df.Length != want {
+		t.Errorf("DATA length = %d; want %d", df.Length, want)
+	}
+}
+
 func TestServer_Send_GoAway_After_Bogus_WindowUpdate(t *testing.T) {
 	st := newServerTester(t, nil)
 	defer st.Close()
@@ -1014,6 +1920,66 @@ func TestServer_Send_RstStream_After_Bogus_WindowUpdate(t *testing.T) {
 	st.wantRSTStream(1, ErrCodeFlowControl)
 }
 
+func TestServer_RstStream_After_Zero_WindowUpdate(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		// Stream 1's handler waits on its body until the reset, so
+		// that it can't end the stream first with a CANCEL.
+		ioutil.ReadAll(r.Body)
+		io.WriteString(w, "ok")
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	// A zero increment is only a stream error, so it resets
+	// stream 1 but leaves the connection usable.
+	st.fr.AllowIllegalWrites = true
+	if err := st.fr.WriteWindowUpdate(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rst, ok := f.(*RSTStreamFrame); ok {
+			if rst.StreamID != 1 || rst.ErrCode != ErrCodeProtocol {
+				t.Fatalf("RST_STREAM = %v on stream %d; want PROTOCOL_ERROR on 1", rst.ErrCode, rst.StreamID)
+			}
+			break
+		}
+	}
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	for {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hf, ok := f.(*HeadersFrame); ok && hf.StreamID == 3 {
+			break
+		}
+	}
+}
+
+func TestServer_GoAway_After_Continuation_On_Stream_0(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.greet()
+	st.fr.WriteRawFrame(FrameContinuation, FlagContinuationEndHeaders, 0, nil)
+	if gf := st.wantGoAway(); gf.ErrCode != ErrCodeProtocol {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeProtocol)
+	}
+}
+
 // testServerPostUnblock sends a hanging POST with unsent data to handler,
 // then runs fn once in the handler, and verifies that the error returned from
 // handler is acceptable. It fails if takes over 5 seconds for handler to exit.
@@ -1822,6 +2788,28 @@ func TestServer_Response_Automatic100Continue(t *testing.T) {
 	})
 }
 
+func TestServer_Response_No100ContinueAfterResponse(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusForbidden)
+		// Too late for a 100; this read mustn't send one.
+		_, err := ioutil.ReadAll(r.Body)
+		return err
+	}, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(":method", "POST", "expect", "100-Continue"),
+			EndStream:     false,
+			EndHeaders:    true,
+		})
+		hf := st.wantHeaders()
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		if len(goth) == 0 || goth[0] != [2]string{":status", "403"} {
+			t.Fatalf("Got headers %v; want :status 403 first", goth)
+		}
+		st.writeData(1, true, []byte("ignored"))
+	})
+}
+
 func TestServer_HandlerWriteErrorOnDisconnect(t *testing.T) {
 	errc := make(chan error, 1)
 	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
@@ -1908,7 +2896,7 @@ func TestServer_Rejects_Too_Many_Streams(t *testing.T) {
 		EndHeaders:    false, // CONTINUATION coming
 	})
 	st.writeContinuation(rejectID, true, frag2)
-	st.wantRSTStream(rejectID, ErrCodeProtocol)
+	st.wantRSTStream(rejectID, ErrCodeRefusedStream)
 
 	// But let a handler finish:
 	leaveHandler <- true
@@ -2119,6 +3107,59 @@ func TestServer_ReadFrames_Exits(t *testing.T) {
 // TODO: move this onto *serverTester, and re-use the same hpack
 // decoding context throughout.  We're just getting lucky here with
 // creating a new decoder each time.
+func TestServer_Response_Trailers(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Trailer", "Grpc-Status, Content-Length")
+		w.WriteHeader(200)
+		io.WriteString(w, "hi")
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"X-Checksum", "abc")
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("response HEADERS has END_STREAM; want trailers to follow")
+		}
+		df := st.wantData()
+		if string(df.Data()) != "hi" {
+			t.Errorf("DATA = %q; want hi", df.Data())
+		}
+		if df.StreamEnded() {
+			t.Fatal("DATA has END_STREAM; want trailers to follow")
+		}
+		tf := st.wantHeaders()
+		if !tf.StreamEnded() {
+			t.Error("trailer HEADERS lacks END_STREAM")
+		}
+		got := map[string]string{}
+		for _, kv := range decodeHeader(t, tf.HeaderBlockFragment()) {
+			got[kv[0]] = kv[1]
+		}
+		want := map[string]string{"grpc-status": "0", "x-checksum": "abc"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("trailers = %v; want %v", got, want)
+		}
+	})
+}
+
+func TestServer_Response_DeclaredTrailersUnset(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Trailer", "Grpc-Status")
+		io.WriteString(w, "hi")
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("want DATA after HEADERS")
+		}
+		if df := st.wantData(); !df.StreamEnded() {
+			t.Error("DATA lacks END_STREAM though no trailers were set")
+		}
+	})
+}
+
 func decodeHeader(t *testing.T, headerBlock []byte) (pairs [][2]string) {
 	d := hpack.NewDecoder(initialHeaderTableSize, func(f hpack.HeaderField) {
 		pairs = append(pairs, [2]string{f.Name, f.Value})
@@ -2135,6 +3176,207 @@ func decodeHeader(t *testing.T, headerBlock []byte) (pairs [][2]string) {
 // testServerResponse sets up an idle HTTP/2 connection and lets you
 // write a single request with writeReq, and then reply to it in some way with the provided handler,
 // and then verify the output with the serverTester again (assuming the handler returns nil)
+func TestServer_Response_Flush(t *testing.T) {
+	unblock := make(chan bool)
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		io.WriteString(w, "event: 1\n\n")
+		w.(http.Flusher).Flush()
+		<-unblock
+		return nil
+	}, func(st *serverTester) {
+		defer close(unblock)
+		getSlash(st)
+		if hf := st.wantHeaders(); hf.StreamEnded() {
+			t.Fatal("HEADERS has END_STREAM")
+		}
+		df := st.wantData()
+		if string(df.Data()) != "event: 1\n\n" {
+			t.Errorf("DATA = %q; want the flushed event", df.Data())
+		}
+		if df.StreamEnded() {
+			t.Error("flushed DATA has END_STREAM while handler is still running")
+		}
+	})
+}
+
+func TestServer_Response_FlushedBeforeBodyRead(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		io.WriteString(w, "ready")
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(r.Body, buf); err != nil {
+			return err
+		}
+		io.WriteString(w, string(buf))
+		return nil
+	}, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(":method", "POST"),
+			EndStream:     false,
+			EndHeaders:    true,
+		})
+		st.wantHeaders()
+		if df := st.wantData(); string(df.Data()) != "ready" {
+			t.Fatalf("DATA = %q; want ready", df.Data())
+		}
+		st.writeData(1, true, []byte("ping"))
+		var df *DataFrame
+		for df == nil {
+			f, err := st.readFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch f := f.(type) {
+			case *WindowUpdateFrame:
+			case *DataFrame:
+				df = f
+			default:
+				t.Fatalf("got a %T; want *DataFrame", f)
+			}
+		}
+		if string(df.Data()) != "ping" || !df.StreamEnded() {
+			t.Errorf("DATA = %q, END_STREAM = %v; want ping, true", df.Data(), df.StreamEnded())
+		}
+	})
+}
+
+// pushPromise is a PUSH_PROMISE frame read by readPushedResponses.
+type pushPromise struct {
+	streamID, promiseID uint32
+	header              [][2]string
+}
+
+// readPushedResponses reads frames until streams 1 and 2 have both
+// ended, and returns the PUSH_PROMISEs seen and the DATA per stream.
+func readPushedResponses(t *testing.T, st *serverTester) (promises []pushPromise, data map[uint32]string) {
+	data = map[uint32]string{}
+	ended := map[uint32]bool{}
+	for !ended[1] || !ended[2] {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatalf("reading frames: %v", err)
+		}
+		switch f := f.(type) {
+		case *PushPromiseFrame:
+			promises = append(promises, pushPromise{f.StreamID, f.PromiseID, decodeHeader(t, f.HeaderBlockFragment())})
+		case *HeadersFrame:
+			ended[f.StreamID] = ended[f.StreamID] || f.StreamEnded()
+		case *DataFrame:
+			data[f.StreamID] += string(f.Data())
+			ended[f.StreamID] = ended[f.StreamID] || f.StreamEnded()
+		}
+	}
+	return
+}
+
+func TestServer_Push(t *testing.T) {
+	pushErr := make(chan error, 1)
+	recursiveErr := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/style.css" {
+			// Pushed streams can't push.
+			recursiveErr <- w.(http.Pusher).Push("/more.css", nil)
+			io.WriteString(w, "css")
+			return
+		}
+		pushErr <- w.(http.Pusher).Push("/style.css", nil)
+		io.WriteString(w, "page")
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1(":authority", "example.com")
+
+	promises, data := readPushedResponses(t, st)
+	if len(promises) != 1 {
+		t.Fatalf("got %d PUSH_PROMISEs; want 1", len(promises))
+	}
+	pp := promises[0]
+	if pp.streamID != 1 || pp.promiseID != 2 {
+		t.Errorf("PUSH_PROMISE on stream %d promising %d; want 1, 2", pp.streamID, pp.promiseID)
+	}
+	goth := pp.header
+	wanth := [][2]string{
+		{":method", "GET"},
+		{":scheme", "https"},
+		{":authority", "example.com"},
+		{":path", "/style.css"},
+	}
+	if !reflect.DeepEqual(goth, wanth) {
+		t.Errorf("promised headers = %v; want %v", goth, wanth)
+	}
+	if data[1] != "page" || data[2] != "css" {
+		t.Errorf("responses = %q; want page on 1 and css on 2", data)
+	}
+	if err := <-pushErr; err != nil {
+		t.Errorf("Push = %v", err)
+	}
+	if err := <-recursiveErr; err != ErrRecursivePush {
+		t.Errorf("Push from pushed stream = %v; want ErrRecursivePush", err)
+	}
+}
+
+func TestServer_Push_DisabledByClient(t *testing.T) {
+	errc := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		errc <- w.(http.Pusher).Push("/style.css", nil)
+	})
+	defer st.Close()
+	st.greet()
+	if err := st.fr.WriteSettings(Setting{SettingEnablePush, 0}); err != nil {
+		t.Fatal(err)
+	}
+	st.wantSettingsAck()
+	st.bodylessReq1(":authority", "example.com")
+	if err := <-errc; err != http.ErrNotSupported {
+		t.Errorf("Push = %v; want http.ErrNotSupported", err)
+	}
+}
+
+func TestServer_PushPreloads(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			io.WriteString(w, "pushed "+r.URL.Path)
+			return
+		}
+		w.Header().Add("Link", "</a.css>; rel=preload; as=style, </b.js>; rel=preload; nopush")
+		w.Header().Add("Link", "<https://other.example/c.js>; rel=preload, </d.png>; rel=prefetch")
+		io.WriteString(w, "page")
+	}, func(srv *Server) {
+		srv.PushPreloads = true
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1(":authority", "example.com")
+
+	promises, data := readPushedResponses(t, st)
+	if len(promises) != 1 {
+		t.Fatalf("got %d PUSH_PROMISEs; want 1 (for /a.css)", len(promises))
+	}
+	if data[2] != "pushed /a.css" {
+		t.Errorf("pushed response = %q; want %q", data[2], "pushed /a.css")
+	}
+}
+
+func TestPreloadLinks(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"</a.css>; rel=preload"}, []string{"/a.css"}},
+		{[]string{`</a.css>; rel="preload"; as=style, </b.js>; rel=preload`}, []string{"/a.css", "/b.js"}},
+		{[]string{"</a.css>; rel=preload; nopush"}, nil},
+		{[]string{`</a,b.css>; rel="prefetch preload"`}, []string{"/a,b.css"}},
+		{[]string{"</a.css>; rel=stylesheet", "<b.js>; REL=Preload"}, []string{"b.js"}},
+		{[]string{"garbage"}, nil},
+	}
+	for _, tt := range tests {
+		if got := preloadLinks(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("preloadLinks(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
 func testServerResponse(t testing.TB,
 	handler func(http.ResponseWriter, *http.Request) error,
 	client func(*serverTester),
@@ -8,17 +8,23 @@ package http2
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/phuslu/http2/hpack"
@@ -30,28 +36,487 @@ type Transport struct {
 	// TODO: remove this and make more general with a TLS dial hook, like http
 	InsecureTLSDial bool
 
+	// TLSClientConfig, if non-nil, is the TLS configuration of the
+	// connections the Transport dials. It's cloned, and the clone's
+	// NextProtos, and ServerName if empty, are set by the
+	// Transport. Its other fields are kept, so Encrypted Client
+	// Hello can be used by setting EncryptedClientHelloConfigList;
+	// if a server rejects the config and sends others to retry
+	// with, the dial is retried once with those. Whether ECH was
+	// accepted is in each response's TLS.ECHAccepted.
+	TLSClientConfig *tls.Config
+
+	// HostTLSConfigs overrides TLSClientConfig for particular
+	// hosts, so that one Transport can talk both to internal
+	// services, with their own roots or client certificates, and
+	// to the public internet. Keys are lowercase host names or IP
+	// addresses, without a port, or patterns like "*.example.com"
+	// that match any name ending in ".example.com". An exact key
+	// is preferred to a pattern, and a longer pattern to a shorter
+	// one.
+	HostTLSConfigs map[string]*tls.Config
+
+	// NextProtos lists the protocols the Transport offers in ALPN,
+	// such as {"h2", "http/1.1"}, in order of preference. "h2" is
+	// added first if it's missing; otherwise the order is kept. If
+	// empty, only "h2" is offered. When the server
+	// picks another protocol, the connection is closed, and the
+	// request goes through that protocol's ProtocolFallbacks
+	// entry, or else Fallback, or fails with an *ALPNError.
+	NextProtos []string
+
+	// ProtocolFallbacks overrides Fallback for hosts whose servers
+	// picked a protocol other than HTTP/2 in ALPN. It's keyed by
+	// that protocol, or "" for servers that didn't negotiate one.
+	ProtocolFallbacks map[string]http.RoundTripper
+
 	// Proxy specifies a function to return a proxy for a given
 	// Request. If the function returns a non-nil error, the
 	// request is aborted with the provided error.
 	// If Proxy is nil or returns a nil *URL, no proxy is used.
 	Proxy func(*http.Request) (*url.URL, error)
 
-	connMu sync.Mutex
-	conns  map[string][]*clientConn // key is host:port
+	// Control, if non-nil, is called with each TCP connection the
+	// Transport dials, after it's created but before it connects,
+	// as with net.Dialer.Control. It can set socket options such
+	// as TCP_USER_TIMEOUT or SO_MARK. An error aborts the dial.
+	Control func(network, address string, c syscall.RawConn) error
+
+	// KeepAlive is the TCP keep-alive period of the connections
+	// the Transport dials, as with net.Dialer.KeepAlive. If zero,
+	// Go's default is used. If negative, keep-alives are disabled.
+	KeepAlive time.Duration
+
+	// OnRequest, if non-nil, is called with a copy of each request,
+	// CONNECTs included, just before its headers are encoded, and
+	// may change it: to add an auth token or tracing headers, say,
+	// or rewrite Host. An error fails the request. A hedged request
+	// is passed to it once per attempt. It must not replace the
+	// request's Body.
+	OnRequest func(req *http.Request) error
+
+	// DialTLS, if non-nil, dials the connections to servers in
+	// place of the Transport's own TLS dialing, which Control and
+	// KeepAlive then don't apply to. cfg is the TLS config the
+	// Transport would have used. A *tls.Conn it returns is
+	// checked to have negotiated HTTP/2 as usual; any other conn
+	// is assumed to speak HTTP/2 already, as the in-memory
+	// servers of package http2test do.
+	DialTLS func(network, addr string, cfg *tls.Config) (net.Conn, error)
+
+	// PingInterval, if non-zero, is how often each connection
+	// sends a PING frame to the server. A connection whose PING
+	// isn't acknowledged within PingTimeout is closed, and the
+	// next request dials a new one.
+	PingInterval time.Duration
+
+	// PingTimeout is how long to wait for a PING acknowledgement.
+	// If zero, a default of 15 seconds is used.
+	PingTimeout time.Duration
+
+	// ReadIdleTimeout, if non-zero, is how long a connection may
+	// go without receiving a frame before it's health checked
+	// with a PING. A connection whose PING isn't acknowledged
+	// within PingTimeout is closed and taken out of the pool, so a
+	// peer that vanished without closing the TCP connection is
+	// noticed before requests are sent to it.
+	ReadIdleTimeout time.Duration
+
+	// StreamIdleTimeout, if non-zero, is how long a stream may go
+	// without a frame sent or received on it, as when a server
+	// never answers or stalls mid-body, or a caller abandons a
+	// response body, before it's reset with CANCEL. Its request or
+	// body read then fails with ErrStreamIdleTimeout. Streams are
+	// checked every StreamIdleTimeout/2. CONNECT tunnels, which
+	// may rightly sit idle, are left alone.
+	StreamIdleTimeout time.Duration
+
+	// FlowControlTimeout, if non-zero, is how long sending a DATA
+	// frame of a request body, or a Write to a CONNECT tunnel, may
+	// wait for the server to open its flow control window. A
+	// stream stalled longer than that is reset with CANCEL, and
+	// the request or Write fails with ErrFlowControlTimeout.
+	FlowControlTimeout time.Duration
+
+	// SettingsTimeout, if non-zero, is how long a new connection
+	// waits for the server's SETTINGS frame after the TLS
+	// handshake. A server that negotiates HTTP/2 but sends no
+	// SETTINGS in time is probably behind a middlebox that drops
+	// HTTP/2, and is treated as not speaking HTTP/2.
+	SettingsTimeout time.Duration
+
+	// PrefaceTimeout bounds the whole HTTP/2 setup of a new
+	// connection after the TLS handshake: writing the client
+	// preface and SETTINGS, reading the server's SETTINGS and
+	// acknowledging them. A connection that doesn't finish in time
+	// is closed and the dial fails. If zero, a default of 10
+	// seconds is used.
+	PrefaceTimeout time.Duration
+
+	// SettingsAckTimeout is how long a connection waits for the
+	// server to acknowledge the client's SETTINGS. A server that
+	// doesn't is sent a GOAWAY with SETTINGS_TIMEOUT and the
+	// connection is closed, failing its requests. If zero, a
+	// default of 10 seconds is used.
+	SettingsAckTimeout time.Duration
+
+	// DefaultMaxConcurrentStreams is the limit on concurrent
+	// streams assumed for a connection whose server hasn't sent
+	// SETTINGS_MAX_CONCURRENT_STREAMS, which per the spec means
+	// there's none. Once the server sends it, in its first
+	// SETTINGS or later, its value is followed instead. If zero,
+	// 1000 is used.
+	DefaultMaxConcurrentStreams uint32
+
+	// StrictMaxConcurrentStreams, if true, makes a request that
+	// finds a connection at the server's concurrent stream limit
+	// wait on it for a stream to finish, as net/http2 does, rather
+	// than dial another connection to the same host. That keeps
+	// to one connection per host, for servers that limit clients
+	// by the streams they run rather than by the connection.
+	StrictMaxConcurrentStreams bool
+
+	// MaxConnStreams, if non-zero, is how many streams a
+	// connection opens in all before it takes no new requests,
+	// finishing those it has and then closing. Stream IDs run out
+	// after about a billion in any case. A replacement connection
+	// is dialed in the background once 90% are used, so that
+	// requests don't wait on a dial when the old one runs out.
+	MaxConnStreams uint32
+
+	// FallbackDuration is how long the Transport remembers that
+	// a host doesn't speak HTTP/2: that ALPN picked another
+	// protocol, or that the server didn't start the connection
+	// with a SETTINGS frame. If there's a Fallback or
+	// ProtocolFallbacks entry for it, requests to such a host are
+	// sent through that, without another HTTP/2 dial, until then.
+	// If zero, a default of 5 minutes is used.
+	FallbackDuration time.Duration
+
+	// MaxConnErrors, if non-zero, is how many errors a connection
+	// may see within ConnErrorWindow before it's marked unhealthy.
+	// An unhealthy connection takes no new requests, so they go
+	// to another connection or a freshly dialed one, and it's
+	// closed once its remaining streams finish. Errors are
+	// RST_STREAM frames from the server with a code other than
+	// NO_ERROR, streams the Transport resets for a protocol or
+	// flow control error, and PINGs slower than SlowPingRTT.
+	MaxConnErrors int
+
+	// ConnErrorWindow is how long an error counts toward
+	// MaxConnErrors. If zero, a default of 1 minute is used.
+	ConnErrorWindow time.Duration
+
+	// SlowPingRTT, if non-zero, is the round trip time above
+	// which a PING sent because of PingInterval counts as an
+	// error toward MaxConnErrors.
+	SlowPingRTT time.Duration
+
+	// CalmBackoff is how long requests to a host wait before
+	// starting a stream after it sends ENHANCE_YOUR_CALM, in an
+	// RST_STREAM or a GOAWAY. The wait doubles with each further
+	// ENHANCE_YOUR_CALM, up to MaxCalmBackoff, and is forgotten
+	// once the host has gone MaxCalmBackoff past the end of the
+	// last one without another. If zero, a default of 100
+	// milliseconds is used.
+	CalmBackoff time.Duration
+
+	// MaxCalmBackoff caps the wait that CalmBackoff grows to. If
+	// zero, a default of 10 seconds is used.
+	MaxCalmBackoff time.Duration
+
+	// StrictProtocolChecks, if true, treats spec violations by
+	// the server as errors: a malformed response header block
+	// (pseudo-headers after regular headers, unknown
+	// pseudo-headers, invalid or uppercase header field names)
+	// fails the request with a stream error, and DATA beyond the
+	// advertised flow control window resets the stream or closes
+	// the connection. If false, such violations are logged and
+	// tolerated.
+	//
+	// A response without exactly one valid :status always fails
+	// with a stream error, since there is no status to report.
+	StrictProtocolChecks bool
+
+	// MaxHeaderListSize is the largest response header list the
+	// Transport accepts, advertised to servers as
+	// SETTINGS_MAX_HEADER_LIST_SIZE. It counts the decoded size
+	// of each field plus 32 bytes, so it bounds what a small,
+	// heavily compressed header block can expand to. A response
+	// exceeding it fails with a stream error. If zero, a default
+	// of 10 MB is used.
+	MaxHeaderListSize uint32
+
+	// MaxReadFrameSize is the largest frame the Transport reads,
+	// advertised to servers as SETTINGS_MAX_FRAME_SIZE. A server
+	// sending a larger frame has its connection closed with
+	// FRAME_SIZE_ERROR before the frame's payload is read. A valid
+	// value is between 16k and 16M, inclusive. If zero or
+	// otherwise invalid, a default of 1 MB is used.
+	MaxReadFrameSize uint32
+
+	// MaxControlFrameRate is the most PING, SETTINGS, and empty
+	// DATA frames per second a connection accepts from the
+	// server. These cost the server nothing to send but make the
+	// Transport do work, so a connection exceeding the rate is
+	// closed with ENHANCE_YOUR_CALM. If zero, a default of 1000
+	// is used. If negative, there is no limit.
+	MaxControlFrameRate int
+
+	// SensitiveHeaders names request header fields, in addition
+	// to Authorization, Proxy-Authorization and Cookie, that are
+	// HPACK-encoded as never-indexed literals, so that an
+	// intermediary that shares the compression context can't
+	// probe their values.
+	SensitiveHeaders []string
+
+	// UnknownFrameHandler, if non-nil, is called with each frame
+	// of a type this package doesn't implement, such as an
+	// experimental extension frame, that a server sends.
+	// Otherwise such frames are ignored, as the spec requires. It
+	// runs on the connection's frame-reading goroutine, so it
+	// must not block, and the frame's payload is only valid until
+	// it returns.
+	UnknownFrameHandler func(f *UnknownFrame)
+
+	// Grease, if true, adds a reserved SETTINGS identifier and a
+	// frame of a reserved type to the connection preface, as
+	// browsers do, so servers and middleboxes that wrongly reject
+	// unknown settings or frames get caught early, and so the
+	// preface looks less unusual.
+	Grease bool
+
+	// CaptureFrames, if non-nil, is called with each new
+	// connection to a server and may return a writer for a
+	// FrameCapture of the connection's frames, such as a file, so
+	// that protocol bugs seen in production can be inspected and
+	// replayed offline. The writer is closed, if it's an io.Closer,
+	// once the connection is. Frames are written to it as they're
+	// sent and received, on the connection's goroutines, so it
+	// shouldn't block.
+	CaptureFrames func(c net.Conn) io.Writer
+
+	// Faults, if non-nil, injects faults into each connection's
+	// frames, for testing an application's retry and timeout
+	// handling against a misbehaving connection. It's not for
+	// production use.
+	Faults FaultInjector
+
+	// Clock, if non-nil, replaces the real clock for the
+	// Transport's timers, such as those for PINGs and hedging,
+	// for tests and simulations.
+	Clock Clock
+
+	// Padding, if non-nil, chooses how much padding to add to
+	// each request DATA and HEADERS frame. See FixedPadding and
+	// RandomPadding.
+	Padding PaddingPolicy
+
+	// DisableCompression, if true, prevents the Transport from
+	// requesting compression with an "Accept-Encoding" request
+	// header when the Request contains no existing
+	// Accept-Encoding value. If the Transport requests
+	// compression on its own and gets an encoded response it has
+	// a decoder for, it's transparently decoded in the
+	// Response.Body. However, if the user explicitly requested
+	// compression it is not automatically uncompressed.
+	DisableCompression bool
+
+	// ContentDecoders adds to or overrides the response body
+	// decoders, keyed by lowercase content coding, that the
+	// Transport advertises and uses when it requests compression
+	// itself. Only gzip is built in, so by default only gzip is
+	// advertised: the standard library has no br or zstd decoder,
+	// and an application that wants either must register one here.
+	// Mapping a coding to nil stops its use.
+	ContentDecoders map[string]ContentDecoder
+
+	// MaxResponseBodySize, if positive, limits each response body
+	// to that many bytes, counted both as received and, for a body
+	// the Transport decodes, as decoded. A response over the limit
+	// has its stream reset, and reads of its body fail with
+	// ErrResponseTooLarge. A request can override it with
+	// WithMaxResponseBodySize.
+	MaxResponseBodySize int64
+
+	// ResponseRateLimiter, if non-nil, returns the RateLimiter
+	// that paces reads of the body of the response to req, or nil
+	// for none. Requests that share a RateLimiter share its rate,
+	// so returning one per user caps each user's bandwidth. Since
+	// the Transport only gives flow control credit back to the
+	// server as a body is read, the server slows down to match.
+	ResponseRateLimiter func(req *http.Request) RateLimiter
+
+	// RequestRateLimiter, if non-nil, returns the RateLimiter that
+	// paces the DATA frames carrying the body of req, or nil for
+	// none. It's consulted before each frame, with the frame's
+	// size, so a bulk upload held to a low rate leaves the
+	// connection free for other streams. Returning the same
+	// RateLimiter for several requests caps them together. If
+	// the RateLimiter fails, the request fails with its error.
+	RequestRateLimiter func(req *http.Request) RateLimiter
+
+	// RequestEncoding, if non-empty, is the content coding, such
+	// as "gzip", in which the Transport compresses request bodies
+	// of a known, non-zero length as it sends them. It then sets
+	// Content-Encoding and sends no Content-Length, since the
+	// encoded length isn't known up front. Requests with a
+	// Content-Encoding of their own are sent as is. A request can
+	// override it with WithRequestEncoding.
+	RequestEncoding string
+
+	// ContentEncoders adds to or overrides the request body
+	// encoders, keyed by lowercase content coding, that
+	// RequestEncoding and WithRequestEncoding choose from. gzip is
+	// built in; an application can add zstd or others here.
+	ContentEncoders map[string]ContentEncoder
+
+	// PushedResponseCache, if non-nil, makes the Transport accept
+	// server push: the responses servers promise go into it, and
+	// RoundTrip answers GET and HEAD requests from it when it can,
+	// rather than opening a stream. Only pushes for the authority
+	// of the request they came with are accepted. If nil, the
+	// Transport tells servers not to push.
+	PushedResponseCache PushedResponseCache
+
+	// PushPolicy is how the Transport treats a server that pushes
+	// even though it was told not to, when PushedResponseCache is
+	// nil. The default, PushRefuse, resets the pushed streams.
+	PushPolicy PushPolicy
+
+	// OnConnOpen, OnGoAway and OnConnClose, if non-nil, are
+	// called as the Transport's connections come and go, so that
+	// connection churn can be logged and alerted on. OnConnOpen is
+	// called once a new connection has exchanged SETTINGS, before
+	// it takes requests, and OnConnClose once it has closed, with
+	// why: io.EOF if the server closed it. OnGoAway is called with
+	// each GOAWAY frame a server sends, on the connection's
+	// frame-reading goroutine; the frame is only valid until it
+	// returns. None of them may block.
+	OnConnOpen  func(cc *ClientConn)
+	OnGoAway    func(cc *ClientConn, f *GoAwayFrame)
+	OnConnClose func(cc *ClientConn, err error)
+
+	// OnStreamOpen and OnStreamClose, if non-nil, are called as
+	// each request's stream, or each pushed stream, opens and
+	// closes, as for access logs. OnStreamOpen is called once the
+	// request's HEADERS are sent. They're called in order, from the
+	// connection's goroutines though not with it locked; still,
+	// they hold it up, so they must not block or use it.
+	OnStreamOpen  func(s StreamStats)
+	OnStreamClose func(s StreamStats)
+
+	// StatsWindow is how far back HostStats looks at closed
+	// streams. If zero, a default of 1 minute is used.
+	StatsWindow time.Duration
+
+	// connMu guards the pool. It's never held while dialing, so
+	// that a slow host holds up only its own requests.
+	connMu  sync.RWMutex
+	conns   map[string][]*ClientConn // key is host:port
+	dialing map[string]*dialCall     // key is host:port
+	noHTTP2 map[string]noHTTP2Host   // key is host:port
+
+	calmMu sync.Mutex
+	calm   map[string]calmHost // key is host:port
+
+	statsMu    sync.Mutex
+	stats      map[string]*hostSamples // key is host:port
+	statsSwept time.Time               // when stats last had idle hosts dropped
+}
+
+// dialCall is a dial in progress to a host:port, which other
+// requests for it wait on rather than dial one more conn each.
+type dialCall struct {
+	done chan struct{} // closed once cc and err are set
+	cc   *ClientConn
+	err  error
+}
+
+// noHTTP2Host records a host that doesn't speak HTTP/2.
+type noHTTP2Host struct {
+	err   error     // a noHTTP2Error
+	until time.Time // when to try HTTP/2 again
+}
+
+// noHTTP2Error is returned by newClientConn when the server turns
+// out not to speak HTTP/2, rather than being unreachable.
+type noHTTP2Error struct {
+	err error
+}
+
+func (e noHTTP2Error) Error() string { return e.err.Error() }
+func (e noHTTP2Error) Unwrap() error { return e.err }
+
+// An ALPNError is the error for a connection to a server that
+// chose a protocol other than HTTP/2 in ALPN.
+type ALPNError struct {
+	Protocol string // the server's choice, or "" if it made none
+}
+
+func (e *ALPNError) Error() string {
+	if e.Protocol == "" {
+		return "http2: server didn't negotiate a protocol"
+	}
+	return fmt.Sprintf("http2: server negotiated %q, not %q", e.Protocol, NextProtoTLS)
+}
+
+// fallback returns the RoundTripper through which a request whose
+// conn failed with err should go, or nil if it should fail.
+func (t *Transport) fallback(err error) http.RoundTripper {
+	ne, ok := err.(noHTTP2Error)
+	if !ok {
+		return nil
+	}
+	if ae, ok := ne.err.(*ALPNError); ok {
+		if rt, ok := t.ProtocolFallbacks[ae.Protocol]; ok {
+			return rt
+		}
+	}
+	return t.Fallback
+}
+
+// nextProtos returns the protocols to offer in ALPN: NextProtos, with
+// "h2" in front if it's not already among them.
+func (t *Transport) nextProtos() []string {
+	for _, p := range t.NextProtos {
+		if p == NextProtoTLS {
+			return append([]string(nil), t.NextProtos...)
+		}
+	}
+	return append([]string{NextProtoTLS}, t.NextProtos...)
 }
 
-type clientConn struct {
+// ClientConn is a Transport's HTTP/2 connection to a server. See
+// Transport.ClientConns.
+type ClientConn struct {
 	t        *Transport
-	tconn    *tls.Conn
-	tlsState *tls.ConnectionState
-	connKey  []string // key(s) this connection is cached in, in t.conns
+	tconn    net.Conn
+	tlsState *tls.ConnectionState // nil if tconn isn't TLS
+	connKey  []string             // key(s) this connection is cached in, in t.conns
 
-	readerDone chan struct{} // closed on error
-	readerErr  error         // set before readerDone is closed
-	hdec       *hpack.Decoder
-	nextRes    *http.Response
+	readerDone       chan struct{} // closed on error
+	readerErr        error         // set before readerDone is closed
+	hdec             *hpack.Decoder
+	nextRes          *http.Response
+	inflow           flow  // conn-wide inbound flow control; owned by readLoop
+	settingsAckTimer Timer // closes the conn if our SETTINGS go unacknowledged
+	readIdleTimer    Timer // health checks the conn; nil unless t.ReadIdleTimeout is set
+	reapTimer        Timer // runs reapIdleStreams; nil unless t.StreamIdleTimeout is set
+
+	// Per-header-block state, owned by readLoop:
+	sawRegularHeader bool   // saw a non-pseudo header field
+	resInvalid       bool   // header block is malformed
+	resHeaderSize    uint32 // decoded size of fields seen so far
+	resTrailers      bool   // header block is trailers
+	keepRaw          bool   // record fields in rawFields; see WithRawHeaders
+	rawFields        []hpack.HeaderField
+	push             *promise // the header block is a PUSH_PROMISE's
+	lastPushID       uint32   // highest stream promised so far
 
 	mu           sync.Mutex
+	cond         sync.Cond // on mu; signaled when a stream may be able to send
+	outflow      flow      // conn-wide outbound flow control
 	closed       bool
 	goAway       *GoAwayFrame // if non-nil, the GoAwayFrame we received
 	streams      map[uint32]*clientStream
@@ -60,24 +525,140 @@ type clientConn struct {
 	werr         error // first write error that has occurred
 	br           *bufio.Reader
 	fr           *Framer
-	// Settings from peer:
+	// Settings from peer, as sent and as applied:
+	peer                 PeerSettings
 	maxFrameSize         uint32
 	maxConcurrentStreams uint32
 	initialWindowSize    uint32
-	hbuf                 bytes.Buffer // HPACK encoder writes into this
+	extendedConnect      bool        // SETTINGS_ENABLE_CONNECT_PROTOCOL
+	hbuf                 headerBlock // HPACK encoder writes into this
 	henc                 *hpack.Encoder
+	pings                map[[8]byte]chan struct{} // in flight PING data to notification channel
+
+	// Our settings: those the server hasn't acknowledged yet, oldest
+	// first, and the stream window the server has acknowledged.
+	sentSettings []sentSettings
+	inWindowSize uint32
+
+	pushed   int          // server-pushed streams in streams; see ownStreams
+	prioTree priorityTree // of our streams, ordering their DATA; see outranked
+	closeErr error        // why we closed cc, if we did; see closeReason
+
+	// Closed streams for readLoop to let go of, unless it's done,
+	// and streams nothing refers to anymore, for newStream to reuse;
+	// see releaseStreamLocked.
+	retired      []*clientStream
+	readLoopDone bool
+	freeStreams  []*clientStream
+
+	// Request bodies waiting for one of cc's body writers, and how
+	// many of those there are, and are waiting on bodyCond for
+	// more; see queueRequestBody.
+	bodyQueue       []queuedBody
+	bodyCond        sync.Cond // on mu; signaled when a body is queued
+	bodyWriters     int
+	idleBodyWriters int
+
+	// Calls to Transport.OnStreamOpen and OnStreamClose put off until
+	// mu is unlocked, and held while they're made, to keep them in
+	// order; see unlock.
+	streamEvents []streamEvent
+	hookMu       sync.Mutex
+
+	// Health, per Transport.MaxConnErrors:
+	errTimes  []time.Time // recent errors, oldest first
+	unhealthy bool        // too many errors; take no new requests
+
+	replacing bool // a replacement is being dialed; see replaceIfNearlyExhausted
+
+	capture *FrameCapture // per Transport.CaptureFrames, or nil
 }
 
 type clientStream struct {
-	ID   uint32
-	resc chan resAndError
-	pw   *io.PipeWriter
-	pr   *io.PipeReader
+	ID        uint32
+	resc      chan resAndError
+	body      *pipe          // response body, buffered by readLoop; nil until HEADERS
+	bodyPipe  pipe           // what body points to, once it's set
+	inflow    flow           // what the server is allowed to send us; guarded by cc.mu
+	outflow   flow           // what we're allowed to send the server; guarded by cc.mu
+	isHead    bool           // request method is HEAD
+	authority string         // request :authority, which pushes must match
+	method    string         // request :method
+	res       *http.Response // once the final response headers arrive; owned by readLoop
+	interim   int            // 1xx responses seen before res; owned by readLoop
+
+	// trailer is the response's trailers, set by readLoop before
+	// the body reaches EOF, and rawTrailer the fields they came
+	// from, if raw is non-nil. raw is from the request's context;
+	// see WithRawHeaders.
+	trailer    http.Header
+	raw        *RawHeaders
+	rawTrailer []hpack.HeaderField
+
+	// ctx is the request's context. reqLimiter and resLimiter, if
+	// non-nil, pace the sending of the request body and reads of
+	// the response body; see Transport.RequestRateLimiter and
+	// ResponseRateLimiter.
+	ctx        context.Context
+	reqLimiter RateLimiter
+	resLimiter RateLimiter
+
+	// requestedEncoding is whether the Transport added
+	// Accept-Encoding itself, and so should decode the response.
+	requestedEncoding bool
+
+	// bodyEncoder, if non-nil, encodes the request body as it's
+	// sent, per Transport.RequestEncoding.
+	bodyEncoder ContentEncoder
+
+	// reqBody is the request body until writeRequestBody is done
+	// with it and closes it; guarded by cc.mu. See
+	// abortRequestBody.
+	reqBody io.ReadCloser
+
+	// Response body accounting, owned by readLoop:
+	declBodyBytes int64 // or -1 if undeclared
+	bodyBytes     int64 // body bytes seen so far
+	maxBodyBytes  int64 // or -1 if unlimited; see MaxResponseBodySize
+
+	state streamState // guarded by cc.mu; see sentEndStream
+
+	// For Transport.StreamIdleTimeout, guarded by cc.mu:
+	tunnel     bool      // a CONNECT stream, exempt from it
+	lastActive time.Time // when a frame was last sent or received
+
+	// For WithResponseBodyTimeout, guarded by cc.mu:
+	bodyTimeout responseBodyTimeout
+	bodyTimer   Timer     // runs checkBodyTimeout; nil when not armed
+	lastData    time.Time // when DATA last arrived or the body was last drained
+
+	// For Transport.OnStreamOpen and OnStreamClose, guarded by
+	// cc.mu:
+	start             time.Time
+	status            int
+	bytesIn, bytesOut int64
+
+	// prio is the stream's priority, from reqPrio if the request
+	// has one; see WithPriority. sending is whether the request
+	// body is waiting to send DATA; see outranked. All are guarded
+	// by cc.mu.
+	prio    Priority
+	reqPrio *requestPriority
+	sending bool
+
+	abandoned bool // do stopped waiting for the response; guarded by cc.mu
+
+	// refs counts what may still use the stream: cc, until
+	// readLoop is done with it after it closes; the caller of do;
+	// the response body; writeRequestBody; and the body timer.
+	// Once it's zero, the stream is recycled. guarded by cc.mu.
+	refs int
 }
 
 type stickyErrWriter struct {
-	w   io.Writer
-	err *error
+	w     io.Writer
+	err   *error
+	onErr func() // if non-nil, called on the first error
 }
 
 func (sew stickyErrWriter) Write(p []byte) (n int, err error) {
@@ -86,6 +667,9 @@ func (sew stickyErrWriter) Write(p []byte) (n int, err error) {
 	}
 	n, err = sew.w.Write(p)
 	*sew.err = err
+	if err != nil && sew.onErr != nil {
+		sew.onErr()
+	}
 	return
 }
 
@@ -96,72 +680,123 @@ func (t *Transport) RoundTrip(req *http.Request) (res *http.Response, err error)
 		}
 		return t.Fallback.RoundTrip(req)
 	}
+	if res := t.pushedResponse(req); res != nil {
+		return res, nil
+	}
 
-	var host, port string
-	if t.Proxy == nil {
-		host, port, err = net.SplitHostPort(req.URL.Host)
-		if err != nil {
-			host = req.URL.Host
-			port = "443"
-		}
-	} else {
+	host, port := hostPort(req.URL)
+	if t.Proxy != nil {
 		u, err := t.Proxy(req)
 		if err != nil {
 			return nil, err
 		}
-		host, port, err = net.SplitHostPort(u.Host)
-		if err != nil {
-			host = u.Host
-			port = "443"
+		host, port = hostPort(u)
+	}
+
+	key := net.JoinHostPort(host, port)
+	if err := t.waitCalm(req.Context(), key); err != nil {
+		return nil, err
+	}
+	if delay, ok := hedgeDelay(req); ok {
+		res, err = t.roundTripHedged(req, host, port, delay)
+	} else {
+		var cc *ClientConn
+		if cc, err = t.getClientConn(host, port); err == nil {
+			res, err = t.roundTripRetry(req.Context(), cc, req, host, port)
 		}
 	}
+	if fb := t.fallback(err); fb != nil {
+		return fb.RoundTrip(req)
+	}
+	return res, err
+}
 
-	const maxRetryRequest int = 3
-	for i := 0; i < maxRetryRequest; i++ {
-		cc, err := t.getClientConn(host, port)
-		if err != nil {
+const maxRetryRequest = 3
+
+// roundTripRetry sends req on cc, as do does with ctx, and sends it
+// again on another conn to host:port, rewound by rewindRequest, if
+// it fails in a way shouldRetryRequest allows, up to
+// maxRetryRequest tries in all, unless WithoutRetry says not to.
+// The response has req as its Request.
+//
+// A request the server refused with a GOAWAY is sent again once,
+// whatever its method, and never on the conn that refused it: per
+// RFC 7540 section 6.8, the server didn't process it, but a server
+// refusing it twice is best left alone.
+func (t *Transport) roundTripRetry(ctx context.Context, cc *ClientConn, req *http.Request, host, port string) (*http.Response, error) {
+	orig := req
+	key := net.JoinHostPort(host, port)
+	resent := false
+	for i := 1; ; i++ {
+		re := cc.do(ctx, req)
+		if re.err == nil {
+			re.res.Request = orig
+			re.res.TLS = cc.tlsState
+			return re.res, nil
+		}
+		err := re.err
+		var exclude *ClientConn
+		switch {
+		case noRetry(ctx):
 			return nil, err
+		case err == errRequestUnprocessed && !resent:
+			resent, exclude = true, cc
+		case !shouldRetryRequest(err):
+			return nil, err
+		case i >= maxRetryRequest:
+			return nil, errors.New("http2: reach max retry request times=3")
 		}
-		res, err = cc.roundTrip(req)
-		if shouldRetryRequest(err) && i < maxRetryRequest { // TODO: or clientconn is overloaded (too many outstanding requests)?
-			continue
+		if req, err = rewindRequest(req, err); err != nil {
+			return nil, err
 		}
-		if err != nil {
+		if err := t.waitCalm(ctx, key); err != nil {
+			return nil, err
+		}
+		if cc, err = t.getClientConnExcept(host, port, exclude); err != nil {
 			return nil, err
 		}
-		return res, nil
 	}
-	return nil, errors.New("http2: reach max retry request times=3")
 }
 
+// Connect sends the CONNECT request req and returns a conn
+// carrying the stream's DATA in both directions once the response
+// headers arrive. It is equivalent to ConnectContext with
+// req.Context().
 func (t *Transport) Connect(req *http.Request) (conn net.Conn, err error) {
-	var host, port string
-	if t.Proxy == nil {
-		host, port, err = net.SplitHostPort(req.URL.Host)
-		if err != nil {
-			host = req.URL.Host
-			port = "443"
-		}
-	} else {
+	return t.ConnectContext(req.Context(), req)
+}
+
+// ConnectContext is like Connect but takes a context. Canceling ctx
+// before the response headers arrive aborts the tunnel establishment
+// with ctx.Err(). Canceling it afterward resets the stream and
+// unblocks any pending Read or Write on the returned conn.
+func (t *Transport) ConnectContext(ctx context.Context, req *http.Request) (conn net.Conn, err error) {
+	host, port := hostPort(req.URL)
+	if t.Proxy != nil {
 		u, err := t.Proxy(req)
 		if err != nil {
 			return nil, err
 		}
-		host, port, err = net.SplitHostPort(u.Host)
-		if err != nil {
-			host = u.Host
-			port = "443"
-		}
+		host, port = hostPort(u)
 	}
 
-	const maxRetryRequest int = 3
+	key := net.JoinHostPort(host, port)
+	var exclude *ClientConn // refused req with a GOAWAY; see roundTripRetry
+	resent := false
 	for i := 0; i < maxRetryRequest; i++ {
-		cc, err := t.getClientConn(host, port)
+		if err := t.waitCalm(ctx, key); err != nil {
+			return nil, err
+		}
+		cc, err := t.getClientConnExcept(host, port, exclude)
 		if err != nil {
 			return nil, err
 		}
-		conn, err = cc.connect(req)
-		if shouldRetryRequest(err) && i < maxRetryRequest { // TODO: or clientconn is overloaded (too many outstanding requests)?
+		conn, err = cc.connect(ctx, req)
+		if err == errRequestUnprocessed && !resent && !noRetry(ctx) {
+			resent, exclude = true, cc
+			continue
+		}
+		if shouldRetryRequest(err) && i < maxRetryRequest && !noRetry(ctx) { // TODO: or clientconn is overloaded (too many outstanding requests)?
 			continue
 		}
 		if err != nil {
@@ -172,6 +807,111 @@ func (t *Transport) Connect(req *http.Request) (conn net.Conn, err error) {
 	return nil, errors.New("http2: reach max retry request times=3")
 }
 
+func (t *Transport) pingTimeout() time.Duration {
+	if t.PingTimeout > 0 {
+		return t.PingTimeout
+	}
+	return 15 * time.Second
+}
+
+func (t *Transport) prefaceTimeout() time.Duration {
+	if t.PrefaceTimeout > 0 {
+		return t.PrefaceTimeout
+	}
+	return 10 * time.Second
+}
+
+func (t *Transport) settingsAckTimeout() time.Duration {
+	if t.SettingsAckTimeout > 0 {
+		return t.SettingsAckTimeout
+	}
+	return 10 * time.Second
+}
+
+func (t *Transport) clock() Clock {
+	if t.Clock != nil {
+		return t.Clock
+	}
+	return realClock{}
+}
+
+func (t *Transport) fallbackDuration() time.Duration {
+	if t.FallbackDuration > 0 {
+		return t.FallbackDuration
+	}
+	return 5 * time.Minute
+}
+
+func (t *Transport) connErrorWindow() time.Duration {
+	if t.ConnErrorWindow > 0 {
+		return t.ConnErrorWindow
+	}
+	return time.Minute
+}
+
+// ConnectProtocol opens an extended CONNECT (RFC 8441) stream to
+// the https URL rawurl, tunneling the named protocol, such as
+// "websocket". The optional hdr is sent with the request.
+//
+// It returns the stream as a conn along with the response
+// headers. A non-2xx response is reported as an error, in which
+// case the response headers are still returned if available.
+func (t *Transport) ConnectProtocol(ctx context.Context, rawurl, protocol string, hdr http.Header) (net.Conn, http.Header, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, nil, fmt.Errorf("http2: unsupported extended CONNECT scheme %q", u.Scheme)
+	}
+	if protocol == "" {
+		return nil, nil, errors.New("http2: empty extended CONNECT protocol")
+	}
+	h := make(http.Header, len(hdr)+1)
+	for k, vv := range hdr {
+		h[k] = vv
+	}
+	h[":protocol"] = []string{protocol}
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        u,
+		Host:       u.Host,
+		RequestURI: u.RequestURI(),
+		Header:     h,
+	}
+	conn, err := t.ConnectContext(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	dc := conn.(*clientDataConn)
+	if err := dc.statusErr(u.Host); err != nil {
+		conn.Close()
+		return nil, dc.re.res.Header, err
+	}
+	return conn, dc.re.res.Header, nil
+}
+
+func (t *Transport) maxControlFrameRate() int {
+	if t.MaxControlFrameRate == 0 {
+		return 1000
+	}
+	return t.MaxControlFrameRate
+}
+
+func (t *Transport) maxHeaderListSize() uint32 {
+	if t.MaxHeaderListSize == 0 {
+		return 10 << 20
+	}
+	return t.MaxHeaderListSize
+}
+
+func (t *Transport) maxReadFrameSize() uint32 {
+	if v := t.MaxReadFrameSize; v >= minMaxFrameSize && v <= maxFrameSize {
+		return v
+	}
+	return defaultMaxReadFrameSize
+}
+
 // CloseIdleConnections closes any connections which were previously
 // connected from previous requests but are now sitting idle.
 // It does not interrupt any connections currently in use.
@@ -185,14 +925,201 @@ func (t *Transport) CloseIdleConnections() {
 	}
 }
 
-var errClientConnClosed = errors.New("http2: client conn is closed")
+// A RateLimiter paces the sending of request bodies or the reading
+// of response bodies, for Transport.RequestRateLimiter and
+// ResponseRateLimiter. A *rate.Limiter from
+// golang.org/x/time/rate with a burst of at least 16 KB is one.
+type RateLimiter interface {
+	// WaitN blocks until n more bytes may be read, or until ctx
+	// is done. n is never more than 16 KB.
+	WaitN(ctx context.Context, n int) error
+}
+
+// rateLimitChunk is the most a response body Read returns at once
+// when it has a RateLimiter, and the most request body the
+// Transport reads, and so sends in one DATA frame, at once.
+const rateLimitChunk = 16 << 10
+
+// ErrResponseTooLarge is returned by reads of a response body that
+// exceeds the Transport's MaxResponseBodySize, or the limit set with
+// WithMaxResponseBodySize. The stream is reset at the same time.
+var ErrResponseTooLarge = errors.New("http2: response body too large")
+
+// ErrRequestCanceled is returned by RoundTrip when the request's
+// legacy Cancel channel is closed before the response headers
+// arrive. The stream is reset with CANCEL, as it is when the
+// request's context is done first, in which case RoundTrip returns
+// the context's error.
+var ErrRequestCanceled = errors.New("http2: request canceled")
+
+// ErrStreamIdleTimeout is the error of a request, or of a read of
+// its response body, whose stream was reset after going
+// Transport.StreamIdleTimeout without a frame. It's a net.Error
+// whose Timeout method reports true.
+var ErrStreamIdleTimeout error = timeoutError("http2: stream idle timeout")
+
+// ErrFlowControlTimeout is the error of a request, or of a Write to
+// a CONNECT tunnel, whose stream was reset after waiting longer than
+// Transport.FlowControlTimeout for the server's flow control window
+// to open. It's a net.Error whose Timeout method reports true.
+var ErrFlowControlTimeout error = timeoutError("http2: timeout waiting for flow control")
+
+// ErrResponseBodyTimeout is the error of a read of a response body
+// whose stream was reset for going past the idle timeout or deadline
+// given by WithResponseBodyTimeout. It's a net.Error whose Timeout
+// method reports true.
+var ErrResponseBodyTimeout error = timeoutError("http2: response body timeout")
+
+type timeoutError string
+
+func (e timeoutError) Error() string   { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+type maxResponseBodySizeKey struct{}
+
+// WithMaxResponseBodySize returns a copy of ctx that limits the body
+// of the response to a request made with it to n bytes, overriding
+// Transport.MaxResponseBodySize. Zero or less means no limit.
+func WithMaxResponseBodySize(ctx context.Context, n int64) context.Context {
+	return context.WithValue(ctx, maxResponseBodySizeKey{}, n)
+}
+
+type responseBodyTimeoutKey struct{}
+
+type responseBodyTimeout struct {
+	idle     time.Duration
+	deadline time.Time
+}
+
+// WithResponseBodyTimeout returns a copy of ctx that bounds the
+// reading of the body of the response to a request made with it. If
+// idle is non-zero, the server may go that long without sending any
+// of the body while the caller waits for it; if deadline is
+// non-zero, the body must be done by then. Otherwise the stream is
+// reset with CANCEL, and reads of the body fail with
+// ErrResponseBodyTimeout. Time the caller spends not reading, with
+// body data buffered, doesn't count as idle.
+func WithResponseBodyTimeout(ctx context.Context, idle time.Duration, deadline time.Time) context.Context {
+	return context.WithValue(ctx, responseBodyTimeoutKey{}, responseBodyTimeout{idle, deadline})
+}
+
+// RawHeaders holds the header fields of a response as they were
+// decoded, in order and with pseudo-headers, duplicates and the
+// Sensitive flag intact, for proxies that must forward them
+// faithfully. See WithRawHeaders.
+type RawHeaders struct {
+	// Header is the response's header block. It's set by the
+	// time RoundTrip returns.
+	Header []hpack.HeaderField
+
+	// Trailer is the response's trailer block, if any. It's set
+	// by the time a Read of the response body returns io.EOF.
+	Trailer []hpack.HeaderField
+}
+
+type rawHeadersKey struct{}
+
+// WithRawHeaders returns a copy of ctx that makes the Transport
+// record the header fields of the response to a request made with
+// it in raw, as well as in the Response.
+func WithRawHeaders(ctx context.Context, raw *RawHeaders) context.Context {
+	return context.WithValue(ctx, rawHeadersKey{}, raw)
+}
+
+// maxResponseBodySize returns the limit on req's response body, or
+// -1 for none.
+func (t *Transport) maxResponseBodySize(req *http.Request) int64 {
+	n := t.MaxResponseBodySize
+	if v, ok := req.Context().Value(maxResponseBodySizeKey{}).(int64); ok {
+		n = v
+	}
+	if n <= 0 {
+		return -1
+	}
+	return n
+}
+
+// maxHeaderBlockFrames is the most HEADERS and CONTINUATION frames
+// the Transport reads for one header block. It's well above what
+// a 10 MB header list of 16 KB frames needs.
+const maxHeaderBlockFrames = 1024
+
+var (
+	errClientConnClosed            = errors.New("http2: client conn is closed")
+	errClientConnUnusable          = errors.New("http2: client conn not usable")
+	errClientConnFull              = errors.New("http2: client conn has no free streams")
+	errRequestUnprocessed          = errors.New("http2: request not processed by server before GOAWAY")
+	errExtendedConnectNotSupported = errors.New("http2: server does not support extended CONNECT")
+	errReqBodyTooLong              = errors.New("http2: request body larger than specified content length")
+	errReqBodyTooShort             = errors.New("http2: request body shorter than specified content length")
+	errResBodyTooLong              = errors.New("http2: response body larger than declared Content-Length")
+	errResBodyTooShort             = errors.New("http2: response body shorter than declared Content-Length")
+	errClosedWrite                 = errors.New("http2: write on half-closed stream")
+	errStreamClosed                = errors.New("http2: stream closed")
+	errBlackholed                  = errors.New("http2: no SETTINGS frame from server")
+	errPrefaceTimeout              = errors.New("http2: timeout exchanging connection preface")
+	errSettingsAckTimeout          = errors.New("http2: timeout waiting for SETTINGS ACK")
+	errConnIdle                    = errors.New("http2: idle connection closed")
+	errConnUnhealthy               = errors.New("http2: connection closed after too many errors")
+	errConnExhausted               = errors.New("http2: connection closed after running out of streams")
+)
 
+// shouldRetryRequest reports whether a request that failed with err
+// never left us, as the conn picked for it had closed or filled up
+// by the time it came to open a stream, and so can be sent on
+// another. One the server refused with a GOAWAY, failing with
+// errRequestUnprocessed, is instead sent again once, on a new conn;
+// see roundTripRetry.
 func shouldRetryRequest(err error) bool {
-	// TODO: or GOAWAY graceful shutdown stuff
-	return err == errClientConnClosed
+	return err == errClientConnUnusable || err == errClientConnFull
+}
+
+// rewindRequest returns req ready to be sent again after failing
+// with err, which shouldRetryRequest allows. A request whose body
+// may have been partly sent gets a fresh copy from GetBody, and
+// can't be sent again without one.
+func rewindRequest(req *http.Request, err error) (*http.Request, error) {
+	if err != errRequestUnprocessed || req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, err
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	newReq := *req
+	newReq.Body = body
+	return &newReq, nil
+}
+
+type noRetryKey struct{}
+
+// WithoutRetry returns a copy of ctx that stops the Transport from
+// retrying a request made with it on another connection, as it
+// otherwise does if the connection it picked closes under it. The
+// request fails instead. For ConnectContext, it's the ctx argument
+// that counts.
+func WithoutRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+func noRetry(ctx context.Context) bool {
+	v, _ := ctx.Value(noRetryKey{}).(bool)
+	return v
+}
+
+// ClientConns returns the connections the Transport has open to
+// addr, a host:port, whether busy or idle.
+func (t *Transport) ClientConns(addr string) []*ClientConn {
+	t.connMu.RLock()
+	defer t.connMu.RUnlock()
+	return append([]*ClientConn(nil), t.conns[addr]...)
 }
 
-func (t *Transport) removeClientConn(cc *clientConn) {
+func (t *Transport) removeClientConn(cc *ClientConn) {
 	t.connMu.Lock()
 	defer t.connMu.Unlock()
 	for _, key := range cc.connKey {
@@ -209,7 +1136,7 @@ func (t *Transport) removeClientConn(cc *clientConn) {
 	}
 }
 
-func filterOutClientConn(in []*clientConn, exclude *clientConn) []*clientConn {
+func filterOutClientConn(in []*ClientConn, exclude *ClientConn) []*ClientConn {
 	out := in[:0]
 	for _, v := range in {
 		if v != exclude {
@@ -219,375 +1146,2375 @@ func filterOutClientConn(in []*clientConn, exclude *clientConn) []*clientConn {
 	return out
 }
 
-func (t *Transport) getClientConn(host, port string) (*clientConn, error) {
-	t.connMu.Lock()
-	defer t.connMu.Unlock()
+func (t *Transport) getClientConn(host, port string) (*ClientConn, error) {
+	return t.getClientConnExcept(host, port, nil)
+}
 
+// getClientConnExcept is like getClientConn, but never returns
+// exclude, dialing a new conn if it's the only one available.
+//
+// Only a read lock is taken to find a pooled conn. Otherwise, one
+// request dials a new conn, without holding connMu, and any others
+// for the same host:port meanwhile wait for that conn.
+func (t *Transport) getClientConnExcept(host, port string, exclude *ClientConn) (*ClientConn, error) {
 	key := net.JoinHostPort(host, port)
 
-	for _, cc := range t.conns[key] {
-		if cc.canTakeNewRequest() {
-			return cc, nil
+	t.connMu.RLock()
+	cc := t.pooledConnLocked(key, exclude)
+	t.connMu.RUnlock()
+	if cc != nil {
+		return cc, nil
+	}
+
+	t.connMu.Lock()
+	if cc := t.pooledConnLocked(key, exclude); cc != nil {
+		t.connMu.Unlock()
+		return cc, nil
+	}
+	if h, ok := t.noHTTP2[key]; ok {
+		if t.clock().Now().Before(h.until) {
+			t.connMu.Unlock()
+			return nil, h.err
 		}
+		delete(t.noHTTP2, key)
 	}
-	if t.conns == nil {
-		t.conns = make(map[string][]*clientConn)
+	if call, ok := t.dialing[key]; ok {
+		t.connMu.Unlock()
+		<-call.done
+		return call.cc, call.err
 	}
-	cc, err := t.newClientConn(host, port, key)
-	if err != nil {
-		return nil, err
+	call := &dialCall{done: make(chan struct{})}
+	if t.dialing == nil {
+		t.dialing = make(map[string]*dialCall)
 	}
-	t.conns[key] = append(t.conns[key], cc)
-	return cc, nil
-}
+	t.dialing[key] = call
+	t.connMu.Unlock()
 
-func (t *Transport) newClientConn(host, port, key string) (*clientConn, error) {
-	cfg := &tls.Config{
-		ServerName:         host,
-		NextProtos:         []string{NextProtoTLS},
-		InsecureSkipVerify: t.InsecureTLSDial,
-	}
-	tconn, err := tls.Dial("tcp", host+":"+port, cfg)
-	if err != nil {
-		return nil, err
+	call.cc, call.err = t.newClientConn(host, port, key)
+
+	t.connMu.Lock()
+	delete(t.dialing, key)
+	if t.fallback(call.err) != nil {
+		if t.noHTTP2 == nil {
+			t.noHTTP2 = make(map[string]noHTTP2Host)
+		}
+		t.noHTTP2[key] = noHTTP2Host{call.err, t.clock().Now().Add(t.fallbackDuration())}
 	}
-	if err := tconn.Handshake(); err != nil {
-		return nil, err
+	if call.err == nil && !call.cc.isDead() {
+		// A conn that died already has been through
+		// removeClientConn, so mustn't be added after it.
+		if t.conns == nil {
+			t.conns = make(map[string][]*ClientConn)
+		}
+		t.conns[key] = append(t.conns[key], call.cc)
 	}
-	if !t.InsecureTLSDial {
-		if err := tconn.VerifyHostname(cfg.ServerName); err != nil {
-			return nil, err
+	t.connMu.Unlock()
+	close(call.done)
+	return call.cc, call.err
+}
+
+// pooledConnLocked returns a conn to key from the pool that can
+// take a new request, other than exclude, or nil. t.connMu must be
+// held, for reading at least.
+func (t *Transport) pooledConnLocked(key string, exclude *ClientConn) *ClientConn {
+	for _, cc := range t.conns[key] {
+		if cc != exclude && cc.canTakeNewRequest() {
+			return cc
 		}
 	}
-	state := tconn.ConnectionState()
-	if p := state.NegotiatedProtocol; p != NextProtoTLS {
-		// TODO(bradfitz): fall back to Fallback
-		return nil, fmt.Errorf("bad protocol: %v", p)
+	return nil
+}
+
+// tlsConfig returns the TLS config with which to dial host.
+func (t *Transport) tlsConfig(host string) *tls.Config {
+	cfg := t.TLSClientConfig
+	if c := t.hostTLSConfig(strings.ToLower(host)); c != nil {
+		cfg = c
 	}
-	if !state.NegotiatedProtocolIsMutual {
-		return nil, errors.New("could not negotiate protocol mutually")
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
 	}
-	if _, err := tconn.Write(clientPreface); err != nil {
-		return nil, err
+	if cfg.ServerName == "" {
+		cfg.ServerName = removeZone(host)
+	}
+	cfg.NextProtos = t.nextProtos()
+	if t.InsecureTLSDial {
+		cfg.InsecureSkipVerify = true
 	}
+	return cfg
+}
 
-	cc := &clientConn{
-		t:                    t,
+// hostTLSConfig returns the entry of t.HostTLSConfigs for host, or
+// nil.
+func (t *Transport) hostTLSConfig(host string) *tls.Config {
+	if cfg, ok := t.HostTLSConfigs[host]; ok {
+		return cfg
+	}
+	var best string
+	var cfg *tls.Config
+	for pattern, c := range t.HostTLSConfigs {
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) && len(pattern) > len(best) {
+			best, cfg = pattern, c
+		}
+	}
+	return cfg
+}
+
+// dialConn dials host:port and checks that the server agreed to
+// speak HTTP/2. The returned state is nil for a conn from DialTLS
+// that isn't a *tls.Conn.
+func (t *Transport) dialConn(host, port string) (net.Conn, *tls.ConnectionState, error) {
+	cfg := t.tlsConfig(host)
+	c, err := t.dialTLS(host, port, cfg)
+	if err != nil && echRetry(cfg, err) {
+		// The server turned down our ECH config, as after a key
+		// rotation, and sent the ones to use instead.
+		c, err = t.dialTLS(host, port, cfg)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	tconn, ok := c.(*tls.Conn)
+	if !ok {
+		return c, nil, nil
+	}
+	if !cfg.InsecureSkipVerify {
+		if err := tconn.VerifyHostname(cfg.ServerName); err != nil {
+			return nil, nil, err
+		}
+	}
+	state := tconn.ConnectionState()
+	if p := state.NegotiatedProtocol; p != NextProtoTLS {
+		tconn.Close()
+		return nil, nil, noHTTP2Error{&ALPNError{p}}
+	}
+	if !state.NegotiatedProtocolIsMutual {
+		return nil, nil, errors.New("could not negotiate protocol mutually")
+	}
+	return tconn, &state, nil
+}
+
+// dialTLS dials host:port and completes the TLS handshake with
+// cfg, unless the conn comes from DialTLS and isn't a *tls.Conn.
+func (t *Transport) dialTLS(host, port string, cfg *tls.Config) (net.Conn, error) {
+	if t.DialTLS != nil {
+		c, err := t.DialTLS("tcp", net.JoinHostPort(host, port), cfg)
+		if err != nil {
+			return nil, err
+		}
+		if tconn, ok := c.(*tls.Conn); ok {
+			if err := tconn.Handshake(); err != nil {
+				tconn.Close()
+				return nil, err
+			}
+		}
+		return c, nil
+	}
+	dialer := &net.Dialer{Control: t.Control, KeepAlive: t.KeepAlive}
+	return tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), cfg)
+}
+
+func (t *Transport) newClientConn(host, port, key string) (*ClientConn, error) {
+	tconn, state, err := t.dialConn(host, port)
+	if err != nil {
+		return nil, err
+	}
+	prefaceDeadline := time.Now().Add(t.prefaceTimeout())
+	tconn.SetDeadline(prefaceDeadline)
+	if _, err := tconn.Write(clientPreface); err != nil {
+		tconn.Close()
+		return nil, prefaceError(err)
+	}
+
+	cc := &ClientConn{
+		t:                    t,
 		tconn:                tconn,
 		connKey:              []string{key}, // TODO: cert's validated hostnames too
-		tlsState:             &state,
+		tlsState:             state,
 		readerDone:           make(chan struct{}),
 		nextStreamID:         1,
+		peer:                 defaultPeerSettings,
 		maxFrameSize:         16 << 10, // spec default
 		initialWindowSize:    65535,    // spec default
-		maxConcurrentStreams: 1000,     // "infinite", per spec. 1000 seems good enough.
+		inWindowSize:         initialWindowSize,
+		maxConcurrentStreams: t.defaultMaxConcurrentStreams(),
 		streams:              make(map[uint32]*clientStream),
 	}
-	cc.bw = bufio.NewWriter(stickyErrWriter{tconn, &cc.werr})
+	cc.cond.L = &cc.mu
+	cc.bodyCond.L = &cc.mu
+	cc.outflow.add(initialWindowSize)
+	cc.bw = bufio.NewWriter(stickyErrWriter{tconn, &cc.werr, cc.closeDead})
 	cc.br = bufio.NewReader(tconn)
 	cc.fr = NewFramer(cc.bw, cc.br)
+	cc.fr.SetMaxReadFrameSize(t.maxReadFrameSize())
+	cc.fr.SetFaultInjector(t.Faults)
+	cc.fr.clock = t.clock()
+	cc.capture = newConnCapture(t.CaptureFrames, tconn, t.clock())
+	cc.fr.SetFrameCapture(cc.capture)
 	cc.henc = hpack.NewEncoder(&cc.hbuf)
+	cc.henc.SetSensitive(sensitiveFunc(t.SensitiveHeaders))
 
-	cc.fr.WriteSettings()
+	settings := []Setting{
+		{SettingMaxHeaderListSize, t.maxHeaderListSize()},
+		{SettingEnablePush, 0},
+		{SettingMaxFrameSize, t.maxReadFrameSize()},
+	}
+	if t.PushedResponseCache != nil {
+		settings[1].Val = 1
+		settings = append(settings, Setting{SettingMaxConcurrentStreams, maxPushedStreams})
+	}
+	if t.Grease {
+		settings = append(settings, greaseSetting())
+	}
+	cc.fr.WriteSettings(settings...)
+	cc.sentSettings = []sentSettings{{settings: settings}}
 	// TODO: re-send more conn-level flow control tokens when server uses all these.
 	cc.fr.WriteWindowUpdate(0, 1<<30) // um, 0x7fffffff doesn't work to Google? it hangs?
+	cc.inflow.add(initialWindowSize + 1<<30)
+	if t.Grease {
+		typ, payload := greaseFrame()
+		cc.fr.WriteRawFrame(typ, 0, 0, payload)
+	}
 	cc.bw.Flush()
 	if cc.werr != nil {
-		return nil, cc.werr
+		tconn.Close()
+		cc.capture.close()
+		return nil, prefaceError(cc.werr)
 	}
 
-	// Read the obligatory SETTINGS frame
+	// Read the obligatory SETTINGS frame. A SettingsTimeout that
+	// runs out first means the server doesn't speak HTTP/2;
+	// running out of PrefaceTimeout is a plain dial failure.
+	settingsFirst := false
+	if t.SettingsTimeout > 0 {
+		if d := time.Now().Add(t.SettingsTimeout); d.Before(prefaceDeadline) {
+			tconn.SetReadDeadline(d)
+			settingsFirst = true
+		}
+	}
 	f, err := cc.fr.ReadFrame()
 	if err != nil {
-		return nil, err
+		tconn.Close()
+		cc.capture.close()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if !settingsFirst {
+				return nil, errPrefaceTimeout
+			}
+			err = errBlackholed
+		}
+		return nil, noHTTP2Error{err}
 	}
 	sf, ok := f.(*SettingsFrame)
 	if !ok {
-		return nil, fmt.Errorf("expected settings frame, got: %T", f)
+		tconn.Close()
+		cc.capture.close()
+		return nil, noHTTP2Error{fmt.Errorf("expected settings frame, got: %T", f)}
 	}
-	cc.fr.WriteSettingsAck()
-	cc.bw.Flush()
+	cc.mu.Lock()
+	cc.applySettings(sf)
+	cc.unlock()
+	if cc.werr != nil {
+		tconn.Close()
+		cc.capture.close()
+		return nil, prefaceError(cc.werr)
+	}
+	tconn.SetDeadline(time.Time{})
+	cc.hdec = hpack.NewDecoder(initialHeaderTableSize, cc.onNewHeaderField)
+	cc.hdec.SetMaxStringLength(int(t.maxHeaderListSize()))
+
+	cc.settingsAckTimer = t.clock().AfterFunc(t.settingsAckTimeout(), cc.settingsAckTimedOut)
+	if t.ReadIdleTimeout > 0 {
+		cc.readIdleTimer = t.clock().AfterFunc(t.ReadIdleTimeout, cc.healthCheck)
+	}
+	if t.StreamIdleTimeout > 0 {
+		cc.reapTimer = t.clock().AfterFunc(t.StreamIdleTimeout/2, cc.reapIdleStreams)
+	}
+	if t.OnConnOpen != nil {
+		t.OnConnOpen(cc)
+	}
+	go cc.readLoop()
+	if t.PingInterval > 0 {
+		go cc.pingLoop()
+	}
+	return cc, nil
+}
+
+// maxStreamIDStreams is how many streams a conn can open before
+// running out of stream IDs: the odd ones below 2^31-1.
+const maxStreamIDStreams = 1<<30 - 1
+
+func (t *Transport) maxConnStreams() uint32 {
+	if t.MaxConnStreams > 0 && t.MaxConnStreams < maxStreamIDStreams {
+		return t.MaxConnStreams
+	}
+	return maxStreamIDStreams
+}
+
+func (t *Transport) defaultMaxConcurrentStreams() uint32 {
+	if t.DefaultMaxConcurrentStreams > 0 {
+		return t.DefaultMaxConcurrentStreams
+	}
+	return 1000 // "infinite", per spec. 1000 seems good enough.
+}
 
+// applySettings applies the server's settings in sf, which isn't an
+// ACK, and acknowledges them. Unlike the first SETTINGS, later ones
+// can come at any time, such as to lower the limit on concurrent
+// streams; a new limit below the streams already open just stops
+// new ones until enough close. requires cc.mu be held.
+func (cc *ClientConn) applySettings(sf *SettingsFrame) {
 	sf.ForeachSetting(func(s Setting) error {
+		cc.peer.apply(s)
 		switch s.ID {
 		case SettingMaxFrameSize:
 			cc.maxFrameSize = s.Val
 		case SettingMaxConcurrentStreams:
 			cc.maxConcurrentStreams = s.Val
 		case SettingInitialWindowSize:
+			// A change applies to the windows of the open
+			// streams too (RFC 7540, 6.9.2), even making them
+			// negative.
+			delta := int32(s.Val) - int32(cc.initialWindowSize)
+			for _, cs := range cc.streams {
+				cs.outflow.add(delta)
+			}
 			cc.initialWindowSize = s.Val
+			cc.cond.Broadcast()
+		case SettingEnableConnectProtocol:
+			cc.extendedConnect = s.Val == 1
+		case SettingHeaderTableSize:
+			cc.henc.SetMaxDynamicTableSize(s.Val)
 		default:
-			// TODO(bradfitz): handle more
-			log.Printf("Unhandled Setting: %v", s)
+			// Unknown settings, such as GREASE ones, are
+			// ignored, as the spec requires.
+			cc.vlogf("Unhandled Setting: %v", s)
 		}
 		return nil
 	})
-	// TODO: figure out henc size
-	cc.hdec = hpack.NewDecoder(initialHeaderTableSize, cc.onNewHeaderField)
+	cc.fr.WriteSettingsAck()
+	cc.bw.Flush()
+}
 
-	go cc.readLoop()
-	return cc, nil
+// sentSettings are the settings of a SETTINGS frame we've sent. done,
+// if non-nil, is closed when the server acknowledges them.
+type sentSettings struct {
+	settings []Setting
+	done     chan struct{}
 }
 
-func (cc *clientConn) setGoAway(f *GoAwayFrame) {
+// UpdateSettings sends the server a SETTINGS frame with settings and
+// waits until it acknowledges them, ctx is done, or cc closes. They
+// take effect, on our side, once the server has acknowledged them.
+//
+// SETTINGS_INITIAL_WINDOW_SIZE can't go above its default of 65535,
+// the size of a response body's buffer, but may be lowered to cut
+// how much a server may send ahead of the reader. SETTINGS_ENABLE_PUSH
+// can only be 0 without a Transport.PushedResponseCache, and
+// SETTINGS_ENABLE_CONNECT_PROTOCOL is for servers to send. Other
+// settings, including unknown ones, are sent as given. If any
+// setting isn't valid, nothing is sent, and the error is the one
+// Setting.Valid returns for it.
+func (cc *ClientConn) UpdateSettings(ctx context.Context, settings ...Setting) error {
+	for _, s := range settings {
+		if err := s.Valid(); err != nil {
+			return err
+		}
+		switch s.ID {
+		case SettingEnablePush:
+			if s.Val != 0 && cc.t.PushedResponseCache == nil {
+				return errors.New("http2: the Transport doesn't accept server push")
+			}
+		case SettingInitialWindowSize:
+			if s.Val > initialWindowSize {
+				return fmt.Errorf("http2: %v is larger than the response body buffer", s)
+			}
+		case SettingEnableConnectProtocol:
+			return fmt.Errorf("http2: %v is a server setting", s.ID)
+		}
+	}
+	done := make(chan struct{})
 	cc.mu.Lock()
-	defer cc.mu.Unlock()
-	cc.goAway = f
+	if cc.closed || cc.isDead() {
+		cc.unlock()
+		return errClientConnClosed
+	}
+	if len(cc.sentSettings) == 0 {
+		cc.settingsAckTimer.Reset(cc.t.settingsAckTimeout())
+	}
+	cc.sentSettings = append(cc.sentSettings, sentSettings{settings, done})
+	cc.fr.WriteSettings(settings...)
+	cc.bw.Flush()
+	werr := cc.werr
+	cc.unlock()
+	if werr != nil {
+		return werr
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cc.readerDone:
+		return errClientConnClosed
+	}
+}
+
+// settingsAcked applies the oldest of our unacknowledged settings,
+// which the server has just acknowledged. SETTINGS_TIMEOUT starts
+// over for the next ones, if any. It's called by readLoop, which owns
+// the framer's reading side and the header decoder; requires cc.mu be
+// held.
+func (cc *ClientConn) settingsAcked() {
+	if len(cc.sentSettings) == 0 {
+		cc.vlogf("http2: unsolicited SETTINGS ACK")
+		return
+	}
+	ss := cc.sentSettings[0]
+	cc.sentSettings = cc.sentSettings[1:]
+	if len(cc.sentSettings) == 0 {
+		cc.settingsAckTimer.Stop()
+	} else {
+		cc.settingsAckTimer.Reset(cc.t.settingsAckTimeout())
+	}
+	for _, s := range ss.settings {
+		switch s.ID {
+		case SettingHeaderTableSize:
+			cc.hdec.SetAllowedMaxDynamicTableSize(s.Val)
+		case SettingInitialWindowSize:
+			delta := int32(s.Val) - int32(cc.inWindowSize)
+			for _, cs := range cc.streams {
+				cs.inflow.add(delta)
+			}
+			cc.inWindowSize = s.Val
+		case SettingMaxFrameSize:
+			cc.fr.SetMaxReadFrameSize(s.Val)
+		}
+	}
+	if ss.done != nil {
+		close(ss.done)
+	}
+}
+
+// Addr returns the host:port cc was dialed for.
+func (cc *ClientConn) Addr() string {
+	return cc.connKey[0]
+}
+
+// RemoteAddr returns the address of the server at the other end of cc.
+func (cc *ClientConn) RemoteAddr() net.Addr {
+	return cc.tconn.RemoteAddr()
+}
+
+// TLS returns the state of cc's TLS connection, or nil if it isn't
+// one.
+func (cc *ClientConn) TLS() *tls.ConnectionState {
+	return cc.tlsState
 }
 
-func (cc *clientConn) canTakeNewRequest() bool {
+// PeerSettings returns the SETTINGS the server has sent on cc so
+// far, with their defaults for those it hasn't. The server may change
+// them at any time.
+func (cc *ClientConn) PeerSettings() PeerSettings {
 	cc.mu.Lock()
-	defer cc.mu.Unlock()
-	return cc.goAway == nil &&
-		int64(len(cc.streams)+1) < int64(cc.maxConcurrentStreams) &&
-		cc.nextStreamID < 2147483647
+	defer cc.unlock()
+	return cc.peer
 }
 
-func (cc *clientConn) closeIfIdle() {
+// settingsAckTimedOut closes the conn with SETTINGS_TIMEOUT, the
+// server not having acknowledged our SETTINGS in time.
+func (cc *ClientConn) settingsAckTimedOut() {
+	cc.logf("http2: timeout waiting for SETTINGS ACK from %v; closing conn", cc.tconn.RemoteAddr())
 	cc.mu.Lock()
-	if len(cc.streams) > 0 {
-		cc.mu.Unlock()
-		return
+	cc.fr.WriteGoAway(0, ErrCodeSettingsTimeout, nil)
+	cc.bw.Flush()
+	cc.setCloseErr(errSettingsAckTimeout)
+	cc.unlock()
+	cc.tconn.Close()
+}
+
+// prefaceError returns errPrefaceTimeout in place of a timeout
+// error from writing the connection preface, and err otherwise.
+func prefaceError(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errPrefaceTimeout
 	}
-	cc.closed = true
-	// TODO: do clients send GOAWAY too? maybe? Just Close:
-	cc.mu.Unlock()
+	return err
+}
 
-	cc.tconn.Close()
+// ping sends a PING frame and waits for the server's ACK.
+func (cc *ClientConn) ping(timeout time.Duration) error {
+	c := make(chan struct{})
+	var data [8]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return err
+	}
+	cc.mu.Lock()
+	if cc.pings == nil {
+		cc.pings = make(map[[8]byte]chan struct{})
+	}
+	cc.pings[data] = c
+	cc.fr.WritePing(false, data)
+	cc.bw.Flush()
+	werr := cc.werr
+	cc.unlock()
+	if werr != nil {
+		return werr
+	}
+
+	timer := cc.t.clock().NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c:
+		return nil
+	case <-timer.C():
+		cc.mu.Lock()
+		delete(cc.pings, data)
+		cc.unlock()
+		return errors.New("http2: timeout waiting for PING ack")
+	case <-cc.readerDone:
+		return errClientConnClosed
+	}
 }
 
-type dataFrameWriter struct {
-	cc        *clientConn
-	cs        *clientStream
-	totalSize int64
+// pingLoop PINGs the server every t.PingInterval until the conn
+// dies, and closes the conn if a PING goes unanswered. Closing it
+// ends readLoop, which removes cc from the pool.
+// It runs in its own goroutine.
+func (cc *ClientConn) pingLoop() {
+	clock := cc.t.clock()
+	timer := clock.NewTimer(cc.t.PingInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-cc.readerDone:
+			return
+		case <-timer.C():
+			start := clock.Now()
+			if err := cc.ping(cc.t.pingTimeout()); err != nil {
+				cc.vlogf("http2: closing conn after failed PING: %v", err)
+				cc.mu.Lock()
+				cc.setCloseErr(err)
+				cc.closeDead()
+				cc.unlock()
+				return
+			}
+			if rtt := clock.Now().Sub(start); cc.t.SlowPingRTT > 0 && rtt > cc.t.SlowPingRTT {
+				cc.mu.Lock()
+				cc.recordError(fmt.Sprintf("PING took %v", rtt))
+				cc.unlock()
+			}
+			timer.Reset(cc.t.PingInterval)
+		}
+	}
 }
 
-func (dw dataFrameWriter) Write(p []byte) (n int, err error) {
-	size := len(p)
-	size64 := int64(size)
-	endStream := size64 >= dw.totalSize
+// healthCheck PINGs the server after cc has read nothing for
+// t.ReadIdleTimeout, and closes cc if the PING goes unanswered.
+func (cc *ClientConn) healthCheck() {
+	if err := cc.ping(cc.t.pingTimeout()); err != nil {
+		cc.vlogf("http2: closing conn after failed health check PING: %v", err)
+		cc.mu.Lock()
+		cc.setCloseErr(err)
+		cc.closeDead()
+		cc.unlock()
+	}
+}
 
-	if err = dw.cc.fr.WriteData(dw.cs.ID, endStream, p); err != nil {
-		dw.cc.werr = err
-		return 0, err
+// reapIdleStreams resets the streams, other than tunnels, that have
+// gone t.StreamIdleTimeout without a frame, failing their requests
+// with ErrStreamIdleTimeout, then schedules itself again.
+func (cc *ClientConn) reapIdleStreams() {
+	timeout := cc.t.StreamIdleTimeout
+	now := cc.t.clock().Now()
+	var idle []*clientStream
+	cc.mu.Lock()
+	for _, cs := range cc.streams {
+		if !cs.tunnel && now.Sub(cs.lastActive) >= timeout {
+			idle = append(idle, cs)
+		}
+	}
+	cc.unlock()
+	for _, cs := range idle {
+		cc.vlogf("http2: resetting stream %d after %v idle", cs.ID, timeout)
+		cc.resetStream(cs, ErrCodeCancel, ErrStreamIdleTimeout)
+		select {
+		case cs.resc <- resAndError{err: ErrStreamIdleTimeout}:
+		default:
+		}
 	}
+	if !cc.isDead() {
+		cc.reapTimer.Reset(timeout / 2)
+	}
+}
+
+// startBodyTimer arms cs's timer for WithResponseBodyTimeout, if it
+// has one, once its response headers have arrived.
+func (cc *ClientConn) startBodyTimer(cs *clientStream) {
+	if cs.bodyTimeout == (responseBodyTimeout{}) {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.unlock()
+	if cs.state == stateClosed {
+		return
+	}
+	now := cc.t.clock().Now()
+	cs.lastData = now
+	cc.acquireStreamLocked(cs) // released by stopBodyTimer or checkBodyTimeout
+	cs.bodyTimer = cc.t.clock().AfterFunc(cs.bodyTimeLeft(now), func() { cc.checkBodyTimeout(cs) })
+}
+
+// stopBodyTimer disarms cs's timer for WithResponseBodyTimeout, as
+// its body is done. requires cc.mu be held.
+func (cc *ClientConn) stopBodyTimer(cs *clientStream) {
+	if cs.bodyTimer != nil {
+		if cs.bodyTimer.Stop() {
+			cc.releaseStreamLocked(cs)
+		} // else checkBodyTimeout is about to run, and releases cs
+		cs.bodyTimer = nil
+	}
+}
 
-	if endStream {
-		if err = dw.cc.bw.Flush(); err != nil {
-			dw.cc.werr = err
-			return 0, err
+// bodyTimeLeft returns how long from now cs's body may go before
+// WithResponseBodyTimeout's idle timeout or deadline passes.
+// requires cc.mu be held.
+func (cs *clientStream) bodyTimeLeft(now time.Time) time.Duration {
+	left := time.Duration(math.MaxInt64)
+	if !cs.bodyTimeout.deadline.IsZero() {
+		left = cs.bodyTimeout.deadline.Sub(now)
+	}
+	if idle := cs.bodyTimeout.idle; idle > 0 {
+		if d := idle - now.Sub(cs.lastData); d < left {
+			left = d
 		}
 	}
+	return left
+}
+
+// checkBodyTimeout runs when cs's body timer fires, resetting cs
+// with ErrResponseBodyTimeout if its time is really up, or setting
+// the timer again if more DATA came in meanwhile.
+func (cc *ClientConn) checkBodyTimeout(cs *clientStream) {
+	cc.mu.Lock()
+	if cs.bodyTimer == nil {
+		cc.releaseStreamLocked(cs)
+		cc.unlock()
+		return
+	}
+	now := cc.t.clock().Now()
+	if cs.body.Len() > 0 {
+		// The caller, not the server, is the one stalling.
+		cs.lastData = now
+	}
+	if left := cs.bodyTimeLeft(now); left > 0 {
+		cs.bodyTimer.Reset(left)
+		cc.unlock()
+		return
+	}
+	cs.bodyTimer = nil
+	cc.vlogf("http2: resetting stream %d after response body timeout", cs.ID)
+	cc.resetStreamLocked(cs, ErrCodeCancel, ErrResponseBodyTimeout)
+	cc.releaseStreamLocked(cs)
+	cc.unlock()
+}
+
+// noteStreamActivity records that a frame was sent or received on
+// cs, for Transport.StreamIdleTimeout. requires cc.mu be held.
+func (cc *ClientConn) noteStreamActivity(cs *clientStream) {
+	if cc.t.StreamIdleTimeout > 0 {
+		cs.lastActive = cc.t.clock().Now()
+	}
+}
+
+// bodyAllowedForStatus reports whether a response with the given
+// status code may have a body, per RFC 7230 section 3.3.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// isControlFrame reports whether f is one of the frames that a
+// server can send in a flood without doing any real work: PING,
+// SETTINGS, or DATA that neither carries data nor ends the stream.
+func isControlFrame(f Frame) bool {
+	switch f := f.(type) {
+	case *PingFrame, *SettingsFrame:
+		return true
+	case *DataFrame:
+		return len(f.Data()) == 0 && !f.StreamEnded()
+	}
+	return false
+}
 
-	dw.totalSize -= size64
+func (cc *ClientConn) processPing(f *PingFrame) {
+	cc.mu.Lock()
+	defer cc.unlock()
+	if f.Flags.Has(FlagPingAck) {
+		if c, ok := cc.pings[f.Data]; ok {
+			close(c)
+			delete(cc.pings, f.Data)
+		}
+		return
+	}
+	cc.fr.WritePing(true, f.Data)
+	cc.bw.Flush()
+}
 
-	return size, err
+// setGoAway records the GOAWAY f and fails the requests on streams
+// after its Last-Stream-ID with errRequestUnprocessed: per RFC 7540
+// section 6.8, the server never processed them, so they can be sent
+// again, whatever their method.
+func (cc *ClientConn) setGoAway(f *GoAwayFrame) {
+	cc.mu.Lock()
+	defer cc.unlock()
+	cc.goAway = f
+	cc.cond.Broadcast()
+	for id, cs := range cc.streams {
+		if id%2 == 0 || id <= f.LastStreamID {
+			continue
+		}
+		cc.closeStream(cs, errRequestUnprocessed)
+		if cs.body != nil {
+			cs.body.Close(errRequestUnprocessed)
+		}
+		select {
+		case cs.resc <- resAndError{err: errRequestUnprocessed}:
+		default:
+		}
+	}
 }
 
-func (cc *clientConn) do(req *http.Request) resAndError {
+func (cc *ClientConn) canTakeNewRequest() bool {
 	cc.mu.Lock()
+	defer cc.unlock()
+	return cc.goAway == nil && !cc.unhealthy && !cc.closed && !cc.exhausted() &&
+		(cc.t.StrictMaxConcurrentStreams || int64(cc.ownStreams()) < int64(cc.maxConcurrentStreams))
+}
+
+// ownStreams returns how many of cc's streams are ours, rather than
+// pushed by the server. cc.mu must be held.
+func (cc *ClientConn) ownStreams() int {
+	return len(cc.streams) - cc.pushed
+}
+
+// streamsUsed returns how many streams cc has opened. cc.mu must be
+// held.
+func (cc *ClientConn) streamsUsed() uint32 {
+	return (cc.nextStreamID - 1) / 2
+}
+
+// exhausted reports whether cc has opened all the streams it may,
+// per Transport.MaxConnStreams. cc.mu must be held.
+func (cc *ClientConn) exhausted() bool {
+	return cc.streamsUsed() >= cc.t.maxConnStreams()
+}
+
+// replaceIfNearlyExhausted starts dialing a replacement for cc, once,
+// when it has used 90% of its streams, so that it's ready when cc
+// runs out. cc.mu must be held.
+func (cc *ClientConn) replaceIfNearlyExhausted() {
+	max := cc.t.maxConnStreams()
+	if cc.replacing || cc.streamsUsed() < max-max/10 {
+		return
+	}
+	cc.replacing = true
+	host, port, err := net.SplitHostPort(cc.connKey[0])
+	if err != nil {
+		return
+	}
+	go func() {
+		// A conn other than cc that can take requests does
+		// as well as a new one.
+		if _, err := cc.t.getClientConnExcept(host, port, cc); err != nil {
+			cc.vlogf("http2: dialing replacement for conn to %s: %v", cc.connKey[0], err)
+		}
+	}()
+}
+
+// isDead reports whether cc's readLoop has exited.
+func (cc *ClientConn) isDead() bool {
+	select {
+	case <-cc.readerDone:
+		return true
+	default:
+		return false
+	}
+}
 
+// closeDead closes cc, which is broken: a write to it failed, or it
+// didn't answer a PING. Marking it closed keeps getClientConn from
+// handing it out in the meantime, and closing the conn ends
+// readLoop, which removes cc from the pool. A peer that vanished
+// without a FIN or RST would otherwise leave cc in the pool, taking
+// requests, until the kernel gave up on it. cc.mu must be held.
+func (cc *ClientConn) closeDead() {
 	if cc.closed {
-		cc.mu.Unlock()
-		return resAndError{err: errClientConnClosed}
+		return
 	}
+	cc.closed = true
+	cc.cond.Broadcast()
+	cc.tconn.Close()
+}
 
-	cs := cc.newStream()
-	hasBody := req.ContentLength > 0 || req.Method == "CONNECT"
+func (cc *ClientConn) closeIfIdle() {
+	cc.mu.Lock()
+	if cc.ownStreams() > 0 {
+		cc.unlock()
+		return
+	}
+	cc.closed = true
+	cc.setCloseErr(errConnIdle)
+	// TODO: do clients send GOAWAY too? maybe? Just Close:
+	cc.unlock()
 
-	// we send: HEADERS[+CONTINUATION] + (DATA?)
-	hdrs := cc.encodeHeaders(req)
-	first := true
-	for len(hdrs) > 0 {
-		chunk := hdrs
-		if len(chunk) > int(cc.maxFrameSize) {
-			chunk = chunk[:cc.maxFrameSize]
+	cc.tconn.Close()
+}
+
+// writeRequestBody copies req.Body to cs as DATA frames, through
+// cs.bodyEncoder if set, ending the stream at EOF. Each read from
+// the body is sent as soon as it's read, so a streamed body, like
+// one being relayed by a proxy, isn't held up. If req.ContentLength
+// is positive and the body's length doesn't match it, the stream is
+// reset instead and the request fails. The body is closed once it's
+// done with, or by abortRequestBody.
+func (cc *ClientConn) writeRequestBody(cs *clientStream, req *http.Request) {
+	defer func() {
+		cc.mu.Lock()
+		body := cs.reqBody
+		cs.reqBody = nil
+		cc.releaseStreamLocked(cs)
+		cc.unlock()
+		if body != nil {
+			body.Close()
 		}
-		hdrs = hdrs[len(chunk):]
-		endHeaders := len(hdrs) == 0
-		if first {
-			cc.fr.WriteHeaders(HeadersFrameParam{
-				StreamID:      cs.ID,
-				BlockFragment: chunk,
-				EndStream:     !hasBody,
-				EndHeaders:    endHeaders,
-			})
-			first = false
-		} else {
-			cc.fr.WriteContinuation(cs.ID, endHeaders, chunk)
+	}()
+	want := actualContentLength(req)
+	if req.Method == "CONNECT" {
+		want = -1
+	}
+	buf := make([]byte, rateLimitChunk)
+	var sent int64
+	// send writes a DATA frame once cs.reqLimiter allows it.
+	send := func(p []byte, endStream bool) error {
+		if cs.reqLimiter != nil && len(p) > 0 {
+			if err := cs.reqLimiter.WaitN(cs.ctx, len(p)); err != nil {
+				cc.failRequestBody(cs, err)
+				return err
+			}
+		}
+		return cc.writeData(cs, p, endStream)
+	}
+	write := send
+	if cs.bodyEncoder != nil {
+		// Buffer the encoder's output, so that it goes out in
+		// DATA frames of a sensible size.
+		bw := bufio.NewWriterSize(streamWriter(send), len(buf))
+		enc, err := cs.bodyEncoder(bw)
+		if err != nil {
+			cc.failRequestBody(cs, err)
+			return
+		}
+		write = func(p []byte, endStream bool) error {
+			if _, err := enc.Write(p); err != nil || !endStream {
+				return err
+			}
+			if err := enc.Close(); err != nil {
+				return err
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			return send(nil, true)
 		}
 	}
-	cc.bw.Flush()
-	werr := cc.werr
-	cc.mu.Unlock()
+	for {
+		n, err := req.Body.Read(buf)
+		sent += int64(n)
+		if want > 0 && sent > want {
+			cc.failRequestBody(cs, errReqBodyTooLong)
+			return
+		}
+		if err == io.EOF && want > 0 && sent != want {
+			cc.failRequestBody(cs, errReqBodyTooShort)
+			return
+		}
+		if n > 0 || err == io.EOF {
+			if werr := write(buf[:n], err == io.EOF); werr != nil {
+				if werr == ErrFlowControlTimeout {
+					cc.failRequestBody(cs, werr)
+				}
+				return
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			cc.failRequestBody(cs, err)
+			return
+		}
+	}
+}
+
+// awaitFlowLocked waits until the server's flow control lets cs
+// send at least a byte, and no stream that goes before it, per
+// WithPriority, is waiting to send too, and returns how many bytes
+// it may send. It fails if cs or cc closes first, or if
+// Transport.FlowControlTimeout runs out waiting for flow control, in
+// which case cs is reset. requires cc.mu be held; it's released
+// while waiting.
+func (cc *ClientConn) awaitFlowLocked(cs *clientStream) (int32, error) {
+	timedOut := false
+	var timer Timer
+	for {
+		switch {
+		case cc.werr != nil:
+			return 0, cc.werr
+		case cc.closed || cc.isDead():
+			return 0, errClientConnClosed
+		case cs.state == stateClosed:
+			return 0, errStreamClosed
+		}
+		if n := cs.outflow.available(); n > 0 {
+			if !cc.outranked(cs) {
+				return n, nil
+			}
+		} else if timedOut {
+			cc.resetStreamLocked(cs, ErrCodeCancel, ErrFlowControlTimeout)
+			return 0, ErrFlowControlTimeout
+		} else if timer == nil && cc.t.FlowControlTimeout > 0 {
+			timer = cc.t.clock().AfterFunc(cc.t.FlowControlTimeout, func() {
+				cc.mu.Lock()
+				timedOut = true
+				cc.cond.Broadcast()
+				cc.unlock()
+			})
+			defer timer.Stop()
+		}
+		// Send what cs has written so far before waiting; the
+		// server may be waiting on it to open its window.
+		cc.bw.Flush()
+		cc.cond.Wait()
+	}
+}
+
+// awaitOpenSlotLocked checks that cc can open a stream for req. If
+// cc filled up, or the server lowered its limit, since
+// canTakeNewRequest said otherwise, it fails with errClientConnFull,
+// so the request goes to another conn, unless
+// Transport.StrictMaxConcurrentStreams is set, in which case it
+// waits for one of cc's streams to finish, or for ctx or req to be
+// canceled. If cc has closed, it fails with errClientConnUnusable,
+// again sending the request elsewhere. requires cc.mu be held; it's
+// released while waiting.
+func (cc *ClientConn) awaitOpenSlotLocked(ctx context.Context, req *http.Request) error {
+	var waitDone chan struct{}
+	for {
+		switch {
+		case cc.closed || cc.isDead():
+			return errClientConnUnusable
+		case cc.exhausted():
+			return errClientConnFull
+		case int64(cc.ownStreams()) < int64(cc.maxConcurrentStreams):
+			return nil
+		case !cc.t.StrictMaxConcurrentStreams || cc.goAway != nil || cc.unhealthy:
+			return errClientConnFull
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-req.Context().Done():
+			return req.Context().Err()
+		case <-req.Cancel:
+			return ErrRequestCanceled
+		default:
+		}
+		if waitDone == nil {
+			waitDone = make(chan struct{})
+			defer close(waitDone)
+			go func() {
+				select {
+				case <-ctx.Done():
+				case <-req.Context().Done():
+				case <-req.Cancel:
+				case <-waitDone:
+					return
+				}
+				cc.mu.Lock()
+				cc.cond.Broadcast()
+				cc.unlock()
+			}()
+		}
+		cc.cond.Wait()
+	}
+}
+
+// writeBodyInline reports whether do should write req's body itself
+// before waiting for the response, rather than queue it for one of
+// cc's body writers. That's for bodies it can't get stuck on: in
+// memory, as GetBody suggests, with no RateLimiter to wait on, and
+// no larger than the server's initial stream window.
+// requires cc.mu be held.
+func (cc *ClientConn) writeBodyInline(cs *clientStream, req *http.Request) bool {
+	return req.GetBody != nil && req.Method != "CONNECT" && cs.reqLimiter == nil &&
+		req.ContentLength > 0 && req.ContentLength <= int64(cc.initialWindowSize)
+}
+
+// abortRequestBody closes cs's request body, if writeRequestBody
+// may still be reading it, so that it stops, or drops it from cc's
+// queue if it's yet to start: a closed stream has no use for the
+// rest. Close is called in a goroutine, as it may block. requires
+// cc.mu be held.
+func (cc *ClientConn) abortRequestBody(cs *clientStream) {
+	if body := cs.reqBody; body != nil {
+		cs.reqBody = nil
+		go body.Close()
+	}
+	for i, q := range cc.bodyQueue {
+		if q.cs == cs {
+			copy(cc.bodyQueue[i:], cc.bodyQueue[i+1:])
+			cc.bodyQueue[len(cc.bodyQueue)-1] = queuedBody{}
+			cc.bodyQueue = cc.bodyQueue[:len(cc.bodyQueue)-1]
+			cc.releaseStreamLocked(cs) // writeRequestBody's
+			break
+		}
+	}
+}
+
+// maxIdleBodyWriters bounds the body writers a ClientConn keeps
+// waiting for more request bodies once it's written those it had.
+// There's no bound on those writing: a body may block until its
+// response arrives, as in a full-duplex exchange, or for as long as
+// its caller likes, and none may wait on another to finish.
+const maxIdleBodyWriters = 16
+
+type queuedBody struct {
+	cs  *clientStream
+	req *http.Request
+}
+
+// queueRequestBody queues req's body for one of cc's body writers,
+// waking an idle one, or starting another if there are more queued
+// bodies than idle writers to take them. requires cc.mu be held.
+func (cc *ClientConn) queueRequestBody(cs *clientStream, req *http.Request) {
+	cc.bodyQueue = append(cc.bodyQueue, queuedBody{cs, req})
+	if len(cc.bodyQueue) > cc.idleBodyWriters {
+		cc.bodyWriters++
+		go cc.writeRequestBodies()
+		return
+	}
+	cc.bodyCond.Signal()
+}
+
+// writeRequestBodies is one of cc's body writers. It writes the
+// queued request bodies in turn, and waits for more while cc is
+// open, unless maxIdleBodyWriters are waiting already. It runs in
+// its own goroutine.
+func (cc *ClientConn) writeRequestBodies() {
+	cc.mu.Lock()
+	defer cc.unlock()
+	for {
+		for len(cc.bodyQueue) == 0 {
+			if cc.closed || cc.isDead() || cc.idleBodyWriters >= maxIdleBodyWriters {
+				cc.bodyWriters--
+				return
+			}
+			cc.idleBodyWriters++
+			cc.bodyCond.Wait()
+			cc.idleBodyWriters--
+		}
+		q := cc.bodyQueue[0]
+		cc.bodyQueue[0] = queuedBody{}
+		cc.bodyQueue = cc.bodyQueue[1:]
+		cc.unlock()
+		cc.writeRequestBody(q.cs, q.req)
+		cc.mu.Lock()
+	}
+}
+
+// writeData writes p to cs as DATA frames and flushes them.
+func (cc *ClientConn) writeData(cs *clientStream, p []byte, endStream bool) error {
+	cc.mu.Lock()
+	defer cc.unlock()
+	return cc.writeDataLocked(cs, p, endStream)
+}
+
+// requires cc.mu be held.
+func (cc *ClientConn) writeDataLocked(cs *clientStream, p []byte, endStream bool) error {
+	if cc.werr != nil {
+		return cc.werr
+	}
+	switch cs.state {
+	case stateHalfClosedLocal:
+		return errClosedWrite
+	case stateClosed:
+		return errStreamClosed
+	}
+	if len(p) > 0 {
+		cs.sending = true
+		defer func() {
+			cs.sending = false
+			cc.cond.Broadcast()
+		}()
+	}
+	for {
+		allowed := cs.outflow.available()
+		if len(p) > 0 {
+			var err error
+			if allowed, err = cc.awaitFlowLocked(cs); err != nil {
+				return err
+			}
+		}
+		max := int(cc.maxFrameSize)
+		if int(allowed) < max {
+			max = int(allowed)
+		}
+		if max < 0 {
+			max = 0
+		}
+		n, pad := cc.t.Padding.split(len(p), max)
+		if pad != nil {
+			// Padding counts against flow control too.
+			cs.outflow.take(int32(n + 1 + len(pad)))
+		} else {
+			cs.outflow.take(int32(n))
+		}
+		cc.fr.WriteDataPadded(cs.ID, endStream && n == len(p), p[:n], pad)
+		cs.bytesOut += int64(n)
+		cc.sentData(cs, n)
+		p = p[n:]
+		if len(p) == 0 || cc.werr != nil {
+			break
+		}
+	}
+	cc.bw.Flush()
+	cc.noteStreamActivity(cs)
+	if cc.werr == nil && endStream {
+		cc.sentEndStream(cs)
+	}
+	return cc.werr
+}
+
+// failRequestBody resets cs after a problem sending its request body
+// and fails the request with err, if it's still waiting.
+func (cc *ClientConn) failRequestBody(cs *clientStream, err error) {
+	cc.resetStream(cs, ErrCodeCancel, err)
+	select {
+	case cs.resc <- resAndError{err: err}:
+	default:
+	}
+}
+
+func (cc *ClientConn) do(ctx context.Context, req *http.Request) resAndError {
+	if hook := cc.t.OnRequest; hook != nil {
+		req = req.Clone(req.Context())
+		if err := hook(req); err != nil {
+			return resAndError{err: err}
+		}
+	}
+	if err := checkRequestHeaders(req); err != nil {
+		return resAndError{err: err}
+	}
+	contentEncoding, bodyEncoder, err := cc.t.requestEncoder(req)
+	if err != nil {
+		return resAndError{err: err}
+	}
+	cc.mu.Lock()
+
+	if err := cc.awaitOpenSlotLocked(ctx, req); err != nil {
+		cc.unlock()
+		return resAndError{err: err}
+	}
+	if _, ok := req.Header[":protocol"]; ok && !cc.extendedConnect {
+		cc.unlock()
+		return resAndError{err: errExtendedConnectNotSupported}
+	}
+
+	cs := cc.newStream()
+	cc.replaceIfNearlyExhausted()
+	cs.isHead = req.Method == "HEAD"
+	cs.authority = authority(req)
+	cs.method = req.Method
+	cs.tunnel = req.Method == "CONNECT"
+	if !cs.tunnel {
+		// A tunnel's clientDataConn keeps using cs after do
+		// returns, so it's never recycled.
+		defer cc.releaseStream(cs)
+	}
+	hasBody := actualContentLength(req) != 0 || req.Method == "CONNECT"
+
+	// we send: HEADERS[+CONTINUATION] + (DATA?)
+	acceptEncoding := cc.t.acceptEncoding(req)
+	cs.requestedEncoding = acceptEncoding != ""
+	cs.bodyEncoder = bodyEncoder
+	cs.maxBodyBytes = cc.t.maxResponseBodySize(req)
+	cs.bodyTimeout, _ = req.Context().Value(responseBodyTimeoutKey{}).(responseBodyTimeout)
+	cs.ctx = req.Context()
+	cs.raw, _ = req.Context().Value(rawHeadersKey{}).(*RawHeaders)
+	cc.setRequestPriority(cs)
+	writeBody := hasBody && req.Body != nil
+	if writeBody {
+		cs.reqBody = req.Body
+	}
+	if cc.t.RequestRateLimiter != nil && hasBody {
+		cs.reqLimiter = cc.t.RequestRateLimiter(req)
+	}
+	if cc.t.ResponseRateLimiter != nil {
+		cs.resLimiter = cc.t.ResponseRateLimiter(req)
+	}
+	hdrs := cc.encodeHeaders(req, acceptEncoding, contentEncoding)
+	if v := cs.priorityHeader(req); v != "" {
+		cc.writeHeader("priority", v)
+		hdrs = cc.hbuf.Bytes()
+	}
+	first := true
+	for len(hdrs) > 0 {
+		chunk := hdrs
+		if len(chunk) > int(cc.maxFrameSize) {
+			chunk = chunk[:cc.maxFrameSize]
+		}
+		hdrs = hdrs[len(chunk):]
+		endHeaders := len(hdrs) == 0
+		if first {
+			cc.fr.WriteHeaders(HeadersFrameParam{
+				StreamID:      cs.ID,
+				BlockFragment: chunk,
+				EndStream:     !hasBody,
+				EndHeaders:    endHeaders,
+				PadLength:     uint8(cc.t.Padding.padLength(len(chunk), int(cc.maxFrameSize))),
+				Priority:      cs.headersPriority(),
+			})
+			first = false
+		} else {
+			cc.fr.WriteContinuation(cs.ID, endHeaders, chunk)
+		}
+	}
+	cc.hbuf.release()
+	cs.state = stateOpen
+	cc.streamOpened(cs)
+	if !hasBody {
+		cc.sentEndStream(cs)
+	}
+	cc.bw.Flush()
+	werr := cc.werr
+	inline := writeBody && cc.writeBodyInline(cs, req)
+	if writeBody && werr == nil {
+		cc.acquireStreamLocked(cs) // released by writeRequestBody
+		if !inline {
+			cc.queueRequestBody(cs, req)
+		}
+	}
+	cc.unlock()
+
+	if werr != nil {
+		cc.resetStream(cs, ErrCodeCancel, werr)
+		return resAndError{err: werr}
+	}
+	if inline {
+		cc.writeRequestBody(cs, req)
+	}
+
+	select {
+	case re := <-cs.resc:
+		return re
+	case <-cc.readerDone:
+		select {
+		case re := <-cs.resc:
+			return re
+		default:
+		}
+		err := cc.readerErr
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return resAndError{err: err}
+	case <-ctx.Done():
+		cc.resetStream(cs, ErrCodeCancel, ctx.Err())
+		cc.abandonResponse(cs)
+		return resAndError{err: ctx.Err()}
+	case <-req.Cancel:
+		cc.resetStream(cs, ErrCodeCancel, ErrRequestCanceled)
+		cc.abandonResponse(cs)
+		return resAndError{err: ErrRequestCanceled}
+	}
+}
+
+// abandonResponse notes that do has given up waiting for cs's
+// response, so that readLoop won't deliver it, and closes the body
+// of one that was delivered meanwhile, releasing the stream.
+func (cc *ClientConn) abandonResponse(cs *clientStream) {
+	cc.mu.Lock()
+	cs.abandoned = true
+	var res *http.Response
+	select {
+	case re := <-cs.resc:
+		res = re.res
+	default:
+	}
+	cc.unlock()
+	if res != nil {
+		res.Body.Close()
+	}
+}
+
+type clientDataConn struct {
+	re    *resAndError
+	ctx   context.Context // ConnectContext's; see WithResetCode
+	donec chan struct{}   // closed by Close
+	once  sync.Once
+
+	err error // if non-nil, returned by Write; guarded by cc.mu
+}
+
+func (dc *clientDataConn) Read(p []byte) (int, error) {
+	return dc.re.res.Body.Read(p)
+}
+
+func (dc *clientDataConn) Write(p []byte) (int, error) {
+	cc := dc.re.cc
+	cc.mu.Lock()
+	defer cc.unlock()
+	if dc.err != nil {
+		return 0, dc.err
+	}
+	if err := cc.writeDataLocked(dc.re.cs, p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite half-closes the stream by sending an empty DATA frame
+// with END_STREAM set. The peer sees EOF on its read side, while
+// Read continues to return data sent by the peer.
+func (dc *clientDataConn) CloseWrite() error {
+	cc := dc.re.cc
+	cc.mu.Lock()
+	defer cc.unlock()
+	switch dc.re.cs.state {
+	case stateHalfClosedLocal, stateClosed:
+		return nil
+	}
+	return cc.writeDataLocked(dc.re.cs, nil, true)
+}
+
+// Close resets the stream, unless both sides are done with it, with
+// the code closeCode picks.
+func (dc *clientDataConn) Close() (err error) {
+	dc.once.Do(func() { close(dc.donec) })
+	cc := dc.re.cc
+	cc.mu.Lock()
+	code := dc.re.cs.closeCode(dc.ctx)
+	cc.unlock()
+	return dc.abort(code, io.EOF)
+}
+
+// statusErr returns an error if the CONNECT response status for
+// target wasn't 2xx.
+func (dc *clientDataConn) statusErr(target string) error {
+	if res := dc.re.res; res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("http2: CONNECT to %s refused: %s", target, res.Status)
+	}
+	return nil
+}
+
+// abort resets the stream with code and fails subsequent Reads and
+// Writes with err.
+func (dc *clientDataConn) abort(code ErrCode, err error) error {
+	cc := dc.re.cc
+	cc.mu.Lock()
+	if dc.err == nil {
+		dc.err = err
+	}
+	cc.unlock()
+	return cc.resetStream(dc.re.cs, code, err)
+}
+
+// watchContext resets the stream when ctx is canceled before the
+// conn is closed. It runs in its own goroutine.
+func (dc *clientDataConn) watchContext(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		dc.abort(ErrCodeCancel, ctx.Err())
+	case <-dc.donec:
+	}
+}
+
+func (dc *clientDataConn) LocalAddr() net.Addr {
+	return dc.re.cc.tconn.LocalAddr()
+}
+
+func (dc *clientDataConn) RemoteAddr() net.Addr {
+	return dc.re.cc.tconn.RemoteAddr()
+}
+
+func (dc *clientDataConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (dc *clientDataConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (dc *clientDataConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (cc *ClientConn) connect(ctx context.Context, req *http.Request) (net.Conn, error) {
+	re := cc.do(ctx, req)
+	if re.err != nil {
+		return nil, re.err
+	}
+	dc := &clientDataConn{re: &re, ctx: ctx, donec: make(chan struct{})}
+	if ctx.Done() != nil {
+		go dc.watchContext(ctx)
+	}
+	return dc, nil
+}
+
+// hostPort returns the host and port to dial for u, with any IPv6
+// literal unbracketed but keeping its zone, and an internationalized
+// name in its ASCII form. The port defaults to 443.
+func hostPort(u *url.URL) (host, port string) {
+	host, port = u.Hostname(), u.Port()
+	if h, err := toASCII(host); err == nil {
+		host = h
+	}
+	if port == "" {
+		port = "443"
+	}
+	return host, port
+}
+
+// authority returns the :authority of req, from its Host or else
+// its URL. As with net/http's Host header, an IPv6 literal is put
+// in brackets and loses its zone, which means nothing to the
+// server, and an internationalized name is sent in its ASCII form.
+// The default port, 443, is left out, except for CONNECT, whose
+// target must have a port.
+func authority(req *http.Request) string {
+	hostport := req.Host
+	if hostport == "" {
+		hostport = req.URL.Host
+	}
+	if isPlainAuthority(hostport) {
+		return hostport
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// No port, and perhaps an unbracketed IPv6 literal.
+		host, port = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), ""
+	}
+	host = removeZone(host)
+	if h, err := toASCII(host); err == nil {
+		host = h
+	}
+	if port == "443" && req.Method != "CONNECT" {
+		port = ""
+	}
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// isPlainAuthority reports whether authority would return hostport
+// unchanged, sparing the common case its allocations: it's an ASCII
+// name or IPv4 address, with any port but the default.
+func isPlainAuthority(hostport string) bool {
+	if !isASCII(hostport) || strings.ContainsAny(hostport, "[]%") || strings.HasSuffix(hostport, ":") {
+		return false
+	}
+	i := strings.IndexByte(hostport, ':')
+	return i < 0 || strings.IndexByte(hostport[i+1:], ':') < 0 && hostport[i+1:] != "443"
+}
+
+// removeZone removes the zone from host if it's an IPv6 literal, as
+// in "fe80::1%en0".
+func removeZone(host string) string {
+	if !strings.Contains(host, ":") {
+		return host
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
+
+// checkRequestHeaders returns an error if any header field that
+// encodeHeaders would send for req is malformed. It must be called
+// before encoding, since HPACK encoding mutates the encoder's
+// dynamic table.
+func checkRequestHeaders(req *http.Request) error {
+	host := authority(req)
+	if host == "" {
+		return errors.New("http2: no Host in request")
+	}
+	if !validHost(host) {
+		return fmt.Errorf("http2: invalid Host %q", host)
+	}
+	// A Host header field is never sent; the :authority is.
+	// Refuse one that names another host rather than let a proxy
+	// on the way, or a server, pick between them.
+	for _, v := range req.Header["Host"] {
+		if h := authority(&http.Request{Method: req.Method, Host: v}); h != host {
+			return fmt.Errorf("http2: Host header %q conflicts with :authority %q", v, host)
+		}
+	}
+	if !validFieldName(req.Method) {
+		return fmt.Errorf("http2: invalid method %q", req.Method)
+	}
+	if !validFieldValue(req.RequestURI) {
+		return fmt.Errorf("http2: invalid request URI %q", req.RequestURI)
+	}
+	for k, vv := range req.Header {
+		switch {
+		case k == ":protocol":
+		case strings.HasPrefix(k, ":"):
+			continue // not sent
+		case !validFieldName(k):
+			return fmt.Errorf("http2: invalid header field name %q", k)
+		}
+		for _, v := range vv {
+			if !validFieldValue(v) {
+				return fmt.Errorf("http2: invalid header field value %q for key %q", v, k)
+			}
+		}
+	}
+	return nil
+}
+
+// requestPath returns the :path of req.
+func requestPath(req *http.Request) string {
+	if req.RequestURI == "" {
+		return "/"
+	}
+	return req.RequestURI
+}
+
+// encodeHeaders encodes req's header block into cc.hbuf; the result
+// is only valid until cc.hbuf.release, which the caller calls once
+// it's written. requires cc.mu be held, as the HPACK encoder's
+// dynamic table has to see header blocks in the order they're written
+// to the conn.
+func (cc *ClientConn) encodeHeaders(req *http.Request, acceptEncoding, contentEncoding string) []byte {
+	cc.hbuf.release()
+
+	cc.writeHeader(":authority", authority(req))
+	cc.writeHeader(":method", req.Method)
+	if _, ok := req.Header[":protocol"]; req.Method != "CONNECT" || ok {
+		cc.writeHeader(":path", requestPath(req))
+		cc.writeHeader(":scheme", req.URL.Scheme)
+		// Extended CONNECT (RFC 8441) carries the tunneled
+		// protocol in the :protocol pseudo-header.
+		for _, v := range req.Header[":protocol"] {
+			cc.writeHeader(":protocol", v)
+		}
+	}
+	// Otherwise it's a CONNECT request, for which 8.3 says "The
+	// :scheme and :path pseudo-header fields MUST be omitted."
+
+	// Header fields nominated by Connection are hop-by-hop too.
+	var nominated map[string]bool
+	for _, v := range req.Header["Connection"] {
+		for _, tok := range strings.Split(v, ",") {
+			if tok = strings.ToLower(strings.TrimSpace(tok)); tok != "" {
+				if nominated == nil {
+					nominated = make(map[string]bool)
+				}
+				nominated[tok] = true
+			}
+		}
+	}
+
+	for k, vv := range req.Header {
+		lowKey := lowerHeader(k)
+		if lowKey == "host" || strings.HasPrefix(lowKey, ":") {
+			continue
+		}
+		// 8.1.2.2 Connection-Specific Header Fields
+		// "An endpoint MUST NOT generate an HTTP/2 message
+		// containing connection-specific header fields."
+		if connectionHeaders[lowKey] || nominated[lowKey] {
+			continue
+		}
+		if lowKey == "content-length" && contentEncoding != "" {
+			// Describes the body before encoding.
+			continue
+		}
+		if lowKey == "te" {
+			// "The only exception to this is the TE header
+			// field, which MAY be present in an HTTP/2
+			// request; when it is, it MUST NOT contain any
+			// value other than "trailers"."
+			if teHasTrailers(vv) {
+				cc.writeHeader("te", "trailers")
+			}
+			continue
+		}
+		if lowKey == "cookie" {
+			// 8.1.2.5 Compressing the Cookie Header Field
+			// Sending each cookie-pair as its own field lets
+			// HPACK index the ones that don't change.
+			for _, v := range vv {
+				for v != "" {
+					crumb := v
+					if i := strings.IndexByte(v, ';'); i >= 0 {
+						crumb, v = v[:i], v[i+1:]
+					} else {
+						v = ""
+					}
+					if crumb = strings.TrimSpace(crumb); crumb != "" {
+						cc.writeHeader("cookie", crumb)
+					}
+				}
+			}
+			continue
+		}
+		for _, v := range vv {
+			cc.writeHeader(lowKey, v)
+		}
+	}
+	if acceptEncoding != "" {
+		cc.writeHeader("accept-encoding", acceptEncoding)
+	}
+	if contentEncoding != "" {
+		cc.writeHeader("content-encoding", contentEncoding)
+	}
+	return cc.hbuf.Bytes()
+}
+
+// connectionHeaders are the connection-specific header fields which
+// must not be sent over HTTP/2, keyed by lowercase name.
+// actualContentLength returns the length of req's body, 0 if it has
+// none, or -1 if it's unknown. As in net/http, a ContentLength of 0
+// with a Body other than http.NoBody means unknown, as does -1,
+// which httputil.ReverseProxy uses for a chunked request it relays.
+func actualContentLength(req *http.Request) int64 {
+	if req.Body == nil || req.Body == http.NoBody {
+		return 0
+	}
+	if req.ContentLength != 0 {
+		return req.ContentLength
+	}
+	return -1
+}
+
+// removeConnectionHeaders deletes from h the connection-specific
+// fields that HTTP/2 forbids, and any that h's Connection field
+// nominates, so that a proxy doesn't pass them on. It reports
+// whether there were any.
+func removeConnectionHeaders(h http.Header) bool {
+	found := false
+	for _, v := range h["Connection"] {
+		for _, tok := range strings.Split(v, ",") {
+			if tok = strings.TrimSpace(tok); tok != "" {
+				h.Del(tok)
+			}
+		}
+	}
+	for k := range connectionHeaders {
+		if ck := http.CanonicalHeaderKey(k); h[ck] != nil {
+			delete(h, ck)
+			found = true
+		}
+	}
+	return found
+}
+
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// teHasTrailers reports whether the TE header values vv include the
+// "trailers" token.
+func teHasTrailers(vv []string) bool {
+	for _, v := range vv {
+		for _, tok := range strings.Split(v, ",") {
+			// Ignore any transfer-coding parameters, such as ";q=0.5".
+			if i := strings.IndexByte(tok, ';'); i >= 0 {
+				tok = tok[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(tok), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cc *ClientConn) writeHeader(name, value string) {
+	if VerboseLogs {
+		// Checked here too, since boxing the args allocates.
+		cc.vlogf("sending %q = %q", name, value)
+	}
+	cc.henc.WriteField(hpack.HeaderField{Name: name, Value: value})
+}
+
+func (cc *ClientConn) vlogf(format string, args ...interface{}) {
+	if VerboseLogs {
+		cc.logf(format, args...)
+	}
+}
+
+func (cc *ClientConn) logf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+type resAndError struct {
+	res *http.Response
+	err error
+	cc  *ClientConn
+	cs  *clientStream
+}
+
+// maxFreeStreams bounds the recycled streams a ClientConn keeps for
+// reuse, which is as many as it's likely to have in flight at once
+// when busy, without holding on to much after a burst.
+const maxFreeStreams = 32
+
+// newStream opens a stream, reusing one that's been released if
+// there are any. The caller holds a reference to it, as does cc
+// until it's closed; see releaseStreamLocked. requires cc.mu be
+// held.
+func (cc *ClientConn) newStream() *clientStream {
+	var cs *clientStream
+	if n := len(cc.freeStreams); n > 0 {
+		cs = cc.freeStreams[n-1]
+		cc.freeStreams[n-1] = nil
+		cc.freeStreams = cc.freeStreams[:n-1]
+	} else {
+		cs = &clientStream{resc: make(chan resAndError, 1)}
+	}
+	cs.ID = cc.nextStreamID
+	cs.prio = defaultPriority
+	cs.declBodyBytes = -1
+	cc.acquireStreamLocked(cs) // cc's, until retireStreamsLocked
+	cc.acquireStreamLocked(cs) // the caller's
+	cs.inflow.setConnFlow(&cc.inflow)
+	cs.inflow.add(int32(cc.inWindowSize))
+	cs.outflow.setConnFlow(&cc.outflow)
+	cs.outflow.add(int32(cc.initialWindowSize))
+	cc.noteStreamActivity(cs)
+	cc.nextStreamID += 2
+	cc.streams[cs.ID] = cs
+	return cs
+}
+
+// debugStreamRefs makes releaseStreamLocked panic if a stream is
+// released more often than it was acquired, which would recycle it
+// while something still used it.
+var debugStreamRefs = DebugGoroutines
+
+// acquireStreamLocked adds a reference to cs, keeping it from being
+// recycled until releaseStreamLocked drops it. requires cc.mu be
+// held.
+func (cc *ClientConn) acquireStreamLocked(cs *clientStream) {
+	cs.refs++
+}
+
+// releaseStreamLocked drops a reference to cs, recycling it once
+// there are none left: its response body is closed and done with,
+// do and writeRequestBody have returned, its body timer won't run,
+// and readLoop, having seen it closed, won't look at it again.
+// Pushed streams, with even IDs, aren't recycled, as their
+// PushedResponse may sit in the cache indefinitely. requires cc.mu
+// be held.
+func (cc *ClientConn) releaseStreamLocked(cs *clientStream) {
+	cs.refs--
+	if debugStreamRefs && cs.refs < 0 {
+		panic(fmt.Sprintf("http2: stream %d released more often than acquired", cs.ID))
+	}
+	if cs.refs > 0 || cs.ID%2 == 0 || len(cc.freeStreams) >= maxFreeStreams {
+		return
+	}
+	cs.reset()
+	cc.freeStreams = append(cc.freeStreams, cs)
+}
+
+func (cc *ClientConn) releaseStream(cs *clientStream) {
+	cc.mu.Lock()
+	defer cc.unlock()
+	cc.releaseStreamLocked(cs)
+}
+
+// reset returns cs, which nothing refers to anymore, to the state
+// newStream expects: zero, but for resc, which is drained of any
+// response that came too late for the caller, and bodyPipe, whose
+// buffer goes back to resBodyBufPool if it's still there.
+func (cs *clientStream) reset() {
+	if cs.body != nil {
+		putResBodyBuf(cs.body.release())
+	}
+	resc := cs.resc
+	select {
+	case <-resc:
+	default:
+	}
+	*cs = clientStream{resc: resc}
+}
+
+// retireStreamsLocked lets go of cc's references to the streams
+// closed since it was last called, dropping them from activeRes.
+// Only readLoop calls it, between frames, so that the stream of the
+// frame it's handling can't be recycled from under it; once it's
+// exited, closeStream lets go of them itself. requires cc.mu be
+// held.
+func (cc *ClientConn) retireStreamsLocked(activeRes map[uint32]*clientStream) {
+	for i, cs := range cc.retired {
+		if activeRes[cs.ID] == cs {
+			delete(activeRes, cs.ID)
+		}
+		cc.releaseStreamLocked(cs)
+		cc.retired[i] = nil
+	}
+	cc.retired = cc.retired[:0]
+}
+
+// Streams move through the states of RFC 7540 section 5.1 as
+// follows, always with cc.mu held:
+//
+//	idle -> open                       HEADERS sent (do)
+//	open -> half-closed (local)        END_STREAM sent (sentEndStream)
+//	open -> half-closed (remote)       END_STREAM received (recvEndStream)
+//	half-closed -> closed              END_STREAM in the other direction
+//	any -> closed                      RST_STREAM sent or received
+//
+// A stream is in cc.streams from newStream until it's closed.
+
+// requires cc.mu be held.
+func (cc *ClientConn) sentEndStream(cs *clientStream) {
+	switch cs.state {
+	case stateOpen:
+		cs.state = stateHalfClosedLocal
+	case stateHalfClosedRemote:
+		cc.closeStream(cs, nil)
+	}
+}
+
+// requires cc.mu be held.
+func (cc *ClientConn) recvEndStream(cs *clientStream) {
+	switch cs.state {
+	case stateOpen:
+		cs.state = stateHalfClosedRemote
+	case stateHalfClosedLocal:
+		cc.closeStream(cs, nil)
+	}
+}
+
+// closeStream closes cs, which ended early with err if err is
+// non-nil. requires cc.mu be held.
+func (cc *ClientConn) closeStream(cs *clientStream, err error) {
+	_, open := cc.streams[cs.ID]
+	if open && cs.ID%2 == 0 {
+		cc.pushed--
+	}
+	cs.state = stateClosed
+	delete(cc.streams, cs.ID)
+	cc.prioTree.close(cs.ID)
+	if cs.reqPrio != nil {
+		cs.reqPrio.remove(cc, cs)
+	}
+	cc.stopBodyTimer(cs)
+	cc.abortRequestBody(cs)
+	if open && cc.readLoopDone {
+		cc.releaseStreamLocked(cs)
+	} else if open {
+		cc.retired = append(cc.retired, cs)
+	}
+	if open {
+		s := cc.streamStats(cs, err)
+		if cs.ID%2 == 1 && len(cc.connKey) > 0 {
+			cc.t.recordStream(cc.connKey[0], s)
+		}
+		if h := cc.t.OnStreamClose; h != nil {
+			cc.streamEvents = append(cc.streamEvents, streamEvent{h, s})
+		}
+	}
+	cc.cond.Broadcast()
+	cc.closeIfRetiredIdle()
+}
+
+// streamOpened notes that cs has opened, for Transport.OnStreamOpen.
+// requires cc.mu be held.
+func (cc *ClientConn) streamOpened(cs *clientStream) {
+	cs.start = cc.t.clock().Now()
+	if h := cc.t.OnStreamOpen; h != nil {
+		s := StreamStats{StreamID: cs.ID, Method: cs.method, Authority: cs.authority, Start: cs.start}
+		cc.streamEvents = append(cc.streamEvents, streamEvent{h, s})
+	}
+}
+
+// A streamEvent is a call to Transport.OnStreamOpen or
+// OnStreamClose, with the StreamStats taken when the stream opened
+// or closed.
+type streamEvent struct {
+	hook func(StreamStats)
+	s    StreamStats
+}
+
+// unlock unlocks cc.mu, then makes the calls to the stream hooks
+// that were put off while it was held, so that no hook runs with cc
+// locked. cc's code unlocks cc.mu with it rather than cc.mu.Unlock.
+func (cc *ClientConn) unlock() {
+	events := cc.streamEvents
+	if len(events) == 0 {
+		cc.mu.Unlock()
+		return
+	}
+	cc.streamEvents = nil
+	// Taking hookMu before letting go of mu keeps the calls in the
+	// order the streams opened and closed in.
+	cc.hookMu.Lock()
+	defer cc.hookMu.Unlock()
+	cc.mu.Unlock()
+	for _, e := range events {
+		e.hook(e.s)
+	}
+}
+
+// streamStats returns the StreamStats of cs, which has just closed
+// with err. requires cc.mu be held.
+func (cc *ClientConn) streamStats(cs *clientStream, err error) StreamStats {
+	return StreamStats{
+		StreamID:  cs.ID,
+		Method:    cs.method,
+		Authority: cs.authority,
+		Start:     cs.start,
+		Status:    cs.status,
+		Err:       err,
+		BytesIn:   cs.bytesIn,
+		BytesOut:  cs.bytesOut,
+		Duration:  cc.t.clock().Now().Sub(cs.start),
+	}
+}
+
+// recordError counts an error, described by why, toward
+// Transport.MaxConnErrors, marking cc unhealthy if it's one too
+// many. cc.mu must be held.
+func (cc *ClientConn) recordError(why string) {
+	max := cc.t.MaxConnErrors
+	if max <= 0 || cc.unhealthy {
+		return
+	}
+	now := cc.t.clock().Now()
+	window := cc.t.connErrorWindow()
+	i := 0
+	for i < len(cc.errTimes) && now.Sub(cc.errTimes[i]) > window {
+		i++
+	}
+	cc.errTimes = append(cc.errTimes[i:], now)
+	if len(cc.errTimes) < max {
+		return
+	}
+	cc.vlogf("http2: conn unhealthy after %d errors in %v; last: %s", len(cc.errTimes), window, why)
+	cc.unhealthy = true
+	cc.errTimes = nil
+	cc.cond.Broadcast()
+	cc.closeIfRetiredIdle()
+}
+
+// closeIfRetiredIdle closes cc if it takes no new requests, being
+// unhealthy or out of streams, and has no streams left. Its readLoop
+// then removes it from the pool. cc.mu must be held.
+func (cc *ClientConn) closeIfRetiredIdle() {
+	if !cc.unhealthy && !cc.exhausted() || cc.closed || cc.ownStreams() > 0 {
+		return
+	}
+	cc.closed = true
+	if cc.unhealthy {
+		cc.setCloseErr(errConnUnhealthy)
+	} else {
+		cc.setCloseErr(errConnExhausted)
+	}
+	cc.tconn.Close()
+}
+
+// setCloseErr records err as why we're closing cc, unless there's a
+// reason already. cc.mu must be held.
+func (cc *ClientConn) setCloseErr(err error) {
+	if cc.closeErr == nil {
+		cc.closeErr = err
+	}
+}
+
+// closeReason returns why cc closed, for Transport.OnConnClose: the
+// reason we gave, if we closed it, or else the error writing to it
+// or reading from it. cc.mu must be held.
+func (cc *ClientConn) closeReason() error {
+	if cc.closeErr != nil {
+		return cc.closeErr
+	}
+	if cc.werr != nil {
+		return cc.werr
+	}
+	return cc.readerErr
+}
+
+func (cc *ClientConn) streamState(cs *clientStream) streamState {
+	cc.mu.Lock()
+	defer cc.unlock()
+	return cs.state
+}
+
+// resetStream sends a RST_STREAM with code for cs, closes the
+// stream, and fails any pending body reads with err. It is a no-op if
+// the stream is already closed.
+func (cc *ClientConn) resetStream(cs *clientStream, code ErrCode, err error) error {
+	cc.mu.Lock()
+	defer cc.unlock()
+	return cc.resetStreamLocked(cs, code, err)
+}
+
+// resetStreamLocked is resetStream with cc.mu held.
+func (cc *ClientConn) resetStreamLocked(cs *clientStream, code ErrCode, err error) error {
+	if cs.state == stateClosed {
+		return nil
+	}
+	if code != ErrCodeNo && code != ErrCodeCancel {
+		cc.recordError(fmt.Sprintf("reset stream %d with %v", cs.ID, code))
+	}
+	cc.closeStream(cs, err)
+	if cs.body != nil {
+		cs.body.Close(err)
+	}
+	if werr := cc.fr.WriteRSTStream(cs.ID, code); werr != nil {
+		cc.werr = werr
+		return werr
+	}
+	if werr := cc.bw.Flush(); werr != nil {
+		cc.werr = werr
+		return werr
+	}
+	return nil
+}
 
-	if hasBody {
-		go io.Copy(dataFrameWriter{cc, cs, req.ContentLength}, req.Body)
+// returnFlow gives n bytes of flow control credit back to the
+// server on the connection and, if the server may still send on it,
+// on cs. cs may be nil for the connection alone.
+func (cc *ClientConn) returnFlow(cs *clientStream, n int) {
+	cc.mu.Lock()
+	defer cc.unlock()
+	if cc.closed || cc.werr != nil {
+		return
 	}
-
-	if werr != nil {
-		return resAndError{err: werr}
+	cc.fr.WriteWindowUpdate(0, uint32(n))
+	cc.inflow.add(int32(n))
+	if cs != nil && (cs.state == stateOpen || cs.state == stateHalfClosedLocal) {
+		cc.fr.WriteWindowUpdate(cs.ID, uint32(n))
+		cs.inflow.add(int32(n))
 	}
-
-	return <-cs.resc
+	cc.bw.Flush()
 }
 
-func (cc *clientConn) roundTrip(req *http.Request) (*http.Response, error) {
-	re := cc.do(req)
-	if re.err != nil {
-		return nil, re.err
+// refundData gives the server back the connection flow control
+// credit of f, DATA that readLoop drops unread, for a stream that's
+// closed or that it resets rather than take f on; otherwise the
+// window would shrink by it for good. It reports false if f
+// overflowed the connection's window, a connection error.
+func (cc *ClientConn) refundData(f *DataFrame) bool {
+	n := int32(f.Length)
+	if n == 0 {
+		return true
 	}
-	res := re.res
-	if cl, ok := cc.nextRes.Header["Content-Length"]; ok && cl[0] != "0" {
-		res.ContentLength, _ = strconv.ParseInt(cl[0], 10, 64)
+	cc.mu.Lock()
+	if n > cc.inflow.available() {
+		cc.unlock()
+		return false
 	}
-	res.Request = req
-	res.TLS = cc.tlsState
-	return res, nil
+	cc.inflow.take(n)
+	cc.unlock()
+	cc.returnFlow(nil, int(n))
+	return true
 }
 
-type clientDataConn struct {
-	re *resAndError
+// headerBufPool holds the buffers request header blocks are encoded
+// into, shared by all conns rather than each keeping one as large as
+// its largest block.
+var headerBufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
 }
 
-func (dc *clientDataConn) Read(p []byte) (int, error) {
-	return dc.re.res.Body.Read(p)
+// A headerBlock is what a ClientConn's HPACK encoder writes a
+// request's header block into: a buffer from headerBufPool, taken on
+// the first Write and put back by release.
+type headerBlock struct {
+	buf *bytes.Buffer
 }
 
-func (dc *clientDataConn) Write(p []byte) (int, error) {
-	if err := dc.re.cc.fr.WriteData(dc.re.cs.ID, false, p); err != nil {
-		dc.re.cc.werr = err
-		return 0, err
+func (hb *headerBlock) Write(p []byte) (int, error) {
+	if hb.buf == nil {
+		hb.buf = headerBufPool.Get().(*bytes.Buffer)
 	}
-	if err := dc.re.cc.bw.Flush(); err != nil {
-		dc.re.cc.werr = err
-		return 0, err
-	}
-	return len(p), nil
+	return hb.buf.Write(p)
 }
 
-func (dc *clientDataConn) Close() (err error) {
-	err = dc.re.cc.fr.WriteRSTStream(dc.re.cs.ID, ErrCodeStreamClosed)
-	dc.re.cc.werr = err
-	if cs, ok := dc.re.cc.streams[dc.re.cs.ID]; ok {
-		delete(dc.re.cc.streams, dc.re.cs.ID)
-		if p := cs.pr; p != nil {
-			p.CloseWithError(io.EOF)
-		}
-		cs.pw.Close()
+// Bytes returns the header block written since the last release.
+func (hb *headerBlock) Bytes() []byte {
+	if hb.buf == nil {
+		return nil
 	}
-	return err
+	return hb.buf.Bytes()
 }
 
-func (dc *clientDataConn) LocalAddr() net.Addr {
-	return dc.re.cc.tconn.LocalAddr()
+// release resets hb's buffer and puts it back in headerBufPool, once
+// the header block has been written to the conn.
+func (hb *headerBlock) release() {
+	if hb.buf == nil {
+		return
+	}
+	hb.buf.Reset()
+	headerBufPool.Put(hb.buf)
+	hb.buf = nil
 }
 
-func (dc *clientDataConn) RemoteAddr() net.Addr {
-	return dc.re.cc.tconn.RemoteAddr()
+// resBodyBufPool holds response body buffers, each a stream's
+// initial window, as their allocation dominates that of a small
+// request. A buffer goes back when the body is closed. The
+// clientStream, with its channel and pipe, is recycled separately,
+// by its ClientConn, once nothing refers to it; see
+// releaseStreamLocked.
+var resBodyBufPool = sync.Pool{
+	New: func() interface{} { return new([initialWindowSize]byte) },
 }
 
-func (dc *clientDataConn) SetDeadline(t time.Time) error {
-	return nil
+func getResBodyBuf() []byte {
+	return resBodyBufPool.Get().(*[initialWindowSize]byte)[:]
 }
 
-func (dc *clientDataConn) SetReadDeadline(t time.Time) error {
-	return nil
+// putResBodyBuf returns buf, from pipe.release, to resBodyBufPool,
+// unless it's nil or was replaced by a larger one in pipe.grow.
+func putResBodyBuf(buf []byte) {
+	if len(buf) != initialWindowSize {
+		return
+	}
+	resBodyBufPool.Put((*[initialWindowSize]byte)(buf))
 }
 
-func (dc *clientDataConn) SetWriteDeadline(t time.Time) error {
-	return nil
-}
+// transportResponseBody is a response body as buffered by the
+// readLoop. Reads give flow control credit back to the server, after
+// waiting on the stream's RateLimiter, if any. It holds a reference
+// to the stream until it's closed and its last Read has returned;
+// after that, it doesn't touch the stream, which may have been
+// recycled.
+type transportResponseBody struct {
+	cc *ClientConn
+	cs *clientStream
 
-func (cc *clientConn) connect(req *http.Request) (net.Conn, error) {
-	re := cc.do(req)
-	if re.err != nil {
-		return nil, re.err
-	}
-	return &clientDataConn{&re}, nil
+	// Guarded by cc.mu:
+	closed bool
+	active int // Reads and Closes in progress
 }
 
-// requires cc.mu be held.
-func (cc *clientConn) encodeHeaders(req *http.Request) []byte {
-	cc.hbuf.Reset()
+var errClosedResponseBody = errors.New("http2: response body closed")
 
-	// TODO(bradfitz): figure out :authority-vs-Host stuff between http2 and Go
-	host := req.Host
-	if host == "" {
-		host = req.URL.Host
+// use starts a Read, or a Close if closing is set, of b. It reports
+// false if b is already closed; otherwise, done must be called when
+// it's finished.
+func (b *transportResponseBody) use(closing bool) bool {
+	b.cc.mu.Lock()
+	defer b.cc.unlock()
+	if b.closed {
+		return false
 	}
+	b.closed = closing
+	b.active++
+	return true
+}
 
-	path := req.RequestURI
-	if path == "" {
-		path = "/"
+// done finishes what use started, releasing the stream if b is
+// closed and nothing else is in progress.
+func (b *transportResponseBody) done() {
+	b.cc.mu.Lock()
+	defer b.cc.unlock()
+	b.active--
+	if b.closed && b.active == 0 {
+		b.cc.releaseStreamLocked(b.cs)
 	}
+}
 
-	cc.writeHeader(":authority", host) // probably not right for all sites
-	cc.writeHeader(":method", req.Method)
-	cc.writeHeader(":path", path)
-	cc.writeHeader(":scheme", req.URL.Scheme)
-
-	for k, vv := range req.Header {
-		lowKey := strings.ToLower(k)
-		if lowKey == "host" {
-			continue
+func (b *transportResponseBody) Read(p []byte) (n int, err error) {
+	if !b.use(false) {
+		return 0, errClosedResponseBody
+	}
+	defer b.done()
+	cs := b.cs
+	if cs.resLimiter != nil && len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+	n, err = cs.body.Read(p)
+	if err == io.EOF && cs.trailer != nil {
+		if cs.res.Trailer == nil {
+			cs.res.Trailer = make(http.Header)
 		}
-		for _, v := range vv {
-			cc.writeHeader(lowKey, v)
+		for k, vv := range cs.trailer {
+			cs.res.Trailer[k] = vv
+		}
+		if cs.raw != nil {
+			cs.raw.Trailer = cs.rawTrailer
 		}
 	}
-	return cc.hbuf.Bytes()
+	if n == 0 {
+		return n, err
+	}
+	if cs.resLimiter != nil {
+		if werr := cs.resLimiter.WaitN(cs.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	b.cc.returnFlow(cs, n)
+	return n, err
 }
 
-func (cc *clientConn) writeHeader(name, value string) {
-	cc.vlogf("sending %q = %q", name, value)
-	cc.henc.WriteField(hpack.HeaderField{Name: name, Value: value})
+// Close resets the stream, unless both sides are done with it, with
+// the code closeCode picks, and returns the connection's flow control
+// for what went unread.
+func (b *transportResponseBody) Close() error {
+	if !b.use(true) {
+		return nil
+	}
+	defer b.done()
+	cs, cc := b.cs, b.cc
+	unread := cs.body.discard(errClosedResponseBody)
+	putResBodyBuf(cs.body.release())
+	cc.mu.Lock()
+	cc.resetStreamLocked(cs, cs.closeCode(cs.ctx), errClosedResponseBody)
+	cc.unlock()
+	if unread > 0 {
+		cc.returnFlow(nil, unread)
+	}
+	return nil
 }
 
-func (cc *clientConn) vlogf(format string, args ...interface{}) {
-	if VerboseLogs {
-		cc.logf(format, args...)
+// resetTooLarge resets the stream with ErrResponseTooLarge, for
+// decodeResponse, unless b is closed.
+func (b *transportResponseBody) resetTooLarge() {
+	if !b.use(false) {
+		return
 	}
+	defer b.done()
+	b.cc.resetStream(b.cs, ErrCodeCancel, ErrResponseTooLarge)
 }
 
-func (cc *clientConn) logf(format string, args ...interface{}) {
-	log.Printf(format, args...)
+type resetCodeKey struct{}
+
+// WithResetCode returns a copy of ctx that makes the Transport reset
+// the stream of a request made with it with code when the caller
+// ends it early, by closing the response body, or the conn returned
+// by ConnectContext, before the stream is done. For ConnectContext,
+// it's the ctx argument that counts. Without it, the Transport uses
+// NO_ERROR if the server has finished sending, and CANCEL otherwise.
+// Timeouts and cancellation always use CANCEL.
+func WithResetCode(ctx context.Context, code ErrCode) context.Context {
+	return context.WithValue(ctx, resetCodeKey{}, code)
 }
 
-type resAndError struct {
-	res *http.Response
-	err error
-	cc  *clientConn
-	cs  *clientStream
+// closeCode returns the code to reset cs with when the caller ends
+// it early, given the context the caller made it with. requires
+// cc.mu be held.
+func (cs *clientStream) closeCode(ctx context.Context) ErrCode {
+	if code, ok := ctx.Value(resetCodeKey{}).(ErrCode); ok {
+		return code
+	}
+	if cs.state == stateHalfClosedRemote {
+		// Nothing went wrong; we just don't need the rest of
+		// our side.
+		return ErrCodeNo
+	}
+	return ErrCodeCancel
 }
 
-// requires cc.mu be held.
-func (cc *clientConn) newStream() *clientStream {
-	cs := &clientStream{
-		ID:   cc.nextStreamID,
-		resc: make(chan resAndError, 1),
+func (cc *ClientConn) streamByID(id uint32) *clientStream {
+	cc.mu.Lock()
+	defer cc.unlock()
+	return cc.streams[id]
+}
+
+// processResetStream closes cs after the server reset it, failing
+// the request or its body read with a StreamError.
+func (cc *ClientConn) processResetStream(cs *clientStream, f *RSTStreamFrame) {
+	cc.mu.Lock()
+	defer cc.unlock()
+	if f.ErrCode != ErrCodeNo {
+		cc.recordError(fmt.Sprintf("server reset stream %d with %v", cs.ID, f.ErrCode))
+	}
+	if f.ErrCode == ErrCodeEnhanceYourCalm {
+		cc.t.noteCalm(cc.connKey[0])
+	}
+	err := StreamError{cs.ID, f.ErrCode}
+	cc.closeStream(cs, err)
+	if cs.body != nil {
+		cs.body.Close(err)
+	}
+	select {
+	case cs.resc <- resAndError{err: err}:
+	default:
 	}
-	cc.nextStreamID += 2
-	cc.streams[cs.ID] = cs
-	return cs
 }
 
-func (cc *clientConn) streamByID(id uint32, andRemove bool) *clientStream {
+// processWindowUpdate adds to the window in which cs may send,
+// resetting cs if the server overflows it.
+func (cc *ClientConn) processWindowUpdate(cs *clientStream, f *WindowUpdateFrame) {
 	cc.mu.Lock()
-	defer cc.mu.Unlock()
-	cs := cc.streams[id]
-	if andRemove {
-		delete(cc.streams, id)
+	defer cc.unlock()
+	if !cs.outflow.add(int32(f.Increment)) {
+		cc.resetStreamLocked(cs, ErrCodeFlowControl, StreamError{cs.ID, ErrCodeFlowControl})
+		return
 	}
-	return cs
+	cc.cond.Broadcast()
 }
 
 // runs in its own goroutine.
-func (cc *clientConn) readLoop() {
+func (cc *ClientConn) readLoop() {
+	if h := cc.t.OnConnClose; h != nil {
+		defer func() {
+			cc.mu.Lock()
+			err := cc.closeReason()
+			cc.unlock()
+			h(cc, err)
+		}()
+	}
 	defer cc.t.removeClientConn(cc)
+	defer cc.capture.close()
+	defer func() {
+		// Wake writers waiting on flow control, now that no
+		// WINDOW_UPDATE will come, and idle body writers, so
+		// that they exit.
+		cc.mu.Lock()
+		cc.cond.Broadcast()
+		cc.bodyCond.Broadcast()
+		cc.unlock()
+	}()
 	defer close(cc.readerDone)
+	defer cc.settingsAckTimer.Stop()
+	if cc.readIdleTimer != nil {
+		defer cc.readIdleTimer.Stop()
+	}
+	if cc.reapTimer != nil {
+		defer cc.reapTimer.Stop()
+	}
 
 	activeRes := map[uint32]*clientStream{} // keyed by streamID
+	// Let go of the streams, which are all closed by now.
+	defer func() {
+		cc.mu.Lock()
+		cc.retireStreamsLocked(nil)
+		cc.readLoopDone = true
+		cc.unlock()
+	}()
 	// Close any response bodies if the server closes prematurely.
 	// TODO: also do this if we've written the headers but not
 	// gotten a response yet.
@@ -597,7 +3524,31 @@ func (cc *clientConn) readLoop() {
 			err = io.ErrUnexpectedEOF
 		}
 		for _, cs := range activeRes {
-			cs.pw.CloseWithError(err)
+			cs.body.Close(err)
+		}
+	}()
+	// Close the streams left on the dead conn, which stops any
+	// request bodies being written to it.
+	defer func() {
+		err := cc.readerErr
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		cc.mu.Lock()
+		cc.closed = true
+		for _, cs := range cc.streams {
+			cc.closeStream(cs, err)
+		}
+		cc.unlock()
+	}()
+	// Tell the server why we're hanging up on a connection error.
+	defer func() {
+		if ce, ok := cc.readerErr.(ConnectionError); ok {
+			cc.mu.Lock()
+			cc.fr.WriteGoAway(0, ErrCode(ce), nil)
+			cc.bw.Flush()
+			cc.unlock()
+			cc.tconn.Close()
 		}
 	}()
 
@@ -605,12 +3556,45 @@ func (cc *clientConn) readLoop() {
 	// continuation frames for.
 	var continueStreamID uint32
 
+	// The number of frames and wire bytes in the header block
+	// being read, to bound a CONTINUATION flood.
+	var hdrFrames, hdrBytes int
+
+	controlFrames := frameRateLimiter{max: cc.t.maxControlFrameRate()}
+
 	for {
 		f, err := cc.fr.ReadFrame()
+		if err == ErrFrameTooLarge {
+			err = ConnectionError(ErrCodeFrameSize)
+		}
+		if fe, ok := err.(FrameError); ok {
+			cc.vlogf("%v", fe)
+			err = fe.Err
+			if continueStreamID != 0 {
+				// Not the CONTINUATION we needed.
+				err = ConnectionError(ErrCodeProtocol)
+			}
+			if se, ok := err.(StreamError); ok {
+				// Only the stream is broken; the frame
+				// was read in full and we can go on.
+				if cs := cc.streamByID(se.StreamID); cs != nil {
+					cc.resetStream(cs, se.Code, se)
+					select {
+					case cs.resc <- resAndError{err: se}:
+					default:
+					}
+					delete(activeRes, se.StreamID)
+				}
+				continue
+			}
+		}
 		if err != nil {
 			cc.readerErr = err
 			return
 		}
+		if cc.readIdleTimer != nil {
+			cc.readIdleTimer.Reset(cc.t.ReadIdleTimeout)
+		}
 		cc.vlogf("Transport received %v: %#v", f.Header(), f)
 
 		streamID := f.Header().StreamID
@@ -630,9 +3614,91 @@ func (cc *clientConn) readLoop() {
 			return
 		}
 
-		if streamID%2 == 0 {
-			// Ignore streams pushed from the server for now.
-			// These always have an even stream id.
+		switch f := f.(type) {
+		case *HeadersFrame:
+			hdrFrames, hdrBytes = 1, len(f.HeaderBlockFragment())
+		case *PushPromiseFrame:
+			hdrFrames, hdrBytes = 1, len(f.HeaderBlockFragment())
+		case *ContinuationFrame:
+			hdrFrames++
+			hdrBytes += len(f.HeaderBlockFragment())
+		}
+		if hdrFrames > maxHeaderBlockFrames || hdrBytes > int(cc.t.maxHeaderListSize()) {
+			cc.logf("http2: header block for stream %d too large: %d frames, %d bytes", streamID, hdrFrames, hdrBytes)
+			cc.readerErr = ConnectionError(ErrCodeEnhanceYourCalm)
+			return
+		}
+
+		if isControlFrame(f) && controlFrames.max > 0 && !controlFrames.allow(cc.t.clock().Now()) {
+			cc.logf("http2: server exceeded %d control frames per second", controlFrames.max)
+			cc.readerErr = ConnectionError(ErrCodeEnhanceYourCalm)
+			return
+		}
+
+		if f, ok := f.(*PingFrame); ok {
+			cc.processPing(f)
+			continue
+		}
+		if f, ok := f.(*GoAwayFrame); ok {
+			// GOAWAY is on stream 0, so must be handled
+			// before the stream lookup below.
+			cc.t.removeClientConn(cc)
+			if f.ErrCode != 0 {
+				// TODO: deal with GOAWAY more. particularly the error code
+				cc.vlogf("transport got GOAWAY with error code = %v", f.ErrCode)
+			}
+			if f.ErrCode == ErrCodeEnhanceYourCalm {
+				cc.t.noteCalm(cc.connKey[0])
+			}
+			if h := cc.t.OnGoAway; h != nil {
+				h(cc, f)
+			}
+			cc.setGoAway(f)
+			continue
+		}
+		if f, ok := f.(*WindowUpdateFrame); ok && streamID == 0 {
+			cc.mu.Lock()
+			ok := cc.outflow.add(int32(f.Increment))
+			cc.cond.Broadcast()
+			cc.unlock()
+			if !ok {
+				cc.readerErr = ConnectionError(ErrCodeFlowControl)
+				return
+			}
+			continue
+		}
+		if f, ok := f.(*SettingsFrame); ok {
+			cc.mu.Lock()
+			if f.IsAck() {
+				cc.settingsAcked()
+			} else {
+				cc.applySettings(f)
+			}
+			cc.unlock()
+			continue
+		}
+		if f, ok := f.(*UnknownFrame); ok {
+			if h := cc.t.UnknownFrameHandler; h != nil {
+				h(f)
+			}
+			continue
+		}
+		if _, ok := f.(*PriorityUpdateFrame); ok {
+			// RFC 9218, section 7.1: "A client MUST treat
+			// receipt of a PRIORITY_UPDATE frame as a
+			// connection error of type PROTOCOL_ERROR."
+			cc.readerErr = ConnectionError(ErrCodeProtocol)
+			return
+		}
+
+		if streamID%2 == 0 && cc.t.PushedResponseCache == nil {
+			// Frames for pushes we refused, which may still
+			// be in flight. Pushed streams always have an
+			// even stream id.
+			if f, ok := f.(*DataFrame); ok && !cc.refundData(f) {
+				cc.readerErr = ConnectionError(ErrCodeFlowControl)
+				return
+			}
 			continue
 		}
 		streamEnded := false
@@ -640,9 +3706,43 @@ func (cc *clientConn) readLoop() {
 			streamEnded = ff.StreamEnded()
 		}
 
-		cs := cc.streamByID(streamID, streamEnded)
+		cc.mu.Lock()
+		cc.retireStreamsLocked(activeRes)
+		cs := cc.streams[streamID]
+		if cs != nil {
+			cc.noteStreamActivity(cs)
+		}
+		cc.unlock()
 		if cs == nil {
 			cc.vlogf("Received frame for untracked stream ID %d", streamID)
+			if f, ok := f.(*DataFrame); ok && !cc.refundData(f) {
+				cc.readerErr = ConnectionError(ErrCodeFlowControl)
+				return
+			}
+			continue
+		}
+		if f, ok := f.(*RSTStreamFrame); ok {
+			cc.processResetStream(cs, f)
+			delete(activeRes, streamID)
+			continue
+		}
+		if f, ok := f.(*WindowUpdateFrame); ok {
+			// Allowed in any state, and needed while the
+			// request body is still being sent.
+			cc.processWindowUpdate(cs, f)
+			continue
+		}
+		if cc.streamState(cs) == stateHalfClosedRemote {
+			// "An endpoint that receives any frames other
+			// than WINDOW_UPDATE, PRIORITY, or RST_STREAM for
+			// a stream in this state MUST respond with a
+			// stream error of type STREAM_CLOSED."
+			switch f.(type) {
+			case *PriorityFrame:
+			default:
+				cc.resetStream(cs, ErrCodeStreamClosed, StreamError{streamID, ErrCodeStreamClosed})
+				delete(activeRes, streamID)
+			}
 			continue
 		}
 
@@ -653,20 +3753,106 @@ func (cc *clientConn) readLoop() {
 				ProtoMajor: 2,
 				Header:     make(http.Header),
 			}
-			cs.pr, cs.pw = io.Pipe()
-			cc.hdec.Write(f.HeaderBlockFragment())
+			cc.sawRegularHeader = false
+			cc.resInvalid = false
+			cc.resHeaderSize = 0
+			// A header block after the final response is
+			// its trailers; before it, one with a 1xx
+			// status is an interim response.
+			cc.resTrailers = cs.res != nil
+			cc.keepRaw = cs.raw != nil
+			cc.rawFields = nil
+			cc.hdec.SetEmitEnabled(true)
+			if cs.body == nil {
+				// The body buffer holds a whole stream
+				// window, so that the readLoop never blocks
+				// on a slow reader: the server can't send
+				// more until the body is read.
+				body := &cs.bodyPipe
+				body.b = buffer{buf: getResBodyBuf()}
+				body.c.L = &body.m
+				cc.mu.Lock()
+				cs.body = body
+				cc.unlock()
+			}
+			if _, err := cc.hdec.Write(f.HeaderBlockFragment()); err != nil {
+				cc.readerErr = ConnectionError(ErrCodeCompression)
+				return
+			}
+		case *PushPromiseFrame:
+			if err := cc.startPush(f); err != nil {
+				cc.readerErr = err
+				return
+			}
 		case *ContinuationFrame:
-			cc.hdec.Write(f.HeaderBlockFragment())
+			if _, err := cc.hdec.Write(f.HeaderBlockFragment()); err != nil {
+				cc.readerErr = ConnectionError(ErrCodeCompression)
+				return
+			}
 		case *DataFrame:
 			cc.vlogf("DATA: %q", f.Data())
-			cs.pw.Write(f.Data())
-		case *GoAwayFrame:
-			cc.t.removeClientConn(cc)
-			if f.ErrCode != 0 {
-				// TODO: deal with GOAWAY more. particularly the error code
-				cc.vlogf("transport got GOAWAY with error code = %v", f.ErrCode)
+			if cs.body == nil {
+				// DATA before the response HEADERS.
+				err := StreamError{streamID, ErrCodeProtocol}
+				cc.resetStream(cs, ErrCodeProtocol, err)
+				cs.resc <- resAndError{err: err}
+				if !cc.refundData(f) {
+					cc.readerErr = ConnectionError(ErrCodeFlowControl)
+					return
+				}
+				continue
+			}
+			data := f.Data()
+			// Padding counts against flow control too.
+			n := int32(f.Length)
+			cc.mu.Lock()
+			overflow := n > cs.inflow.available()
+			connOverflow := n > cc.inflow.available()
+			if !overflow {
+				cs.inflow.take(n)
+			}
+			cs.bytesIn += int64(len(data))
+			if cs.bodyTimer != nil {
+				cs.lastData = cc.t.clock().Now()
+			}
+			cc.unlock()
+			if overflow {
+				if cc.protocolViolation("DATA on stream %d exceeds flow control window", streamID) {
+					if connOverflow {
+						cc.readerErr = ConnectionError(ErrCodeFlowControl)
+						return
+					}
+					err := StreamError{streamID, ErrCodeFlowControl}
+					cc.resetStream(cs, ErrCodeFlowControl, err)
+					cc.refundData(f)
+					break
+				}
+				// Tolerated, so make room for it.
+				cs.body.grow(len(data))
+			} else if pad := int(n) - len(data); pad > 0 {
+				// The padding is never read, so give it
+				// back now.
+				cc.returnFlow(cs, pad)
+			}
+			// Resetting the stream drops the data it took,
+			// so the connection gets it back. The padding
+			// was given back above.
+			if cs.declBodyBytes != -1 && cs.bodyBytes+int64(len(data)) > cs.declBodyBytes {
+				cc.resetStream(cs, ErrCodeProtocol, errResBodyTooLong)
+				cc.returnFlow(nil, len(data))
+				break
+			}
+			if cs.maxBodyBytes != -1 && cs.bodyBytes+int64(len(data)) > cs.maxBodyBytes {
+				cc.resetStream(cs, ErrCodeCancel, ErrResponseTooLarge)
+				cc.returnFlow(nil, len(data))
+				break
+			}
+			cs.bodyBytes += int64(len(data))
+			if _, err := cs.body.Write(data); err != nil {
+				// The body was closed, so nobody will
+				// read this.
+				cc.returnFlow(nil, len(data))
 			}
-			cc.setGoAway(f)
 		default:
 			cc.vlogf("Transport: unhandled response frame type %T", f)
 		}
@@ -680,42 +3866,294 @@ func (cc *clientConn) readLoop() {
 			}
 		}
 
-		if streamEnded {
-			cs.pw.Close()
-			delete(activeRes, streamID)
+		if headersEnded && cc.push != nil {
+			if err := cc.hdec.Close(); err != nil {
+				cc.readerErr = ConnectionError(ErrCodeCompression)
+				return
+			}
+			cc.newPush(cs)
+			continue
 		}
-		if headersEnded {
+		if headersEnded && cc.resTrailers {
+			if err := cc.hdec.Close(); err != nil {
+				cc.readerErr = ConnectionError(ErrCodeCompression)
+				return
+			}
+			if !streamEnded {
+				cc.logf("http2: trailers without END_STREAM on stream %d", streamID)
+				cc.resInvalid = true
+			}
+			if cc.resInvalid {
+				err := StreamError{streamID, ErrCodeProtocol}
+				cc.resetStream(cs, ErrCodeProtocol, err)
+				delete(activeRes, streamID)
+				continue
+			}
+			// Copied to res.Trailer by the body's Read at
+			// EOF, as the caller may be looking at it.
+			cs.trailer = cc.nextRes.Header
+			cs.rawTrailer = cc.rawFields
+		} else if headersEnded {
 			if cs == nil {
 				panic("couldn't find stream") // TODO be graceful
 			}
-			// TODO: set the Body to one which notes the
-			// Close and also sends the server a
-			// RST_STREAM
-			cc.nextRes.Body = cs.pr
-			res := cc.nextRes
+			if err := cc.hdec.Close(); err != nil {
+				cc.readerErr = ConnectionError(ErrCodeCompression)
+				return
+			}
+			if code := cc.nextRes.StatusCode; code >= 100 && code < 200 && !cc.resInvalid {
+				// The final response is still to come.
+				if code, err := cc.interimResponse(cs, streamEnded); err != nil {
+					cc.resetStream(cs, code, err)
+					putResBodyBuf(cs.body.release())
+					cs.resc <- resAndError{err: err}
+				}
+				continue
+			}
+			res, ok := cc.newResponse(cs, streamEnded)
+			if !ok {
+				err := StreamError{streamID, ErrCodeProtocol}
+				cc.resetStream(cs, ErrCodeProtocol, err)
+				// The body was never handed out.
+				putResBodyBuf(cs.body.release())
+				cs.resc <- resAndError{err: err}
+				continue
+			}
 			activeRes[streamID] = cs
-			cs.resc <- resAndError{res: res, cc: cc, cs: cs}
+			if cs.maxBodyBytes != -1 && cs.declBodyBytes > cs.maxBodyBytes {
+				// No point waiting for the DATA.
+				cc.resetStream(cs, ErrCodeCancel, ErrResponseTooLarge)
+			}
+			cs.res = res
+			if cs.raw != nil {
+				cs.raw.Header = cc.rawFields
+			}
+			if !streamEnded {
+				cc.startBodyTimer(cs)
+			}
+			cc.mu.Lock()
+			cs.status = res.StatusCode
+			if cs.abandoned {
+				// do gave up on it, so nothing would close
+				// the body. do reset the stream, closing it.
+				putResBodyBuf(cs.body.release())
+			} else {
+				cc.acquireStreamLocked(cs) // res.Body's
+				cs.resc <- resAndError{res: res, cc: cc, cs: cs}
+			}
+			cc.unlock()
+		}
+		if streamEnded {
+			if cs.declBodyBytes != -1 && cs.bodyBytes != cs.declBodyBytes {
+				cs.body.Close(errResBodyTooShort)
+			}
+			cs.body.Close(io.EOF)
+			delete(activeRes, streamID)
+			cc.mu.Lock()
+			cc.stopBodyTimer(cs)
+			cc.recvEndStream(cs)
+			cc.unlock()
+		}
+	}
+}
+
+// maxInterimResponses is how many 1xx responses a stream may have
+// before its final one, so that a server can't keep a request from
+// ever completing with an endless stream of them.
+const maxInterimResponses = 5
+
+// interimResponse handles cc.nextRes, a 1xx response on cs ahead of
+// its final one, such as 100 Continue or 103 Early Hints, by passing
+// it to the request's httptrace.ClientTrace, if it has one. It
+// returns the error, and code, to reset cs with if the response is
+// malformed or the trace's Got1xxResponse rejects it.
+func (cc *ClientConn) interimResponse(cs *clientStream, streamEnded bool) (ErrCode, error) {
+	res := cc.nextRes
+	cs.interim++
+	switch {
+	case streamEnded:
+		// 8.1: only the final response may end the stream.
+		cc.logf("http2: %d response with END_STREAM on stream %d", res.StatusCode, cs.ID)
+		return ErrCodeProtocol, StreamError{cs.ID, ErrCodeProtocol}
+	case res.StatusCode == http.StatusSwitchingProtocols:
+		// 8.1.1: HTTP/2 has no 101 (Switching Protocols).
+		cc.logf("http2: 101 response on stream %d", cs.ID)
+		return ErrCodeProtocol, StreamError{cs.ID, ErrCodeProtocol}
+	case cs.interim > maxInterimResponses:
+		cc.logf("http2: more than %d 1xx responses on stream %d", maxInterimResponses, cs.ID)
+		return ErrCodeProtocol, StreamError{cs.ID, ErrCodeProtocol}
+	}
+	trace := httptrace.ContextClientTrace(cs.ctx)
+	if trace == nil {
+		return 0, nil
+	}
+	if trace.Got1xxResponse != nil {
+		if err := trace.Got1xxResponse(res.StatusCode, textproto.MIMEHeader(res.Header)); err != nil {
+			return ErrCodeCancel, err
+		}
+	}
+	if res.StatusCode == http.StatusContinue && trace.Got100Continue != nil {
+		trace.Got100Continue()
+	}
+	return 0, nil
+}
+
+// newResponse turns cc.nextRes, once its header block has been
+// decoded, into cs's response: it checks that it's well formed,
+// sets ContentLength from the Content-Length header field or the
+// lack of a body, announces its trailers, and sets up its body. It
+// reports false for a malformed response, which the stream must be
+// reset for.
+func (cc *ClientConn) newResponse(cs *clientStream, streamEnded bool) (*http.Response, bool) {
+	res := cc.nextRes
+	if removeConnectionHeaders(res.Header) &&
+		cc.protocolViolation("connection-specific header in response on stream %d", cs.ID) {
+		cc.resInvalid = true
+	}
+	if res.StatusCode == 0 && !cc.resInvalid {
+		cc.logf("http2: missing :status in response on stream %d", cs.ID)
+		cc.resInvalid = true
+	}
+	if cc.resInvalid {
+		return nil, false
+	}
+
+	res.ContentLength = -1
+	if cl := res.Header["Content-Length"]; len(cl) > 0 {
+		// Repeated fields must agree, as in net/http, or a
+		// proxy relaying the response could be fooled about
+		// where it ends.
+		n, err := strconv.ParseInt(cl[0], 10, 64)
+		for _, v := range cl[1:] {
+			if v != cl[0] {
+				err = errors.New("conflicting values")
+			}
+		}
+		if err == nil && n >= 0 {
+			res.ContentLength = n
+			res.Header["Content-Length"] = cl[:1]
+		} else if cc.protocolViolation("invalid Content-Length %q in response on stream %d", cl, cs.ID) {
+			return nil, false
+		} else {
+			delete(res.Header, "Content-Length")
+		}
+	} else if streamEnded && !cs.isHead {
+		res.ContentLength = 0
+	}
+	cs.declBodyBytes = res.ContentLength
+
+	// Announced trailers appear in res.Trailer with nil values
+	// until they arrive, so that a proxy like
+	// httputil.ReverseProxy can announce them in turn.
+	for _, v := range res.Header["Trailer"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = http.CanonicalHeaderKey(strings.TrimSpace(k)); k != "" {
+				if res.Trailer == nil {
+					res.Trailer = make(http.Header)
+				}
+				res.Trailer[k] = nil
+			}
+		}
+	}
+
+	body := &transportResponseBody{cc: cc, cs: cs}
+	res.Body = body
+	if cs.isHead || !bodyAllowedForStatus(res.StatusCode) {
+		// There's no body, whatever the headers say, so don't
+		// make the caller wait for DATA. Any that a
+		// misbehaving server sends anyway fails to write to
+		// the closed body and is dropped.
+		cs.declBodyBytes = -1
+		if !cs.isHead {
+			res.ContentLength = 0
 		}
+		cs.body.Close(io.EOF)
+	} else if cs.requestedEncoding && !streamEnded && res.ContentLength != 0 {
+		// As in net/http, an empty body isn't decoded, so its
+		// headers are left alone.
+		cc.t.decodeResponse(res, cs.maxBodyBytes, body.resetTooLarge)
 	}
+	return res, true
 }
 
-func (cc *clientConn) onNewHeaderField(f hpack.HeaderField) {
-	// TODO: verifiy pseudo headers come before non-pseudo headers
-	// TODO: verifiy the status is set
+func (cc *ClientConn) onNewHeaderField(f hpack.HeaderField) {
 	cc.vlogf("Header field: %+v", f)
-	if f.Name == ":status" {
-		code, err := strconv.Atoi(f.Value)
-		if err != nil {
-			panic("TODO: be graceful")
+	if cc.resInvalid {
+		return
+	}
+	size := f.Size()
+	if limit := cc.t.maxHeaderListSize(); size > limit-cc.resHeaderSize {
+		cc.logf("http2: response header list larger than %d bytes", limit)
+		cc.resInvalid = true
+		cc.hdec.SetEmitEnabled(false)
+		return
+	}
+	cc.resHeaderSize += size
+	if cc.keepRaw {
+		cc.rawFields = append(cc.rawFields, f)
+	}
+	if !validHeader(f.Name) && cc.protocolViolation("invalid header field name %q", f.Name) {
+		cc.resInvalid = true
+		return
+	}
+	if cc.resTrailers && strings.HasPrefix(f.Name, ":") {
+		if cc.protocolViolation("pseudo-header %q in trailers", f.Name) {
+			cc.resInvalid = true
 		}
-		cc.nextRes.Status = f.Value + " " + http.StatusText(code)
-		cc.nextRes.StatusCode = code
 		return
 	}
-	if strings.HasPrefix(f.Name, ":") {
-		// "Endpoints MUST NOT generate pseudo-header fields other than those defined in this document."
-		// TODO: treat as invalid?
+	if !strings.HasPrefix(f.Name, ":") {
+		cc.sawRegularHeader = true
+		if cc.push != nil {
+			cc.push.header.Add(http.CanonicalHeaderKey(f.Name), f.Value)
+			return
+		}
+		cc.nextRes.Header.Add(http.CanonicalHeaderKey(f.Name), f.Value)
+		return
+	}
+	if cc.sawRegularHeader && cc.protocolViolation("pseudo-header %q after regular header", f.Name) {
+		cc.resInvalid = true
+		return
+	}
+	if cc.push != nil {
+		cc.onPushPseudoHeader(f)
+		return
+	}
+	if f.Name != ":status" {
+		// "Endpoints MUST NOT generate pseudo-header fields
+		// other than those defined in this document."
+		if cc.protocolViolation("invalid pseudo-header %q", f.Name) {
+			cc.resInvalid = true
+		}
+		return
+	}
+	// 8.1.2.4 Response Pseudo-Header Fields
+	// "For HTTP/2 responses, a single :status pseudo-header field
+	// is defined that carries the HTTP status code field. This
+	// pseudo-header field MUST be included in all responses;
+	// otherwise, the response is malformed."
+	if cc.nextRes.StatusCode != 0 {
+		cc.logf("http2: duplicate :status %q", f.Value)
+		cc.resInvalid = true
+		return
+	}
+	code, err := strconv.Atoi(f.Value)
+	if err != nil || len(f.Value) != 3 || code < 100 {
+		cc.logf("http2: invalid :status %q", f.Value)
+		cc.resInvalid = true
 		return
 	}
-	cc.nextRes.Header.Add(http.CanonicalHeaderKey(f.Name), f.Value)
+	cc.nextRes.Status = f.Value
+	if text := http.StatusText(code); text != "" {
+		cc.nextRes.Status += " " + text
+	}
+	cc.nextRes.StatusCode = code
+}
+
+// protocolViolation logs a spec violation by the server and reports
+// whether it should be treated as an error, per
+// Transport.StrictProtocolChecks.
+func (cc *ClientConn) protocolViolation(format string, args ...interface{}) bool {
+	cc.logf("http2: protocol violation: "+format, args...)
+	return cc.t.StrictProtocolChecks
 }
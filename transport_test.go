@@ -6,15 +6,36 @@
 package http2
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/phuslu/http2/hpack"
 )
 
 var (
@@ -166,3 +187,4476 @@ func TestTransportAbortClosesPipes(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+func TestTransportConnectCloseWrite(t *testing.T) {
+	const authority = "example.com:443"
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			t.Errorf("Method = %q; want CONNECT", r.Method)
+		}
+		w.(http.Flusher).Flush()
+		slurp, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Body read: %v", err)
+		}
+		io.WriteString(w, "got: "+string(slurp))
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+
+	conn, err := tr.Connect(newConnectRequest(st, authority))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	cw, ok := conn.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		t.Fatalf("%T does not implement CloseWrite", conn)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if _, err := io.WriteString(conn, "more"); err == nil {
+		t.Error("Write after CloseWrite succeeded; want error")
+	}
+	slurp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got, want := string(slurp), "got: hello"; got != want {
+		t.Errorf("read %q; want %q", got, want)
+	}
+}
+
+func newConnectRequest(st *serverTester, authority string) *http.Request {
+	return &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: st.ts.Listener.Addr().String()},
+		Host:       authority,
+		RequestURI: authority,
+		Header:     make(http.Header),
+	}
+}
+
+func TestTransportConnectContextCancelBeforeResponse(t *testing.T) {
+	unblock := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}, optOnlyServer)
+	defer st.Close()
+	defer close(unblock)
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := tr.ConnectContext(ctx, newConnectRequest(st, "example.com:443"))
+	if err != context.Canceled {
+		t.Errorf("ConnectContext error = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestTransportConnectContextCancelUnblocksRead(t *testing.T) {
+	unblock := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		<-unblock
+	}, optOnlyServer)
+	defer st.Close()
+	defer close(unblock)
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := tr.ConnectContext(ctx, newConnectRequest(st, "example.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		errc <- err
+	}()
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("Read error = %v; want %v", err, context.Canceled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for Read to unblock")
+	}
+	if _, err := conn.Write([]byte("x")); err != context.Canceled {
+		t.Errorf("Write error = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestTransportPing(t *testing.T) {
+	st := newServerTester(t, nil, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	host, port, _ := net.SplitHostPort(st.ts.Listener.Addr().String())
+	cc, err := tr.getClientConn(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.ping(2 * time.Second); err != nil {
+		t.Errorf("ping: %v", err)
+	}
+}
+
+func TestTransportEncodeHeadersProtocol(t *testing.T) {
+	cc := &ClientConn{}
+	cc.henc = hpack.NewEncoder(&cc.hbuf)
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Scheme: "https", Host: "relay.example:443", Path: "/chat"},
+		Host:       "relay.example:443",
+		RequestURI: "/chat",
+		Header: http.Header{
+			":protocol": {"websocket"},
+			"Foo":       {"bar"},
+		},
+	}
+	got := decodeHeader(t, cc.encodeHeaders(req, "", ""))
+	want := [][2]string{
+		{":authority", "relay.example:443"},
+		{":method", "CONNECT"},
+		{":path", "/chat"},
+		{":scheme", "https"},
+		{":protocol", "websocket"},
+		{"foo", "bar"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("headers = %q; want %q", got, want)
+	}
+}
+
+func TestTransportConnectProtocolValidation(t *testing.T) {
+	tr := &Transport{InsecureTLSDial: true}
+	tests := []struct {
+		url, protocol string
+	}{
+		{"http://example.com/chat", "websocket"},
+		{"example.com:443", "websocket"},
+		{"https://example.com/chat", ""},
+	}
+	for _, tt := range tests {
+		if _, _, err := tr.ConnectProtocol(context.Background(), tt.url, tt.protocol, nil); err == nil {
+			t.Errorf("ConnectProtocol(%q, %q) succeeded; want error", tt.url, tt.protocol)
+		}
+	}
+}
+
+func TestTransportConnectProtocol(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get(":protocol"); got != "websocket" {
+			t.Errorf(":protocol = %q; want websocket", got)
+		}
+		w.Header().Set("X-Accepted", "yes")
+		conn, err := AcceptConnect(w, r)
+		if err != nil {
+			t.Errorf("AcceptConnect: %v", err)
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	u := "https://" + st.ts.Listener.Addr().String() + "/chat"
+	conn, hdr, err := tr.ConnectProtocol(context.Background(), u, "websocket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := hdr.Get("X-Accepted"); got != "yes" {
+		t.Errorf("X-Accepted = %q; want yes", got)
+	}
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v; want hello", buf, err)
+	}
+}
+
+func TestTransportConnectProtocolNotSupported(t *testing.T) {
+	// The raw server's SETTINGS don't enable extended CONNECT.
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		t.Error("extended CONNECT request sent")
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	u := "https://" + ts.Listener.Addr().String() + "/chat"
+	_, _, err := tr.ConnectProtocol(context.Background(), u, "websocket", nil)
+	if err != errExtendedConnectNotSupported {
+		t.Errorf("ConnectProtocol error = %v; want %v", err, errExtendedConnectNotSupported)
+	}
+}
+
+// newRawServer starts a TLS server that speaks just enough HTTP/2 to
+// let tests script the frames a Transport sees. After the SETTINGS
+// exchange, script is called with the ID of the first request
+// stream; the conn is then drained until the client closes it.
+func newRawServer(t *testing.T, script func(fr *Framer, streamID uint32)) *httptest.Server {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.TLS = &tls.Config{NextProtos: []string{NextProtoTLS}}
+	ts.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		NextProtoTLS: func(_ *http.Server, c *tls.Conn, _ http.Handler) {
+			defer c.Close()
+			if _, err := io.ReadFull(c, make([]byte, len(clientPreface))); err != nil {
+				t.Errorf("reading preface: %v", err)
+				return
+			}
+			fr := NewFramer(c, c)
+			if err := fr.WriteSettings(); err != nil {
+				t.Errorf("writing settings: %v", err)
+				return
+			}
+			for {
+				f, err := fr.ReadFrame()
+				if err != nil {
+					return // client hung up without a request
+				}
+				if sf, ok := f.(*SettingsFrame); ok && !sf.IsAck() {
+					fr.WriteSettingsAck()
+				}
+				if hf, ok := f.(*HeadersFrame); ok {
+					script(fr, hf.StreamID)
+					break
+				}
+			}
+			io.Copy(ioutil.Discard, c)
+		},
+	}
+	ts.StartTLS()
+	return ts
+}
+
+func TestTransportMaxConcurrentStreams(t *testing.T) {
+	tests := []struct {
+		name     string
+		def      uint32 // Transport.DefaultMaxConcurrentStreams
+		settings []Setting
+	}{
+		{"lowered by server", 0, []Setting{{SettingMaxConcurrentStreams, 1}}},
+		{"configured default", 1, nil},
+	}
+	for _, tt := range tests {
+		acked := make(chan bool, 1)
+		ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+			if tt.settings != nil {
+				fr.WriteSettings(tt.settings...)
+				for {
+					f, err := fr.ReadFrame()
+					if err != nil {
+						return
+					}
+					if sf, ok := f.(*SettingsFrame); ok && sf.IsAck() {
+						acked <- true
+						break
+					}
+				}
+			}
+			writeRawHeaders(fr, streamID, false, ":status", "200")
+		})
+		tr := &Transport{InsecureTLSDial: true, DefaultMaxConcurrentStreams: tt.def}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.settings != nil {
+			select {
+			case <-acked:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: server's later SETTINGS not acknowledged", tt.name)
+			}
+		}
+		tr.connMu.RLock()
+		cc := tr.conns[req.URL.Host][0]
+		tr.connMu.RUnlock()
+		if cc.canTakeNewRequest() {
+			t.Errorf("%s: conn takes a second request with a limit of 1", tt.name)
+		}
+		res.Body.Close()
+		if !cc.canTakeNewRequest() {
+			t.Errorf("%s: conn takes no request once its only stream is closed", tt.name)
+		}
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestTransportPeerSettings(t *testing.T) {
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		fr.WriteSettings(
+			Setting{SettingHeaderTableSize, 0},
+			Setting{SettingMaxConcurrentStreams, 7},
+			Setting{SettingMaxFrameSize, 1 << 20},
+			Setting{SettingEnableConnectProtocol, 1},
+		)
+		writeRawHeaders(fr, streamID, true, ":status", "200")
+	})
+	defer ts.Close()
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	ccs := tr.ClientConns(req.URL.Host)
+	if len(ccs) != 1 {
+		t.Fatalf("ClientConns(%q) has %d conns; want 1", req.URL.Host, len(ccs))
+	}
+	want := PeerSettings{
+		HeaderTableSize:       0,
+		EnablePush:            true,
+		MaxConcurrentStreams:  7,
+		InitialWindowSize:     65535,
+		MaxFrameSize:          1 << 20,
+		MaxHeaderListSize:     math.MaxUint32,
+		EnableConnectProtocol: true,
+	}
+	if got := ccs[0].PeerSettings(); got != want {
+		t.Errorf("PeerSettings = %+v; want %+v", got, want)
+	}
+	if ccs := tr.ClientConns("example.com:443"); len(ccs) != 0 {
+		t.Errorf("ClientConns of an unknown host = %v; want none", ccs)
+	}
+}
+
+func TestTransportRetryUnprocessedAfterGoAway(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(nil)
+	ts.TLS = &tls.Config{NextProtos: []string{NextProtoTLS}}
+	ts.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		NextProtoTLS: func(_ *http.Server, c *tls.Conn, _ http.Handler) {
+			defer c.Close()
+			conn := atomic.AddInt32(&conns, 1)
+			if _, err := io.ReadFull(c, make([]byte, len(clientPreface))); err != nil {
+				return
+			}
+			fr := NewFramer(c, c)
+			fr.WriteSettings()
+			bodyLen := map[uint32]int{}
+			for {
+				f, err := fr.ReadFrame()
+				if err != nil {
+					return
+				}
+				switch f := f.(type) {
+				case *SettingsFrame:
+					if !f.IsAck() {
+						fr.WriteSettingsAck()
+					}
+				case *HeadersFrame:
+					if conn == 1 && f.StreamID == 3 {
+						// Process the first request, but not
+						// the second.
+						fr.WriteGoAway(1, ErrCodeNo, nil)
+						writeRawHeaders(fr, 1, true, ":status", "200", "conn", "1")
+					}
+				case *DataFrame:
+					bodyLen[f.StreamID] += len(f.Data())
+					if conn == 2 && f.StreamEnded() {
+						writeRawHeaders(fr, f.StreamID, true, ":status", "200",
+							"conn", "2", "body-len", strconv.Itoa(bodyLen[f.StreamID]))
+					}
+				}
+			}
+		},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+
+	first := make(chan *http.Response, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Errorf("first request: %v", err)
+		}
+		first <- res
+	}()
+	// Wait for the first request to be in flight.
+	for tr.HostStats(ts.Listener.Addr().String()).ActiveStreams == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	req, _ := http.NewRequest("POST", ts.URL, strings.NewReader("not idempotent"))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("second request: %v", err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get("conn"); got != "2" {
+		t.Errorf("second request answered on conn %s; want a retry on conn 2", got)
+	}
+	if got, want := res.Header.Get("body-len"), strconv.Itoa(len("not idempotent")); got != want {
+		t.Errorf("retried request body was %s bytes; want %s", got, want)
+	}
+	if res.Request != req {
+		t.Error("response's Request isn't the request made")
+	}
+	if res := <-first; res != nil {
+		if got := res.Header.Get("conn"); got != "1" {
+			t.Errorf("first request answered on conn %s; want 1", got)
+		}
+		res.Body.Close()
+	}
+}
+
+// A request refused by GOAWAY is sent again once, on a new conn, and
+// fails if that refuses it too.
+func TestTransportRetryUnprocessedOnce(t *testing.T) {
+	var reqs int32
+	// newRawServer takes one request per conn, so each try is on a
+	// conn of its own.
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		atomic.AddInt32(&reqs, 1)
+		fr.WriteGoAway(0, ErrCodeNo, nil)
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("POST", ts.URL, strings.NewReader("body"))
+	if _, err := tr.RoundTrip(req); err != errRequestUnprocessed {
+		t.Errorf("RoundTrip error = %v; want %v", err, errRequestUnprocessed)
+	}
+	if n := atomic.LoadInt32(&reqs); n != 2 {
+		t.Errorf("request sent %d times; want 2, retried once", n)
+	}
+}
+
+func TestTransportStrictMaxConcurrentStreams(t *testing.T) {
+	entered := make(chan bool, 1)
+	release := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			entered <- true
+			<-release
+		}
+		io.WriteString(w, r.URL.Path)
+	}, optOnlyServer, func(s *Server) {
+		s.MaxConcurrentStreams = 1
+	})
+	defer st.Close()
+	var conns int32
+	tr := &Transport{
+		InsecureTLSDial:            true,
+		StrictMaxConcurrentStreams: true,
+		OnConnOpen:                 func(cc *ClientConn) { atomic.AddInt32(&conns, 1) },
+	}
+	defer tr.CloseIdleConnections()
+
+	type result struct {
+		body string
+		err  error
+	}
+	get := func(ctx context.Context, path string) chan result {
+		c := make(chan result, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", st.ts.URL+path, nil)
+			req.RequestURI = path
+			res, err := tr.RoundTrip(req.WithContext(ctx))
+			if err != nil {
+				c <- result{err: err}
+				return
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			c <- result{body: string(body)}
+		}()
+		return c
+	}
+	first := get(context.Background(), "/block")
+	<-entered
+	second := get(context.Background(), "/second")
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := get(ctx, "/canceled")
+	select {
+	case r := <-second:
+		t.Fatalf("second request finished with %+v while the first held the only stream", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case r := <-canceled:
+		if r.err != context.Canceled {
+			t.Errorf("queued request canceled got %+v; want error %v", r, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for canceled request")
+	}
+
+	close(release)
+	for _, tt := range []struct {
+		c    chan result
+		want string
+	}{{first, "/block"}, {second, "/second"}} {
+		select {
+		case r := <-tt.c:
+			if r.err != nil || r.body != tt.want {
+				t.Errorf("got %+v; want body %q", r, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", tt.want)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("dialed %d conns; want 1", n)
+	}
+}
+
+func TestTransportPriority(t *testing.T) {
+	type seen struct {
+		header string
+		p      Priority
+	}
+	got := make(chan seen, 1)
+	updated := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		p, _ := PriorityFromContext(r.Context())
+		got <- seen{r.Header.Get("Priority"), p}
+		<-updated
+		deadline := time.Now().Add(2 * time.Second)
+		for p.Urgency == 1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+			p, _ = PriorityFromContext(r.Context())
+		}
+		got <- seen{p: p}
+	}, optOnlyServer)
+	defer st.Close()
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+
+	ctx := WithPriority(context.Background(), Priority{PriorityParam: PriorityParam{Weight: 200}, Urgency: 1})
+	errc := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", st.ts.URL, nil)
+		res, err := tr.RoundTrip(req.WithContext(ctx))
+		if err == nil {
+			res.Body.Close()
+		}
+		errc <- err
+	}()
+	want := seen{"u=1", Priority{PriorityParam: PriorityParam{Weight: 200}, Urgency: 1}}
+	if s := <-got; s != want {
+		t.Errorf("server saw %+v; want %+v", s, want)
+	}
+	if !UpdatePriority(ctx, Priority{PriorityParam: PriorityParam{Weight: 50}, Urgency: 6, Incremental: true}) {
+		t.Error("UpdatePriority = false; want true")
+	}
+	close(updated)
+	want = seen{p: Priority{PriorityParam: PriorityParam{Weight: 50}, Urgency: 6, Incremental: true}}
+	if s := <-got; s != want {
+		t.Errorf("after UpdatePriority, server saw %+v; want %+v", s, want)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if UpdatePriority(context.Background(), Priority{}) {
+		t.Error("UpdatePriority of a context without WithPriority = true; want false")
+	}
+}
+
+// postAsync POSTs a body of size bytes to url with ctx, and returns
+// a channel for the error.
+func postAsync(tr *Transport, url string, ctx context.Context, size int) chan error {
+	errc := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", url, bytes.NewReader(make([]byte, size)))
+		res, err := tr.RoundTrip(req.WithContext(ctx))
+		if err == nil {
+			res.Body.Close()
+		}
+		errc <- err
+	}()
+	return errc
+}
+
+// awaitSending waits for the body of cc's stream id to be waiting
+// to send DATA.
+func awaitSending(cc *ClientConn, id uint32) {
+	for sending := false; !sending; {
+		time.Sleep(time.Millisecond)
+		cc.mu.Lock()
+		cs := cc.streams[id]
+		sending = cs != nil && cs.sending
+		cc.mu.Unlock()
+	}
+}
+
+// TestTransportPrioritySendOrder checks that when the conn's flow
+// control window opens, the most urgent request body waiting goes
+// first, whatever order the requests came in.
+func TestTransportPrioritySendOrder(t *testing.T) {
+	fillerBlocked := make(chan bool, 1)
+	waiting := make(chan bool)
+	first := make(chan uint32, 1)
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		var n int
+		headers := 1
+		for n < initialWindowSize || headers < 3 {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *DataFrame:
+				if n += len(f.Data()); n == initialWindowSize {
+					fillerBlocked <- true
+				}
+			case *HeadersFrame:
+				headers++
+			}
+		}
+		<-waiting
+		fr.WriteWindowUpdate(0, 1000)
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if _, ok := f.(*DataFrame); ok {
+				first <- f.Header().StreamID
+				break
+			}
+		}
+		// Let the other through too; its body is sent before
+		// its response is awaited.
+		fr.WriteWindowUpdate(0, 1000)
+		for id := uint32(1); id <= 5; id += 2 {
+			writeRawHeaders(fr, id, true, ":status", "200")
+		}
+	})
+	defer ts.Close()
+	opened := make(chan *ClientConn, 1)
+	tr := &Transport{
+		InsecureTLSDial: true,
+		OnConnOpen:      func(cc *ClientConn) { opened <- cc },
+	}
+	defer tr.CloseIdleConnections()
+
+	// The filler uses up the conn's window, and then its own, so
+	// that the others wait for the conn's.
+	filler := postAsync(tr, ts.URL, context.Background(), 1<<20)
+	cc := <-opened
+	<-fillerBlocked
+	urgent := postAsync(tr, ts.URL, WithPriority(context.Background(), Priority{Urgency: 0}), 1000)
+	awaitSending(cc, 3)
+	bulk := postAsync(tr, ts.URL, WithPriority(context.Background(), Priority{Urgency: 7}), 1000)
+	awaitSending(cc, 5)
+	close(waiting)
+	if id := <-first; id != 3 {
+		t.Errorf("first DATA after the window opened was on stream %d; want 3, the urgent request's", id)
+	}
+	for _, errc := range []chan error{filler, urgent, bulk} {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestTransportWeightedUploads checks that equally urgent request
+// bodies waiting on the conn's flow control window share it in
+// proportion to their weights.
+func TestTransportWeightedUploads(t *testing.T) {
+	const (
+		grant  = 4000
+		grants = 40
+	)
+	fillerBlocked := make(chan bool, 1)
+	waiting := make(chan bool)
+	got := make(chan map[uint32]int, 1)
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		var n int
+		headers := 1
+		for n < initialWindowSize || headers < 3 {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *DataFrame:
+				if n += len(f.Data()); n == initialWindowSize {
+					fillerBlocked <- true
+				}
+			case *HeadersFrame:
+				headers++
+			}
+		}
+		<-waiting
+		fr.WriteWindowUpdate(3, 1<<20)
+		fr.WriteWindowUpdate(5, 1<<20)
+		sent := make(map[uint32]int)
+		for i := 0; i < grants; i++ {
+			fr.WriteWindowUpdate(0, grant)
+			for n := 0; n < grant; {
+				f, err := fr.ReadFrame()
+				if err != nil {
+					return
+				}
+				if f, ok := f.(*DataFrame); ok {
+					n += len(f.Data())
+					sent[f.StreamID] += len(f.Data())
+				}
+			}
+		}
+		got <- sent
+		for id := uint32(1); id <= 5; id += 2 {
+			writeRawHeaders(fr, id, true, ":status", "200")
+		}
+	})
+	defer ts.Close()
+	opened := make(chan *ClientConn, 1)
+	tr := &Transport{
+		InsecureTLSDial: true,
+		OnConnOpen:      func(cc *ClientConn) { opened <- cc },
+	}
+	defer tr.CloseIdleConnections()
+
+	filler := postAsync(tr, ts.URL, context.Background(), 1<<20)
+	cc := <-opened
+	<-fillerBlocked
+	heavy := postAsync(tr, ts.URL, WithPriority(context.Background(), Priority{PriorityParam: PriorityParam{Weight: 255}, Urgency: 3}), 1<<20)
+	awaitSending(cc, 3)
+	light := postAsync(tr, ts.URL, WithPriority(context.Background(), Priority{PriorityParam: PriorityParam{Weight: 63}, Urgency: 3}), 1<<20)
+	awaitSending(cc, 5)
+	close(waiting)
+	sent := <-got
+	// Weights 256 and 64 share the conn 4:1, give or take where
+	// frames are cut at the ends of the bodies' chunks.
+	if r := float64(sent[3]) / float64(sent[5]); r < 3.5 || r > 4.5 {
+		t.Errorf("heavy stream sent %d bytes, light one %d; want 4:1", sent[3], sent[5])
+	}
+	for _, errc := range []chan error{filler, heavy, light} {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTransportConnHooks(t *testing.T) {
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		writeRawHeaders(fr, streamID, true, ":status", "200")
+		fr.WriteGoAway(streamID, ErrCodeNo, []byte("bye"))
+	})
+	defer ts.Close()
+	var (
+		opened  = make(chan *ClientConn, 1)
+		goAways = make(chan string, 1)
+		closed  = make(chan error, 1)
+	)
+	tr := &Transport{
+		InsecureTLSDial: true,
+		OnConnOpen:      func(cc *ClientConn) { opened <- cc },
+		OnGoAway: func(cc *ClientConn, f *GoAwayFrame) {
+			goAways <- fmt.Sprintf("%v %d %q", f.ErrCode, f.LastStreamID, f.DebugData())
+		},
+		OnConnClose: func(cc *ClientConn, err error) { closed <- err },
+	}
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	cc := <-opened
+	if cc.Addr() != req.URL.Host {
+		t.Errorf("Addr = %q; want %q", cc.Addr(), req.URL.Host)
+	}
+	if got, want := cc.RemoteAddr().String(), ts.Listener.Addr().String(); got != want {
+		t.Errorf("RemoteAddr = %q; want %q", got, want)
+	}
+	if cc.TLS() == nil || cc.TLS().NegotiatedProtocol != NextProtoTLS {
+		t.Errorf("TLS = %+v; want a connection negotiating %q", cc.TLS(), NextProtoTLS)
+	}
+	select {
+	case got := <-goAways:
+		if want := `NO_ERROR 1 "bye"`; got != want {
+			t.Errorf("OnGoAway got %s; want %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for OnGoAway")
+	}
+	select {
+	case err := <-closed:
+		t.Fatalf("OnConnClose called early, with %v", err)
+	default:
+	}
+
+	ts.CloseClientConnections()
+	select {
+	case err := <-closed:
+		if err != io.EOF {
+			t.Errorf("OnConnClose got %v; want %v", err, io.EOF)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for OnConnClose")
+	}
+}
+
+func TestTransportStreamHooks(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(201)
+		io.WriteString(w, "hello")
+	}, optOnlyServer)
+	defer st.Close()
+	opened := make(chan StreamStats, 1)
+	closed := make(chan StreamStats, 1)
+	tr := &Transport{
+		InsecureTLSDial: true,
+		OnStreamOpen:    func(s StreamStats) { opened <- s },
+		OnStreamClose:   func(s StreamStats) { closed <- s },
+	}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("POST", st.ts.URL, strings.NewReader("abc"))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	host := req.URL.Host
+	open, got := <-opened, <-closed
+	if open.Start.IsZero() || got.Start != open.Start || got.Duration < 0 {
+		t.Errorf("OnStreamOpen got Start %v; OnStreamClose got Start %v, Duration %v", open.Start, got.Start, got.Duration)
+	}
+	open.Start, got.Start, got.Duration = time.Time{}, time.Time{}, 0
+	if want := (StreamStats{StreamID: 1, Method: "POST", Authority: host}); open != want {
+		t.Errorf("OnStreamOpen got %+v; want %+v", open, want)
+	}
+	if want := (StreamStats{StreamID: 1, Method: "POST", Authority: host, Status: 201, BytesIn: 5, BytesOut: 3}); got != want {
+		t.Errorf("OnStreamClose got %+v; want %+v", got, want)
+	}
+}
+
+// The stream hooks aren't called with the conn locked, so one may
+// look at the Transport's stats, which lock it.
+func TestTransportStreamHooksUnlocked(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, optOnlyServer)
+	defer st.Close()
+	active := make(chan int, 2)
+	tr := &Transport{InsecureTLSDial: true}
+	hook := func(s StreamStats) { active <- tr.HostStats(s.Authority).ActiveStreams }
+	tr.OnStreamOpen, tr.OnStreamClose = hook, hook
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	for i, want := range []int{1, 0} {
+		select {
+		case got := <-active:
+			if got != want {
+				t.Errorf("hook %d saw %d active streams; want %d", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for hook %d", i)
+		}
+	}
+}
+
+func TestTransportHostStats(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		ms, _ := strconv.Atoi(r.URL.Query().Get("ms"))
+		clock.advance(time.Duration(ms) * time.Millisecond)
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(503)
+		}
+	}, optOnlyServer)
+	defer st.Close()
+	closed := make(chan StreamStats, 1)
+	tr := &Transport{
+		InsecureTLSDial: true,
+		Clock:           clock,
+		OnStreamClose:   func(s StreamStats) { closed <- s },
+	}
+	defer tr.CloseIdleConnections()
+	for ms := 10; ms <= 100; ms += 10 {
+		path := fmt.Sprintf("/?ms=%d", ms)
+		if ms == 100 {
+			path += "&fail=1"
+		}
+		req, _ := http.NewRequest("GET", st.ts.URL+path, nil)
+		req.RequestURI = path
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		<-closed
+	}
+
+	addr := st.ts.Listener.Addr().String()
+	want := HostStats{
+		ActiveConns: 1,
+		Streams:     10,
+		ErrorRate:   0.1,
+		P50:         50 * time.Millisecond,
+		P99:         100 * time.Millisecond,
+	}
+	if got := tr.HostStats(addr); got != want {
+		t.Errorf("HostStats = %+v; want %+v", got, want)
+	}
+	clock.advance(time.Minute)
+	if got, want := tr.HostStats(addr), (HostStats{ActiveConns: 1}); got != want {
+		t.Errorf("after a minute, HostStats = %+v; want %+v", got, want)
+	}
+	if got := tr.HostStats("example.com:443"); got != (HostStats{}) {
+		t.Errorf("HostStats of an unknown host = %+v; want zero", got)
+	}
+}
+
+func TestTransportUpdateSettings(t *testing.T) {
+	const size = 100 << 10
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), size))
+	}, optOnlyServer)
+	defer st.Close()
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	get := func() {
+		req, _ := http.NewRequest("GET", st.ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if n, err := io.Copy(ioutil.Discard, res.Body); n != size || err != nil {
+			t.Fatalf("read %d bytes of body, %v; want %d", n, err, size)
+		}
+	}
+	get()
+	cc := tr.ClientConns(st.ts.Listener.Addr().String())[0]
+
+	for _, s := range []Setting{
+		{SettingEnablePush, 1},
+		{SettingInitialWindowSize, 1 << 20},
+		{SettingEnableConnectProtocol, 1},
+	} {
+		if err := cc.UpdateSettings(context.Background(), s); err == nil {
+			t.Errorf("UpdateSettings(%v) succeeded; want error", s)
+		}
+	}
+	for _, s := range []Setting{
+		{SettingEnablePush, 2},
+		{SettingMaxFrameSize, 1},
+	} {
+		if err, want := cc.UpdateSettings(context.Background(), s), s.Valid(); err != want {
+			t.Errorf("UpdateSettings(%v) = %v; want %v", s, err, want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cc.UpdateSettings(ctx, Setting{SettingInitialWindowSize, 1024}, Setting{SettingHeaderTableSize, 0}); err != nil {
+		t.Fatal(err)
+	}
+	cc.mu.Lock()
+	win := cc.inWindowSize
+	cc.mu.Unlock()
+	if win != 1024 {
+		t.Errorf("stream window after ACK = %d; want 1024", win)
+	}
+	// The server keeps to the smaller window, or the conn
+	// would fail.
+	get()
+}
+
+func TestTransportUpdateSettingsUnacknowledged(t *testing.T) {
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		writeRawHeaders(fr, streamID, true, ":status", "200")
+		// The server reads no more frames, and so never
+		// acknowledges more SETTINGS.
+	})
+	defer ts.Close()
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	cc := tr.ClientConns(req.URL.Host)[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cc.UpdateSettings(ctx, Setting{SettingMaxHeaderListSize, 1 << 10}); err != context.DeadlineExceeded {
+		t.Errorf("UpdateSettings error = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestTransportPushedResponse(t *testing.T) {
+	var fetched int32 // requests for /style.css the client made itself
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			opts := &http.PushOptions{Header: http.Header{"X-Lang": {r.Header.Get("X-Lang")}}}
+			if err := w.(http.Pusher).Push("/style.css", opts); err != nil {
+				t.Errorf("Push: %v", err)
+			}
+			io.WriteString(w, "main")
+		case "/style.css":
+			if r.Header.Get("X-Client") != "" {
+				atomic.AddInt32(&fetched, 1)
+			}
+			w.Header().Set("Vary", "X-Lang")
+			io.WriteString(w, "style "+r.Header.Get("X-Lang"))
+		}
+	}, optOnlyServer)
+	defer st.Close()
+	tr := &Transport{InsecureTLSDial: true, PushedResponseCache: NewPushedResponseCache(10)}
+	defer tr.CloseIdleConnections()
+	get := func(path, lang string) string {
+		req, _ := http.NewRequest("GET", st.ts.URL+path, nil)
+		req.RequestURI = path
+		req.Header.Set("X-Client", "1")
+		req.Header.Set("X-Lang", lang)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Request != req {
+			t.Errorf("%s: Response.Request isn't the request", path)
+		}
+		return string(body)
+	}
+
+	get("/", "en")
+	if got := get("/style.css", "en"); got != "style en" {
+		t.Errorf("pushed body = %q; want %q", got, "style en")
+	}
+	if n := atomic.LoadInt32(&fetched); n != 0 {
+		t.Errorf("client fetched the pushed resource %d times; want 0", n)
+	}
+
+	// The push varies on X-Lang, so can't answer for another
+	// language.
+	get("/", "en")
+	if got := get("/style.css", "fr"); got != "style fr" {
+		t.Errorf("body = %q; want %q", got, "style fr")
+	}
+	if n := atomic.LoadInt32(&fetched); n != 1 {
+		t.Errorf("client fetched the resource %d times; want 1", n)
+	}
+}
+
+func TestTransportPushPolicy(t *testing.T) {
+	for _, policy := range []PushPolicy{PushRefuse, PushConnError} {
+		resetc := make(chan *RSTStreamFrame, 1)
+		goAwayc := make(chan *GoAwayFrame, 1)
+		ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+			// The promise and the response share the HPACK
+			// dynamic table, so the client must decode the
+			// promise even to drop it.
+			var buf bytes.Buffer
+			enc := hpack.NewEncoder(&buf)
+			for _, kv := range [][2]string{{":method", "GET"}, {":scheme", "https"}, {":authority", "example.com"}, {":path", "/pushed"}, {"x-shared", "yes"}} {
+				enc.WriteField(hpack.HeaderField{Name: kv[0], Value: kv[1]})
+			}
+			fr.WritePushPromise(PushPromiseParam{StreamID: streamID, PromiseID: 2, BlockFragment: buf.Bytes(), EndHeaders: true})
+			buf.Reset()
+			enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			enc.WriteField(hpack.HeaderField{Name: "x-shared", Value: "yes"})
+			fr.WriteHeaders(HeadersFrameParam{StreamID: streamID, BlockFragment: buf.Bytes(), EndStream: true, EndHeaders: true})
+			for {
+				f, err := fr.ReadFrame()
+				if err != nil {
+					return
+				}
+				switch f := f.(type) {
+				case *RSTStreamFrame:
+					resetc <- f
+				case *GoAwayFrame:
+					goAwayc <- f
+				}
+			}
+		})
+		tr := &Transport{InsecureTLSDial: true, PushPolicy: policy}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		switch policy {
+		case PushRefuse:
+			if err != nil {
+				t.Fatalf("PushRefuse: %v", err)
+			}
+			if got := res.Header.Get("X-Shared"); got != "yes" {
+				t.Errorf("PushRefuse: X-Shared = %q; want %q", got, "yes")
+			}
+			select {
+			case f := <-resetc:
+				if f.StreamID != 2 || f.ErrCode != ErrCodeCancel {
+					t.Errorf("PushRefuse: got RST_STREAM %v on stream %d; want CANCEL on 2", f.ErrCode, f.StreamID)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("PushRefuse: pushed stream not reset")
+			}
+		case PushConnError:
+			if err == nil {
+				t.Errorf("PushConnError: RoundTrip succeeded; want error")
+			}
+			select {
+			case f := <-goAwayc:
+				if f.ErrCode != ErrCodeProtocol {
+					t.Errorf("PushConnError: GOAWAY code = %v; want %v", f.ErrCode, ErrCodeProtocol)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("PushConnError: no GOAWAY")
+			}
+		}
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestTransportCloseResetCode(t *testing.T) {
+	tests := []struct {
+		name      string
+		endStream bool // server ends its side with the response headers
+		ctx       context.Context
+		want      ErrCode
+	}{
+		{"body abandoned", false, context.Background(), ErrCodeCancel},
+		{"server done", true, context.Background(), ErrCodeNo},
+		{"overridden", false, WithResetCode(context.Background(), ErrCodeNo), ErrCodeNo},
+	}
+	for _, tt := range tests {
+		for _, tunnel := range []bool{false, true} {
+			name := tt.name
+			if tunnel {
+				name += ", tunnel"
+			}
+			rstc := make(chan ErrCode, 1)
+			ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+				writeRawHeaders(fr, streamID, tt.endStream, ":status", "200")
+				for {
+					f, err := fr.ReadFrame()
+					if err != nil {
+						return
+					}
+					if rf, ok := f.(*RSTStreamFrame); ok {
+						rstc <- rf.ErrCode
+						return
+					}
+				}
+			})
+			tr := &Transport{InsecureTLSDial: true}
+			if tunnel {
+				u, _ := url.Parse(ts.URL)
+				req := &http.Request{Method: "CONNECT", URL: u, Host: "example.com:443", Header: make(http.Header)}
+				conn, err := tr.ConnectContext(tt.ctx, req)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				conn.Close()
+			} else {
+				// The request body stays open, so the stream is
+				// never done from our side.
+				pr, pw := io.Pipe()
+				req, _ := http.NewRequest("POST", ts.URL, pr)
+				req = req.WithContext(tt.ctx)
+				res, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				res.Body.Close()
+				pw.Close()
+			}
+			select {
+			case code := <-rstc:
+				if code != tt.want {
+					t.Errorf("%s: RST_STREAM code = %v; want %v", name, code, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s: no RST_STREAM", name)
+			}
+			tr.CloseIdleConnections()
+			ts.Close()
+		}
+	}
+}
+
+// writeRawHeaders writes a complete header block of name/value
+// pairs to fr, in order and without validation.
+func writeRawHeaders(fr *Framer, streamID uint32, endStream bool, kv ...string) error {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	for i := 0; i < len(kv); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: kv[i], Value: kv[i+1]})
+	}
+	return fr.WriteHeaders(HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: buf.Bytes(),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+}
+
+func TestTransportStrictProtocolChecksHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		kv   []string
+	}{
+		{"pseudo after regular", []string{"foo", "bar", ":status", "200"}},
+		{"unknown pseudo", []string{":status", "200", ":bogus", "x"}},
+		{"uppercase name", []string{":status", "200", "Foo", "bar"}},
+	}
+	for _, tt := range tests {
+		for _, strict := range []bool{false, true} {
+			ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+				writeRawHeaders(fr, streamID, true, tt.kv...)
+			})
+			tr := &Transport{InsecureTLSDial: true, StrictProtocolChecks: strict}
+			req, _ := http.NewRequest("GET", ts.URL, nil)
+			res, err := tr.RoundTrip(req)
+			if strict {
+				if se, ok := err.(StreamError); !ok || se.Code != ErrCodeProtocol {
+					t.Errorf("%s, strict: RoundTrip error = %v; want PROTOCOL_ERROR stream error", tt.name, err)
+				}
+			} else if err != nil {
+				t.Errorf("%s, lenient: RoundTrip error = %v", tt.name, err)
+			} else if res.StatusCode != 200 {
+				t.Errorf("%s, lenient: status = %d; want 200", tt.name, res.StatusCode)
+			}
+			tr.CloseIdleConnections()
+			ts.Close()
+		}
+	}
+}
+
+func TestTransportStrictProtocolChecksFlowControl(t *testing.T) {
+	const size = initialWindowSize + 1
+	for _, strict := range []bool{false, true} {
+		ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+			writeRawHeaders(fr, streamID, false, ":status", "200")
+			chunk := make([]byte, 16<<10)
+			for sent := 0; sent < size; sent += len(chunk) {
+				if size-sent < len(chunk) {
+					chunk = chunk[:size-sent]
+				}
+				fr.WriteData(streamID, sent+len(chunk) == size, chunk)
+			}
+		})
+		tr := &Transport{InsecureTLSDial: true, StrictProtocolChecks: strict}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if strict {
+			if se, ok := err.(StreamError); !ok || se.Code != ErrCodeFlowControl {
+				t.Errorf("strict: body error = %v; want FLOW_CONTROL_ERROR stream error", err)
+			}
+		} else if err != nil || n != size {
+			t.Errorf("lenient: read %d bytes, %v; want %d bytes", n, err, size)
+		}
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+// DATA the client drops, for a stream it resets on account of the
+// frame or one that's closed or unknown, still counts against the
+// connection's window, so the client gives that back.
+func TestTransportRefundsDroppedData(t *testing.T) {
+	refunded := make(chan int, 1)
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		writeRawHeaders(fr, streamID, false, ":status", "200", "content-length", "1")
+		fr.WriteData(streamID, false, make([]byte, 10))     // too long, so reset
+		fr.WriteData(streamID, false, make([]byte, 100))    // closed
+		fr.WriteData(streamID+2, false, make([]byte, 1000)) // unknown
+		const want = 10 + 100 + 1000
+		got := 0
+		for got < want {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				break
+			}
+			if wu, ok := f.(*WindowUpdateFrame); ok && wu.StreamID == 0 {
+				got += int(wu.Increment)
+			}
+		}
+		refunded <- got
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(res.Body); err != errResBodyTooLong {
+		t.Errorf("body error = %v; want %v", err, errResBodyTooLong)
+	}
+	res.Body.Close()
+	select {
+	case got := <-refunded:
+		if got != 1110 {
+			t.Errorf("connection window refunded %d bytes; want 1110", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the connection window to be refunded")
+	}
+}
+
+func TestCheckRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		mod    func(*http.Request)
+		wantOK bool
+	}{
+		{"valid", func(r *http.Request) { r.Header.Set("X-Foo", "bar baz") }, true},
+		{"pseudo ignored", func(r *http.Request) { r.Header[":junk\n"] = []string{"x\n"} }, true},
+		{"name with space", func(r *http.Request) { r.Header["X Foo"] = []string{"bar"} }, false},
+		{"name with colon", func(r *http.Request) { r.Header["X:Foo"] = []string{"bar"} }, false},
+		{"empty name", func(r *http.Request) { r.Header[""] = []string{"bar"} }, false},
+		{"value with CRLF", func(r *http.Request) { r.Header.Set("X-Foo", "bar\r\nEvil: 1") }, false},
+		{"value with LF", func(r *http.Request) { r.Header.Set("X-Foo", "bar\nEvil: 1") }, false},
+		{"value with NUL", func(r *http.Request) { r.Header.Set("X-Foo", "bar\x00") }, false},
+		{"protocol with LF", func(r *http.Request) { r.Header[":protocol"] = []string{"web\nsocket"} }, false},
+		{"host with LF", func(r *http.Request) { r.Host = "example.com\n" }, false},
+		{"host with slash", func(r *http.Request) { r.Host = "example.com/evil" }, false},
+		{"host with userinfo", func(r *http.Request) { r.Host = "user@evil.example" }, false},
+		{"no host", func(r *http.Request) { r.Host, r.URL.Host = "", "" }, false},
+		{"virtual host", func(r *http.Request) { r.Host = "vhost.example:8443" }, true},
+		{"Host header agreeing", func(r *http.Request) { r.Header.Set("Host", "example.com:443") }, true},
+		{"Host header conflicting", func(r *http.Request) { r.Header.Set("Host", "evil.example") }, false},
+		{"method with space", func(r *http.Request) { r.Method = "GET /" }, false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		tt.mod(req)
+		err := checkRequestHeaders(req)
+		if (err == nil) != tt.wantOK {
+			t.Errorf("%s: checkRequestHeaders = %v; want ok=%v", tt.name, err, tt.wantOK)
+		}
+	}
+}
+
+func TestTransportRejectsInvalidHeaders(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("X-Foo"); v != "ok" {
+			t.Errorf("X-Foo = %q; want ok", v)
+		}
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	req.Header.Set("X-Foo", "bar\r\nX-Evil: 1")
+	if _, err := tr.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "invalid header field value") {
+		t.Fatalf("RoundTrip error = %v; want invalid header field value", err)
+	}
+
+	// The conn is still usable afterwards.
+	req.Header.Set("X-Foo", "ok")
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
+
+func TestTransportVirtualHost(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "vhost.example" {
+			t.Errorf("Host = %q; want vhost.example", r.Host)
+		}
+		if v, ok := r.Header["Host"]; ok {
+			t.Errorf("got a host header field %q as well as :authority", v)
+		}
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	req.Host = "vhost.example"
+	req.Header.Set("Host", "vhost.example")
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
+
+func TestTransportEncodeHeadersConnectionSpecific(t *testing.T) {
+	tests := []struct {
+		te   string
+		want string // TE value sent, if any
+	}{
+		{"", ""},
+		{"trailers", "trailers"},
+		{"gzip, Trailers;q=0.5", "trailers"},
+		{"gzip", ""},
+	}
+	for _, tt := range tests {
+		cc := &ClientConn{}
+		cc.henc = hpack.NewEncoder(&cc.hbuf)
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		req.Header.Set("Connection", "keep-alive, X-Hop")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		req.Header.Set("Transfer-Encoding", "chunked")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("X-End", "2")
+		if tt.te != "" {
+			req.Header.Set("TE", tt.te)
+		}
+		var got [][2]string
+		for _, kv := range decodeHeader(t, cc.encodeHeaders(req, "", "")) {
+			if !strings.HasPrefix(kv[0], ":") {
+				got = append(got, kv)
+			}
+		}
+		want := [][2]string{{"x-end", "2"}}
+		if tt.want != "" {
+			want = append(want, [2]string{"te", tt.want})
+		}
+		if len(got) == 2 && got[0][0] == "te" {
+			got[0], got[1] = got[1], got[0]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("TE %q: regular headers = %q; want %q", tt.te, got, want)
+		}
+	}
+}
+
+func TestTransportCookieCrumbs(t *testing.T) {
+	cc := &ClientConn{}
+	cc.henc = hpack.NewEncoder(&cc.hbuf)
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	req.Header["Cookie"] = []string{"a=b; c=d;;", " e=f"}
+	var got []string
+	for _, kv := range decodeHeader(t, cc.encodeHeaders(req, "", "")) {
+		if kv[0] == "cookie" {
+			got = append(got, kv[1])
+		}
+	}
+	if want := []string{"a=b", "c=d", "e=f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cookie fields = %q; want %q", got, want)
+	}
+}
+
+// newEncodeHeadersRequest returns a request with the sort of header
+// fields a busy API client sends on every request.
+func newEncodeHeadersRequest() *http.Request {
+	req, _ := http.NewRequest("GET", "https://example.com:8443/v1/items?page=2", nil)
+	req.RequestURI = "/v1/items?page=2"
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cookie", "session=abc; theme=dark")
+	req.Header.Set("User-Agent", "client/1.0")
+	return req
+}
+
+func TestTransportEncodeHeadersAllocs(t *testing.T) {
+	if VerboseLogs {
+		t.Skip("verbose logging allocates")
+	}
+	cc := &ClientConn{}
+	cc.henc = hpack.NewEncoder(&cc.hbuf)
+	req := newEncodeHeadersRequest()
+	allocs := testing.AllocsPerRun(100, func() {
+		cc.encodeHeaders(req, "gzip", "")
+		cc.hbuf.release()
+	})
+	if allocs > 0 {
+		t.Errorf("encodeHeaders allocated %v times per request; want 0", allocs)
+	}
+}
+
+func BenchmarkClientEncodeHeaders(b *testing.B) {
+	cc := &ClientConn{}
+	cc.henc = hpack.NewEncoder(&cc.hbuf)
+	req := newEncodeHeadersRequest()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cc.encodeHeaders(req, "gzip", "")
+		cc.hbuf.release()
+	}
+}
+
+// Many conns encoding at once share headerBufPool's buffers.
+func BenchmarkClientEncodeHeadersParallel(b *testing.B) {
+	req := newEncodeHeadersRequest()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		cc := &ClientConn{}
+		cc.henc = hpack.NewEncoder(&cc.hbuf)
+		for pb.Next() {
+			cc.encodeHeaders(req, "gzip", "")
+			cc.hbuf.release()
+		}
+	})
+}
+
+func TestHeaderBlockRelease(t *testing.T) {
+	var hb headerBlock
+	io.WriteString(&hb, "abc")
+	if got := string(hb.Bytes()); got != "abc" {
+		t.Fatalf("Bytes = %q; want %q", got, "abc")
+	}
+	buf := hb.buf
+	hb.release()
+	if hb.buf != nil || hb.Bytes() != nil {
+		t.Error("release kept the buffer")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("released buffer holds %d bytes; want it reset", buf.Len())
+	}
+}
+
+func TestTransportSensitiveHeaders(t *testing.T) {
+	cc := &ClientConn{}
+	cc.henc = hpack.NewEncoder(&cc.hbuf)
+	cc.henc.SetSensitive(sensitiveFunc([]string{"X-Api-Key"}))
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("Cookie", "a=b")
+	req.Header.Set("X-Api-Key", "k")
+	req.Header.Set("X-Other", "o")
+	fields, err := hpack.NewDecoder(initialHeaderTableSize, nil).DecodeFull(cc.encodeHeaders(req, "", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, f := range fields {
+		got[f.Name] = f.Sensitive
+	}
+	want := map[string]bool{
+		":authority":    false,
+		":method":       false,
+		":path":         false,
+		":scheme":       false,
+		"authorization": true,
+		"cookie":        true,
+		"x-api-key":     true,
+		"x-other":       false,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: sensitive = %v; want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestTransportPadding(t *testing.T) {
+	body := strings.Repeat("x", 40<<10)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}, optOnlyServer, func(srv *Server) {
+		srv.Padding = FixedPadding(255)
+	})
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true, Padding: RandomPadding(255)}
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("POST", st.ts.URL, strings.NewReader(body))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Errorf("echoed body of %d bytes; want %d", len(got), len(body))
+	}
+}
+
+func TestTransportDecompression(t *testing.T) {
+	const body = "some compressible content, some compressible content"
+	var gotAccept string
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		gotAccept = r.Header.Get("Accept-Encoding")
+		switch r.Header.Get("X-Send") {
+		case "gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			io.WriteString(zw, body)
+			zw.Close()
+		case "zstd":
+			// Stands in for zstd; see the decoder below.
+			w.Header().Set("Content-Encoding", "zstd")
+			io.WriteString(w, strings.ToLower(body))
+		default:
+			io.WriteString(w, body)
+		}
+	}, optOnlyServer)
+	defer st.Close()
+
+	upper := func(r io.Reader) (io.ReadCloser, error) {
+		b, err := ioutil.ReadAll(r)
+		return ioutil.NopCloser(strings.NewReader(strings.ToUpper(string(b)))), err
+	}
+	tests := []struct {
+		send       string // what the server sends: gzip, zstd or plain
+		tr         *Transport
+		reqAccept  string
+		wantAccept string
+		wantBody   string
+		wantUncomp bool
+	}{
+		{
+			send:       "gzip",
+			tr:         &Transport{},
+			wantAccept: "gzip",
+			wantBody:   body,
+			wantUncomp: true,
+		},
+		{
+			send:       "zstd",
+			tr:         &Transport{ContentDecoders: map[string]ContentDecoder{"zstd": upper, "x-custom": upper}},
+			wantAccept: "zstd, gzip, x-custom",
+			wantBody:   strings.ToUpper(body),
+			wantUncomp: true,
+		},
+		{
+			send:       "zstd",
+			tr:         &Transport{},
+			wantAccept: "gzip",
+			wantBody:   strings.ToLower(body), // no decoder, so left alone
+		},
+		{
+			send:       "plain",
+			tr:         &Transport{ContentDecoders: map[string]ContentDecoder{"gzip": nil}},
+			wantAccept: "",
+			wantBody:   body,
+		},
+		{
+			send:       "plain",
+			tr:         &Transport{DisableCompression: true},
+			wantAccept: "",
+			wantBody:   body,
+		},
+		{
+			// The caller asked for gzip, so gets it as is.
+			send:       "gzip",
+			tr:         &Transport{},
+			reqAccept:  "gzip",
+			wantAccept: "gzip",
+		},
+	}
+	for i, tt := range tests {
+		tt.tr.InsecureTLSDial = true
+		req, _ := http.NewRequest("GET", st.ts.URL, nil)
+		req.Header.Set("X-Send", tt.send)
+		if tt.reqAccept != "" {
+			req.Header.Set("Accept-Encoding", tt.reqAccept)
+		}
+		res, err := tt.tr.RoundTrip(req)
+		if err != nil {
+			t.Errorf("%d. RoundTrip: %v", i, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		tt.tr.CloseIdleConnections()
+		if err != nil {
+			t.Errorf("%d. reading body: %v", i, err)
+			continue
+		}
+		if gotAccept != tt.wantAccept {
+			t.Errorf("%d. server got Accept-Encoding %q; want %q", i, gotAccept, tt.wantAccept)
+		}
+		if res.Uncompressed != tt.wantUncomp {
+			t.Errorf("%d. Uncompressed = %v; want %v", i, res.Uncompressed, tt.wantUncomp)
+		}
+		if tt.wantUncomp && res.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%d. Content-Encoding = %q after decoding; want none", i, res.Header.Get("Content-Encoding"))
+		}
+		if tt.wantBody != "" && string(got) != tt.wantBody {
+			t.Errorf("%d. body = %q; want %q", i, got, tt.wantBody)
+		}
+	}
+}
+
+// br and zstd have no built-in decoder, so are only asked for once
+// the application registers one.
+func TestTransportAcceptEncoding(t *testing.T) {
+	dec := func(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(r), nil }
+	tests := []struct {
+		decoders map[string]ContentDecoder
+		want     string
+	}{
+		{nil, "gzip"},
+		{map[string]ContentDecoder{"br": dec}, "br, gzip"},
+		{map[string]ContentDecoder{"zstd": dec, "br": dec}, "br, zstd, gzip"},
+	}
+	for i, tt := range tests {
+		tr := &Transport{ContentDecoders: tt.decoders}
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		if got := tr.acceptEncoding(req); got != tt.want {
+			t.Errorf("%d. Accept-Encoding = %q; want %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestTransportDecompressionHeaders(t *testing.T) {
+	const body = "some compressible content"
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.Header.Get("X-Empty") != "" {
+			w.Header().Set("Content-Length", "0")
+			return
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		io.WriteString(zw, body)
+		zw.Close()
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || string(got) != body {
+		t.Errorf("body = %q, %v; want %q", got, err, body)
+	}
+	if !res.Uncompressed {
+		t.Error("Uncompressed = false; want true")
+	}
+	if res.ContentLength != -1 {
+		t.Errorf("ContentLength = %d; want -1", res.ContentLength)
+	}
+	for _, k := range []string{"Content-Encoding", "Content-Length"} {
+		if v, ok := res.Header[k]; ok {
+			t.Errorf("%s = %q after decoding; want it removed", k, v)
+		}
+	}
+
+	// An empty body isn't decoded, so the headers stay as sent.
+	req, _ = http.NewRequest("GET", st.ts.URL, nil)
+	req.Header.Set("X-Empty", "1")
+	res, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Uncompressed || res.ContentLength != 0 || res.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("empty body: Uncompressed = %v, ContentLength = %d, Content-Encoding = %q; want false, 0, gzip",
+			res.Uncompressed, res.ContentLength, res.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestTransportMaxResponseBodySize(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.Header.Get("X-Size"))
+		switch r.Header.Get("X-Send") {
+		case "declared":
+			w.Header().Set("Content-Length", strconv.Itoa(n))
+		case "gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write(make([]byte, n))
+			zw.Close()
+			return
+		default:
+			w.(http.Flusher).Flush() // so no Content-Length is sent
+		}
+		w.Write(make([]byte, n))
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true, MaxResponseBodySize: 1000}
+	defer tr.CloseIdleConnections()
+
+	tests := []struct {
+		send    string
+		size    int
+		reqMax  int64 // or 0 to leave the context alone
+		wantErr error
+	}{
+		{"", 1000, 0, nil},
+		{"", 5000, 0, ErrResponseTooLarge},
+		{"declared", 5000, 0, ErrResponseTooLarge},
+		{"gzip", 5000, 0, ErrResponseTooLarge}, // small on the wire, but not decoded
+		{"", 5000, -1, nil},
+		{"", 5000, 10000, nil},
+		{"", 500, 100, ErrResponseTooLarge},
+	}
+	for i, tt := range tests {
+		req, _ := http.NewRequest("GET", st.ts.URL, nil)
+		req.Header.Set("X-Send", tt.send)
+		req.Header.Set("X-Size", strconv.Itoa(tt.size))
+		if tt.reqMax != 0 {
+			req = req.WithContext(WithMaxResponseBodySize(req.Context(), tt.reqMax))
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Errorf("%d. RoundTrip: %v", i, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != tt.wantErr {
+			t.Errorf("%d. reading body: %v; want %v", i, err, tt.wantErr)
+		}
+		if err == nil && len(got) != tt.size {
+			t.Errorf("%d. read %d bytes; want %d", i, len(got), tt.size)
+		}
+	}
+}
+
+// countingLimiter is a RateLimiter that never waits, but counts
+// what it's asked for, or fails with err if set.
+type countingLimiter struct {
+	mu       sync.Mutex
+	n, calls int
+	max      int
+	err      error
+}
+
+func (l *countingLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.n += n
+	l.calls++
+	if n > l.max {
+		l.max = n
+	}
+	return l.err
+}
+
+func TestTransportResponseRateLimiter(t *testing.T) {
+	const size = 1 << 20 // well past the initial window
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), size))
+	}, optOnlyServer)
+	defer st.Close()
+
+	lim := new(countingLimiter)
+	var gotReq *http.Request
+	tr := &Transport{InsecureTLSDial: true}
+	tr.ResponseRateLimiter = func(req *http.Request) RateLimiter {
+		gotReq = req
+		return lim
+	}
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if err != nil || n != size {
+		t.Fatalf("read %d bytes, %v; want %d", n, err, size)
+	}
+	if gotReq != req {
+		t.Error("ResponseRateLimiter wasn't passed the request")
+	}
+	if lim.n != size || lim.max > rateLimitChunk {
+		t.Errorf("limiter asked for %d bytes in %d calls of at most %d; want %d in calls of at most %d",
+			lim.n, lim.calls, lim.max, size, rateLimitChunk)
+	}
+
+	lim.err = errors.New("over quota")
+	req, _ = http.NewRequest("GET", st.ts.URL, nil)
+	res, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if err != lim.err {
+		t.Errorf("read error = %v; want %v", err, lim.err)
+	}
+}
+
+func TestTransportRequestRateLimiter(t *testing.T) {
+	const size = 40 << 10
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}, optOnlyServer)
+	defer st.Close()
+
+	lim := new(countingLimiter)
+	tr := &Transport{InsecureTLSDial: true}
+	tr.RequestRateLimiter = func(req *http.Request) RateLimiter { return lim }
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("POST", st.ts.URL, bytes.NewReader(make([]byte, size)))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(got) != strconv.Itoa(size) {
+		t.Errorf("server read %s bytes; want %d", got, size)
+	}
+	if lim.n != size || lim.max > rateLimitChunk {
+		t.Errorf("limiter asked for %d bytes in %d calls of at most %d; want %d in calls of at most %d",
+			lim.n, lim.calls, lim.max, size, rateLimitChunk)
+	}
+
+	lim.err = errors.New("over quota")
+	req, _ = http.NewRequest("POST", st.ts.URL, bytes.NewReader(make([]byte, size)))
+	if _, err := tr.RoundTrip(req); err != lim.err {
+		t.Errorf("RoundTrip error = %v; want %v", err, lim.err)
+	}
+}
+
+// Response body buffers are reused once a body is closed, so a
+// closed body mustn't see the data of a later response, even if
+// it's read or closed again.
+func TestTransportResponseBodyBufReuse(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	get := func(path string) *http.Response {
+		req, _ := http.NewRequest("GET", st.ts.URL+path, nil)
+		req.RequestURI = path
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	first := get("/first")
+	if body, _ := ioutil.ReadAll(first.Body); string(body) != "/first" {
+		t.Fatalf("first body = %q; want %q", body, "/first")
+	}
+	first.Body.Close()
+	for i := 0; i < 10; i++ {
+		res := get("/second")
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != "/second" {
+			t.Fatalf("second body = %q; want %q", body, "/second")
+		}
+		if n, err := first.Body.Read(make([]byte, 10)); n != 0 || err == nil {
+			t.Fatalf("Read of closed body = %d, %v; want 0 and an error", n, err)
+		}
+		first.Body.Close()
+		res.Body.Close()
+	}
+}
+
+// A stream is recycled once its response body is closed and the
+// readLoop is done with it, and its old body then leaves the new
+// request alone.
+func TestTransportRecyclesStreams(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	get := func(path string) (*http.Response, *clientStream) {
+		req, _ := http.NewRequest("GET", st.ts.URL+path, nil)
+		req.RequestURI = path
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, res.Body.(*transportResponseBody).cs
+	}
+	read := func(res *http.Response, want string) {
+		if body, err := ioutil.ReadAll(res.Body); err != nil || string(body) != want {
+			t.Fatalf("body = %q, %v; want %q", body, err, want)
+		}
+		res.Body.Close()
+	}
+	first, cs1 := get("/1")
+	read(first, "/1")
+	second, _ := get("/2")
+	read(second, "/2")
+	// The readLoop let go of the first stream on the frames of the
+	// second, so the third gets it.
+	third, cs3 := get("/3")
+	if cs3 != cs1 {
+		t.Fatal("third request didn't reuse the first one's stream")
+	}
+	if cs3.ID != 5 {
+		t.Errorf("reused stream ID = %d; want 5", cs3.ID)
+	}
+	if n, err := first.Body.Read(make([]byte, 10)); n != 0 || err != errClosedResponseBody {
+		t.Errorf("Read of old body = %d, %v; want 0, %v", n, err, errClosedResponseBody)
+	}
+	first.Body.Close()
+	read(third, "/3")
+}
+
+// A response that arrives as do gives up on it, on its context being
+// canceled, is closed for it, so its stream is still recycled.
+func TestTransportRecyclesAbandonedStreams(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "x")
+		w.(http.Flusher).Flush()
+		ioutil.ReadAll(r.Body)
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	fi := &abandonFaults{tr: tr, delivered: make(chan bool, 1)}
+	tr.Faults = fi
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequest("POST", st.ts.URL, nil)
+		req = req.WithContext(ctx)
+		// An inline body, which do writes itself before waiting
+		// for the response, so that by the time it does, both the
+		// response and the cancellation are there for it.
+		req.Body = cancelingBody{fi.delivered, cancel}
+		req.GetBody = func() (io.ReadCloser, error) { return cancelingBody{fi.delivered, cancel}, nil }
+		req.ContentLength = 1
+		res, err := tr.RoundTrip(req)
+		if err == nil {
+			res.Body.Close()
+		} else if err != context.Canceled {
+			t.Fatal(err)
+		}
+		cancel()
+	}
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := res.Body.(*transportResponseBody).cs
+	res.Body.Close()
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.cc.mu.Lock()
+	defer fi.cc.mu.Unlock()
+	for _, cs := range fi.streams {
+		if cs != last && cs.refs != 0 {
+			t.Fatalf("stream %d left with %d refs", cs.ID, cs.refs)
+		}
+	}
+}
+
+// abandonFaults is a FaultInjector that, on the DATA frame that
+// follows a response's headers, notes the response's stream and
+// tells its cancelingBody it's been delivered.
+type abandonFaults struct {
+	tr        *Transport
+	delivered chan bool
+
+	mu      sync.Mutex
+	cc      *ClientConn
+	streams []*clientStream
+}
+
+func (fi *abandonFaults) ReadFault(fh FrameHeader) Fault {
+	if fh.Type != FrameData || fh.Length == 0 {
+		return Fault{}
+	}
+	fi.mu.Lock()
+	if fi.cc == nil {
+		fi.tr.connMu.RLock()
+		for _, ccs := range fi.tr.conns {
+			fi.cc = ccs[0]
+		}
+		fi.tr.connMu.RUnlock()
+	}
+	fi.cc.mu.Lock()
+	if cs := fi.cc.streams[fh.StreamID]; cs != nil {
+		fi.streams = append(fi.streams, cs)
+	}
+	fi.cc.mu.Unlock()
+	fi.mu.Unlock()
+	select {
+	case fi.delivered <- true:
+	default:
+	}
+	return Fault{}
+}
+
+func (fi *abandonFaults) WriteFault(fh FrameHeader) Fault { return Fault{} }
+
+// cancelingBody is a one-byte request body that, once its response
+// has been delivered, cancels its request.
+type cancelingBody struct {
+	delivered <-chan bool
+	cancel    context.CancelFunc
+}
+
+func (b cancelingBody) Read(p []byte) (int, error) {
+	<-b.delivered
+	b.cancel()
+	p[0] = 'a'
+	return 1, io.EOF
+}
+
+func (b cancelingBody) Close() error { return nil }
+
+func TestTransportResponseBodyClose(t *testing.T) {
+	writeErr := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 16<<10)
+		for {
+			if _, err := w.Write(buf); err != nil {
+				writeErr <- err
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(res.Body, make([]byte, 100<<10)); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if _, err := res.Body.Read(make([]byte, 1)); err != errClosedResponseBody {
+		t.Errorf("Read after Close = %v; want %v", err, errClosedResponseBody)
+	}
+	// Closing the body early resets the stream, which stops the
+	// handler.
+	select {
+	case <-writeErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still writing after the response body was closed")
+	}
+}
+
+func TestTransportRequestEncoding(t *testing.T) {
+	body := strings.Repeat("some compressible content, ", 2000)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		var rd io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("gzip.NewReader: %v", err)
+				return
+			}
+			rd = zr
+		}
+		got, err := ioutil.ReadAll(rd)
+		if err != nil {
+			t.Errorf("reading body: %v", err)
+		}
+		if string(got) != body {
+			t.Errorf("server got a body of %d bytes; want %d", len(got), len(body))
+		}
+		fmt.Fprintf(w, "%s %d", r.Header.Get("Content-Encoding"), r.ContentLength)
+	}, optOnlyServer)
+	defer st.Close()
+
+	str := func(s string) *string { return &s }
+	plain := " " + strconv.Itoa(len(body))
+	tests := []struct {
+		trEncoding  string
+		reqEncoding *string // or nil to leave the context alone
+		want        string
+	}{
+		{"gzip", nil, "gzip -1"},
+		{"", nil, plain},
+		{"GZIP", str(""), plain},
+		{"", str("gzip"), "gzip -1"},
+	}
+	for i, tt := range tests {
+		tr := &Transport{InsecureTLSDial: true, RequestEncoding: tt.trEncoding}
+		req, _ := http.NewRequest("POST", st.ts.URL, strings.NewReader(body))
+		// Sent as is, unless the body is encoded.
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		if tt.reqEncoding != nil {
+			req = req.WithContext(WithRequestEncoding(req.Context(), *tt.reqEncoding))
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Errorf("%d. RoundTrip: %v", i, err)
+			continue
+		}
+		got, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		tr.CloseIdleConnections()
+		if string(got) != tt.want {
+			t.Errorf("%d. server saw %q; want %q", i, got, tt.want)
+		}
+	}
+
+	tr := &Transport{InsecureTLSDial: true, RequestEncoding: "x-unknown"}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("POST", st.ts.URL, strings.NewReader(body))
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Error("RoundTrip with an unknown RequestEncoding succeeded; want an error")
+	}
+}
+
+func TestTransportCookieRoundTrip(t *testing.T) {
+	const want = "a=b; c=d; e=f"
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Cookie"); got != want {
+			t.Errorf("Cookie = %q; want %q", got, want)
+		}
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	req.Header.Set("Cookie", want)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
+
+func TestTransportEncodeHeadersConnect(t *testing.T) {
+	cc := &ClientConn{}
+	cc.henc = hpack.NewEncoder(&cc.hbuf)
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: "relay.example:443"},
+		Host:       "example.com:443",
+		RequestURI: "example.com:443",
+		Header:     http.Header{"Foo": {"bar"}},
+	}
+	got := decodeHeader(t, cc.encodeHeaders(req, "", ""))
+	want := [][2]string{
+		{":authority", "example.com:443"},
+		{":method", "CONNECT"},
+		{"foo", "bar"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("headers = %q; want %q", got, want)
+	}
+}
+
+func TestTransportResponseContentLengthMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		cl      string
+		body    string
+		wantErr error
+	}{
+		{"exact", "GET", "5", "hello", nil},
+		{"too long", "GET", "5", "hello world", errResBodyTooLong},
+		{"too short", "GET", "10", "hello", errResBodyTooShort},
+		{"head", "HEAD", "10", "", nil},
+	}
+	for _, tt := range tests {
+		ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+			writeRawHeaders(fr, streamID, tt.body == "", ":status", "200", "content-length", tt.cl)
+			if tt.body != "" {
+				fr.WriteData(streamID, true, []byte(tt.body))
+			}
+		})
+		tr := &Transport{InsecureTLSDial: true}
+		req, _ := http.NewRequest(tt.method, ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if want, _ := strconv.ParseInt(tt.cl, 10, 64); res.ContentLength != want {
+			t.Errorf("%s: ContentLength = %d; want %d", tt.name, res.ContentLength, want)
+		}
+		_, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != tt.wantErr {
+			t.Errorf("%s: body read error = %v; want %v", tt.name, err, tt.wantErr)
+		}
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestTransportNoBodyResponses(t *testing.T) {
+	tests := []struct {
+		method string
+		status string
+		wantCL int64
+	}{
+		{"HEAD", "200", 10},
+		{"GET", "204", 0},
+		{"GET", "304", 0},
+	}
+	for _, tt := range tests {
+		release := make(chan struct{})
+		ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+			// Misbehave: declare a length and keep the
+			// stream open, sending DATA only once the
+			// client has read the body.
+			writeRawHeaders(fr, streamID, false, ":status", tt.status, "content-length", "10")
+			<-release
+			fr.WriteData(streamID, true, []byte("0123456789"))
+		})
+		tr := &Transport{InsecureTLSDial: true}
+		req, _ := http.NewRequest(tt.method, ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.status, err)
+		}
+		if res.ContentLength != tt.wantCL {
+			t.Errorf("%s %s: ContentLength = %d; want %d", tt.method, tt.status, res.ContentLength, tt.wantCL)
+		}
+		slurp, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil || len(slurp) != 0 {
+			t.Errorf("%s %s: body = %q, %v; want empty", tt.method, tt.status, slurp, err)
+		}
+		close(release)
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestTransportRequestContentLengthMismatch(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+
+	tests := []struct {
+		body    string
+		cl      int64
+		wantErr error
+	}{
+		{"hi", 10, errReqBodyTooShort},
+		{"hello", 2, errReqBodyTooLong},
+		{"hello", 5, nil},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", st.ts.URL, strings.NewReader(tt.body))
+		req.ContentLength = tt.cl
+		res, err := tr.RoundTrip(req)
+		if err != tt.wantErr {
+			t.Errorf("body %q, ContentLength %d: RoundTrip error = %v; want %v", tt.body, tt.cl, err, tt.wantErr)
+		}
+		if err == nil {
+			res.Body.Close()
+		}
+	}
+}
+
+func TestTransportResponseStatusRules(t *testing.T) {
+	tests := []struct {
+		name string
+		kv   []string
+	}{
+		{"missing", []string{"foo", "bar"}},
+		{"non-numeric", []string{":status", "2OO"}},
+		{"too short", []string{":status", "20"}},
+		{"too long", []string{":status", "2000"}},
+		{"duplicate", []string{":status", "200", ":status", "204"}},
+	}
+	for _, tt := range tests {
+		// Neither mode tolerates a bad :status.
+		for _, strict := range []bool{false, true} {
+			ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+				writeRawHeaders(fr, streamID, true, tt.kv...)
+			})
+			tr := &Transport{InsecureTLSDial: true, StrictProtocolChecks: strict}
+			req, _ := http.NewRequest("GET", ts.URL, nil)
+			_, err := tr.RoundTrip(req)
+			if se, ok := err.(StreamError); !ok || se.Code != ErrCodeProtocol {
+				t.Errorf("%s, strict=%v: RoundTrip error = %v; want PROTOCOL_ERROR stream error", tt.name, strict, err)
+			}
+			tr.CloseIdleConnections()
+			ts.Close()
+		}
+	}
+}
+
+func TestTransportResponseHeaderListTooLarge(t *testing.T) {
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		fr.WriteHeaders(HeadersFrameParam{
+			StreamID:      streamID,
+			BlockFragment: hpackBomb(":status", "200"),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true, MaxHeaderListSize: 64 << 10}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	_, err := tr.RoundTrip(req)
+	if se, ok := err.(StreamError); !ok || se.Code != ErrCodeProtocol {
+		t.Errorf("RoundTrip error = %v; want PROTOCOL_ERROR stream error", err)
+	}
+}
+
+func TestTransportMaxReadFrameSize(t *testing.T) {
+	goAway := make(chan ErrCode, 1)
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		writeRawHeaders(fr, streamID, false, ":status", "200")
+		fr.WriteData(streamID, true, make([]byte, 32<<10))
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				close(goAway)
+				return
+			}
+			if ga, ok := f.(*GoAwayFrame); ok {
+				goAway <- ga.ErrCode
+				return
+			}
+		}
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true, MaxReadFrameSize: 16 << 10}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if _, err := ioutil.ReadAll(res.Body); err == nil {
+		t.Error("reading body succeeded; want an error")
+	}
+	select {
+	case code := <-goAway:
+		if code != ErrCodeFrameSize {
+			t.Errorf("GOAWAY code = %v; want %v", code, ErrCodeFrameSize)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for GOAWAY")
+	}
+}
+
+func TestTransportUnknownFrameHandler(t *testing.T) {
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		fr.WriteRawFrame(0xf0, 0, 0, []byte("conn"))
+		fr.WriteRawFrame(0xf0, 0x2, streamID, []byte("stream"))
+		writeRawHeaders(fr, streamID, true, ":status", "200")
+	})
+	defer ts.Close()
+
+	var got []string
+	tr := &Transport{InsecureTLSDial: true}
+	tr.UnknownFrameHandler = func(f *UnknownFrame) {
+		got = append(got, fmt.Sprintf("%d/%d/%s", f.StreamID, f.Flags, f.Payload()))
+	}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	// The handler ran on the read loop before the response was
+	// delivered, so got is safe to read.
+	if want := []string{"0/0/conn", "1/2/stream"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("handler got %q; want %q", got, want)
+	}
+}
+
+func TestTransportGrease(t *testing.T) {
+	gotType := make(chan FrameType, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, optOnlyServer, func(s *Server) {
+		s.UnknownFrameHandler = func(c net.Conn, f *UnknownFrame) {
+			gotType <- f.Type
+		}
+	})
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true, Grease: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case typ := <-gotType:
+		if typ%0x1f != 0x0b {
+			t.Errorf("server got frame type %v; want a GREASE type", typ)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server never got the GREASE frame")
+	}
+}
+
+func TestTransportContinuationFlood(t *testing.T) {
+	goAway := make(chan ErrCode, 1)
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		fr.WriteHeaders(HeadersFrameParam{
+			StreamID:      streamID,
+			BlockFragment: []byte{0x88}, // :status 200
+		})
+		for i := 0; i < 2*maxHeaderBlockFrames; i++ {
+			if err := fr.WriteContinuation(streamID, false, nil); err != nil {
+				break
+			}
+		}
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				close(goAway)
+				return
+			}
+			if ga, ok := f.(*GoAwayFrame); ok {
+				goAway <- ga.ErrCode
+				return
+			}
+		}
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	want := ConnectionError(ErrCodeEnhanceYourCalm)
+	if _, err := tr.RoundTrip(req); err != want {
+		t.Errorf("RoundTrip error = %v; want %v", err, want)
+	}
+	select {
+	case code := <-goAway:
+		if code != ErrCodeEnhanceYourCalm {
+			t.Errorf("GOAWAY code = %v; want %v", code, ErrCodeEnhanceYourCalm)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for GOAWAY")
+	}
+}
+
+func TestTransportControlFrameFlood(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(fr *Framer, streamID uint32) error
+	}{
+		{"PING", func(fr *Framer, _ uint32) error { return fr.WritePing(false, [8]byte{}) }},
+		{"SETTINGS", func(fr *Framer, _ uint32) error { return fr.WriteSettings() }},
+		{"empty DATA", func(fr *Framer, streamID uint32) error { return fr.WriteData(streamID, false, nil) }},
+	}
+	for _, tt := range tests {
+		ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+			writeRawHeaders(fr, streamID, false, ":status", "200")
+			for i := 0; i < 200; i++ {
+				if tt.write(fr, streamID) != nil {
+					return
+				}
+			}
+		})
+		tr := &Transport{InsecureTLSDial: true, MaxControlFrameRate: 100}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := ConnectionError(ErrCodeEnhanceYourCalm)
+		if _, err := io.Copy(ioutil.Discard, res.Body); err != want {
+			t.Errorf("%s: body read error = %v; want %v", tt.name, err, want)
+		}
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestFrameRateLimiter(t *testing.T) {
+	l := frameRateLimiter{max: 2}
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow(now); got != want {
+			t.Errorf("frame %d: allow = %v; want %v", i, got, want)
+		}
+	}
+	if !l.allow(now.Add(time.Second)) {
+		t.Error("allow = false in a new window; want true")
+	}
+}
+
+func TestTransportDataBeforeHeaders(t *testing.T) {
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		fr.WriteData(streamID, true, []byte("oops"))
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	_, err := tr.RoundTrip(req)
+	if se, ok := err.(StreamError); !ok || se.Code != ErrCodeProtocol {
+		t.Errorf("RoundTrip error = %v; want PROTOCOL_ERROR stream error", err)
+	}
+}
+
+func TestTransportStreamStates(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps string // s: END_STREAM sent, r: END_STREAM received
+		want  streamState
+	}{
+		{"open", "", stateOpen},
+		{"sent", "s", stateHalfClosedLocal},
+		{"received", "r", stateHalfClosedRemote},
+		{"sent then received", "sr", stateClosed},
+		{"received then sent", "rs", stateClosed},
+	}
+	for _, tt := range tests {
+		cc := &ClientConn{t: &Transport{}, streams: make(map[uint32]*clientStream), nextStreamID: 1}
+		cs := cc.newStream()
+		if cs.state != stateIdle {
+			t.Fatalf("new stream state = %v; want Idle", cs.state)
+		}
+		cs.state = stateOpen
+		for _, step := range tt.steps {
+			if step == 's' {
+				cc.sentEndStream(cs)
+			} else {
+				cc.recvEndStream(cs)
+			}
+		}
+		if cs.state != tt.want {
+			t.Errorf("%s: state = %v; want %v", tt.name, cs.state, tt.want)
+		}
+		if _, tracked := cc.streams[cs.ID]; tracked != (tt.want != stateClosed) {
+			t.Errorf("%s: tracked = %v in state %v", tt.name, tracked, cs.state)
+		}
+	}
+}
+
+func TestTransportServerResetStream(t *testing.T) {
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		fr.WriteRSTStream(streamID, ErrCodeRefusedStream)
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	_, err := tr.RoundTrip(req)
+	if se, ok := err.(StreamError); !ok || se.Code != ErrCodeRefusedStream {
+		t.Errorf("RoundTrip error = %v; want REFUSED_STREAM stream error", err)
+	}
+}
+
+func TestTransportUnhealthyConn(t *testing.T) {
+	var conns int32
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		atomic.AddInt32(&conns, 1)
+		fr.WriteRSTStream(streamID, ErrCodeInternal)
+	})
+	defer ts.Close()
+
+	// Each conn of the raw server answers one request and ignores
+	// the rest, so the later requests only get a response if the
+	// first conn stops taking requests after its stream error.
+	tr := &Transport{InsecureTLSDial: true, MaxConnErrors: 1}
+	defer tr.CloseIdleConnections()
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		_, err := tr.RoundTrip(req)
+		if se, ok := err.(StreamError); !ok || se.Code != ErrCodeInternal {
+			t.Fatalf("request %d: RoundTrip error = %v; want INTERNAL_ERROR stream error", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 3 {
+		t.Errorf("server saw %d conns; want 3", n)
+	}
+}
+
+func TestClientConnRecordError(t *testing.T) {
+	cc := &ClientConn{
+		t:       &Transport{MaxConnErrors: 2, ConnErrorWindow: time.Hour},
+		streams: make(map[uint32]*clientStream),
+	}
+	cc.streams[1] = &clientStream{ID: 1} // keeps cc from being closed
+	cc.errTimes = []time.Time{time.Now().Add(-2 * time.Hour)}
+	cc.recordError("test")
+	if cc.unhealthy {
+		t.Fatal("unhealthy after one error in the window")
+	}
+	cc.recordError("test")
+	if !cc.unhealthy {
+		t.Fatal("healthy after two errors in the window")
+	}
+}
+
+// dropPings is a FaultInjector that loses the PING frames a conn
+// reads, as a peer that has silently gone away would.
+type dropPings struct{}
+
+func (dropPings) ReadFault(fh FrameHeader) Fault  { return Fault{Drop: fh.Type == FramePing} }
+func (dropPings) WriteFault(fh FrameHeader) Fault { return Fault{} }
+
+func TestTransportReadIdleTimeout(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{
+		InsecureTLSDial: true,
+		ReadIdleTimeout: 50 * time.Millisecond,
+		PingTimeout:     50 * time.Millisecond,
+		Faults:          dropPings{},
+	}
+	defer tr.CloseIdleConnections()
+	host, port, _ := net.SplitHostPort(st.ts.Listener.Addr().String())
+	cc, err := tr.getClientConn(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cc.readerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn that can't answer PINGs wasn't closed")
+	}
+	if cc.canTakeNewRequest() {
+		t.Error("dead conn can take new requests")
+	}
+	cc2, err := tr.getClientConn(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc2 == cc {
+		t.Error("getClientConn returned the dead conn")
+	}
+}
+
+// failWritesConn is a net.Conn whose writes fail once fail is set,
+// while reads still block, like one whose peer vanished.
+type failWritesConn struct {
+	net.Conn
+	fail int32
+}
+
+func (c *failWritesConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.fail) != 0 {
+		return 0, errors.New("broken pipe")
+	}
+	return c.Conn.Write(p)
+}
+
+func TestTransportEvictsConnOnWriteError(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, optOnlyServer)
+	defer st.Close()
+
+	var conns []*failWritesConn
+	tr := &Transport{
+		InsecureTLSDial: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			c, err := tls.Dial(network, addr, cfg)
+			if err != nil {
+				return nil, err
+			}
+			fc := &failWritesConn{Conn: c}
+			conns = append(conns, fc)
+			return fc, nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	atomic.StoreInt32(&conns[0].fail, 1)
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip on a conn that can't write succeeded")
+	}
+	res, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip after write error: %v", err)
+	}
+	res.Body.Close()
+	if len(conns) != 2 {
+		t.Errorf("dialed %d conns; want 2, the broken one evicted", len(conns))
+	}
+}
+
+// A slow dial holds up only requests to its own host, which share
+// it rather than dial one conn each.
+func TestTransportDialPerHost(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, optOnlyServer)
+	defer st.Close()
+
+	release := make(chan struct{})
+	var slowDials int32
+	tr := &Transport{
+		InsecureTLSDial: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			if addr == "slow.example:443" {
+				atomic.AddInt32(&slowDials, 1)
+				<-release
+				return nil, errors.New("slow dial failed")
+			}
+			return tls.Dial(network, addr, cfg)
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	const n = 3
+	slowErrs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			req, _ := http.NewRequest("GET", "https://slow.example/", nil)
+			_, err := tr.RoundTrip(req)
+			slowErrs <- err
+		}()
+	}
+	for atomic.LoadInt32(&slowDials) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	time.Sleep(50 * time.Millisecond) // let all the slow requests get to the dial
+	close(release)
+	for i := 0; i < n; i++ {
+		if err := <-slowErrs; err == nil || err.Error() != "slow dial failed" {
+			t.Errorf("slow RoundTrip error = %v; want the dial's", err)
+		}
+	}
+	if got := atomic.LoadInt32(&slowDials); got != 1 {
+		t.Errorf("slow host dialed %d times; want 1", got)
+	}
+}
+
+// closeNotifyConn is a net.Conn that reports when it's closed.
+type closeNotifyConn struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestTransportMaxConnStreams(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, optOnlyServer)
+	defer st.Close()
+
+	var mu sync.Mutex
+	var conns []*closeNotifyConn
+	tr := &Transport{
+		InsecureTLSDial: true,
+		MaxConnStreams:  2,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			c, err := tls.Dial(network, addr, cfg)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			cc := &closeNotifyConn{Conn: c, closed: make(chan struct{})}
+			conns = append(conns, cc)
+			return cc, nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+	dials := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(conns)
+	}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", st.ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		res.Body.Close()
+		if i == 1 {
+			// The second stream both uses up the first
+			// conn and has a replacement dialed.
+			deadline := time.Now().Add(5 * time.Second)
+			for dials() < 2 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if n := dials(); n != 2 {
+		t.Fatalf("dialed %d conns for 3 requests with MaxConnStreams 2; want 2", n)
+	}
+	select {
+	case <-conns[0].closed:
+	case <-time.After(5 * time.Second):
+		t.Error("used up conn not closed once idle")
+	}
+}
+
+func TestAuthority(t *testing.T) {
+	tests := []struct {
+		method, host, urlHost string
+		want                  string
+	}{
+		{"GET", "", "example.com", "example.com"},
+		{"GET", "", "example.com:443", "example.com"},
+		{"GET", "", "example.com:8443", "example.com:8443"},
+		{"GET", "", "[2001:db8::1]:8443", "[2001:db8::1]:8443"},
+		{"GET", "", "[2001:db8::1]:443", "[2001:db8::1]"},
+		{"GET", "", "[2001:db8::1]", "[2001:db8::1]"},
+		{"GET", "2001:db8::1", "example.com", "[2001:db8::1]"},
+		{"GET", "", "[fe80::1%en0]:8443", "[fe80::1]:8443"},
+		{"GET", "", "[fe80::1%en0]", "[fe80::1]"},
+		{"GET", "other.example:8080", "example.com", "other.example:8080"},
+		{"CONNECT", "example.com:443", "relay.example", "example.com:443"},
+		{"CONNECT", "[2001:db8::1]:443", "relay.example", "[2001:db8::1]:443"},
+	}
+	for _, tt := range tests {
+		req := &http.Request{Method: tt.method, Host: tt.host, URL: &url.URL{Host: tt.urlHost}}
+		if got := authority(req); got != tt.want {
+			t.Errorf("authority(%s Host %q, URL host %q) = %q; want %q", tt.method, tt.host, tt.urlHost, got, tt.want)
+		}
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	tests := []struct {
+		url, host, port string
+	}{
+		{"https://example.com/", "example.com", "443"},
+		{"https://example.com:8443/", "example.com", "8443"},
+		{"https://[2001:db8::1]/", "2001:db8::1", "443"},
+		{"https://[2001:db8::1]:8443/", "2001:db8::1", "8443"},
+		{"https://[fe80::1%25en0]:8443/", "fe80::1%en0", "8443"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host, port := hostPort(u); host != tt.host || port != tt.port {
+			t.Errorf("hostPort(%q) = %q, %q; want %q, %q", tt.url, host, port, tt.host, tt.port)
+		}
+	}
+	if got, want := (&Transport{}).tlsConfig("fe80::1%en0").ServerName, "fe80::1"; got != want {
+		t.Errorf("ServerName for a zoned address = %q; want %q", got, want)
+	}
+}
+
+func TestTransportIPv6Authority(t *testing.T) {
+	gotHost := make(chan string, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		gotHost <- r.Host
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	req.Host = "[fe80::1%en0]:443"
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got, want := <-gotHost, "[fe80::1]"; got != want {
+		t.Errorf("server got Host %q; want %q", got, want)
+	}
+}
+
+func TestTransportHostTLSConfigs(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, optOnlyServer)
+	defer st.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(st.ts.Certificate())
+	tr := &Transport{
+		TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}, // trusts nothing
+		HostTLSConfigs: map[string]*tls.Config{
+			"127.0.0.1": {RootCAs: roots},
+		},
+	}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip with the host's roots: %v", err)
+	}
+	res.Body.Close()
+
+	tr2 := &Transport{TLSClientConfig: tr.TLSClientConfig}
+	defer tr2.CloseIdleConnections()
+	if _, err := tr2.RoundTrip(req); err == nil {
+		t.Error("RoundTrip without the host's roots succeeded")
+	}
+}
+
+func TestTransportHostTLSConfigMatch(t *testing.T) {
+	exact, sub, subsub := &tls.Config{}, &tls.Config{}, &tls.Config{}
+	tr := &Transport{HostTLSConfigs: map[string]*tls.Config{
+		"a.example.com":   exact,
+		"*.example.com":   sub,
+		"*.b.example.com": subsub,
+	}}
+	tests := []struct {
+		host string
+		want *tls.Config
+	}{
+		{"a.example.com", exact},
+		{"c.example.com", sub},
+		{"c.b.example.com", subsub},
+		{"b.example.com", sub},
+		{"example.com", nil},
+		{"notexample.com", nil},
+	}
+	for _, tt := range tests {
+		if got := tr.hostTLSConfig(tt.host); got != tt.want {
+			t.Errorf("hostTLSConfig(%q) = %p; want %p", tt.host, got, tt.want)
+		}
+	}
+	if cfg := tr.tlsConfig("A.Example.com"); cfg.ServerName != "A.Example.com" || len(cfg.NextProtos) != 1 {
+		t.Errorf("tlsConfig = ServerName %q, NextProtos %q", cfg.ServerName, cfg.NextProtos)
+	}
+}
+
+func TestTransportControl(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, optOnlyServer)
+	defer st.Close()
+
+	var gotNetwork, gotAddr string
+	var controlled bool
+	tr := &Transport{
+		InsecureTLSDial: true,
+		KeepAlive:       -1,
+		Control: func(network, address string, c syscall.RawConn) error {
+			gotNetwork, gotAddr = network, address
+			return c.Control(func(fd uintptr) { controlled = true })
+		},
+	}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if addr := st.ts.Listener.Addr().String(); gotNetwork != "tcp4" || gotAddr != addr {
+		t.Errorf("Control called with %q, %q; want %q, %q", gotNetwork, gotAddr, "tcp4", addr)
+	}
+	if !controlled {
+		t.Error("Control didn't get the socket")
+	}
+
+	errDenied := errors.New("denied")
+	tr2 := &Transport{
+		InsecureTLSDial: true,
+		Control:         func(string, string, syscall.RawConn) error { return errDenied },
+	}
+	if _, err := tr2.RoundTrip(req); !errors.Is(err, errDenied) {
+		t.Errorf("RoundTrip error = %v; want %v", err, errDenied)
+	}
+}
+
+func TestTransportFaultsGoAway(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	}, optOnlyServer)
+	defer st.Close()
+
+	// A GOAWAY ahead of the first response's HEADERS leaves that
+	// response intact, but sends the next request to a new conn.
+	tr := &Transport{
+		InsecureTLSDial: true,
+		Faults:          faultsByStream{read: map[uint32]Fault{1: {GoAway: true}}},
+	}
+	defer tr.CloseIdleConnections()
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", st.ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		addr, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		addrs = append(addrs, string(addr))
+	}
+	if addrs[0] == addrs[1] {
+		t.Errorf("both requests used conn %s; want a new conn after GOAWAY", addrs[0])
+	}
+}
+
+func TestTransportResponseTrailers(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if want := (http.Header{"X-Checksum": nil}); !reflect.DeepEqual(res.Trailer, want) {
+		t.Errorf("announced Trailer = %v; want %v", res.Trailer, want)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil || string(body) != "body" {
+		t.Fatalf("body = %q, %v; want %q", body, err, "body")
+	}
+	if want := (http.Header{"X-Checksum": {"abc"}}); !reflect.DeepEqual(res.Trailer, want) {
+		t.Errorf("Trailer after EOF = %v; want %v", res.Trailer, want)
+	}
+}
+
+func TestTransportConnectionHeadersRemoved(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+			writeRawHeaders(fr, streamID, true, ":status", "200",
+				"connection", "x-hop", "x-hop", "1", "keep-alive", "5", "x-keep", "y")
+		})
+		tr := &Transport{InsecureTLSDial: true, StrictProtocolChecks: strict}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if strict {
+			if se, ok := err.(StreamError); !ok || se.Code != ErrCodeProtocol {
+				t.Errorf("strict: RoundTrip error = %v; want PROTOCOL_ERROR stream error", err)
+			}
+		} else if err != nil {
+			t.Errorf("lenient: %v", err)
+		} else {
+			res.Body.Close()
+			if want := (http.Header{"X-Keep": {"y"}}); !reflect.DeepEqual(res.Header, want) {
+				t.Errorf("lenient: Header = %v; want %v", res.Header, want)
+			}
+		}
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestTransportUnknownLengthRequestBody(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	for _, cl := range []int64{0, -1} {
+		req, _ := http.NewRequest("POST", st.ts.URL, ioutil.NopCloser(strings.NewReader("streamed")))
+		req.ContentLength = cl
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "streamed" {
+			t.Errorf("ContentLength %d: echoed body = %q; want %q", cl, body, "streamed")
+		}
+	}
+}
+
+// closeNotifyBody is a request body that reports when it's closed.
+type closeNotifyBody struct {
+	io.Reader
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newCloseNotifyBody(r io.Reader) *closeNotifyBody {
+	return &closeNotifyBody{Reader: r, closed: make(chan struct{})}
+}
+
+func (b *closeNotifyBody) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+// The client sends no more than the server's flow control windows
+// allow, and keeps sending as WINDOW_UPDATEs open them.
+func TestTransportSendFlowControl(t *testing.T) {
+	const size = 1 << 20
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("POST", st.ts.URL, bytes.NewReader(make([]byte, size)))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != strconv.Itoa(size) {
+		t.Errorf("server read %s bytes; want %d", body, size)
+	}
+}
+
+func TestTransportFlowControlTimeout(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		// Never read the body, so the window never opens.
+		<-r.Context().Done()
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true, FlowControlTimeout: 100 * time.Millisecond}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("POST", st.ts.URL, bytes.NewReader(make([]byte, 1<<20)))
+	_, err := tr.RoundTrip(req)
+	if err != ErrFlowControlTimeout {
+		t.Errorf("RoundTrip error = %v; want %v", err, ErrFlowControlTimeout)
+	}
+}
+
+func TestTransportRequestBodyInline(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("POST", st.ts.URL, strings.NewReader("small"))
+	body := newCloseNotifyBody(req.Body)
+	req.Body = body
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	// A small in-memory body is written before RoundTrip waits for
+	// the response, with no goroutine to finish it off later.
+	select {
+	case <-body.closed:
+	default:
+		t.Error("request body not yet closed when RoundTrip returned")
+	}
+	if got, _ := ioutil.ReadAll(res.Body); string(got) != "small" {
+		t.Errorf("echoed body = %q; want %q", got, "small")
+	}
+}
+
+// A request body that's still being read when its stream closes is
+// closed, so that the goroutine writing it doesn't stay stuck in
+// Read: here, when the request is canceled before the response
+// comes, and when the response body is closed early.
+func TestTransportRequestBodyAbort(t *testing.T) {
+	started := make(chan bool, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		if r.URL.Path != "/cancel" {
+			w.WriteHeader(200)
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	for _, path := range []string{"/cancel", "/close"} {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		body := newCloseNotifyBody(pr)
+		req, _ := http.NewRequest("POST", st.ts.URL+path, body)
+		req.RequestURI = path
+		if path == "/cancel" {
+			cancel := make(chan struct{})
+			req.Cancel = cancel
+			go func() {
+				<-started
+				close(cancel)
+			}()
+			if _, err := tr.RoundTrip(req); err != ErrRequestCanceled {
+				t.Fatalf("%s: RoundTrip error = %v; want %v", path, err, ErrRequestCanceled)
+			}
+		} else {
+			res, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			<-started
+			res.Body.Close()
+		}
+		select {
+		case <-body.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: request body not closed after the stream was", path)
+		}
+	}
+}
+
+// Each streamed request body has a writer of its own, however many
+// others are stuck: here, full-duplex streams whose server wants
+// some of the body before it responds, and then echoes the rest.
+func TestTransportRequestBodyWriters(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 10)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	const n = maxIdleBodyWriters + 4
+	var (
+		pws  []*io.PipeWriter
+		ress []*http.Response
+	)
+	for i := 0; i < n; i++ {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		req, _ := http.NewRequest("POST", st.ts.URL, pr)
+		go io.WriteString(pw, "x")
+		resc := make(chan *http.Response, 1)
+		go func() {
+			res, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+			}
+			resc <- res
+		}()
+		select {
+		case res := <-resc:
+			if res == nil {
+				return
+			}
+			pws, ress = append(pws, pw), append(ress, res)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no response to request %d, with %d full-duplex streams open", i, i)
+		}
+	}
+
+	// The last stream still makes progress both ways.
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(ress[n-1].Body, buf[:1]); err != nil || buf[0] != 'x' {
+		t.Fatalf("echo = %q, %v; want %q", buf[:1], err, "x")
+	}
+	go io.WriteString(pws[n-1], "yz")
+	if _, err := io.ReadFull(ress[n-1].Body, buf); err != nil || string(buf) != "yz" {
+		t.Fatalf("echo = %q, %v; want %q", buf, err, "yz")
+	}
+
+	for i, pw := range pws {
+		pw.Close()
+		ioutil.ReadAll(ress[i].Body)
+		ress[i].Body.Close()
+	}
+	cc := ress[0].Body.(*transportResponseBody).cc
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cc.mu.Lock()
+		writers := cc.bodyWriters
+		cc.mu.Unlock()
+		if writers <= maxIdleBodyWriters {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d body writers left once all were done; want at most %d", writers, maxIdleBodyWriters)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransportReverseProxyStreaming(t *testing.T) {
+	next := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Trailer", "X-Events")
+		io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		<-next
+		io.WriteString(w, "data: 2\n\n")
+		w.Header().Set("X-Events", "2")
+	}, optOnlyServer)
+	defer st.Close()
+
+	backend, _ := url.Parse(st.ts.URL)
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	proxy := httputil.NewSingleHostReverseProxy(backend)
+	proxy.Transport = tr
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	res, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	br := bufio.NewReader(res.Body)
+	// The first event must come through before the backend
+	// sends the second.
+	if line, err := br.ReadString('\n'); err != nil || line != "data: 1\n" {
+		t.Fatalf("first line = %q, %v; want %q", line, err, "data: 1\n")
+	}
+	close(next)
+	rest, _ := ioutil.ReadAll(br)
+	if string(rest) != "\ndata: 2\n\n" {
+		t.Errorf("rest of body = %q", rest)
+	}
+	if got := res.Trailer.Get("X-Events"); got != "2" {
+		t.Errorf("proxied trailer X-Events = %q; want %q", got, "2")
+	}
+}
+
+func TestTransportOnRequest(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.Header.Get("Authorization"))
+	}, optOnlyServer)
+	defer st.Close()
+
+	errDenied := errors.New("denied")
+	tr := &Transport{
+		InsecureTLSDial: true,
+		OnRequest: func(req *http.Request) error {
+			if req.Method == "CONNECT" {
+				return errDenied
+			}
+			req.Host = "rewritten.example"
+			req.Header.Set("Authorization", "Bearer token")
+			return nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if want := "rewritten.example Bearer token"; string(body) != want {
+		t.Errorf("server saw %q; want %q", body, want)
+	}
+	if req.Header.Get("Authorization") != "" || res.Request != req {
+		t.Error("OnRequest changed the caller's request")
+	}
+
+	_, err = tr.Connect(&http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: st.ts.Listener.Addr().String()},
+		Host:       "example.com:443",
+		RequestURI: "example.com:443",
+		Header:     make(http.Header),
+	})
+	if err != errDenied {
+		t.Errorf("Connect error = %v; want %v", err, errDenied)
+	}
+}
+
+func TestTransportRawHeaders(t *testing.T) {
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		writeRawHeaders(fr, streamID, false, ":status", "200", "x-b", "2", "x-a", "1", "x-b", "3")
+		fr.WriteData(streamID, false, []byte("body"))
+		writeRawHeaders(fr, streamID, true, "x-sum", "abc")
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	var raw RawHeaders
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req = req.WithContext(WithRawHeaders(req.Context(), &raw))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	wantHeader := []hpack.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "x-b", Value: "2"},
+		{Name: "x-a", Value: "1"},
+		{Name: "x-b", Value: "3"},
+	}
+	if !reflect.DeepEqual(raw.Header, wantHeader) {
+		t.Errorf("raw header = %v; want %v", raw.Header, wantHeader)
+	}
+	if _, err := ioutil.ReadAll(res.Body); err != nil {
+		t.Fatal(err)
+	}
+	if want := []hpack.HeaderField{{Name: "x-sum", Value: "abc"}}; !reflect.DeepEqual(raw.Trailer, want) {
+		t.Errorf("raw trailer = %v; want %v", raw.Trailer, want)
+	}
+}
+
+func TestTransportInterimResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		interim []string
+	}{
+		{"100 Continue", []string{":status", "100"}},
+		{"103 Early Hints", []string{":status", "103", "link", "</style.css>; rel=preload"}},
+	}
+	for _, tt := range tests {
+		ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+			writeRawHeaders(fr, streamID, false, tt.interim...)
+			writeRawHeaders(fr, streamID, false, ":status", "200", "trailer", "x-sum")
+			fr.WriteData(streamID, false, []byte("body"))
+			writeRawHeaders(fr, streamID, true, "x-sum", "abc")
+		})
+		tr := &Transport{InsecureTLSDial: true}
+		var got1xx []int
+		var got100 bool
+		var link string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				got1xx = append(got1xx, code)
+				link = header.Get("Link")
+				return nil
+			},
+			Got100Continue: func() { got100 = true },
+		}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 || string(body) != "body" || err != nil {
+			t.Errorf("%s: response %d, body %q, %v; want 200, %q", tt.name, res.StatusCode, body, err, "body")
+		}
+		if got := res.Trailer.Get("X-Sum"); got != "abc" {
+			t.Errorf("%s: trailer X-Sum = %q; want %q", tt.name, got, "abc")
+		}
+		code, _ := strconv.Atoi(tt.interim[1])
+		if !reflect.DeepEqual(got1xx, []int{code}) {
+			t.Errorf("%s: Got1xxResponse saw %v; want [%d]", tt.name, got1xx, code)
+		}
+		if got100 != (code == 100) {
+			t.Errorf("%s: Got100Continue called = %v", tt.name, got100)
+		}
+		if code == 103 && link != "</style.css>; rel=preload" {
+			t.Errorf("%s: Link = %q", tt.name, link)
+		}
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestTransportInterimResponseErrors(t *testing.T) {
+	errReject := errors.New("rejected")
+	tests := []struct {
+		name    string
+		script  func(fr *Framer, streamID uint32)
+		reject  bool
+		wantErr error
+	}{
+		{"END_STREAM", func(fr *Framer, streamID uint32) {
+			writeRawHeaders(fr, streamID, true, ":status", "103")
+		}, false, StreamError{1, ErrCodeProtocol}},
+		{"101", func(fr *Framer, streamID uint32) {
+			writeRawHeaders(fr, streamID, false, ":status", "101")
+		}, false, StreamError{1, ErrCodeProtocol}},
+		{"too many", func(fr *Framer, streamID uint32) {
+			for i := 0; i <= maxInterimResponses; i++ {
+				writeRawHeaders(fr, streamID, false, ":status", "103")
+			}
+		}, false, StreamError{1, ErrCodeProtocol}},
+		{"rejected by trace", func(fr *Framer, streamID uint32) {
+			writeRawHeaders(fr, streamID, false, ":status", "103")
+		}, true, errReject},
+	}
+	for _, tt := range tests {
+		ts := newRawServer(t, tt.script)
+		tr := &Transport{InsecureTLSDial: true}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		if tt.reject {
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+				Got1xxResponse: func(int, textproto.MIMEHeader) error { return errReject },
+			}))
+		}
+		if _, err := tr.RoundTrip(req); err != tt.wantErr {
+			t.Errorf("%s: RoundTrip error = %v; want %v", tt.name, err, tt.wantErr)
+		}
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestTransportExpectContinue(t *testing.T) {
+	// The Server answers Expect: 100-continue with 100 Continue
+	// when the handler first reads the body, ahead of its response.
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}, optOnlyServer)
+	defer st.Close()
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	var got100 bool
+	req, _ := http.NewRequest("POST", st.ts.URL, strings.NewReader("hello"))
+	req.Header.Set("Expect", "100-continue")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got100Continue: func() { got100 = true },
+	}))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != "hello" || err != nil {
+		t.Errorf("response %d, body %q, %v; want 200, %q", res.StatusCode, body, err, "hello")
+	}
+	if !got100 {
+		t.Error("Got100Continue not called")
+	}
+}
+
+func TestTransportTrailersValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		strict      bool
+		endStream   bool
+		trailer     []string
+		wantErr     bool
+		wantTrailer http.Header
+	}{
+		{"ok", false, true, []string{"x-sum", "abc"}, false, http.Header{"X-Sum": {"abc"}}},
+		{"no END_STREAM", false, false, []string{"x-sum", "abc"}, true, nil},
+		{"pseudo-header lenient", false, true, []string{":status", "500", "x-sum", "abc"}, false, http.Header{"X-Sum": {"abc"}}},
+		{"pseudo-header strict", true, true, []string{":status", "500", "x-sum", "abc"}, true, nil},
+	}
+	for _, tt := range tests {
+		ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+			writeRawHeaders(fr, streamID, false, ":status", "200")
+			fr.WriteData(streamID, false, []byte("body"))
+			writeRawHeaders(fr, streamID, tt.endStream, tt.trailer...)
+		})
+		tr := &Transport{InsecureTLSDial: true, StrictProtocolChecks: tt.strict}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		_, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if se, ok := err.(StreamError); tt.wantErr && (!ok || se.Code != ErrCodeProtocol) {
+			t.Errorf("%s: body read error = %v; want PROTOCOL_ERROR stream error", tt.name, err)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: body read error = %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(res.Trailer, tt.wantTrailer) {
+			t.Errorf("%s: Trailer = %v; want %v", tt.name, res.Trailer, tt.wantTrailer)
+		}
+		if res.StatusCode != 200 {
+			t.Errorf("%s: trailers changed status to %d", tt.name, res.StatusCode)
+		}
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestTransportWithoutRetry(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// Close the pooled conn just after it's picked for the next
+	// request.
+	host, port, _ := net.SplitHostPort(st.ts.Listener.Addr().String())
+	cc, err := tr.getClientConn(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.OnRequest = func(*http.Request) error {
+		cc.mu.Lock()
+		cc.closed = true
+		cc.mu.Unlock()
+		return nil
+	}
+
+	req = req.WithContext(WithoutRetry(req.Context()))
+	if _, err := tr.RoundTrip(req); err != errClientConnUnusable {
+		t.Errorf("RoundTrip error = %v; want %v, unretried", err, errClientConnUnusable)
+	}
+}
+
+func TestTransportRequestCancel(t *testing.T) {
+	gotReq := make(chan bool, 1)
+	handlerDone := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		gotReq <- true
+		<-r.Context().Done()
+		handlerDone <- r.Context().Err()
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	cancel := make(chan struct{})
+	req.Cancel = cancel
+	go func() {
+		<-gotReq
+		close(cancel)
+	}()
+	if _, err := tr.RoundTrip(req); err != ErrRequestCanceled {
+		t.Fatalf("RoundTrip error = %v; want %v", err, ErrRequestCanceled)
+	}
+	select {
+	case <-handlerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler's context not canceled; stream not reset")
+	}
+}
+
+func TestTransportRequestContextCancel(t *testing.T) {
+	for _, deadline := range []bool{false, true} {
+		gotReq := make(chan bool, 1)
+		handlerDone := make(chan error, 1)
+		st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+			gotReq <- true
+			<-r.Context().Done()
+			handlerDone <- r.Context().Err()
+		}, optOnlyServer)
+
+		tr := &Transport{InsecureTLSDial: true}
+		ctx, cancel := context.WithCancel(context.Background())
+		want := context.Canceled
+		if deadline {
+			ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+			want = context.DeadlineExceeded
+		} else {
+			go func() {
+				<-gotReq
+				cancel()
+			}()
+		}
+		req, _ := http.NewRequest("GET", st.ts.URL, nil)
+		req = req.WithContext(ctx)
+		if _, err := tr.RoundTrip(req); err != want {
+			t.Errorf("deadline=%v: RoundTrip error = %v; want %v", deadline, err, want)
+		}
+		select {
+		case <-handlerDone:
+		case <-time.After(5 * time.Second):
+			t.Errorf("deadline=%v: handler's context not canceled; stream not reset", deadline)
+		}
+		cancel()
+		tr.CloseIdleConnections()
+		st.Close()
+	}
+}
+
+func TestTransportCalmBackoff(t *testing.T) {
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		fr.WriteRSTStream(streamID, ErrCodeEnhanceYourCalm)
+		// newRawServer takes one request per conn.
+		fr.WriteGoAway(streamID, ErrCodeNo, nil)
+	})
+	defer ts.Close()
+
+	const backoff = 50 * time.Millisecond
+	tr := &Transport{InsecureTLSDial: true, CalmBackoff: backoff, MaxCalmBackoff: time.Minute}
+	defer tr.CloseIdleConnections()
+	for i, want := range []time.Duration{0, backoff, 2 * backoff} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		start := time.Now()
+		_, err := tr.RoundTrip(req)
+		if se, ok := err.(StreamError); !ok || se.Code != ErrCodeEnhanceYourCalm {
+			t.Fatalf("request %d: error = %v; want ENHANCE_YOUR_CALM reset", i, err)
+		}
+		if d := time.Since(start); d < want {
+			t.Errorf("request %d took %v; want a backoff of at least %v", i, d, want)
+		}
+	}
+
+	// A canceled request stops waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	if _, err := tr.RoundTrip(req.WithContext(ctx)); err != context.Canceled {
+		t.Errorf("canceled request error = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestTransportStreamIdleTimeout(t *testing.T) {
+	started := make(chan bool, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall-body" {
+			io.WriteString(w, "partial")
+			w.(http.Flusher).Flush()
+		}
+		started <- true
+		<-r.Context().Done()
+	}, optOnlyServer)
+	defer st.Close()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	tr := &Transport{InsecureTLSDial: true, Clock: clock, StreamIdleTimeout: 2 * time.Second}
+	defer tr.CloseIdleConnections()
+	get := func(path string) (*http.Response, error) {
+		req, _ := http.NewRequest("GET", st.ts.URL+path, nil)
+		req.RequestURI = path
+		return tr.RoundTrip(req)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := get("/no-response")
+		errc <- err
+	}()
+	<-started
+	clock.advance(2 * time.Second)
+	if err := <-errc; err != ErrStreamIdleTimeout {
+		t.Errorf("RoundTrip error = %v; want %v", err, ErrStreamIdleTimeout)
+	}
+
+	res, err := get("/stall-body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	<-started
+	if _, err := io.ReadFull(res.Body, make([]byte, len("partial"))); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(2 * time.Second)
+	if _, err = res.Body.Read(make([]byte, 1)); err != ErrStreamIdleTimeout {
+		t.Errorf("stalled body Read error = %v; want %v", err, ErrStreamIdleTimeout)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("body error %v isn't a timeout net.Error", err)
+	}
+}
+
+func TestTransportResponseBodyTimeout(t *testing.T) {
+	canceled := make(chan bool, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		if r.URL.Path == "/whole" {
+			return
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		canceled <- true
+	}, optOnlyServer)
+	defer st.Close()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	tr := &Transport{InsecureTLSDial: true, Clock: clock}
+	defer tr.CloseIdleConnections()
+	get := func(path string, idle time.Duration, deadline time.Time) *http.Response {
+		req, _ := http.NewRequest("GET", st.ts.URL+path, nil)
+		req.RequestURI = path
+		req = req.WithContext(WithResponseBodyTimeout(req.Context(), idle, deadline))
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, tt := range []struct {
+		name     string
+		idle     time.Duration
+		deadline time.Time
+	}{
+		{"idle", 2 * time.Second, time.Time{}},
+		{"deadline", 0, clock.Now().Add(5 * time.Second)},
+	} {
+		res := get("/stall", tt.idle, tt.deadline)
+		if _, err := io.ReadFull(res.Body, make([]byte, len("partial"))); err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(5 * time.Second)
+		_, err := res.Body.Read(make([]byte, 1))
+		if err != ErrResponseBodyTimeout {
+			t.Errorf("%s: stalled body Read error = %v; want %v", tt.name, err, ErrResponseBodyTimeout)
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("%s: body error %v isn't a timeout net.Error", tt.name, err)
+		}
+		res.Body.Close()
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: server's stream wasn't reset", tt.name)
+		}
+	}
+
+	res := get("/whole", 2*time.Second, clock.Now().Add(5*time.Second))
+	defer res.Body.Close()
+	if body, err := ioutil.ReadAll(res.Body); err != nil || string(body) != "partial" {
+		t.Fatalf("body = %q, %v; want \"partial\", nil", body, err)
+	}
+	clock.advance(5 * time.Second)
+	if _, err := res.Body.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read of a finished body after its deadline = %v; want EOF", err)
+	}
+}
+
+func TestTransportNoteCalm(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	tr := &Transport{Clock: clock, CalmBackoff: time.Second, MaxCalmBackoff: 4 * time.Second}
+	for _, want := range []time.Duration{1, 2, 4, 4} {
+		tr.noteCalm("h:443")
+		if got := tr.calm["h:443"].until.Sub(clock.Now()); got != want*time.Second {
+			t.Errorf("backoff = %v; want %v", got, want*time.Second)
+		}
+	}
+	clock.advance(9 * time.Second)
+	tr.noteCalm("h:443")
+	if got := tr.calm["h:443"].until.Sub(clock.Now()); got != time.Second {
+		t.Errorf("backoff after a calm spell = %v; want %v", got, time.Second)
+	}
+}
+
+func TestTransportResponseConversion(t *testing.T) {
+	tests := []struct {
+		name      string
+		strict    bool
+		endStream bool // on the HEADERS
+		kv        []string
+		body      string
+
+		wantErr    bool
+		wantStatus string
+		wantCL     int64
+		wantHdrCL  []string
+	}{
+		{name: "unknown status", kv: []string{":status", "299"}, endStream: true, wantStatus: "299", wantCL: 0},
+		{name: "no body, no length", kv: []string{":status", "200"}, endStream: true, wantStatus: "200 OK", wantCL: 0},
+		{name: "body, no length", kv: []string{":status", "200"}, body: "hello", wantStatus: "200 OK", wantCL: -1},
+		{
+			name:       "repeated length",
+			kv:         []string{":status", "200", "content-length", "5", "content-length", "5"},
+			body:       "hello",
+			wantStatus: "200 OK", wantCL: 5, wantHdrCL: []string{"5"},
+		},
+		{
+			name:       "conflicting lengths, lenient",
+			kv:         []string{":status", "200", "content-length", "5", "content-length", "6"},
+			body:       "hello",
+			wantStatus: "200 OK", wantCL: -1,
+		},
+		{
+			name:    "conflicting lengths, strict",
+			strict:  true,
+			kv:      []string{":status", "200", "content-length", "5", "content-length", "6"},
+			body:    "hello",
+			wantErr: true,
+		},
+		{name: "bad length, strict", strict: true, kv: []string{":status", "200", "content-length", "x"}, body: "hello", wantErr: true},
+	}
+	for _, tt := range tests {
+		ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+			writeRawHeaders(fr, streamID, tt.endStream, tt.kv...)
+			if !tt.endStream {
+				fr.WriteData(streamID, true, []byte(tt.body))
+			}
+		})
+		tr := &Transport{InsecureTLSDial: true, StrictProtocolChecks: tt.strict}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: RoundTrip succeeded; want error", tt.name)
+				res.Body.Close()
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else {
+			if res.Status != tt.wantStatus || res.ContentLength != tt.wantCL {
+				t.Errorf("%s: Status %q, ContentLength %d; want %q, %d", tt.name, res.Status, res.ContentLength, tt.wantStatus, tt.wantCL)
+			}
+			if got := res.Header["Content-Length"]; !reflect.DeepEqual(got, tt.wantHdrCL) {
+				t.Errorf("%s: Content-Length header = %q; want %q", tt.name, got, tt.wantHdrCL)
+			}
+			if res.TransferEncoding != nil || res.Close || res.ProtoMajor != 2 {
+				t.Errorf("%s: TransferEncoding %q, Close %v, ProtoMajor %d", tt.name, res.TransferEncoding, res.Close, res.ProtoMajor)
+			}
+			if body, err := ioutil.ReadAll(res.Body); err != nil || string(body) != tt.body {
+				t.Errorf("%s: body = %q, %v; want %q", tt.name, body, err, tt.body)
+			}
+			res.Body.Close()
+		}
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestTransportSettingsTimeoutFallback(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(nil)
+	ts.TLS = &tls.Config{NextProtos: []string{NextProtoTLS}}
+	ts.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		NextProtoTLS: func(_ *http.Server, c *tls.Conn, _ http.Handler) {
+			// Negotiate HTTP/2 but never send SETTINGS.
+			atomic.AddInt32(&conns, 1)
+			io.Copy(ioutil.Discard, c)
+			c.Close()
+		},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	var fallbacks int
+	tr := &Transport{
+		InsecureTLSDial: true,
+		SettingsTimeout: 100 * time.Millisecond,
+		Fallback: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			fallbacks++
+			return &http.Response{StatusCode: 204, Body: http.NoBody, Request: req}, nil
+		}),
+	}
+	defer tr.CloseIdleConnections()
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if res.StatusCode != 204 {
+			t.Errorf("request %d: status = %d; want 204 from Fallback", i, res.StatusCode)
+		}
+	}
+	if fallbacks != 2 {
+		t.Errorf("Fallback used %d times; want 2", fallbacks)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("dialed %d HTTP/2 conns; want 1, then Fallback only", n)
+	}
+
+	tr.Fallback = nil
+	tr.noHTTP2 = nil
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	if _, err := tr.RoundTrip(req); !errors.Is(err, errBlackholed) {
+		t.Errorf("RoundTrip without Fallback error = %v; want %v", err, errBlackholed)
+	}
+}
+
+func TestTransportPrefaceTimeout(t *testing.T) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.TLS = &tls.Config{NextProtos: []string{NextProtoTLS}}
+	ts.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		NextProtoTLS: func(_ *http.Server, c *tls.Conn, _ http.Handler) {
+			// Negotiate HTTP/2 but never send SETTINGS.
+			io.Copy(ioutil.Discard, c)
+			c.Close()
+		},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	var fallbacks int
+	tr := &Transport{
+		InsecureTLSDial: true,
+		PrefaceTimeout:  100 * time.Millisecond,
+		Fallback: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			fallbacks++
+			return nil, errors.New("unexpected Fallback")
+		}),
+	}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	start := time.Now()
+	if _, err := tr.RoundTrip(req); err != errPrefaceTimeout {
+		t.Errorf("RoundTrip error = %v; want %v", err, errPrefaceTimeout)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("RoundTrip took %v; want about PrefaceTimeout", d)
+	}
+	if fallbacks != 0 {
+		t.Errorf("Fallback used %d times; want 0 for a preface timeout", fallbacks)
+	}
+}
+
+func TestTransportSettingsAckTimeout(t *testing.T) {
+	goAway := make(chan ErrCode, 1)
+	ts := httptest.NewUnstartedServer(nil)
+	ts.TLS = &tls.Config{NextProtos: []string{NextProtoTLS}}
+	ts.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		NextProtoTLS: func(_ *http.Server, c *tls.Conn, _ http.Handler) {
+			defer c.Close()
+			if _, err := io.ReadFull(c, make([]byte, len(clientPreface))); err != nil {
+				return
+			}
+			// Send SETTINGS, but never ACK the client's.
+			fr := NewFramer(c, c)
+			fr.WriteSettings()
+			for {
+				f, err := fr.ReadFrame()
+				if err != nil {
+					return
+				}
+				if ga, ok := f.(*GoAwayFrame); ok {
+					goAway <- ga.ErrCode
+					return
+				}
+			}
+		},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true, SettingsAckTimeout: 50 * time.Millisecond}
+	defer tr.CloseIdleConnections()
+	host, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	cc, err := tr.getClientConn(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-goAway:
+		if code != ErrCodeSettingsTimeout {
+			t.Errorf("GOAWAY error code = %v; want %v", code, ErrCodeSettingsTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no GOAWAY from client")
+	}
+	select {
+	case <-cc.readerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn not closed")
+	}
+}
+
+func TestTransportNextProtos(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.TLS = &tls.Config{NextProtos: []string{"http/1.1"}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	var fallbacks int
+	tr := &Transport{
+		InsecureTLSDial: true,
+		NextProtos:      []string{"http/1.1"},
+		Fallback: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("used Fallback, not ProtocolFallbacks")
+		}),
+		ProtocolFallbacks: map[string]http.RoundTripper{
+			"http/1.1": roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				fallbacks++
+				return &http.Response{StatusCode: 204, Body: http.NoBody, Request: req}, nil
+			}),
+		},
+	}
+	defer tr.CloseIdleConnections()
+	for _, tt := range []struct {
+		protos, want []string
+	}{
+		{nil, []string{NextProtoTLS}},
+		{[]string{"http/1.1"}, []string{NextProtoTLS, "http/1.1"}},
+		{[]string{"http/1.1", NextProtoTLS}, []string{"http/1.1", NextProtoTLS}},
+	} {
+		tr := &Transport{NextProtos: tt.protos}
+		if got := tr.nextProtos(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("nextProtos with NextProtos %q = %q; want %q", tt.protos, got, tt.want)
+		}
+	}
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 204 || fallbacks != 1 {
+		t.Errorf("status = %d after %d fallbacks; want 204 from the http/1.1 fallback", res.StatusCode, fallbacks)
+	}
+
+	tr2 := &Transport{InsecureTLSDial: true, NextProtos: []string{"http/1.1"}}
+	defer tr2.CloseIdleConnections()
+	_, err = tr2.RoundTrip(req)
+	var ae *ALPNError
+	if !errors.As(err, &ae) || ae.Protocol != "http/1.1" {
+		t.Errorf("RoundTrip without fallbacks error = %v; want ALPNError for http/1.1", err)
+	}
+}
+
+func TestTransportNoHTTP2Cache(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.TLS = &tls.Config{NextProtos: []string{}} // no ALPN, so no h2
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	var fallbacks int
+	tr := &Transport{
+		InsecureTLSDial: true,
+		Fallback: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			fallbacks++
+			return &http.Response{StatusCode: 204, Body: http.NoBody, Request: req}, nil
+		}),
+	}
+	defer tr.CloseIdleConnections()
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if fallbacks != 3 {
+		t.Errorf("Fallback used %d times; want 3", fallbacks)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("dialed %d times; want 1, then Fallback only", n)
+	}
+
+	// Once the entry expires, HTTP/2 is tried again.
+	tr.connMu.Lock()
+	for k, h := range tr.noHTTP2 {
+		h.until = time.Now()
+		tr.noHTTP2[k] = h
+	}
+	tr.connMu.Unlock()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("dialed %d times after expiry; want 2", n)
+	}
+}
+
+func TestTransportConnectWriteAfterServerEnd(t *testing.T) {
+	ts := newRawServer(t, func(fr *Framer, streamID uint32) {
+		writeRawHeaders(fr, streamID, true, ":status", "200")
+	})
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	addr := ts.Listener.Addr().String()
+	conn, err := tr.Connect(&http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: addr},
+		Host:       "example.com:443",
+		RequestURI: "example.com:443",
+		Header:     make(http.Header),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("Read = %d, %v; want 0, EOF", n, err)
+	}
+	// The server has only half-closed the stream, so we can
+	// still send.
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Errorf("Write after server END_STREAM = %v", err)
+	}
+	if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Errorf("CloseWrite = %v", err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != errStreamClosed {
+		t.Errorf("Write after both ends closed = %v; want %v", err, errStreamClosed)
+	}
+}
+
+func TestTransportHedging(t *testing.T) {
+	var calls int32
+	canceled := make(chan error, 1)
+	addrs := make(chan string, 2)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		addrs <- r.RemoteAddr
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-r.Context().Done()
+			canceled <- r.Context().Err()
+			return
+		}
+		io.WriteString(w, "hedged")
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	req = req.WithContext(WithHedging(req.Context(), 50*time.Millisecond))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hedged" {
+		t.Errorf("body = %q; want %q", body, "hedged")
+	}
+	select {
+	case err := <-canceled:
+		if err == nil {
+			t.Error("losing request's context done without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("losing request wasn't canceled")
+	}
+	if a, b := <-addrs, <-addrs; a == b {
+		t.Errorf("both attempts came from %s; want two conns", a)
+	}
+
+	// A POST isn't idempotent, so it's only ever sent once.
+	atomic.StoreInt32(&calls, 0)
+	req, _ = http.NewRequest("POST", st.ts.URL, nil)
+	req = req.WithContext(WithHedging(req.Context(), time.Millisecond))
+	res, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("POST sent %d times; want 1", n)
+	}
+}
+
+// A hedged request's attempt is retried like any other request's:
+// here, the first conn's GOAWAY refuses it before the hedge delay is
+// up, and it's sent again on a second conn.
+func TestTransportHedgingRetry(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(nil)
+	ts.TLS = &tls.Config{NextProtos: []string{NextProtoTLS}}
+	ts.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		NextProtoTLS: func(_ *http.Server, c *tls.Conn, _ http.Handler) {
+			defer c.Close()
+			conn := atomic.AddInt32(&conns, 1)
+			if _, err := io.ReadFull(c, make([]byte, len(clientPreface))); err != nil {
+				return
+			}
+			fr := NewFramer(c, c)
+			fr.WriteSettings()
+			for {
+				f, err := fr.ReadFrame()
+				if err != nil {
+					return
+				}
+				switch f := f.(type) {
+				case *SettingsFrame:
+					if !f.IsAck() {
+						fr.WriteSettingsAck()
+					}
+				case *HeadersFrame:
+					if conn == 1 {
+						fr.WriteGoAway(0, ErrCodeNo, nil)
+						continue
+					}
+					writeRawHeaders(fr, f.StreamID, true, ":status", "200", "conn", strconv.Itoa(int(conn)))
+				}
+			}
+		},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tr := &Transport{InsecureTLSDial: true}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req = req.WithContext(WithHedging(req.Context(), time.Minute))
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v; want a retry on a second conn", err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get("conn"); got != "2" {
+		t.Errorf("answered on conn %s; want 2", got)
+	}
+	if res.Request != req {
+		t.Error("response's Request isn't the request made")
+	}
+}
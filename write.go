@@ -11,6 +11,8 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/phuslu/http2/hpack"
@@ -34,6 +36,8 @@ type writeContext interface {
 	// HeaderEncoder returns an HPACK encoder that writes to the
 	// returned buffer.
 	HeaderEncoder() (*hpack.Encoder, *bytes.Buffer)
+	// Padding returns the policy for padding HEADERS frames, or nil.
+	Padding() PaddingPolicy
 }
 
 // endsStream reports whether the given frame writer w will locally
@@ -54,6 +58,30 @@ func (flushFrameWriter) writeFrame(ctx writeContext) error {
 	return ctx.Flush()
 }
 
+// writeHeaderTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE
+// to the HPACK encoder. It writes nothing itself; the encoder emits
+// a Dynamic Table Size Update with the next header block.
+type writeHeaderTableSize uint32
+
+func (v writeHeaderTableSize) writeFrame(ctx writeContext) error {
+	enc, _ := ctx.HeaderEncoder()
+	enc.SetMaxDynamicTableSize(uint32(v))
+	return nil
+}
+
+// writeRawFrame is a frame of a type the package doesn't implement,
+// from Server.WriteRawFrame.
+type writeRawFrame struct {
+	typ      FrameType
+	flags    Flags
+	streamID uint32
+	payload  []byte
+}
+
+func (w *writeRawFrame) writeFrame(ctx writeContext) error {
+	return ctx.Framer().WriteRawFrame(w.typ, w.flags, w.streamID, w.payload)
+}
+
 type writeSettings []Setting
 
 func (s writeSettings) writeFrame(ctx writeContext) error {
@@ -79,6 +107,7 @@ type writeData struct {
 	streamID  uint32
 	p         []byte
 	endStream bool
+	pad       []byte // or nil; set by the writeScheduler
 }
 
 func (w *writeData) String() string {
@@ -86,7 +115,7 @@ func (w *writeData) String() string {
 }
 
 func (w *writeData) writeFrame(ctx writeContext) error {
-	return ctx.Framer().WriteData(w.streamID, w.endStream, w.p)
+	return ctx.Framer().WriteDataPadded(w.streamID, w.endStream, w.p, w.pad)
 }
 
 func (se StreamError) writeFrame(ctx writeContext) error {
@@ -106,10 +135,11 @@ func (writeSettingsAck) writeFrame(ctx writeContext) error {
 }
 
 // writeResHeaders is a request to write a HEADERS and 0+ CONTINUATION frames
-// for HTTP response headers from a server handler.
+// for HTTP response headers from a server handler. With a zero
+// httpResCode it writes trailers instead.
 type writeResHeaders struct {
 	streamID    uint32
-	httpResCode int
+	httpResCode int         // or 0 for trailers
 	h           http.Header // may be nil
 	endStream   bool
 
@@ -120,8 +150,13 @@ type writeResHeaders struct {
 func (w *writeResHeaders) writeFrame(ctx writeContext) error {
 	enc, buf := ctx.HeaderEncoder()
 	buf.Reset()
-	enc.WriteField(hpack.HeaderField{Name: ":status", Value: httpCodeString(w.httpResCode)})
+	if w.httpResCode != 0 {
+		enc.WriteField(hpack.HeaderField{Name: ":status", Value: httpCodeString(w.httpResCode)})
+	}
 	for k, vv := range w.h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			continue // sent as a trailer, if at all
+		}
 		k = lowerHeader(k)
 		for _, v := range vv {
 			// TODO: more of "8.1.2.2 Connection-Specific Header Fields"
@@ -142,7 +177,20 @@ func (w *writeResHeaders) writeFrame(ctx writeContext) error {
 	if len(headerBlock) == 0 {
 		panic("unexpected empty hpack")
 	}
+	return writeHeaderBlock(ctx, w.streamID, headerBlock, func(frag []byte, endHeaders bool) error {
+		return ctx.Framer().WriteHeaders(HeadersFrameParam{
+			StreamID:      w.streamID,
+			BlockFragment: frag,
+			EndStream:     w.endStream,
+			EndHeaders:    endHeaders,
+			PadLength:     uint8(ctx.Padding().padLength(len(frag), initialMaxFrameSize)),
+		})
+	})
+}
 
+// writeHeaderBlock writes headerBlock for streamID as a first frame,
+// written by writeFirst, and zero or more CONTINUATION frames.
+func writeHeaderBlock(ctx writeContext, streamID uint32, headerBlock []byte, writeFirst func(frag []byte, endHeaders bool) error) error {
 	// For now we're lazy and just pick the minimum MAX_FRAME_SIZE
 	// that all peers must support (16KB). Later we could care
 	// more and send larger frames if the peer advertised it, but
@@ -162,14 +210,9 @@ func (w *writeResHeaders) writeFrame(ctx writeContext) error {
 		var err error
 		if first {
 			first = false
-			err = ctx.Framer().WriteHeaders(HeadersFrameParam{
-				StreamID:      w.streamID,
-				BlockFragment: frag,
-				EndStream:     w.endStream,
-				EndHeaders:    endHeaders,
-			})
+			err = writeFirst(frag, endHeaders)
 		} else {
-			err = ctx.Framer().WriteContinuation(w.streamID, endHeaders, frag)
+			err = ctx.Framer().WriteContinuation(streamID, endHeaders, frag)
 		}
 		if err != nil {
 			return err
@@ -178,6 +221,46 @@ func (w *writeResHeaders) writeFrame(ctx writeContext) error {
 	return nil
 }
 
+// writePushPromise is a request to write a PUSH_PROMISE and 0+
+// CONTINUATION frames.
+type writePushPromise struct {
+	streamID uint32   // pusher's stream
+	method   string   // GET or HEAD
+	url      *url.URL // absolute, with scheme and host
+	h        http.Header
+
+	// allocatePromisedID is called on the serve goroutine just
+	// before the frame is written, and sets up the promised
+	// stream. Doing it then, rather than when the push was asked
+	// for, means no frame for the promised stream can be written
+	// ahead of its PUSH_PROMISE.
+	allocatePromisedID func() (uint32, error)
+	promisedID         uint32
+}
+
+func (w *writePushPromise) writeFrame(ctx writeContext) error {
+	enc, buf := ctx.HeaderEncoder()
+	buf.Reset()
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: w.method})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: w.url.Scheme})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: w.url.Host})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: w.url.RequestURI()})
+	for k, vv := range w.h {
+		k = lowerHeader(k)
+		for _, v := range vv {
+			enc.WriteField(hpack.HeaderField{Name: k, Value: v})
+		}
+	}
+	return writeHeaderBlock(ctx, w.streamID, buf.Bytes(), func(frag []byte, endHeaders bool) error {
+		return ctx.Framer().WritePushPromise(PushPromiseParam{
+			StreamID:      w.streamID,
+			PromiseID:     w.promisedID,
+			BlockFragment: frag,
+			EndHeaders:    endHeaders,
+		})
+	})
+}
+
 type write100ContinueHeadersFrame struct {
 	streamID uint32
 }
@@ -24,6 +24,28 @@ type frameWriteMsg struct {
 	done chan error
 }
 
+// isControl reports whether wm is a frame the peer can make us queue
+// just by sending frames of its own, such as a PING ACK.
+func (wm frameWriteMsg) isControl() bool {
+	switch wm.write.(type) {
+	case writePingAck, writeWindowUpdate, writeHeaderTableSize, StreamError:
+		return true
+	}
+	return false
+}
+
+// dropped tells whoever is waiting on wm.done, if anyone, that wm
+// won't be written because its stream is gone.
+func (wm frameWriteMsg) dropped() {
+	if wm.done == nil {
+		return
+	}
+	select {
+	case wm.done <- errStreamBroken:
+	default:
+	}
+}
+
 // for debugging only:
 func (wm frameWriteMsg) String() string {
 	var streamID uint32
@@ -50,6 +72,10 @@ type writeScheduler struct {
 	// we'll write. Must be non-zero and between 16K-16M.
 	maxFrameSize uint32
 
+	// padding, if non-nil, chooses the padding for each DATA
+	// frame. Padding costs flow control tokens too.
+	padding PaddingPolicy
+
 	// sq contains the stream-specific queues, keyed by stream ID.
 	// when a stream is idle, it's deleted from the map.
 	sq map[uint32]*writeQueue
@@ -62,6 +88,14 @@ type writeScheduler struct {
 
 	// pool of empty queues for reuse.
 	queuePool []*writeQueue
+
+	// controlFrames is the number of queued frames for which
+	// isControl is true.
+	controlFrames int
+
+	// tree is the client's RFC 7540 stream dependency tree, which
+	// orders equally urgent streams' DATA.
+	tree priorityTree
 }
 
 func (ws *writeScheduler) putEmptyQueue(q *writeQueue) {
@@ -84,6 +118,9 @@ func (ws *writeScheduler) getEmptyQueue() *writeQueue {
 func (ws *writeScheduler) empty() bool { return ws.zero.empty() && len(ws.sq) == 0 }
 
 func (ws *writeScheduler) add(wm frameWriteMsg) {
+	if wm.isControl() {
+		ws.controlFrames++
+	}
 	st := wm.stream
 	if st == nil {
 		ws.zero.push(wm)
@@ -115,7 +152,11 @@ func (ws *writeScheduler) take() (wm frameWriteMsg, ok bool) {
 	// If there any frames not associated with streams, prefer those first.
 	// These are usually SETTINGS, etc.
 	if !ws.zero.empty() {
-		return ws.zero.shift(), true
+		wm := ws.zero.shift()
+		if wm.isControl() {
+			ws.controlFrames--
+		}
+		return wm, true
 	}
 	if len(ws.sq) == 0 {
 		return
@@ -143,10 +184,28 @@ func (ws *writeScheduler) take() (wm frameWriteMsg, ok bool) {
 	}
 	defer ws.zeroCanSend()
 
-	// TODO: find the best queue
+	// The most urgent streams, per the Priority header, go first,
+	// and the dependency tree decides among them.
 	q := ws.canSend[0]
-
-	return ws.takeFrom(q.streamID(), q)
+	for _, c := range ws.canSend[1:] {
+		if c.head().stream.urgency < q.head().stream.urgency {
+			q = c
+		}
+	}
+	urgency := q.head().stream.urgency
+	id, ok := ws.tree.pick(func(id uint32) bool {
+		c := ws.sq[id]
+		return c != nil && c.head().stream.urgency == urgency && ws.streamWritableBytes(c) > 0
+	})
+	if ok {
+		q = ws.sq[id]
+	}
+	id = q.streamID()
+	wm, ok = ws.takeFrom(id, q)
+	if wd, isData := wm.write.(*writeData); ok && isData {
+		ws.tree.charge(id, len(wd.p))
+	}
+	return wm, ok
 }
 
 // zeroCanSend is defered from take.
@@ -198,10 +257,18 @@ func (ws *writeScheduler) takeFrom(id uint32, q *writeQueue) (wm frameWriteMsg,
 		// want to write smaller ones to properly weight competing
 		// streams' priorities.
 
-		if len(wd.p) > int(allowed) {
-			wm.stream.flow.take(allowed)
-			chunk := wd.p[:allowed]
-			wd.p = wd.p[allowed:]
+		// Padding and its length byte come out of the same
+		// allowance, so the chunk may be cut short to make room.
+		n, pad := ws.padding.split(len(wd.p), int(allowed))
+		cost := int32(n)
+		if pad != nil {
+			cost += 1 + int32(len(pad))
+		}
+
+		if len(wd.p) > n {
+			wm.stream.flow.take(cost)
+			chunk := wd.p[:n]
+			wd.p = wd.p[n:]
 			// Make up a new write message of a valid size, rather
 			// than shifting one off the queue.
 			return frameWriteMsg{
@@ -213,16 +280,21 @@ func (ws *writeScheduler) takeFrom(id uint32, q *writeQueue) (wm frameWriteMsg,
 					// arebytes remaining because len(wd.p) > allowed,
 					// so we know endStream is false:
 					endStream: false,
+					pad:       pad,
 				},
 				// our caller is blocking on the final DATA frame, not
 				// these intermediates, so no need to wait:
 				done: nil,
 			}, true
 		}
-		wm.stream.flow.take(int32(len(wd.p)))
+		wd.pad = pad
+		wm.stream.flow.take(cost)
 	}
 
 	q.shift()
+	if wm.isControl() {
+		ws.controlFrames--
+	}
 	if q.empty() {
 		ws.putEmptyQueue(q)
 		delete(ws.sq, id)
@@ -231,6 +303,7 @@ func (ws *writeScheduler) takeFrom(id uint32, q *writeQueue) (wm frameWriteMsg,
 }
 
 func (ws *writeScheduler) forgetStream(id uint32) {
+	ws.tree.close(id)
 	q, ok := ws.sq[id]
 	if !ok {
 		return
@@ -239,6 +312,10 @@ func (ws *writeScheduler) forgetStream(id uint32) {
 
 	// But keep it for others later.
 	for i := range q.s {
+		if q.s[i].isControl() {
+			ws.controlFrames--
+		}
+		q.s[i].dropped()
 		q.s[i] = frameWriteMsg{}
 	}
 	q.s = q.s[:0]